@@ -0,0 +1,148 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+// bundleContentType marks pastes written by the bundle command: a tar
+// archive of the bundled files.
+const bundleContentType = "application/x-tar"
+
+// bundleCommand writes files, and the files in directories, as one paste
+// that -extract restores with their names and modes. It takes the write
+// options, such as -key or -compress, of writing any other content.
+func bundleCommand(ctx context.Context, service *pastila.Service, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: bundle FILE...")
+	}
+	if contentType != "" && contentType != bundleContentType {
+		return fmt.Errorf("bundles are written with content type %s", bundleContentType)
+	}
+	contentType = bundleContentType
+
+	r, w := io.Pipe()
+	go func() {
+		_ = w.CloseWithError(writeBundle(w, args))
+	}()
+	defer r.Close()
+
+	return writePaste(ctx, service, r)
+}
+
+// writeBundle writes the files at paths, relative to the working directory,
+// as a tar archive to w.
+func writeBundle(w io.Writer, paths []string) error {
+	tw := tar.NewWriter(w)
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		if !filepath.IsLocal(path) {
+			return fmt.Errorf("cannot bundle %s: only paths within the working directory are bundled", path)
+		}
+
+		err := filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return fmt.Errorf("cannot bundle %s: not a regular file", path)
+			}
+			return addBundleFile(tw, path)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+func addBundleFile(tw *tar.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     filepath.ToSlash(path),
+		Mode:     int64(info.Mode().Perm()),
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to bundle %s: %w", path, err)
+	}
+	if _, err := io.Copy(tw, f); err != nil {
+		return fmt.Errorf("failed to bundle %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// extractBundle restores the files of a bundle read from r into dir. Existing
+// files are not overwritten. The files are created through a root, so
+// symlinks in dir cannot redirect them out of it.
+func extractBundle(r io.Reader, dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read bundle: %w", err)
+		}
+
+		// Bundles come from elsewhere; they must not write outside of dir.
+		name := filepath.FromSlash(header.Name)
+		if header.Typeflag != tar.TypeReg || !filepath.IsLocal(name) {
+			return fmt.Errorf("bundle holds an invalid entry %q", header.Name)
+		}
+		if err := extractBundleFile(root, tr, name, fs.FileMode(header.Mode).Perm()); err != nil {
+			return fmt.Errorf("failed to extract %s: %w", header.Name, err)
+		}
+		_, _ = fmt.Fprintf(os.Stderr, "%s\n", header.Name)
+	}
+}
+
+func extractBundleFile(root *os.Root, r io.Reader, name string, mode fs.FileMode) error {
+	if err := root.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+
+	f, err := root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
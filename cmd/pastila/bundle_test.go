@@ -0,0 +1,79 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/pastila-cli/pkg/chtest"
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+func TestBundle(t *testing.T) {
+	service, err := pastila.NewService(pastila.WithClickHouseURL(chtest.NewFakeClickHouse(t).URL))
+	require.NoError(t, err)
+	var out bytes.Buffer
+	printWriter = &out
+	t.Cleanup(func() {
+		printWriter = os.Stdout
+		contentType, extract = "", false
+	})
+	ctx := context.Background()
+
+	t.Chdir(t.TempDir())
+	require.NoError(t, os.WriteFile("a.go", []byte("package a\n"), 0o644))
+	require.NoError(t, os.MkdirAll(filepath.Join("cmd", "run"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join("cmd", "run", "run.sh"), []byte("#!/bin/sh\n"), 0o755))
+
+	require.NoError(t, bundleCommand(ctx, service, []string{"a.go", "cmd"}))
+	url := strings.TrimSpace(out.String())
+
+	t.Chdir(t.TempDir())
+	extract = true
+	require.NoError(t, readPaste(ctx, service, url))
+
+	content, err := os.ReadFile("a.go")
+	require.NoError(t, err)
+	assert.Equal(t, "package a\n", string(content))
+	info, err := os.Stat(filepath.Join("cmd", "run", "run.sh"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o755), info.Mode().Perm())
+
+	require.ErrorIs(t, readPaste(ctx, service, url), os.ErrExist, "existing files are not overwritten")
+
+	plainPaste, err := service.Write(strings.NewReader("not a bundle"), pastila.WithKey([]byte("0123456789abcdef")))
+	require.NoError(t, err)
+	require.ErrorContains(t, readPaste(ctx, service, plainPaste.URL), "not a bundle")
+
+	require.ErrorContains(t, bundleCommand(ctx, service, []string{"../outside"}), "within the working directory")
+}
+
+func TestExtractBundleInvalidPath(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "../escape", Mode: 0o644}))
+	require.NoError(t, tw.Close())
+
+	dir := t.TempDir()
+	require.ErrorContains(t, extractBundle(&archive, filepath.Join(dir, "sub")), "invalid entry")
+	assert.NoFileExists(t, filepath.Join(dir, "escape"))
+}
+
+func TestExtractBundleSymlink(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "sub/escape", Mode: 0o644}))
+	require.NoError(t, tw.Close())
+
+	dir, outside := t.TempDir(), t.TempDir()
+	require.NoError(t, os.Symlink(outside, filepath.Join(dir, "sub")))
+	require.ErrorContains(t, extractBundle(&archive, dir), "sub/escape")
+	assert.NoFileExists(t, filepath.Join(outside, "escape"))
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+// clipsyncPollInterval is how often clipsync looks at both clipboards.
+var clipsyncPollInterval = time.Second
+
+// clipboard is the clipboard clipsync keeps in sync.
+type clipboard interface {
+	Get() (string, error)
+	Set(text string) error
+}
+
+type systemClipboard struct{}
+
+func (systemClipboard) Get() (string, error) { return pasteFromClipboard() }
+
+func (systemClipboard) Set(text string) error { return copyToClipboard(text) }
+
+// clipsyncCommand keeps the clipboards of machines sharing the -key secret in
+// sync, until interrupted. Local changes are written as new versions of a
+// channel derived from the secret, encrypted with a key derived from it, and
+// the newest version written elsewhere is copied to the local clipboard.
+// Where both clipboards change between two polls, the remote one wins.
+// With -webhook, each version written elsewhere is also posted there.
+//
+// New versions are found with Latest, which the public pastila service does
+// not allow.
+func clipsyncCommand(ctx context.Context, service *pastila.Service, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: -key SECRET clipsync")
+	}
+	if key == "" {
+		return fmt.Errorf("clipsync requires the shared secret given by -key")
+	}
+
+	secret, err := loadKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = clipsync(ctx, service, string(secret), systemClipboard{}, webhookNotifier(ctx, webhook))
+	if ctx.Err() != nil {
+		// Interrupting is how clipsync is stopped.
+		return nil
+	}
+
+	return err
+}
+
+// clipsync keeps clip in sync with the channel of secret, and calls notify,
+// if not nil, for every version written elsewhere.
+func clipsync(ctx context.Context, service *pastila.Service, secret string, clip clipboard, notify func(*pastila.PasteInfo)) error {
+	head, err := writeChannelHead(ctx, service, "clipsync", secret)
+	if err != nil {
+		return err
+	}
+	latest, err := service.Latest(ctx, head)
+	if err != nil {
+		return err
+	}
+
+	c := &clipsyncer{service: service, clip: clip, notify: notify, head: head, current: latest.URL}
+	_, c.fingerprint = deriveChannel("clipsync", secret)
+	// The local clipboard at start is not published until it changes.
+	if c.synced, err = clip.Get(); errors.Is(err, errNoClipboard) {
+		return err
+	}
+
+	for {
+		// A failing poll, e.g. of an unreachable backend, is retried at the
+		// next one instead of ending the session.
+		if err := c.pull(ctx); err != nil && ctx.Err() == nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+		if err := c.push(ctx); err != nil && ctx.Err() == nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(clipsyncPollInterval):
+		}
+	}
+}
+
+type clipsyncer struct {
+	service     *pastila.Service
+	clip        clipboard
+	notify      func(*pastila.PasteInfo)
+	head        string
+	fingerprint []byte
+
+	// current is the URL of the newest version known.
+	current string
+	// synced is the content both sides are known to have.
+	synced string
+}
+
+// pull copies the newest version written elsewhere to the local clipboard.
+func (c *clipsyncer) pull(ctx context.Context) error {
+	latest, err := c.service.Latest(ctx, c.head)
+	if err != nil || latest.URL == c.current {
+		return err
+	}
+
+	text, err := readClipsyncVersion(ctx, c.service, latest.URL)
+	if err != nil {
+		return err
+	}
+	if text != c.synced {
+		// The version stays new until it is copied, so a failed copy is
+		// retried.
+		if err := c.clip.Set(text); err != nil {
+			return fmt.Errorf("failed to copy to clipboard: %w", err)
+		}
+		c.synced = text
+		_, _ = fmt.Fprintf(os.Stderr, "received %d bytes\n", len(text))
+	}
+
+	c.current = latest.URL
+	if c.notify != nil {
+		c.notify(latest)
+	}
+	return nil
+}
+
+// push publishes the local clipboard as a new version if it changed.
+func (c *clipsyncer) push(ctx context.Context) error {
+	// Reading the clipboard fails while it holds no text, e.g. an image;
+	// there is nothing to publish then.
+	text, err := c.clip.Get()
+	if errors.Is(err, errNoClipboard) {
+		return err
+	}
+	if err != nil || text == "" || text == c.synced {
+		return nil
+	}
+
+	// Versions use a random IV, as they share the key of the channel.
+	paste, err := c.service.WriteContext(ctx, strings.NewReader(text),
+		pastila.WithPreviousURL(c.current), pastila.WithFingerprint(c.fingerprint), pastila.WithRandomIV())
+	if err != nil {
+		return fmt.Errorf("failed to publish clipboard: %w", err)
+	}
+	c.current = paste.URL
+	c.synced = text
+	_, _ = fmt.Fprintf(os.Stderr, "sent %d bytes\n", len(text))
+	return nil
+}
+
+func readClipsyncVersion(ctx context.Context, service *pastila.Service, url string) (string, error) {
+	paste, err := service.ReadContext(ctx, url)
+	if err != nil {
+		return "", fmt.Errorf("failed to read clipboard of another machine: %w", err)
+	}
+	defer paste.Close()
+
+	text, err := io.ReadAll(paste)
+	if err != nil {
+		return "", fmt.Errorf("failed to read clipboard of another machine: %w", err)
+	}
+
+	return string(text), nil
+}
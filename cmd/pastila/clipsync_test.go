@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/pastila-cli/pkg/chtest"
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+type memoryClipboard struct {
+	mu   sync.Mutex
+	text string
+	// failures is how many of the next Sets fail.
+	failures int
+}
+
+func (c *memoryClipboard) Get() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.text, nil
+}
+
+func (c *memoryClipboard) Set(text string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures > 0 {
+		c.failures--
+		return errors.New("clipboard busy")
+	}
+	c.text = text
+	return nil
+}
+
+func TestClipsync(t *testing.T) {
+	service, err := pastila.NewService(pastila.WithClickHouseURL(chtest.NewFakeClickHouse(t).URL))
+	require.NoError(t, err)
+	clipsyncPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { clipsyncPollInterval = time.Second })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	start := func(secret string, clip *memoryClipboard, notify func(*pastila.PasteInfo)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.ErrorIs(t, clipsync(ctx, service, secret, clip, notify), context.Canceled)
+		}()
+	}
+
+	a := &memoryClipboard{text: "left alone at start"}
+	// A failing copy does not end the session, and is retried.
+	b := &memoryClipboard{failures: 1}
+	other := &memoryClipboard{}
+	notified := make(chan *pastila.PasteInfo, 10)
+	start("shared", a, nil)
+	start("shared", b, func(info *pastila.PasteInfo) { notified <- info })
+	start("other", other, nil)
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, mustGet(b), "clipboard at start is not published")
+
+	require.NoError(t, a.Set("from a"))
+	assert.Eventually(t, func() bool { return mustGet(b) == "from a" }, time.Second, 10*time.Millisecond)
+	select {
+	case info := <-notified:
+		assert.NotZero(t, info.Size)
+	case <-time.After(time.Second):
+		t.Fatal("no notification for the version written by a")
+	}
+
+	require.NoError(t, b.Set("from b"))
+	assert.Eventually(t, func() bool { return mustGet(a) == "from b" }, time.Second, 10*time.Millisecond)
+
+	assert.Empty(t, mustGet(other), "other secrets use other channels")
+}
+
+func mustGet(c *memoryClipboard) string {
+	text, _ := c.Get()
+	return text
+}
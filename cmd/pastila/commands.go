@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+// commands are selected by the first argument. Anything else is treated as a
+// pastila URL.
+var commands = map[string]func(ctx context.Context, service *pastila.Service, args []string) error{
+	"bundle":   bundleCommand,
+	"clipsync": clipsyncCommand,
+	"doctor":   doctorCommand,
+	"info":     infoCommand,
+	"join":     joinCommand,
+	"latest":   latestCommand,
+	"list":     listCommand,
+	"mcp":      mcpCommand,
+	"pipe":     pipeCommand,
+	"record":   recordCommand,
+	"rpc":      rpcCommand,
+	"serve":    serveCommand,
+	"share":    shareCommand,
+	"stats":    statsCommand,
+	"sync":     syncCommand,
+}
+
+func infoCommand(ctx context.Context, service *pastila.Service, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: info URL")
+	}
+
+	info, err := service.Stat(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	printf("Fingerprint:\t%x\n", info.Fingerprint)
+	printf("Hash:\t\t%x\n", info.Hash)
+	printf("Encrypted:\t%t\n", info.Encrypted)
+	printf("Size:\t\t%d bytes\n", info.Size)
+	printf("Created:\t%s\n", info.Time.Format(time.RFC3339))
+	if !info.Expires.IsZero() {
+		printf("Expires:\t%s\n", info.Expires.Format(time.RFC3339))
+	}
+	if info.HasPrevious() {
+		printf("Previous:\t%x/%x\n", info.PreviousFingerprint, info.PreviousHash)
+	}
+
+	return nil
+}
+
+// listCommand prints the pastes sharing a fingerprint, given as hex or as the
+// URL of one of them, newest first.
+func listCommand(ctx context.Context, service *pastila.Service, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: list FINGERPRINT|URL")
+	}
+
+	fingerprint, err := hex.DecodeString(args[0])
+	if err != nil {
+		ref, parseErr := pastila.ParseURL(args[0])
+		if parseErr != nil {
+			return fmt.Errorf("invalid fingerprint or URL %s: %w", args[0], parseErr)
+		}
+		fingerprint = ref.Fingerprint
+	}
+
+	infos, err := service.ListByFingerprint(ctx, fingerprint)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		printf("%s\t%s\n", info.Time.Format(time.RFC3339), info.URL)
+	}
+
+	return nil
+}
+
+// latestCommand prints the URL of the newest version of a paste.
+func latestCommand(ctx context.Context, service *pastila.Service, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: latest URL")
+	}
+
+	info, err := service.Latest(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	printf("%s\n", info.URL)
+	return nil
+}
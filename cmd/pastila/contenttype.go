@@ -0,0 +1,107 @@
+package main
+
+import (
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// detectContentTypeEnv enables storing the content type detected from the
+// name of a written file. It is off by default, as pastila.nl cannot read
+// pastes with a content type.
+const detectContentTypeEnv = "PASTILA_DETECT_CONTENT_TYPE"
+
+// languages maps file extensions of source code and text formats, which the
+// mime package mostly does not know, to media types. The first extension of
+// a media type is the one temporary files get.
+var languages = []struct {
+	extension   string
+	contentType string
+}{
+	{".c", "text/x-c"},
+	{".h", "text/x-c"},
+	{".cpp", "text/x-c++"},
+	{".cc", "text/x-c++"},
+	{".hpp", "text/x-c++"},
+	{".cs", "text/x-csharp"},
+	{".css", "text/css"},
+	{".diff", "text/x-diff"},
+	{".patch", "text/x-diff"},
+	{".go", "text/x-go"},
+	{".html", "text/html"},
+	{".java", "text/x-java"},
+	{".js", "text/javascript"},
+	{".json", "application/json"},
+	{".kt", "text/x-kotlin"},
+	{".lua", "text/x-lua"},
+	{".md", "text/markdown"},
+	{".php", "application/x-httpd-php"},
+	{".pl", "text/x-perl"},
+	{".py", "text/x-python"},
+	{".rb", "text/x-ruby"},
+	{".rs", "text/x-rust"},
+	{".sh", "application/x-sh"},
+	{".bash", "application/x-sh"},
+	{".sql", "application/sql"},
+	{".swift", "text/x-swift"},
+	{".toml", "application/toml"},
+	{".ts", "text/x-typescript"},
+	{".txt", "text/plain"},
+	{".log", "text/plain"},
+	{".xml", "application/xml"},
+	{".yaml", "application/yaml"},
+	{".yml", "application/yaml"},
+}
+
+// detectedContentType returns the content type to store for the file at
+// path, if detection is enabled by PASTILA_DETECT_CONTENT_TYPE.
+func detectedContentType(path string) string {
+	if os.Getenv(detectContentTypeEnv) == "" || path == "" || path == "-" {
+		return ""
+	}
+
+	return contentTypeOf(path)
+}
+
+// contentTypeOf returns the media type of a file by its extension, without
+// parameters, or an empty string if the extension is unknown.
+func contentTypeOf(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == "" {
+		return ""
+	}
+	for _, language := range languages {
+		if language.extension == ext {
+			return language.contentType
+		}
+	}
+
+	mediaType, _, err := mime.ParseMediaType(mime.TypeByExtension(ext))
+	if err != nil {
+		return ""
+	}
+
+	return mediaType
+}
+
+// contentTypeExtension returns the file extension, with the dot, for a media
+// type, or an empty string if there is none.
+func contentTypeExtension(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	for _, language := range languages {
+		if language.contentType == mediaType {
+			return language.extension
+		}
+	}
+
+	extensions, err := mime.ExtensionsByType(mediaType)
+	if err != nil || len(extensions) == 0 {
+		return ""
+	}
+
+	return extensions[0]
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+func TestContentTypeOf(t *testing.T) {
+	for path, expected := range map[string]string{
+		"main.go":          "text/x-go",
+		"dir/README.MD":    "text/markdown",
+		"deploy.yml":       "application/yaml",
+		"query.sql":        "application/sql",
+		"index.html":       "text/html",
+		"image.png":        "image/png",
+		"Makefile":         "",
+		"notes.unknownext": "",
+	} {
+		assert.Equal(t, expected, contentTypeOf(path), path)
+	}
+}
+
+func TestContentTypeExtension(t *testing.T) {
+	for contentType, expected := range map[string]string{
+		"text/x-go":                 ".go",
+		"application/yaml":          ".yaml",
+		"text/html; charset=utf-8":  ".html",
+		"image/png":                 ".png",
+		"application/x-no-such-one": "",
+		"":                          "",
+	} {
+		assert.Equal(t, expected, contentTypeExtension(contentType), contentType)
+	}
+}
+
+func TestDetectedContentType(t *testing.T) {
+	t.Setenv(detectContentTypeEnv, "")
+	assert.Empty(t, detectedContentType("main.go"))
+
+	t.Setenv(detectContentTypeEnv, "1")
+	assert.Equal(t, "text/x-go", detectedContentType("main.go"))
+	assert.Empty(t, detectedContentType("-"))
+	assert.Empty(t, detectedContentType(""))
+}
+
+func TestPasteToTemp(t *testing.T) {
+	paste := &pastila.Paste{
+		ReadCloser:  io.NopCloser(strings.NewReader("package main\n")),
+		Hash:        []byte{0xca, 0xfe},
+		ContentType: "text/x-go",
+	}
+	f, err := pasteToTemp(paste)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	})
+
+	assert.True(t, strings.HasPrefix(filepath.Base(f.Name()), "pastila-cafe"), f.Name())
+	assert.Equal(t, ".go", filepath.Ext(f.Name()))
+}
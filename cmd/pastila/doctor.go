@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+const (
+	// maxClockSkew is how far the local clock may be off that of ClickHouse
+	// before doctor complains. The Date header has a resolution of a second.
+	maxClockSkew = 30 * time.Second
+
+	// ClickHouse error codes of rejected credentials.
+	errCodeRequiredPassword     = 194
+	errCodeAuthenticationFailed = 516
+)
+
+// doctorCheck is one check run by doctor. run returns what it found, or an
+// error saying what to do about it.
+type doctorCheck struct {
+	name string
+	run  func(ctx context.Context) (string, error)
+}
+
+// doctor checks whether pastila can work with the configured service.
+type doctor struct {
+	service   *pastila.Service
+	endpoints []string
+
+	// serverTime is the time ClickHouse answered the ping with, if known.
+	serverTime time.Time
+	// sent is when the ping was sent.
+	sent time.Time
+}
+
+// doctorCommand checks the connection to ClickHouse, the credentials,
+// writing and reading a paste, the editor and the clock, and prints what to
+// do about each problem found. The paste written is a tiny encrypted one.
+func doctorCommand(ctx context.Context, service *pastila.Service, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: doctor")
+	}
+
+	d := &doctor{service: service, endpoints: service.Endpoints}
+	if len(d.endpoints) == 0 {
+		d.endpoints = []string{service.ClickHouseURL}
+		if service.ClickHouseURL == "" {
+			d.endpoints = []string{pastila.DefaultClickHouseURL}
+		}
+	}
+
+	return d.run(ctx, []doctorCheck{
+		{"proxy", d.checkProxy},
+		{"connection", d.checkConnection},
+		{"auth", d.checkAuth},
+		{"write", d.checkWrite},
+		{"editor", d.checkEditor},
+		{"clock", d.checkClock},
+	})
+}
+
+func (d *doctor) run(ctx context.Context, checks []doctorCheck) error {
+	failed := 0
+	for _, check := range checks {
+		result, err := check.run(ctx)
+		if err != nil {
+			failed++
+			printf("FAIL\t%s: %v\n", check.name, err)
+			continue
+		}
+		printf("ok\t%s: %s\n", check.name, result)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+
+	return nil
+}
+
+func (d *doctor) checkProxy(context.Context) (string, error) {
+	var proxies []string
+	for _, endpoint := range d.endpoints {
+		req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+		if err != nil {
+			return "", fmt.Errorf("invalid ClickHouse URL %s: %w; check PASTILA_CLICKHOUSE_URL", endpoint, err)
+		}
+		proxy, err := http.ProxyFromEnvironment(req)
+		if err != nil {
+			return "", fmt.Errorf("invalid proxy: %w; check HTTPS_PROXY and HTTP_PROXY", err)
+		}
+		if proxy != nil {
+			proxies = append(proxies, fmt.Sprintf("%s via %s", req.URL.Host, proxy.Redacted()))
+		}
+	}
+
+	if len(proxies) == 0 {
+		return "none", nil
+	}
+
+	return strings.Join(proxies, ", "), nil
+}
+
+// checkConnection pings every endpoint, which needs no credentials.
+func (d *doctor) checkConnection(ctx context.Context) (string, error) {
+	client := d.service.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	var hosts []string
+	for _, endpoint := range d.endpoints {
+		ping, err := url.Parse(endpoint)
+		if err != nil {
+			return "", fmt.Errorf("invalid ClickHouse URL %s: %w", endpoint, err)
+		}
+		ping.Path, ping.RawQuery = "/ping", ""
+
+		if err := d.ping(ctx, client, ping.String()); err != nil {
+			return "", err
+		}
+		hosts = append(hosts, ping.Host)
+	}
+
+	return "reached " + strings.Join(hosts, ", "), nil
+}
+
+func (d *doctor) ping(ctx context.Context, client *http.Client, ping string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ping, nil)
+	if err != nil {
+		return err
+	}
+	// Private backends may reject unsigned pings.
+	d.service.SignRequest(req)
+
+	sent := time.Now()
+	res, err := client.Do(req)
+	if err != nil {
+		if isTLSError(err) {
+			return fmt.Errorf("%w; if a proxy intercepts TLS, add its CA certificate to SSL_CERT_FILE", err)
+		}
+		return fmt.Errorf("%w; check PASTILA_CLICKHOUSE_URL, the network and the proxy", err)
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("%s answered with %s; check PASTILA_API_TOKEN and PASTILA_SIGNING_KEY", req.URL.Host, res.Status)
+	default:
+		return fmt.Errorf("%s answered with %s; is it ClickHouse?", req.URL.Host, res.Status)
+	}
+	if date, err := http.ParseTime(res.Header.Get("Date")); err == nil && d.serverTime.IsZero() {
+		d.serverTime, d.sent = date, sent
+	}
+
+	return nil
+}
+
+func isTLSError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	var verification *tls.CertificateVerificationError
+
+	return errors.As(err, &unknownAuthority) || errors.As(err, &invalid) ||
+		errors.As(err, &hostname) || errors.As(err, &verification)
+}
+
+// checkAuth looks up a paste that does not exist, which the credentials
+// must allow.
+func (d *doctor) checkAuth(ctx context.Context) (string, error) {
+	_, err := d.service.Exists(ctx, "https://pastila.nl/?00000000/00000000000000000000000000000000")
+
+	var chErr *pastila.ClickHouseError
+	switch {
+	case err == nil:
+		return "credentials accepted", nil
+	case errors.As(err, &chErr) && (chErr.Code == errCodeAuthenticationFailed || chErr.Code == errCodeRequiredPassword):
+		return "", fmt.Errorf("%w; check PASTILA_CLICKHOUSE_USER, PASTILA_CLICKHOUSE_PASSWORD, PASTILA_CLICKHOUSE_JWT and PASTILA_COOKIE", err)
+	case errors.As(err, &chErr) && chErr.Code == 0 &&
+		(chErr.StatusCode == http.StatusUnauthorized || chErr.StatusCode == http.StatusForbidden):
+		// Private backends reject requests before they reach ClickHouse.
+		return "", fmt.Errorf("%w; check PASTILA_API_TOKEN and PASTILA_SIGNING_KEY", err)
+	case errors.Is(err, pastila.ErrAccessDenied):
+		return "", fmt.Errorf("%w; grant the user SELECT on the pastes table", err)
+	default:
+		return "", err
+	}
+}
+
+// checkWrite writes a tiny encrypted paste and reads it back.
+func (d *doctor) checkWrite(ctx context.Context) (string, error) {
+	k, err := generateRandomKey()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate random key: %w", err)
+	}
+	content := "pastila doctor " + time.Now().UTC().Format(time.RFC3339)
+	written, err := d.service.WriteContext(ctx, strings.NewReader(content), pastila.WithKey(k))
+	if errors.Is(err, pastila.ErrReadOnly) || errors.Is(err, pastila.ErrAccessDenied) {
+		return "", fmt.Errorf("%w; reading pastes may still work", err)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	paste, err := d.service.ReadContext(ctx, written.URL)
+	if err != nil {
+		return "", fmt.Errorf("failed to read back %s: %w", written.URL, err)
+	}
+	defer paste.Close()
+	read, err := io.ReadAll(paste)
+	if err != nil {
+		return "", fmt.Errorf("failed to read back %s: %w", written.URL, err)
+	}
+	if string(read) != content {
+		return "", fmt.Errorf("%s reads back different content; check that all endpoints share the pastes table", written.URL)
+	}
+
+	return "wrote and read " + written.URL, nil
+}
+
+func (d *doctor) checkEditor(context.Context) (string, error) {
+	editor := getEditor()
+	fields := strings.Fields(editor)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("no editor; set %s", editorEnv)
+	}
+
+	path, err := exec.LookPath(fields[0])
+	if err != nil {
+		return "", fmt.Errorf("%w; install %s or set %s to another editor", err, fields[0], editorEnv)
+	}
+
+	return path, nil
+}
+
+// checkClock compares the local clock with the Date of the ping response.
+func (d *doctor) checkClock(context.Context) (string, error) {
+	if d.serverTime.IsZero() {
+		return "", fmt.Errorf("ClickHouse did not tell its time; fix the connection first")
+	}
+
+	// Date is truncated to the second, so the local time is as well.
+	skew := d.sent.Truncate(time.Second).Sub(d.serverTime)
+	if skew.Abs() > maxClockSkew {
+		return "", fmt.Errorf("local clock is %s off that of ClickHouse; synchronize it, e.g. with NTP, "+
+			"as paste times and TLS certificate checks depend on it", skew.Abs())
+	}
+
+	return fmt.Sprintf("%s off that of ClickHouse", skew.Abs()), nil
+}
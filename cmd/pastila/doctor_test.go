@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/pastila-cli/pkg/chtest"
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+func TestDoctor(t *testing.T) {
+	// The test binary stands in for an editor that exists.
+	t.Setenv(editorEnv, os.Args[0])
+
+	var out bytes.Buffer
+	printWriter = &out
+	t.Cleanup(func() { printWriter = os.Stdout })
+
+	fake := chtest.NewFakeClickHouse(t)
+	service, err := pastila.NewService(pastila.WithClickHouseURL(fake.URL))
+	require.NoError(t, err)
+	require.NoError(t, doctorCommand(context.Background(), service, nil))
+	rows := fake.Rows()
+	require.Len(t, rows, 1)
+	assert.True(t, rows[0].Encrypted)
+	assert.NotContains(t, rows[0].Content, "pastila doctor")
+
+	assert.Contains(t, out.String(), "ok\tproxy: none\n")
+	assert.Contains(t, out.String(), "ok\tconnection: reached 127.0.0.1:")
+	assert.Contains(t, out.String(), "ok\tauth: credentials accepted\n")
+	assert.Contains(t, out.String(), "ok\twrite: wrote and read https://pastila.nl/?")
+	assert.Contains(t, out.String(), "ok\teditor: "+os.Args[0]+"\n")
+	assert.Contains(t, out.String(), "ok\tclock: ")
+}
+
+func TestDoctorProblems(t *testing.T) {
+	t.Setenv(editorEnv, "pastila-no-such-editor")
+
+	var out bytes.Buffer
+	printWriter = &out
+	t.Cleanup(func() { printWriter = os.Stdout })
+
+	// A ClickHouse that rejects the credentials and whose clock is an hour
+	// ahead.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+		if r.URL.Path == "/ping" {
+			_, _ = w.Write([]byte("Ok.\n"))
+			return
+		}
+		w.Header().Set("X-ClickHouse-Query-Id", "doctor")
+		w.Header().Set("X-ClickHouse-Exception-Code", "516")
+		http.Error(w, "Code: 516. DB::Exception: paste: Authentication failed. (AUTHENTICATION_FAILED)", http.StatusUnauthorized)
+	}))
+	t.Cleanup(server.Close)
+
+	service, err := pastila.NewService(pastila.WithClickHouseURL(server.URL + "/?user=paste"))
+	require.NoError(t, err)
+	require.EqualError(t, doctorCommand(context.Background(), service, nil), "4 of 6 checks failed")
+
+	assert.Contains(t, out.String(), "ok\tconnection: reached ")
+	assert.Contains(t, out.String(), "FAIL\tauth: ")
+	assert.Contains(t, out.String(), "check PASTILA_CLICKHOUSE_USER")
+	assert.Contains(t, out.String(), "FAIL\twrite: ")
+	assert.Contains(t, out.String(), "FAIL\teditor: ")
+	assert.Contains(t, out.String(), "FAIL\tclock: local clock is ")
+}
+
+func TestDoctorRejected(t *testing.T) {
+	t.Setenv(editorEnv, os.Args[0])
+
+	var out bytes.Buffer
+	printWriter = &out
+	t.Cleanup(func() { printWriter = os.Stdout })
+
+	// A private backend that rejects requests without the API token.
+	fake := chtest.NewFakeClickHouse(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(pastila.APITokenHeader) != "token" {
+			http.Error(w, "missing token", http.StatusUnauthorized)
+			return
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	service, err := pastila.NewService(pastila.WithClickHouseURL(server.URL + "/"))
+	require.NoError(t, err)
+	require.Error(t, doctorCommand(context.Background(), service, nil))
+	assert.Contains(t, out.String(), "FAIL\tconnection: ")
+	assert.Contains(t, out.String(), "check PASTILA_API_TOKEN and PASTILA_SIGNING_KEY")
+
+	out.Reset()
+	service, err = pastila.NewService(pastila.WithClickHouseURL(server.URL+"/"), pastila.WithAPIToken("token"))
+	require.NoError(t, err)
+	require.NoError(t, doctorCommand(context.Background(), service, nil), out.String())
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/pastila-cli/pkg/chtest"
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+// TestE2E runs the flows of everyday use through the binary, against the
+// fake ClickHouse of chtest and against a real one.
+func TestE2E(t *testing.T) {
+	for name, clickHouseURL := range map[string]func(t *testing.T) string{
+		"fake": func(t *testing.T) string {
+			return chtest.NewFakeClickHouse(t).URL
+		},
+		"clickhouse": chtest.EnsureClickHouseInstance,
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := newCLIWithClickHouse(t, clickHouseURL(t))
+
+			t.Run("pipe", func(t *testing.T) {
+				testE2EPipe(t, c)
+			})
+			t.Run("key file", func(t *testing.T) {
+				testE2EKeyFile(t, c)
+			})
+			t.Run("edit", func(t *testing.T) {
+				testE2EEdit(t, c)
+			})
+		})
+	}
+}
+
+// testE2EPipe writes stdin to an encrypted paste and reads it back from the
+// printed URL.
+func testE2EPipe(t *testing.T, c *cli) {
+	write := c.run(ptr("Hello from a pipe!\n"))
+	require.Equal(t, 0, write.code, write.stdout)
+	url := strings.TrimSpace(write.stdout)
+	ref, err := pastila.ParseURL(url)
+	require.NoError(t, err)
+	assert.Len(t, ref.Key, 16)
+
+	read := c.run(nil, url)
+	require.Equal(t, 0, read.code, read.stdout)
+	assert.Equal(t, "Hello from a pipe!\n", read.stdout)
+
+	read = c.run(nil, strings.SplitN(url, "#", 2)[0])
+	assert.Equal(t, 1, read.code)
+	assert.Contains(t, read.stdout, "key is required")
+}
+
+// testE2EKeyFile writes a file with the key in a key file, and reads the
+// paste from its URL without the key, with the key file.
+func testE2EKeyFile(t *testing.T, c *cli) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	require.NoError(t, os.WriteFile(keyFile, []byte("0123456789abcdef"), 0o600))
+	contentFile := filepath.Join(dir, "content.txt")
+	require.NoError(t, os.WriteFile(contentFile, []byte("Hello from a file!\n"), 0o600))
+
+	write := c.run(nil, "-key", keyFile, "-f", contentFile)
+	require.Equal(t, 0, write.code, write.stdout)
+	url := strings.TrimSpace(write.stdout)
+	ref, err := pastila.ParseURL(url)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("0123456789abcdef"), ref.Key)
+
+	read := c.run(nil, "-key", keyFile, strings.SplitN(url, "#", 2)[0])
+	require.Equal(t, 0, read.code, read.stdout)
+	assert.Equal(t, "Hello from a file!\n", read.stdout)
+
+	// A key given on the command line is used as it is.
+	read = c.run(nil, "-key", "0123456789abcdef", strings.SplitN(url, "#", 2)[0])
+	require.Equal(t, 0, read.code, read.stdout)
+	assert.Equal(t, "Hello from a file!\n", read.stdout)
+}
+
+// testE2EEdit edits a paste with a scripted editor, which makes the CLI
+// write the edited content as a new version.
+func testE2EEdit(t *testing.T, c *cli) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the scripted editor is a shell script")
+	}
+
+	write := c.run(ptr("Hello, editor!\n"))
+	require.Equal(t, 0, write.code, write.stdout)
+	url := strings.TrimSpace(write.stdout)
+
+	// The editor outlives the check for editors running in background.
+	editor := filepath.Join(t.TempDir(), "editor.sh")
+	require.NoError(t, os.WriteFile(editor, []byte("#!/bin/sh\nsleep 1.5\nprintf 'Hello, edited paste!\\n' > \"$1\"\n"), 0o700))
+
+	edit := c.with("EDITOR="+editor).run(nil, "-e", url)
+	require.Equal(t, 0, edit.code, edit.stdout+edit.stderr)
+	editedURL := strings.TrimSpace(edit.stdout)
+	require.NotEqual(t, url, editedURL)
+
+	read := c.run(nil, editedURL)
+	require.Equal(t, 0, read.code, read.stdout)
+	assert.Equal(t, "Hello, edited paste!\n", read.stdout)
+
+	latest := c.run(nil, "latest", url)
+	require.Equal(t, 0, latest.code, latest.stdout)
+	assert.Equal(t, strings.SplitN(editedURL, "#", 2)[0], strings.SplitN(strings.TrimSpace(latest.stdout), "#", 2)[0])
+}
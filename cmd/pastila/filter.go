@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+// filter runs r through command with filterContent, unless command is empty,
+// in which case r is returned as is.
+func filter(ctx context.Context, command string, r io.Reader) (io.Reader, error) {
+	if command == "" {
+		return r, nil
+	}
+
+	content, err := filterContent(ctx, command, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(content), nil
+}
+
+// filterContent runs r through command, a shell command line such as "jq ."
+// or a redaction script, and returns what it prints. The output is buffered,
+// so a failing filter neither writes nor prints partial content.
+func filterContent(ctx context.Context, command string, r io.Reader) ([]byte, error) {
+	var out bytes.Buffer
+	cmd := shellCommand(ctx, command)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = r, &out, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("filter %q failed: %w", command, err)
+	}
+
+	return out.Bytes(), nil
+}
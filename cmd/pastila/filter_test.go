@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterContent(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the filters are sh command lines")
+	}
+
+	content, err := filterContent(context.Background(), "tr a-z A-Z", strings.NewReader("hello\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "HELLO\n", string(content))
+
+	_, err = filterContent(context.Background(), "cat; exit 3", strings.NewReader("hello\n"))
+	assert.ErrorContains(t, err, `filter "cat; exit 3" failed: exit status 3`)
+
+	r := strings.NewReader("hello\n")
+	unfiltered, err := filter(context.Background(), "", r)
+	require.NoError(t, err)
+	assert.Same(t, r, unfiltered)
+}
+
+func TestFilters(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the filters are sh command lines")
+	}
+
+	c := newCLI(t)
+	write := c.run(ptr("password=hunter2\n"), "-plain", "-filter", "sed s/=.*/=REDACTED/")
+	require.Equal(t, 0, write.code, write.stderr)
+	url := strings.TrimSpace(write.stdout)
+
+	read := c.run(nil, url)
+	assert.Equal(t, "password=REDACTED\n", read.stdout)
+
+	// The flags take precedence over the environment.
+	filtered := c.with("PASTILA_READ_FILTER=tr a-z A-Z")
+	assert.Equal(t, "PASSWORD=REDACTED\n", filtered.run(nil, url).stdout)
+	assert.Equal(t, "password\n", filtered.run(nil, "-read-filter", "cut -d= -f1", url).stdout)
+
+	// Nothing is written when the filter fails.
+	failed := c.with("PASTILA_FILTER=exit 3").run(ptr("password=hunter2\n"), "-plain")
+	assert.Equal(t, 1, failed.code)
+	assert.Equal(t, "filter \"exit 3\" failed: exit status 3\n", failed.stdout)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/rand"
@@ -9,8 +10,11 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"os/signal"
+	"strings"
 	"time"
 
+	"filippo.io/age"
 	"github.com/jkaflik/pastila-cli/pkg/pastila"
 )
 
@@ -25,11 +29,37 @@ var (
 	fileName         string
 	showSummary      bool
 	teeFlag          bool
+	copyFlag         bool
 	launchEditorFlag bool
 	plain            bool
+	randomIV         bool
+	compress         bool
 	key              string
+	passphraseFile   string
+	verify           bool
+	requireMAC       bool
+	chunkSize        int64
+	dedup            bool
+	contentType      string
+	previousURL      string
+	mac              bool
+	recipients       []string
+	identityFile     string
+	extract          bool
+	webhook          string
+	stripANSI        bool
+	expire           time.Duration
+	writeFilter      string
+	readFilter       string
+
+	// passphrase is read from passphraseFile or PASTILA_PASSPHRASE, never
+	// from the command line, where other users can see it.
+	passphrase string
 )
 
+// cacheSize bounds the read cache enabled by PASTILA_CACHE_DIR.
+const cacheSize = 256 << 20
+
 var printWriter io.Writer = os.Stdout
 
 func printf(format string, args ...interface{}) {
@@ -40,10 +70,29 @@ var printUsage = func() {
 	printf("Pastila CLI is a command line utility to read and write from pastila.nl copy-paste service.\n")
 	printf("See a GitHub repository for more information: https://github.com/ClickHouse/pastila\n\n")
 	printf("Usage: %s [options] [URL]\n\n", os.Args[0])
-	printf("\t[URL] can be a pastila URL or \"-\" to read from URL stdin.\n\nAvailable options:\n\n")
+	printf("\t[URL] can be a pastila URL or \"-\" to read URLs from stdin, one per line.\n\n")
+	printf("Commands:\n\n")
+	printf("\tbundle FILE...\tWrite files, with their names and modes, as one paste to restore with -extract.\n")
+	printf("\tclipsync\tKeep the clipboards of machines sharing the -key secret in sync.\n")
+	printf("\tdoctor\tCheck the connection, credentials, editor and clock, and say how to fix what is wrong.\n")
+	printf("\tinfo URL\tShow metadata of a paste without reading its content.\n")
+	printf("\tjoin URL\tPrint a paste, and again whenever a newer version is written, e.g. by share.\n")
+	printf("\tlatest URL\tPrint the URL of the newest version of a paste.\n")
+	printf("\tlist FINGERPRINT|URL\tList the pastes sharing a fingerprint, newest first.\n")
+	printf("\tmcp\tServe tools to read, write and follow pastes as a Model Context Protocol server over stdio.\n")
+	printf("\tpipe send|recv CHANNEL\tMove stdin to stdout of another machine through chained pastes.\n")
+	printf("\trecord [COMMAND...]\tRecord a shell session, or a command, in a terminal, and write the transcript when it exits.\n")
+	printf("\trpc\tServe JSON-RPC over stdin and stdout, for editor plugins.\n")
+	printf("\tserve [ADDR]\tServe a REST API to write and read pastes, on localhost:8080 by default.\n")
+	printf("\tshare FILE\tWrite a file, and a new version of it whenever it changes, until interrupted.\n")
+	printf("\tstats [DAYS]\tSummarize the pastes stored, and those of the last 30 days by day, on self-hosted ClickHouse.\n")
+	printf("\tsync DIR [MANIFEST_URL]\tSync a directory with a manifest paste in both directions.\n\n")
+	printf("Available options:\n\n")
 	flag.PrintDefaults()
 	printf("\nRead data goes into output, anything else goes into stderr.\n")
 	printf("When writing to pastila, URL will be printed to stdout.\n")
+	printf("Pastes written with -chunk-size, -compress, -content-type, -mac, -random-iv, -recipient or a passphrase\n")
+	printf("can be read with pastila CLI only, see the compatibility section of the README.\n")
 }
 
 func stdinWithTimeout(timeout time.Duration) (io.Reader, error) {
@@ -56,6 +105,14 @@ func stdinWithTimeout(timeout time.Duration) (io.Reader, error) {
 		return nil, nil
 	}
 
+	// Pipes and redirected files are unambiguous, so wait for the producer
+	// instead of racing it. Slow producers (and Windows pipes in general)
+	// often miss the timeout otherwise.
+	var timeoutCh <-chan time.Time
+	if mode := fi.Mode(); mode&os.ModeNamedPipe == 0 && !mode.IsRegular() {
+		timeoutCh = time.After(timeout)
+	}
+
 	dataCh := make(chan []byte, 1)
 	errCh := make(chan error, 1)
 
@@ -81,7 +138,7 @@ func stdinWithTimeout(timeout time.Duration) (io.Reader, error) {
 	case err := <-errCh:
 		return nil, err
 
-	case <-time.After(timeout):
+	case <-timeoutCh:
 		return nil, nil
 	}
 }
@@ -89,35 +146,66 @@ func stdinWithTimeout(timeout time.Duration) (io.Reader, error) {
 func main() {
 	setupFlags()
 
-	stdin, err := stdinWithTimeout(time.Millisecond)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	code := run(ctx)
+	stop()
+	os.Exit(code)
+}
+
+func run(ctx context.Context) int {
+	pasteURL := flag.Arg(0)
+
+	var err error
+	passphrase, err = loadPassphrase(passphraseFile)
 	if err != nil {
-		printf("Failed to read from stdin: %v\n", err)
-		os.Exit(1)
+		printf("%v\n", err)
+		return 1
 	}
 
-	pasteURL := flag.Arg(0)
+	service, err := newService(pasteURL)
+	if err != nil {
+		printf("%v\n", err)
+		return 1
+	}
 
-	if pasteURL == "-" {
-		pasteURL, err = readURL(stdin)
+	if command, ok := commands[pasteURL]; ok {
+		if commandErr := command(ctx, service, flag.Args()[1:]); commandErr != nil {
+			printf("%v\n", commandErr)
+			return 1
+		}
+
+		return 0
+	}
+
+	// Stdin is only looked at when no URL or command is given, so an
+	// inherited pipe nobody writes to cannot block reads.
+	var stdin io.Reader
+	if pasteURL == "-" || (pasteURL == "" && (fileName == "" || fileName == "-")) {
+		stdin, err = stdinWithTimeout(time.Millisecond)
 		if err != nil {
-			printf("%v\n", err)
-			os.Exit(1)
+			printf("Failed to read from stdin: %v\n", err)
+			return 1
 		}
 	}
 
-	service := pastila.Service{
-		PastilaURL:    os.Getenv("PASTILA_URL"),
-		ClickHouseURL: os.Getenv("PASTILA_CLICKHOUSE_URL"),
-		AuthCookie:    os.Getenv("PASTILA_COOKIE"),
+	if pasteURL == "-" {
+		if readErr := readURLs(stdin, func(u string) error {
+			return readPaste(ctx, service, u)
+		}); readErr != nil {
+			printf("%v\n", readErr)
+			return 1
+		}
+
+		return 0
 	}
 
 	if pasteURL != "" {
-		if readErr := readPaste(service, pasteURL); readErr != nil {
+		if readErr := readPaste(ctx, service, pasteURL); readErr != nil {
 			printf("%v\n", readErr)
-			os.Exit(1)
+			return 1
 		}
 
-		return
+		return 0
 	}
 
 	var reader io.Reader
@@ -125,7 +213,7 @@ func main() {
 		reader, err = os.Open(fileName)
 		if err != nil {
 			printf("failed to open file %s: %v\n", fileName, err)
-			os.Exit(1)
+			return 1
 		}
 	} else {
 		reader = stdin
@@ -133,17 +221,181 @@ func main() {
 
 	if reader == nil {
 		printUsage()
-		os.Exit(1)
+		return 1
 	}
 
-	if writeErr := writePaste(service, reader); writeErr != nil {
+	if writeErr := writePaste(ctx, service, reader); writeErr != nil {
 		printf("%v\n", writeErr)
-		os.Exit(1)
+		return 1
+	}
+
+	return 0
+}
+
+// newService returns the service configured by the environment and the
+// flags, for command, the first argument.
+func newService(command string) (*pastila.Service, error) {
+	serviceOpts, err := serviceOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if key != "" {
+		// Read URLs without a key with the key given by -key.
+		serviceOpts = append(serviceOpts, pastila.WithKeyProvider(pastila.KeyProviderFunc(
+			func(context.Context, pastila.Ref) ([]byte, error) {
+				return loadKey(key)
+			},
+		)))
+	}
+	if command == "serve" {
+		serviceOpts = append(serviceOpts, pastila.WithMetrics(serveMetrics))
+	}
+
+	return pastila.NewService(serviceOpts...)
+}
+
+// serviceOptionsFromEnv returns the options of the service configured by the
+// PASTILA_* environment variables.
+func serviceOptionsFromEnv() ([]pastila.ServiceOption, error) {
+	serviceOpts := []pastila.ServiceOption{
+		pastila.WithPastilaURL(os.Getenv("PASTILA_URL")),
+		pastila.WithClickHouseURL(os.Getenv("PASTILA_CLICKHOUSE_URL")),
+		pastila.WithAuthCookie(os.Getenv("PASTILA_COOKIE")),
+		pastila.WithAuth(os.Getenv("PASTILA_CLICKHOUSE_USER"), os.Getenv("PASTILA_CLICKHOUSE_PASSWORD")),
+		pastila.WithJWT(os.Getenv("PASTILA_CLICKHOUSE_JWT")),
+		pastila.WithRetry(pastila.DefaultRetryPolicy),
+		pastila.WithUserAgent("PastilaCLI/" + version),
+	}
+	if token := os.Getenv("PASTILA_API_TOKEN"); token != "" {
+		serviceOpts = append(serviceOpts, pastila.WithAPIToken(token))
+	}
+	if signingKey := os.Getenv("PASTILA_SIGNING_KEY"); signingKey != "" {
+		k, err := loadKey(signingKey)
+		if err != nil {
+			return nil, err
+		}
+		serviceOpts = append(serviceOpts, pastila.WithRequestSigning(k))
+	}
+	if endpoints := os.Getenv("PASTILA_CLICKHOUSE_ENDPOINTS"); endpoints != "" {
+		serviceOpts = append(serviceOpts, pastila.WithEndpoints(strings.Split(endpoints, ",")...))
+	}
+	if socket := os.Getenv("PASTILA_CLICKHOUSE_SOCKET"); socket != "" {
+		serviceOpts = append(serviceOpts, pastila.WithUnixSocket(socket))
+	}
+	if table := os.Getenv("PASTILA_CLICKHOUSE_TABLE"); table != "" {
+		database, name, ok := strings.Cut(table, ".")
+		if !ok {
+			database, name = "", table
+		}
+		serviceOpts = append(serviceOpts, pastila.WithTable(database, name))
+	}
+	if os.Getenv("PASTILA_CLICKHOUSE_EXPIRY") != "" {
+		serviceOpts = append(serviceOpts, pastila.WithExpiryColumn())
+	}
+	if os.Getenv("PASTILA_URL_STYLE") == "path" {
+		pastilaURL := os.Getenv("PASTILA_URL")
+		if pastilaURL == "" {
+			pastilaURL = "https://pastila.nl/"
+		}
+		serviceOpts = append(serviceOpts, pastila.WithURLBuilder(pastila.PathURLBuilder(pastilaURL)))
+	}
+	if os.Getenv("PASTILA_WIRE_FORMAT") == "json" {
+		serviceOpts = append(serviceOpts, pastila.WithWireFormat(pastila.WireFormatJSON))
+	}
+	switch os.Getenv("PASTILA_ASYNC_INSERT") {
+	case "wait":
+		serviceOpts = append(serviceOpts, pastila.WithAsyncInsert(true))
+	case "nowait":
+		serviceOpts = append(serviceOpts, pastila.WithAsyncInsert(false))
+	}
+	if queryID := os.Getenv("PASTILA_QUERY_ID"); queryID != "" {
+		serviceOpts = append(serviceOpts, pastila.WithQueryID(queryID))
+	}
+	if cacheDir := os.Getenv("PASTILA_CACHE_DIR"); cacheDir != "" {
+		serviceOpts = append(serviceOpts, pastila.WithCache(cacheDir, cacheSize))
+	}
+
+	return serviceOpts, nil
+}
+
+// loadKey reads the key from the file at path, or takes path as the key
+// itself if there is no such file.
+func loadKey(path string) ([]byte, error) {
+	if _, statErr := os.Stat(path); statErr != nil {
+		return []byte(path), nil
+	}
+
+	k, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key from file %s: %w", path, err)
+	}
+	return k, nil
+}
+
+// loadPassphrase reads the passphrase from the file at path, less the line
+// break ending it, or from PASTILA_PASSPHRASE if path is empty.
+func loadPassphrase(path string) (string, error) {
+	if path == "" {
+		return os.Getenv("PASTILA_PASSPHRASE"), nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase from file %s: %w", path, err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// loadRecipients parses age recipients, each given either as a public key or
+// as the path of a file listing public keys.
+func loadRecipients(values []string) ([]age.Recipient, error) {
+	var all []age.Recipient
+	for _, value := range values {
+		text := []byte(value)
+		if _, statErr := os.Stat(value); statErr == nil {
+			var err error
+			text, err = os.ReadFile(value)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read recipients from file %s: %w", value, err)
+			}
+		}
+
+		r, err := age.ParseRecipients(bytes.NewReader(text))
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient %s: %w", value, err)
+		}
+		all = append(all, r...)
+	}
+
+	return all, nil
+}
+
+// loadIdentities parses the age identities in the file at path.
+func loadIdentities(path string) ([]age.Identity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identities from file %s: %w", path, err)
+	}
+	defer f.Close()
+
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity file %s: %w", path, err)
 	}
+
+	return identities, nil
 }
 
-func writePaste(service pastila.Service, contentReader io.Reader) error {
+func writePaste(ctx context.Context, service *pastila.Service, contentReader io.Reader) error {
 	var reader = contentReader
+	// Bundles are tar archives no filter expects.
+	if contentType != bundleContentType {
+		filtered, err := filter(ctx, writeFilter, reader)
+		if err != nil {
+			return err
+		}
+		reader = filtered
+	}
 	if teeFlag {
 		printWriter = os.Stderr
 		reader = io.TeeReader(reader, os.Stdout)
@@ -151,77 +403,145 @@ func writePaste(service pastila.Service, contentReader io.Reader) error {
 
 	var err error
 	var k []byte
-	if !plain {
+	if !plain && len(recipients) == 0 {
 		if key == "" {
 			k, err = generateRandomKey()
 			if err != nil {
 				return fmt.Errorf("failed to generate random key: %w", err)
 			}
 		} else {
-			if _, statErr := os.Stat(key); statErr == nil {
-				k, err = os.ReadFile(key)
-				if err != nil {
-					return fmt.Errorf("failed to read key from file %s: %w", key, err)
-				}
-			} else {
-				k = []byte(key)
+			k, err = loadKey(key)
+			if err != nil {
+				return err
 			}
 		}
 	}
 
-	result, err := service.Write(reader, pastila.WithKey(k))
+	opts := []pastila.WriteOption{pastila.WithKey(k)}
+	if previousURL != "" {
+		// The new version keeps the key of the previous one unless -key is
+		// given.
+		opts = []pastila.WriteOption{pastila.WithPreviousURL(previousURL)}
+		if key != "" || plain || len(recipients) > 0 {
+			opts = append(opts, pastila.WithKey(k))
+		}
+	}
+	if len(recipients) > 0 && !plain {
+		r, parseErr := loadRecipients(recipients)
+		if parseErr != nil {
+			return parseErr
+		}
+		opts = append(opts, pastila.WithAgeRecipients(r...))
+	}
+	if passphrase != "" && !plain {
+		opts = append(opts, pastila.WithPassphrase(passphrase, pastila.DefaultKDFParams))
+	}
+	if randomIV {
+		opts = append(opts, pastila.WithRandomIV())
+	}
+	if mac {
+		opts = append(opts, pastila.WithMAC())
+	}
+	if compress {
+		opts = append(opts, pastila.WithCompression(pastila.Zstd))
+	}
+	if chunkSize > 0 {
+		opts = append(opts, pastila.WithChunkSize(chunkSize))
+	}
+	if dedup {
+		opts = append(opts, pastila.WithDedup())
+	}
+	if expire != 0 {
+		opts = append(opts, pastila.WithExpiry(expire))
+	}
+	if contentType != "" {
+		opts = append(opts, pastila.WithContentType(contentType))
+	} else if detected := detectedContentType(fileName); detected != "" {
+		opts = append(opts, pastila.WithContentType(detected))
+	}
+
+	result, err := service.WriteContext(ctx, reader, opts...)
 	if err != nil {
 		return fmt.Errorf("failed to write paste: %w", err)
 	}
 
 	printf("%s\n", result.URL)
+
+	if showSummary {
+		printStats(result)
+	}
+
+	if copyFlag {
+		if clipErr := copyToClipboard(result.URL); clipErr != nil {
+			return fmt.Errorf("failed to copy URL to clipboard: %w", clipErr)
+		}
+	}
+
 	return nil
 }
 
-func readURL(r io.Reader) (string, error) {
+// readURLs reads pastila URLs from r, one per line, and calls handle for each
+// of them in order. Blank lines are skipped.
+func readURLs(r io.Reader, handle func(string) error) error {
 	if r == nil {
-		return "", fmt.Errorf("no URL provided in stdin, but \"-\" was passed as URL")
+		return fmt.Errorf("no URL provided in stdin, but \"-\" was passed as URL")
 	}
 
-	buf := make([]byte, 1024)
-	_, readErr := r.Read(buf)
-	if readErr != nil {
-		return "", fmt.Errorf("failed to read pastila URL from stdin: %w", readErr)
+	var count int
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		count++
+		if err := handle(line); err != nil {
+			return err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read pastila URL from stdin: %w", err)
 	}
-	return string(buf), nil
+
+	if count == 0 {
+		return fmt.Errorf("no URL provided in stdin, but \"-\" was passed as URL")
+	}
+
+	return nil
 }
 
 func setupFlags() {
+	setupWriteFlags()
+	setupReadFlags()
+	setupCommandFlags()
 	flag.StringVar(
-		&fileName,
-		"f",
+		&key,
+		"key",
 		"",
-		"Content file path. Use \"-\" to read from stdin. If not provided, content will be read from stdin.",
-	)
-	flag.BoolVar(
-		&plain,
-		"plain",
-		false,
-		"Do not encrypt content. Default is to encrypt content.",
+		"Key to encrypt content, and to decrypt pastes read from URLs without a key. Provide a file path to read key from a file. "+
+			"If not provided, a random 64bit key will be generated.",
 	)
 	flag.StringVar(
-		&key,
-		"key",
+		&passphraseFile,
+		"passphrase-file",
 		"",
-		"Key to encrypt content. Provide a file path to read key from a file.  If not provided, a random 64bit key will be generated.",
+		"Path of a file holding the passphrase to derive the encryption key from, instead of PASTILA_PASSPHRASE. "+
+			"Used instead of a key when writing and to read passphrase protected pastes.",
 	)
 	flag.BoolVar(
 		&showSummary,
 		"s",
 		false,
-		"Show query summary after reading from pastila",
+		"Show query summary after reading from or writing to pastila. The summary goes into stderr.",
 	)
 	flag.BoolVar(
 		&launchEditorFlag,
 		"e",
 		false,
 		`Launch editor to edit content. If URL is provided, editor will be launched with a content read from pastila.
-				Use EDITOR environment variable to set editor. Otherwise, vi will be used.`,
+				Use EDITOR environment variable to set editor. Otherwise, vi (notepad on Windows) will be used.`,
 	)
 	flag.BoolVar(
 		&teeFlag,
@@ -229,6 +549,12 @@ func setupFlags() {
 		false,
 		"Write to output and to pastila. URL will be printed to stderr.",
 	)
+	flag.BoolVar(
+		&copyFlag,
+		"c",
+		false,
+		"Copy the URL of a written paste to the clipboard.",
+	)
 	flag.Bool(
 		"version",
 		false,
@@ -236,34 +562,214 @@ func setupFlags() {
 	)
 	flag.Parse()
 
+	// The flags take precedence over the filters of the environment.
+	if writeFilter == "" {
+		writeFilter = os.Getenv("PASTILA_FILTER")
+	}
+	if readFilter == "" {
+		readFilter = os.Getenv("PASTILA_READ_FILTER")
+	}
+
 	if versionFlag := flag.Lookup("version"); versionFlag != nil && versionFlag.Value.String() == "true" {
 		fmt.Printf("Pastila CLI v%s (%s) - %s\n", version, commit, date)
 		return
 	}
 }
 
-func readPaste(service pastila.Service, urlToRead string) error {
-	pasteRes, readErr := service.Read(urlToRead)
+// setupWriteFlags sets up the flags of writing pastes.
+func setupWriteFlags() {
+	flag.StringVar(
+		&fileName,
+		"f",
+		"",
+		"Content file path. Use \"-\" to read from stdin. If not provided, content will be read from stdin.",
+	)
+	flag.BoolVar(
+		&plain,
+		"plain",
+		false,
+		"Do not encrypt content. Default is to encrypt content.",
+	)
+	flag.BoolVar(
+		&compress,
+		"compress",
+		false,
+		"Compress content with zstd before encryption.",
+	)
+	flag.Int64Var(
+		&chunkSize,
+		"chunk-size",
+		0,
+		"Split content larger than this many bytes into chunks stored as separate pastes.",
+	)
+	flag.StringVar(
+		&contentType,
+		"content-type",
+		"",
+		"Media type of the written content, such as application/json. See PASTILA_DETECT_CONTENT_TYPE to detect it from the -f file name.",
+	)
+	flag.StringVar(
+		&previousURL,
+		"previous",
+		"",
+		"Write content as a new version of the paste at this URL, encrypted with its key unless -key or -plain is given.",
+	)
+	flag.BoolVar(
+		&dedup,
+		"dedup",
+		false,
+		"Do not upload content that is stored already; print the URL of the existing paste instead. Requires -key or -plain to match.",
+	)
+	flag.BoolVar(
+		&randomIV,
+		"random-iv",
+		false,
+		"Encrypt content with a random IV.",
+	)
+	flag.BoolVar(
+		&mac,
+		"mac",
+		false,
+		"Authenticate encrypted content, so corrupted or tampered pastes fail to read.",
+	)
+	flag.Func(
+		"recipient",
+		"Encrypt content with age to this public key, or to the public keys listed in this file, instead of with a key. Can be repeated.",
+		func(value string) error {
+			recipients = append(recipients, value)
+			return nil
+		},
+	)
+	flag.DurationVar(
+		&expire,
+		"expire",
+		0,
+		"Make the written paste expire after this duration, such as 24h, on self-hosted ClickHouse with PASTILA_CLICKHOUSE_EXPIRY set.",
+	)
+	flag.StringVar(
+		&writeFilter,
+		"filter",
+		"",
+		"Shell command to run written content through before it is uploaded, such as a redaction script. Defaults to PASTILA_FILTER.",
+	)
+}
+
+// setupReadFlags sets up the flags of reading pastes.
+func setupReadFlags() {
+	flag.StringVar(
+		&identityFile,
+		"identity",
+		"",
+		"Path of an age identity file to read pastes encrypted with -recipient.",
+	)
+	flag.BoolVar(
+		&verify,
+		"verify",
+		false,
+		"Verify that the content of a read paste matches the hash in its URL before printing any of it.",
+	)
+	flag.BoolVar(
+		&requireMAC,
+		"require-mac",
+		false,
+		"Fail to read pastes that are not authenticated with -mac, so tampered pastes cannot pass for pastes without a MAC.",
+	)
+	flag.BoolVar(
+		&extract,
+		"extract",
+		false,
+		"Restore the files of a paste written by the bundle command into the working directory, instead of printing it.",
+	)
+	flag.StringVar(
+		&readFilter,
+		"read-filter",
+		"",
+		"Shell command to run read content through before it is printed, such as jq . to format JSON. Defaults to PASTILA_READ_FILTER.",
+	)
+}
+
+// setupCommandFlags sets up the flags of commands.
+func setupCommandFlags() {
+	flag.BoolVar(
+		&stripANSI,
+		"strip-ansi",
+		false,
+		"Remove colors and other terminal escape sequences from the transcript written by record.",
+	)
+	flag.StringVar(
+		&webhook,
+		"webhook",
+		"",
+		"URL to post a JSON notification to, in a format Slack incoming webhooks accept, "+
+			"whenever join, clipsync or a watch of rpc sees a newer version.",
+	)
+}
+
+func readPaste(ctx context.Context, service *pastila.Service, urlToRead string) error {
+	opts := []pastila.ReadOption{pastila.WithReadPassphrase(passphrase)}
+	if verify {
+		// The content is known to match its hash only once it is read to
+		// the end, so it is spooled before any of it is printed.
+		opts = append(opts, pastila.WithVerify(), pastila.WithSpool(""))
+	}
+	if requireMAC {
+		opts = append(opts, pastila.WithRequireMAC())
+	}
+	if identityFile != "" {
+		identities, err := loadIdentities(identityFile)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, pastila.WithAgeIdentity(identities...))
+	}
+
+	pasteRes, readErr := service.ReadContext(ctx, urlToRead, opts...)
 	if readErr != nil {
 		return readErr
 	}
 	defer pasteRes.Close()
 
+	if showSummary {
+		printStats(pasteRes)
+	}
+
 	if launchEditorFlag {
-		if _, editErr := editPaste(service, pasteRes); editErr != nil {
+		if _, editErr := editPaste(ctx, service, pasteRes); editErr != nil {
 			return fmt.Errorf("failed to edit paste: %w", editErr)
 		}
 		return nil
 	}
 
-	if _, err := io.Copy(os.Stdout, pasteRes); err != nil {
+	if extract {
+		if pasteRes.ContentType != bundleContentType {
+			return fmt.Errorf("paste %s is not a bundle", urlToRead)
+		}
+		return extractBundle(pasteRes, ".")
+	}
+
+	content, err := filter(ctx, readFilter, pasteRes)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(os.Stdout, content); err != nil {
 		return fmt.Errorf("failed to write paste to stdout: %w", err)
 	}
 
 	return nil
 }
 
-func editPaste(service pastila.Service, paste *pastila.Paste) (*pastila.Paste, error) {
+// printStats prints the query statistics of a paste to stderr, so they don't
+// mix with the paste content.
+func printStats(paste *pastila.Paste) {
+	stats := paste.Stats
+	_, _ = fmt.Fprintf(os.Stderr,
+		"Query %s: read %d rows (%d bytes), written %d rows (%d bytes), elapsed %s\n",
+		paste.QueryID, stats.ReadRows, stats.ReadBytes, stats.WrittenRows, stats.WrittenBytes, stats.Elapsed,
+	)
+}
+
+func editPaste(ctx context.Context, service *pastila.Service, paste *pastila.Paste) (*pastila.Paste, error) {
 	editorFile, fileErr := pasteToTemp(paste)
 	if fileErr != nil {
 		printf("%v\n", fileErr)
@@ -305,14 +811,16 @@ func editPaste(service pastila.Service, paste *pastila.Paste) (*pastila.Paste, e
 		printBuffer = nil
 	}
 
-	fileWatchCtx, cancelFileWatch := context.WithCancel(context.Background())
+	fileWatchCtx, cancelFileWatch := context.WithCancel(ctx)
 	fileWatchDone := watchFile(fileWatchCtx, editorFile, func(_ os.FileInfo) {
 		if _, seekErr := editorFile.Seek(0, io.SeekStart); seekErr != nil {
 			printf("Failed to seek to the beginning of the file: %v\n", seekErr)
 			return
 		}
 
-		paste, fileErr = service.Write(editorFile, pastila.WithPreviousPaste(paste))
+		// The new version keeps the content type of the edited one.
+		paste, fileErr = service.WriteContext(ctx, editorFile,
+			pastila.WithPreviousPaste(paste), pastila.WithContentType(paste.ContentType))
 		if fileErr != nil {
 			printf("%v\n", fileErr)
 			return
@@ -350,7 +858,8 @@ func editPaste(service pastila.Service, paste *pastila.Paste) (*pastila.Paste, e
 }
 
 func pasteToTemp(paste *pastila.Paste) (*os.File, error) {
-	f, err := os.CreateTemp("", fmt.Sprintf("pastila-%x", paste.Hash))
+	// The extension of the content type lets editors highlight the syntax.
+	f, err := os.CreateTemp("", fmt.Sprintf("pastila-%x*%s", paste.Hash, contentTypeExtension(paste.ContentType)))
 	if err != nil {
 		return f, fmt.Errorf("failed to create temporary file: %w", err)
 	}
@@ -399,13 +908,10 @@ func watchFile(ctx context.Context, f *os.File, changeHandler func(os.FileInfo))
 	return done
 }
 
-const (
-	defaultEditor = "vi"
-	editorEnv     = "EDITOR"
-)
+const editorEnv = "EDITOR"
 
 func getEditor() string {
-	if v, ok := os.LookupEnv(editorEnv); ok {
+	if v, ok := os.LookupEnv(editorEnv); ok && v != "" {
 		return v
 	}
 	return defaultEditor
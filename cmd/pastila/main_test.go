@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/pastila-cli/pkg/chtest"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// binary is the pastila binary built by TestMain.
+var binary string
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+
+	dir, err := os.MkdirTemp("", "pastila-cli-test-*")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	binary = filepath.Join(dir, "pastila")
+	if runtime.GOOS == "windows" {
+		binary += ".exe"
+	}
+	build := exec.Command("go", "build", "-o", binary, ".")
+	build.Stdout, build.Stderr = os.Stdout, os.Stderr
+	if err := build.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, "failed to build pastila:", err)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// cli runs the pastila binary against a ClickHouse of its own.
+type cli struct {
+	t   *testing.T
+	env []string
+}
+
+// newCLI returns a cli using a chtest.FakeClickHouse, and pastila.example as
+// the pastila service, so the URLs it prints are the same on every run.
+func newCLI(t *testing.T) *cli {
+	return newCLIWithClickHouse(t, chtest.NewFakeClickHouse(t).URL)
+}
+
+func newCLIWithClickHouse(t *testing.T, clickHouseURL string) *cli {
+	var env []string
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, "PASTILA_") && !strings.HasPrefix(v, "EDITOR=") {
+			env = append(env, v)
+		}
+	}
+
+	return &cli{t: t, env: append(env,
+		"PASTILA_CLICKHOUSE_URL="+clickHouseURL,
+		"PASTILA_URL=https://pastila.example/",
+		"PASTILA_QUERY_ID=golden",
+	)}
+}
+
+// with returns a copy of c with more environment variables.
+func (c *cli) with(env ...string) *cli {
+	return &cli{t: c.t, env: append(slices.Clone(c.env), env...)}
+}
+
+// result is the outcome of a run of the binary.
+type result struct {
+	stdout, stderr string
+	code           int
+}
+
+// String formats the result as golden files hold it.
+func (r result) String() string {
+	return fmt.Sprintf("exit code: %d\n-- stdout --\n%s-- stderr --\n%s", r.code, r.stdout, r.stderr)
+}
+
+// run runs the binary with args and stdin, which is a pipe unless stdin is
+// nil.
+func (c *cli) run(stdin *string, args ...string) result {
+	c.t.Helper()
+
+	cmd := exec.Command(binary, args...)
+	// The usage shows how the binary was called.
+	cmd.Args[0] = "pastila"
+	cmd.Env = c.env
+	if stdin != nil {
+		cmd.Stdin = strings.NewReader(*stdin)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		require.NoError(c.t, err)
+	}
+
+	return result{stdout: stdout.String(), stderr: stderr.String(), code: cmd.ProcessState.ExitCode()}
+}
+
+// assertGolden compares actual with testdata/name.golden, or writes the file
+// when the tests run with -update.
+func assertGolden(t *testing.T, name, actual string) {
+	t.Helper()
+
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		require.NoError(t, os.WriteFile(path, []byte(actual), 0o644))
+		return
+	}
+
+	expected, err := os.ReadFile(path)
+	require.NoError(t, err, "run the tests with -update to create the golden file")
+	assert.Equal(t, string(expected), actual)
+}
+
+// timeRegex matches the RFC 3339 times of pastes, which differ on every run.
+var timeRegex = regexp.MustCompile(`\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(Z|[+-]\d{2}:\d{2})`)
+
+func ptr(s string) *string {
+	return &s
+}
+
+func TestGolden(t *testing.T) {
+	const content = "Hello golden files!\n"
+	c := newCLI(t)
+	write := c.run(ptr(content), "-plain")
+	require.Equal(t, 0, write.code, write.stderr)
+	url := strings.TrimSpace(write.stdout)
+
+	for name, tc := range map[string]struct {
+		stdin *string
+		args  []string
+	}{
+		"usage":               {},
+		"write":               {stdin: ptr(content), args: []string{"-plain"}},
+		"write_summary":       {stdin: ptr(content), args: []string{"-plain", "-s"}},
+		"write_tee":           {stdin: ptr(content), args: []string{"-plain", "-teeFlag"}},
+		"read":                {args: []string{url}},
+		"read_summary":        {args: []string{"-s", url}},
+		"read_urls":           {stdin: ptr(url + "\n\n" + url + "\n"), args: []string{"-"}},
+		"latest":              {args: []string{"latest", url}},
+		"list":                {args: []string{"list", url}},
+		"error_invalid_url":   {args: []string{"https://pastila.example/?not-a-reference"}},
+		"error_not_found":     {args: []string{"https://pastila.example/?ffffffff/00000000000000000000000000000001"}},
+		"error_command_usage": {args: []string{"info"}},
+		"error_missing_file":  {args: []string{"-f", "does-not-exist.txt"}},
+		"error_bad_flag":      {args: []string{"-no-such-flag"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			actual := c.run(tc.stdin, tc.args...).String()
+			actual = strings.ReplaceAll(actual, url, "$URL")
+			assertGolden(t, name, timeRegex.ReplaceAllString(actual, "$$TIME"))
+		})
+	}
+}
+
+func TestRequireMAC(t *testing.T) {
+	c := newCLI(t)
+
+	write := c.run(ptr("authenticated\n"), "-mac")
+	require.Equal(t, 0, write.code, write.stdout)
+	read := c.run(nil, "-require-mac", strings.TrimSpace(write.stdout))
+	require.Equal(t, 0, read.code, read.stdout)
+	assert.Equal(t, "authenticated\n", read.stdout)
+
+	write = c.run(ptr("not authenticated\n"))
+	require.Equal(t, 0, write.code, write.stdout)
+	read = c.run(nil, "-require-mac", strings.TrimSpace(write.stdout))
+	assert.Equal(t, 1, read.code)
+	assert.Contains(t, read.stdout, "paste has no MAC")
+}
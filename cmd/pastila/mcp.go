@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+// mcpProtocolVersions are the versions of the Model Context Protocol the
+// mcp command speaks, newest first.
+var mcpProtocolVersions = []string{"2025-06-18", "2025-03-26", "2024-11-05"}
+
+// mcpTools are the tools of the mcp command, with the JSON schemas of their
+// arguments.
+var mcpTools = []map[string]any{
+	{
+		"name":        "pastila_read",
+		"description": "Read the content of a pastila paste, decrypting it with the key in its URL.",
+		"inputSchema": map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"url": map[string]any{"type": "string", "description": "URL of the paste, with its key after #."},
+			},
+			"required": []string{"url"},
+		},
+	},
+	{
+		"name": "pastila_write",
+		"description": "Write content to a new pastila paste, encrypted with a random key unless plain is set, " +
+			"and return its URL, which carries the key.",
+		"inputSchema": map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"content":  map[string]any{"type": "string"},
+				"plain":    map[string]any{"type": "boolean", "description": "Do not encrypt the content."},
+				"previous": map[string]any{"type": "string", "description": "URL of a paste to write a new version of."},
+			},
+			"required": []string{"content"},
+		},
+	},
+	{
+		"name": "pastila_latest",
+		"description": "Return the URL of the newest version of a pastila paste, to follow a paste as it is edited. " +
+			"Needs a self-hosted ClickHouse.",
+		"inputSchema": map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"url": map[string]any{"type": "string", "description": "URL of a version of the paste."},
+			},
+			"required": []string{"url"},
+		},
+	},
+	{
+		"name":        "pastila_history",
+		"description": "Read the versions of a pastila paste, newest first.",
+		"inputSchema": map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"url":         map[string]any{"type": "string", "description": "URL of a version of the paste."},
+				"maxVersions": map[string]any{"type": "integer", "description": "Number of versions to read, 10 by default."},
+			},
+			"required": []string{"url"},
+		},
+	},
+}
+
+// mcpCommand serves pastila as a Model Context Protocol server over stdin and
+// stdout, so AI assistants can read, write and follow pastes with the
+// encryption of the CLI. It stops at the end of stdin.
+func mcpCommand(ctx context.Context, service *pastila.Service, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: mcp")
+	}
+
+	return newMCPServer(service, os.Stdout).serve(ctx, os.Stdin)
+}
+
+type mcpServer struct {
+	service *pastila.Service
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+type mcpToolParams struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type mcpHistoryArguments struct {
+	URL         string `json:"url"`
+	MaxVersions int    `json:"maxVersions"`
+}
+
+func newMCPServer(service *pastila.Service, w io.Writer) *mcpServer {
+	return &mcpServer{service: service, w: w}
+}
+
+// serve answers the messages read from r, one JSON object per line, until its
+// end.
+func (s *mcpServer) serve(ctx context.Context, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), maxRPCMessageSize)
+	for scanner.Scan() {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		var req rpcMessage
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			s.send(&rpcMessage{ID: json.RawMessage("null"), Error: &rpcError{Code: rpcParseError, Message: err.Error()}})
+			continue
+		}
+
+		result, rpcErr := s.handle(ctx, &req)
+		// Notifications, such as notifications/initialized, are not
+		// answered.
+		if req.ID == nil {
+			continue
+		}
+		if rpcErr != nil {
+			s.send(&rpcMessage{ID: req.ID, Error: rpcErr})
+			continue
+		}
+		s.send(&rpcMessage{ID: req.ID, Result: result})
+	}
+
+	return scanner.Err()
+}
+
+// send writes msg on a line of its own.
+func (s *mcpServer) send(msg *rpcMessage) {
+	msg.JSONRPC = "2.0"
+	body, err := json.Marshal(msg)
+	if err != nil {
+		body, _ = json.Marshal(&rpcMessage{JSONRPC: "2.0", ID: msg.ID, Error: &rpcError{
+			Code: rpcBackendError, Message: fmt.Sprintf("failed to encode response: %v", err),
+		}})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, _ = fmt.Fprintf(s.w, "%s\n", body)
+}
+
+func (s *mcpServer) handle(ctx context.Context, req *rpcMessage) (any, *rpcError) {
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return nil, &rpcError{Code: rpcInvalidRequest, Message: "not a JSON-RPC 2.0 request"}
+	}
+
+	switch req.Method {
+	case "initialize":
+		var params struct {
+			ProtocolVersion string `json:"protocolVersion"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, rpcInvalidParamsError(err)
+		}
+		// Clients asking for a version the server does not speak get the
+		// newest one, and decide whether to go on.
+		protocolVersion := mcpProtocolVersions[0]
+		if slices.Contains(mcpProtocolVersions, params.ProtocolVersion) {
+			protocolVersion = params.ProtocolVersion
+		}
+		return map[string]any{
+			"protocolVersion": protocolVersion,
+			"capabilities":    map[string]any{"tools": map[string]any{}},
+			"serverInfo":      map[string]any{"name": "pastila", "version": version},
+		}, nil
+	case "ping":
+		return struct{}{}, nil
+	case "tools/list":
+		return map[string]any{"tools": mcpTools}, nil
+	case "tools/call":
+		var params mcpToolParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, rpcInvalidParamsError(err)
+		}
+		return s.call(ctx, &params)
+	default:
+		if req.ID == nil {
+			return nil, nil
+		}
+		return nil, &rpcError{Code: rpcMethodNotFound, Message: "unknown method " + req.Method}
+	}
+}
+
+// call runs a tool. Failures of the tool are results, so the model sees
+// them; only unknown tools and malformed arguments are protocol errors.
+func (s *mcpServer) call(ctx context.Context, params *mcpToolParams) (any, *rpcError) {
+	var text string
+	var err error
+	switch params.Name {
+	case "pastila_read":
+		var args rpcPaste
+		if err := json.Unmarshal(params.Arguments, &args); err != nil || args.URL == "" {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: "url is required"}
+		}
+		var paste *rpcPaste
+		if paste, err = rpcRead(ctx, s.service, args.URL); err == nil {
+			text = paste.Content
+		}
+	case "pastila_write":
+		var args rpcWriteParams
+		if err := json.Unmarshal(params.Arguments, &args); err != nil {
+			return nil, rpcInvalidParamsError(err)
+		}
+		var paste *rpcPaste
+		if paste, err = rpcWrite(ctx, s.service, &args); err == nil {
+			text = paste.URL
+		}
+	case "pastila_latest":
+		var args rpcPaste
+		if err := json.Unmarshal(params.Arguments, &args); err != nil || args.URL == "" {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: "url is required"}
+		}
+		var info *pastila.PasteInfo
+		if info, err = s.service.Latest(ctx, args.URL); err == nil {
+			text = info.URL
+		}
+	case "pastila_history":
+		var args mcpHistoryArguments
+		if err := json.Unmarshal(params.Arguments, &args); err != nil || args.URL == "" {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: "url is required"}
+		}
+		text, err = s.history(ctx, &args)
+	default:
+		return nil, &rpcError{Code: rpcInvalidParams, Message: "unknown tool " + params.Name}
+	}
+
+	if err != nil {
+		return mcpToolResult(err.Error(), true), nil
+	}
+	return mcpToolResult(text, false), nil
+}
+
+// history formats the versions of a paste as text, newest first.
+func (s *mcpServer) history(ctx context.Context, args *mcpHistoryArguments) (string, error) {
+	maxVersions := args.MaxVersions
+	if maxVersions <= 0 {
+		maxVersions = 10
+	}
+
+	versions, err := s.service.History(ctx, args.URL, pastila.WithMaxVersions(maxVersions))
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for _, version := range versions {
+		content, err := io.ReadAll(version)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "## %s\n\n%s\n\n", version.URL, content)
+	}
+
+	return b.String(), nil
+}
+
+func mcpToolResult(text string, isError bool) map[string]any {
+	return map[string]any{
+		"content": []map[string]any{{"type": "text", "text": text}},
+		"isError": isError,
+	}
+}
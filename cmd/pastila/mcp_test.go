@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/pastila-cli/pkg/chtest"
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+func TestMCP(t *testing.T) {
+	service, err := pastila.NewService(pastila.WithClickHouseURL(chtest.NewFakeClickHouse(t).URL))
+	require.NoError(t, err)
+
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- newMCPServer(service, stdoutW).serve(context.Background(), stdinR)
+		_ = stdoutW.Close()
+	}()
+	responses := bufio.NewScanner(stdoutR)
+
+	id := 0
+	send := func(t *testing.T, msg map[string]any) {
+		body, err := json.Marshal(msg)
+		require.NoError(t, err)
+		_, err = fmt.Fprintf(stdinW, "%s\n", body)
+		require.NoError(t, err)
+	}
+	call := func(t *testing.T, method string, params any) (map[string]any, *rpcError) {
+		id++
+		send(t, map[string]any{"jsonrpc": "2.0", "id": id, "method": method, "params": params})
+
+		require.True(t, responses.Scan())
+		var msg struct {
+			ID     int            `json:"id"`
+			Result map[string]any `json:"result"`
+			Error  *rpcError      `json:"error"`
+		}
+		require.NoError(t, json.Unmarshal(responses.Bytes(), &msg))
+		assert.Equal(t, id, msg.ID)
+		return msg.Result, msg.Error
+	}
+	tool := func(t *testing.T, name string, args map[string]any) (string, bool) {
+		result, rpcErr := call(t, "tools/call", map[string]any{"name": name, "arguments": args})
+		require.Nil(t, rpcErr)
+		content := result["content"].([]any)[0].(map[string]any)
+		return content["text"].(string), result["isError"].(bool)
+	}
+
+	initialized, rpcErr := call(t, "initialize", map[string]any{
+		"protocolVersion": "2025-03-26",
+		"capabilities":    map[string]any{},
+		"clientInfo":      map[string]any{"name": "test", "version": "1"},
+	})
+	require.Nil(t, rpcErr)
+	assert.Equal(t, "2025-03-26", initialized["protocolVersion"])
+	send(t, map[string]any{"jsonrpc": "2.0", "method": "notifications/initialized"})
+
+	tools, rpcErr := call(t, "tools/list", nil)
+	require.Nil(t, rpcErr)
+	assert.Len(t, tools["tools"], len(mcpTools))
+
+	url, isError := tool(t, "pastila_write", map[string]any{"content": "first"})
+	require.False(t, isError, url)
+	ref, err := pastila.ParseURL(url)
+	require.NoError(t, err)
+	assert.NotNil(t, ref.Key)
+	newer, isError := tool(t, "pastila_write", map[string]any{"content": "second", "previous": url})
+	require.False(t, isError, newer)
+
+	content, isError := tool(t, "pastila_read", map[string]any{"url": newer})
+	require.False(t, isError, content)
+	assert.Equal(t, "second", content)
+
+	latest, isError := tool(t, "pastila_latest", map[string]any{"url": url})
+	require.False(t, isError, latest)
+	assert.Equal(t, newer, latest)
+
+	history, isError := tool(t, "pastila_history", map[string]any{"url": newer})
+	require.False(t, isError, history)
+	assert.Equal(t, "## "+newer+"\n\nsecond\n\n## "+url+"\n\nfirst\n\n", history)
+
+	message, isError := tool(t, "pastila_read", map[string]any{"url": "https://pastila.nl/?ffffffff/00000000000000000000000000000001"})
+	assert.True(t, isError)
+	assert.Contains(t, message, "not found")
+
+	_, rpcErr = call(t, "tools/call", map[string]any{"name": "pastila_delete", "arguments": map[string]any{}})
+	require.NotNil(t, rpcErr)
+	assert.Equal(t, rpcInvalidParams, rpcErr.Code)
+
+	require.NoError(t, stdinW.Close())
+	require.NoError(t, <-done)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+// pipeChunkSize bounds the content of a pipe chunk. Smaller reads are sent
+// as they come, so interactive streams are not held back.
+const pipeChunkSize = 1 << 20
+
+// pipePollInterval is how often pipe recv looks for the next chunk.
+var pipePollInterval = time.Second
+
+// pipeCommand moves data between machines through the paste backend. send
+// writes a session paste after the head of the channel, then stdin as a chain
+// of encrypted chunks after it, ending with an empty one. recv waits for a
+// session started after itself and follows its chain to stdout, waiting for
+// chunks as they are written, so it never replays a former transfer: start
+// recv first.
+//
+// The key of a channel is derived from its name, so anyone knowing the name
+// can read the data: pick one that is hard to guess. The sessions and chunks
+// are found with Next, which the public pastila service does not allow.
+func pipeCommand(ctx context.Context, service *pastila.Service, args []string) error {
+	if len(args) != 2 || (args[0] != "send" && args[0] != "recv") {
+		return fmt.Errorf("usage: pipe send|recv CHANNEL")
+	}
+
+	if args[0] == "send" {
+		return pipeSend(ctx, service, args[1], os.Stdin)
+	}
+	return pipeRecv(ctx, service, args[1], printWriter)
+}
+
+// deriveChannel returns the key and fingerprint of the channel named by
+// secret, for the given use of channels.
+func deriveChannel(use, secret string) (key, fingerprint []byte) {
+	sum := sha256.Sum256([]byte("pastila " + use + " " + secret))
+	return sum[:16], sum[16:20]
+}
+
+// writeChannelHead writes the paste a channel starts from and returns its
+// URL. The head is written with the key and fingerprint of the channel and
+// the all-zero IV, so all ends arrive at the same URL without exchanging
+// anything but the secret.
+func writeChannelHead(ctx context.Context, service *pastila.Service, use, secret string) (string, error) {
+	key, fingerprint := deriveChannel(use, secret)
+	head, err := service.WriteContext(ctx, strings.NewReader("pastila "+use+"\n"),
+		pastila.WithKey(key), pastila.WithFingerprint(fingerprint))
+	if err != nil {
+		return "", fmt.Errorf("failed to write head of %s channel: %w", use, err)
+	}
+
+	return head.URL, nil
+}
+
+func pipeSend(ctx context.Context, service *pastila.Service, channel string, input io.Reader) error {
+	head, err := writeChannelHead(ctx, service, "pipe", channel)
+	if err != nil {
+		return err
+	}
+	_, fingerprint := deriveChannel("pipe", channel)
+
+	// Sessions and chunks use a random IV, as they share the key of the
+	// channel and repeat content, e.g. the empty last chunk. It makes every
+	// session a new paste for recv to tell apart from former ones.
+	session, err := service.WriteContext(ctx, strings.NewReader("pastila pipe session\n"),
+		pastila.WithPreviousURL(head), pastila.WithFingerprint(fingerprint), pastila.WithRandomIV())
+	if err != nil {
+		return fmt.Errorf("failed to write session: %w", err)
+	}
+	previous := session.URL
+
+	write := func(chunk []byte) error {
+		paste, err := service.WriteContext(ctx, strings.NewReader(string(chunk)),
+			pastila.WithPreviousURL(previous), pastila.WithFingerprint(fingerprint), pastila.WithRandomIV())
+		if err != nil {
+			return fmt.Errorf("failed to write chunk: %w", err)
+		}
+		previous = paste.URL
+		return nil
+	}
+
+	buf := make([]byte, pipeChunkSize)
+	for {
+		n, err := input.Read(buf)
+		if n > 0 {
+			if err := write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read input: %w", err)
+		}
+	}
+
+	return write(nil)
+}
+
+func pipeRecv(ctx context.Context, service *pastila.Service, channel string, output io.Writer) error {
+	head, err := writeChannelHead(ctx, service, "pipe", channel)
+	if err != nil {
+		return err
+	}
+
+	// The newest session when recv starts belongs to a former transfer.
+	var stale string
+	former, err := service.Next(ctx, head)
+	switch {
+	case err == nil:
+		stale = former.URL
+	case !errors.Is(err, pastila.ErrNotFound):
+		return err
+	}
+
+	session, err := pipeNext(ctx, service, head, stale)
+	if err != nil {
+		return err
+	}
+
+	current := session.URL
+	for {
+		next, err := pipeNext(ctx, service, current, "")
+		if err != nil {
+			return err
+		}
+
+		paste, err := service.ReadContext(ctx, next.URL)
+		if err != nil {
+			return fmt.Errorf("failed to read chunk: %w", err)
+		}
+		n, err := io.Copy(output, paste)
+		_ = paste.Close()
+		if err != nil {
+			return fmt.Errorf("failed to copy chunk: %w", err)
+		}
+		if n == 0 {
+			return nil
+		}
+
+		current = next.URL
+	}
+}
+
+// pipeNext waits for the paste after url, other than the one at skip.
+func pipeNext(ctx context.Context, service *pastila.Service, url, skip string) (*pastila.PasteInfo, error) {
+	for {
+		next, err := service.Next(ctx, url)
+		if err == nil && next.URL != skip {
+			return next, nil
+		}
+		if err != nil && !errors.Is(err, pastila.ErrNotFound) {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(pipePollInterval):
+		}
+	}
+}
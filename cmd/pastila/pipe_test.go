@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/pastila-cli/pkg/chtest"
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+func TestPipe(t *testing.T) {
+	service, err := pastila.NewService(pastila.WithClickHouseURL(chtest.NewFakeClickHouse(t).URL))
+	require.NoError(t, err)
+	pipePollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { pipePollInterval = time.Second })
+	ctx := context.Background()
+
+	// The receiver waits for the sender.
+	var out bytes.Buffer
+	done := make(chan error, 1)
+	go func() { done <- pipeRecv(ctx, service, "first", &out) }()
+	time.Sleep(50 * time.Millisecond)
+
+	// Repeated chunks must not be mistaken for earlier ones.
+	input := strings.Repeat("y\n", pipeChunkSize)
+	require.NoError(t, pipeSend(ctx, service, "first", strings.NewReader(input)))
+	require.NoError(t, <-done)
+	assert.Equal(t, input, out.String())
+
+	// A receiver started later does not replay the former transfer, but
+	// waits for the next one.
+	out.Reset()
+	go func() { done <- pipeRecv(ctx, service, "first", &out) }()
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, out.String())
+	require.NoError(t, pipeSend(ctx, service, "first", strings.NewReader("again")))
+	require.NoError(t, <-done)
+	assert.Equal(t, "again", out.String())
+
+	// Other channels are separate.
+	timeout, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, pipeRecv(timeout, service, "second", &out), context.DeadlineExceeded)
+}
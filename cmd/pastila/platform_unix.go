@@ -0,0 +1,93 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+const defaultEditor = "vi"
+
+// clipboardCommands lists clipboard utilities in order of preference:
+// macOS, Wayland and then X11.
+var clipboardCommands = [][]string{
+	{"pbcopy"},
+	{"wl-copy"},
+	{"xclip", "-selection", "clipboard"},
+	{"xsel", "--clipboard", "--input"},
+}
+
+// clipboardPasteCommands are the utilities of clipboardCommands reading the
+// clipboard.
+var clipboardPasteCommands = [][]string{
+	{"pbpaste"},
+	{"wl-paste", "--no-newline"},
+	{"xclip", "-selection", "clipboard", "-out"},
+	{"xsel", "--clipboard", "--output"},
+}
+
+var errNoClipboard = errors.New("no clipboard utility found, install pbcopy, wl-copy, xclip or xsel")
+
+func copyToClipboard(text string) error {
+	for _, c := range clipboardCommands {
+		path, err := exec.LookPath(c[0])
+		if err != nil {
+			continue
+		}
+
+		// #nosec G204 -- command is picked from a fixed list
+		cmd := exec.Command(path, c[1:]...)
+		cmd.Stdin = strings.NewReader(text)
+		return cmd.Run()
+	}
+
+	return errNoClipboard
+}
+
+func pasteFromClipboard() (string, error) {
+	for _, c := range clipboardPasteCommands {
+		path, err := exec.LookPath(c[0])
+		if err != nil {
+			continue
+		}
+
+		// #nosec G204 -- command is picked from a fixed list
+		out, err := exec.Command(path, c[1:]...).Output()
+		return string(out), err
+	}
+
+	return "", errNoClipboard
+}
+
+// shellCommand returns the invocation running command with sh.
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	// #nosec G204 -- This is intended behavior to run the user's filter
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
+
+// scriptCommand returns the script(1) invocation recording command into the
+// file at transcript, for util-linux on Linux and BSD script elsewhere.
+func scriptCommand(transcript string, command []string) (*exec.Cmd, error) {
+	path, err := exec.LookPath("script")
+	if err != nil {
+		return nil, fmt.Errorf("record needs script(1): %w", err)
+	}
+
+	if runtime.GOOS == "linux" {
+		// util-linux script runs a single command line with the shell.
+		quoted := make([]string, len(command))
+		for i, arg := range command {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+		// #nosec G204 -- This is intended behavior to record the user's command
+		return exec.Command(path, "-q", "-e", "-c", strings.Join(quoted, " "), transcript), nil
+	}
+
+	// #nosec G204 -- This is intended behavior to record the user's command
+	return exec.Command(path, append([]string{"-q", transcript}, command...)...), nil
+}
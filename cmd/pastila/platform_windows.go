@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+const defaultEditor = "notepad"
+
+func copyToClipboard(text string) error {
+	// clip.exe ships with every supported Windows version.
+	cmd := exec.Command("clip")
+	cmd.Stdin = strings.NewReader(text)
+	return cmd.Run()
+}
+
+// errNoClipboard is never returned on Windows, which always has a clipboard.
+var errNoClipboard = errors.New("no clipboard utility found")
+
+func pasteFromClipboard() (string, error) {
+	out, err := exec.Command("powershell", "-NoProfile", "-Command", "Get-Clipboard -Raw").Output()
+	return strings.TrimSuffix(string(out), "\r\n"), err
+}
+
+// shellCommand returns the invocation running command with cmd.exe.
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	// #nosec G204 -- This is intended behavior to run the user's filter
+	return exec.CommandContext(ctx, "cmd", "/C", command)
+}
+
+// scriptCommand fails on Windows, which has no script(1) to record a
+// terminal with.
+func scriptCommand(string, []string) (*exec.Cmd, error) {
+	return nil, errors.New("record needs script(1), which Windows does not have")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+// ansiRegex matches terminal escape sequences: CSI sequences, such as colors
+// and cursor movement, OSC sequences, such as window titles, and the
+// remaining two byte escapes, such as keypad modes.
+var ansiRegex = regexp.MustCompile("\x1b\\[[0-?]*[ -/]*[@-~]|\x1b\\][^\x07\x1b]*(?:\x07|\x1b\\\\)|\x1b[=>@-Z\\\\-_]")
+
+// recordCommand runs a shell, or the given command, in a terminal recorded
+// with script(1), and writes the transcript as a paste once it exits, like
+// any other content. With -strip-ansi, colors and other escape sequences are
+// removed from it.
+func recordCommand(ctx context.Context, service *pastila.Service, args []string) error {
+	if len(args) == 0 {
+		shell := os.Getenv("SHELL")
+		if shell == "" {
+			shell = "sh"
+		}
+		args = []string{shell}
+	}
+
+	_, _ = fmt.Fprintf(os.Stderr, "recording %s, exit it to write the transcript\n", args[0])
+	transcript, err := record(args)
+	if err != nil {
+		return err
+	}
+	if stripANSI {
+		transcript = stripEscapes(transcript)
+	}
+
+	return writePaste(ctx, service, bytes.NewReader(transcript))
+}
+
+// record runs command under script(1) and returns what it wrote to the
+// terminal. A failing command is recorded like any other.
+func record(command []string) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "pastila-record-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "transcript")
+	cmd, err := scriptCommand(path, command)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stderr, os.Stderr
+
+	var exitErr *exec.ExitError
+	if err := cmd.Run(); err != nil && !errors.As(err, &exitErr) {
+		return nil, fmt.Errorf("failed to run script: %w", err)
+	}
+
+	transcript, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transcript: %w", err)
+	}
+
+	return trimScriptMessages(transcript), nil
+}
+
+// trimScriptMessages removes the lines util-linux script writes before and
+// after the session, even with -q.
+func trimScriptMessages(transcript []byte) []byte {
+	if bytes.HasPrefix(transcript, []byte("Script started on ")) {
+		if _, rest, ok := bytes.Cut(transcript, []byte("\n")); ok {
+			transcript = rest
+		}
+	}
+
+	trimmed := bytes.TrimRight(transcript, "\n")
+	if i := bytes.LastIndexByte(trimmed, '\n'); bytes.HasPrefix(trimmed[i+1:], []byte("Script done on ")) {
+		// The line break script writes before the message goes too.
+		transcript = trimmed[:i]
+	}
+
+	return transcript
+}
+
+// stripEscapes removes terminal escape sequences from a transcript, and the
+// carriage returns terminals end lines with.
+func stripEscapes(transcript []byte) []byte {
+	transcript = ansiRegex.ReplaceAll(transcript, nil)
+	return bytes.ReplaceAll(transcript, []byte("\r\n"), []byte("\n"))
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os/exec"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecord(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no script(1)")
+	}
+	if _, err := exec.LookPath("script"); err != nil {
+		t.Skip("script(1) is not installed")
+	}
+
+	// The exit status of the recorded command does not matter.
+	transcript, err := record([]string{"sh", "-c", "echo \"it's recorded\"; exit 3"})
+	require.NoError(t, err)
+	assert.Equal(t, "it's recorded\n", string(stripEscapes(transcript)))
+}
+
+func TestTrimScriptMessages(t *testing.T) {
+	transcript := "Script started on 2024-05-01 12:00:00+00:00 [COMMAND=\"sh\"]\n$ ls\r\nfile\r\n\nScript done on 2024-05-01 12:00:01+00:00\n"
+	assert.Equal(t, "$ ls\r\nfile\r\n", string(trimScriptMessages([]byte(transcript))))
+	assert.Equal(t, "$ ls\r\n", string(trimScriptMessages([]byte("$ ls\r\n"))))
+}
+
+func TestStripEscapes(t *testing.T) {
+	transcript := "\x1b]0;user@host: ~\x07\x1b[01;32muser@host\x1b[00m:~$ ls\r\n\x1b[?2004lfile\r\n\x1b=done\r\n"
+	assert.Equal(t, "user@host:~$ ls\nfile\ndone\n", string(stripEscapes([]byte(transcript))))
+}
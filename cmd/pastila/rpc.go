@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+// maxRPCMessageSize bounds the size of a message, which holds at most a
+// paste of the size serve accepts, escaped as a JSON string.
+const maxRPCMessageSize = 2 * maxServeContentSize
+
+// rpcWatchInterval is how often watched pastes are looked up for newer
+// versions.
+var rpcWatchInterval = 2 * time.Second
+
+// JSON-RPC error codes. The ones below -32000 are those of the
+// specification, the others are errors of pastila.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcBackendError   = -32000
+	rpcNotFound       = -32001
+	rpcBadPaste       = -32002
+)
+
+// rpcCommand serves JSON-RPC 2.0 over stdin and stdout, with messages framed
+// by a Content-Length header as in the Language Server Protocol, so editor
+// plugins can use pastila without implementing its encryption. It stops at
+// the end of stdin. Methods are:
+//
+//	paste/write   {content, plain?, previous?, contentType?} -> {url}
+//	paste/read    {url} -> {url, content, contentType}
+//	paste/watch   {url} -> {url}, the newest version, and then a
+//	              paste/changed notification {url, content, contentType}
+//	              whenever a newer version is written
+//	paste/unwatch {url}
+//
+// Like serve, paste/write encrypts with a random key unless plain is set, and
+// previous makes the paste a new version of another one, with its key. With
+// -webhook, each newer version of a watched paste is also posted there.
+func rpcCommand(ctx context.Context, service *pastila.Service, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: rpc")
+	}
+
+	return newRPCServer(service, os.Stdout, webhookNotifier(ctx, webhook)).serve(ctx, os.Stdin)
+}
+
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcPaste struct {
+	URL         string `json:"url"`
+	Content     string `json:"content,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+type rpcWriteParams struct {
+	Content     string `json:"content"`
+	Plain       bool   `json:"plain"`
+	Previous    string `json:"previous"`
+	ContentType string `json:"contentType"`
+}
+
+type rpcServer struct {
+	service *pastila.Service
+	// notify, if not nil, is called for every newer version of a watched
+	// paste, like by join.
+	notify func(*pastila.PasteInfo)
+
+	// mu serializes the messages written by requests and watches.
+	mu sync.Mutex
+	w  io.Writer
+
+	watchesMu sync.Mutex
+	watches   map[string]context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+func newRPCServer(service *pastila.Service, w io.Writer, notify func(*pastila.PasteInfo)) *rpcServer {
+	return &rpcServer{service: service, notify: notify, w: w, watches: map[string]context.CancelFunc{}}
+}
+
+// serve answers the requests read from r until its end, and then stops the
+// watches.
+func (s *rpcServer) serve(ctx context.Context, r io.Reader) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()
+		s.wg.Wait()
+	}()
+
+	reader := textproto.NewReader(bufio.NewReader(r))
+	for {
+		body, err := readRPCMessage(reader)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var req rpcMessage
+		if err := json.Unmarshal(body, &req); err != nil {
+			s.send(&rpcMessage{ID: json.RawMessage("null"), Error: &rpcError{Code: rpcParseError, Message: err.Error()}})
+			continue
+		}
+
+		result, rpcErr := s.handle(ctx, &req)
+		// Notifications, requests without an ID, are not answered.
+		if req.ID == nil {
+			continue
+		}
+		if rpcErr != nil {
+			s.send(&rpcMessage{ID: req.ID, Error: rpcErr})
+			continue
+		}
+		s.send(&rpcMessage{ID: req.ID, Result: result})
+	}
+}
+
+// readRPCMessage reads the body of the next message.
+func readRPCMessage(r *textproto.Reader) ([]byte, error) {
+	header, err := r.ReadMIMEHeader()
+	if err != nil {
+		if errors.Is(err, io.EOF) && len(header) == 0 {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("failed to read message header: %w", err)
+	}
+
+	size, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil || size < 0 || size > maxRPCMessageSize {
+		return nil, fmt.Errorf("invalid Content-Length %q", header.Get("Content-Length"))
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r.R, body); err != nil {
+		return nil, fmt.Errorf("failed to read message: %w", err)
+	}
+
+	return body, nil
+}
+
+// send writes msg, framed.
+func (s *rpcServer) send(msg *rpcMessage) {
+	msg.JSONRPC = "2.0"
+	body, err := json.Marshal(msg)
+	if err != nil {
+		body, _ = json.Marshal(&rpcMessage{JSONRPC: "2.0", ID: msg.ID, Error: &rpcError{
+			Code: rpcBackendError, Message: fmt.Sprintf("failed to encode response: %v", err),
+		}})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, _ = fmt.Fprintf(s.w, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+func (s *rpcServer) handle(ctx context.Context, req *rpcMessage) (any, *rpcError) {
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return nil, &rpcError{Code: rpcInvalidRequest, Message: "not a JSON-RPC 2.0 request"}
+	}
+
+	switch req.Method {
+	case "paste/write":
+		var params rpcWriteParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, rpcInvalidParamsError(err)
+		}
+		paste, err := rpcWrite(ctx, s.service, &params)
+		if err != nil {
+			return nil, rpcBackendErrorOf(err)
+		}
+		return paste, nil
+	case "paste/read", "paste/watch", "paste/unwatch":
+		var params rpcPaste
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, rpcInvalidParamsError(err)
+		}
+		if params.URL == "" {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: "url is required"}
+		}
+
+		switch req.Method {
+		case "paste/read":
+			paste, err := rpcRead(ctx, s.service, params.URL)
+			if err != nil {
+				return nil, rpcBackendErrorOf(err)
+			}
+			return paste, nil
+		case "paste/watch":
+			return s.watch(ctx, params.URL)
+		default:
+			s.unwatch(params.URL)
+			return struct{}{}, nil
+		}
+	default:
+		return nil, &rpcError{Code: rpcMethodNotFound, Message: "unknown method " + req.Method}
+	}
+}
+
+// rpcWrite writes a paste as paste/write does.
+func rpcWrite(ctx context.Context, service *pastila.Service, params *rpcWriteParams) (*rpcPaste, error) {
+	var opts []pastila.WriteOption
+	if !params.Plain {
+		k, err := generateRandomKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate random key: %w", err)
+		}
+		opts = append(opts, pastila.WithKey(k))
+	}
+	if params.Previous != "" {
+		// As with serve, the new version keeps the key of the previous one
+		// unless it is written unencrypted.
+		opts = []pastila.WriteOption{pastila.WithPreviousURL(params.Previous)}
+		if params.Plain {
+			opts = append(opts, pastila.WithKey(nil))
+		}
+	}
+	if params.ContentType != "" {
+		opts = append(opts, pastila.WithContentType(params.ContentType))
+	}
+
+	paste, err := service.WriteContext(ctx, strings.NewReader(params.Content), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rpcPaste{URL: paste.URL}, nil
+}
+
+// rpcRead reads a paste as paste/read does.
+func rpcRead(ctx context.Context, service *pastila.Service, url string) (*rpcPaste, error) {
+	paste, err := service.ReadContext(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer paste.Close()
+
+	content, err := io.ReadAll(paste)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rpcPaste{URL: url, Content: string(content), ContentType: paste.ContentType}, nil
+}
+
+// watch answers with the newest version of url, and notifies of the versions
+// written after it until unwatched.
+func (s *rpcServer) watch(ctx context.Context, url string) (any, *rpcError) {
+	latest, err := s.service.Latest(ctx, url)
+	if err != nil {
+		return nil, rpcBackendErrorOf(err)
+	}
+
+	s.watchesMu.Lock()
+	defer s.watchesMu.Unlock()
+	if cancel, ok := s.watches[url]; ok {
+		cancel()
+	}
+	watchCtx, cancel := context.WithCancel(ctx)
+	s.watches[url] = cancel
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.poll(watchCtx, url, latest.URL)
+	}()
+
+	return &rpcPaste{URL: latest.URL}, nil
+}
+
+func (s *rpcServer) unwatch(url string) {
+	s.watchesMu.Lock()
+	defer s.watchesMu.Unlock()
+	if cancel, ok := s.watches[url]; ok {
+		cancel()
+		delete(s.watches, url)
+	}
+}
+
+// poll notifies of the versions of url newer than current. Failing lookups
+// are retried at the next poll, as the watch has been answered already.
+func (s *rpcServer) poll(ctx context.Context, url, current string) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(rpcWatchInterval):
+		}
+
+		latest, err := s.service.Latest(ctx, url)
+		if err != nil || latest.URL == current {
+			continue
+		}
+		paste, err := rpcRead(ctx, s.service, latest.URL)
+		if err != nil {
+			continue
+		}
+
+		current = latest.URL
+		params, _ := json.Marshal(paste)
+		s.send(&rpcMessage{Method: "paste/changed", Params: params})
+		if s.notify != nil {
+			s.notify(latest)
+		}
+	}
+}
+
+func rpcInvalidParamsError(err error) *rpcError {
+	return &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+}
+
+// rpcBackendErrorOf maps errors of pastila to error codes, like
+// serveErrorStatus does to HTTP status codes.
+func rpcBackendErrorOf(err error) *rpcError {
+	code := rpcBackendError
+	switch serveErrorStatus(err) {
+	case http.StatusNotFound:
+		code = rpcNotFound
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		code = rpcBadPaste
+	}
+
+	return &rpcError{Code: code, Message: err.Error()}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/pastila-cli/pkg/chtest"
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+func TestRPC(t *testing.T) {
+	service, err := pastila.NewService(pastila.WithClickHouseURL(chtest.NewFakeClickHouse(t).URL))
+	require.NoError(t, err)
+	rpcWatchInterval = 10 * time.Millisecond
+	t.Cleanup(func() { rpcWatchInterval = 2 * time.Second })
+
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+	done := make(chan error, 1)
+	notified := make(chan *pastila.PasteInfo, 10)
+	notify := func(info *pastila.PasteInfo) { notified <- info }
+	go func() {
+		done <- newRPCServer(service, stdoutW, notify).serve(context.Background(), stdinR)
+		_ = stdoutW.Close()
+	}()
+	responses := textproto.NewReader(bufio.NewReader(stdoutR))
+
+	id := 0
+	send := func(t *testing.T, body string) {
+		_, err := fmt.Fprintf(stdinW, "Content-Length: %d\r\n\r\n%s", len(body), body)
+		require.NoError(t, err)
+	}
+	receive := func(t *testing.T) rpcMessage {
+		body, err := readRPCMessage(responses)
+		require.NoError(t, err)
+		var msg rpcMessage
+		require.NoError(t, json.Unmarshal(body, &msg))
+		return msg
+	}
+	// Notifications may come before the response of a request.
+	var notifications []rpcMessage
+	call := func(t *testing.T, method string, params any) (map[string]any, *rpcError) {
+		id++
+		body, err := json.Marshal(map[string]any{"jsonrpc": "2.0", "id": id, "method": method, "params": params})
+		require.NoError(t, err)
+		send(t, string(body))
+
+		msg := receive(t)
+		for msg.ID == nil {
+			notifications = append(notifications, msg)
+			msg = receive(t)
+		}
+		assert.JSONEq(t, fmt.Sprint(id), string(msg.ID))
+		result, _ := msg.Result.(map[string]any)
+		return result, msg.Error
+	}
+
+	written, rpcErr := call(t, "paste/write", map[string]any{"content": "Hello, editor!", "contentType": "text/markdown"})
+	require.Nil(t, rpcErr)
+	url := written["url"].(string)
+	ref, err := pastila.ParseURL(url)
+	require.NoError(t, err)
+	assert.NotNil(t, ref.Key)
+
+	read, rpcErr := call(t, "paste/read", map[string]any{"url": url})
+	require.Nil(t, rpcErr)
+	assert.Equal(t, "Hello, editor!", read["content"])
+	assert.Equal(t, "text/markdown", read["contentType"])
+
+	_, rpcErr = call(t, "paste/read", map[string]any{"url": "https://pastila.nl/?ffffffff/00000000000000000000000000000001"})
+	require.NotNil(t, rpcErr)
+	assert.Equal(t, rpcNotFound, rpcErr.Code)
+
+	_, rpcErr = call(t, "paste/delete", map[string]any{"url": url})
+	require.NotNil(t, rpcErr)
+	assert.Equal(t, rpcMethodNotFound, rpcErr.Code)
+
+	watched, rpcErr := call(t, "paste/watch", map[string]any{"url": url})
+	require.Nil(t, rpcErr)
+	assert.Equal(t, url, watched["url"])
+
+	newer, rpcErr := call(t, "paste/write", map[string]any{"content": "Hello again!", "previous": url})
+	require.Nil(t, rpcErr)
+	if len(notifications) == 0 {
+		notifications = append(notifications, receive(t))
+	}
+	changed := notifications[0]
+	assert.Equal(t, "paste/changed", changed.Method)
+	var params rpcPaste
+	require.NoError(t, json.Unmarshal(changed.Params, &params))
+	assert.Equal(t, newer["url"], params.URL)
+	assert.Equal(t, "Hello again!", params.Content)
+	select {
+	case info := <-notified:
+		assert.Equal(t, newer["url"], info.URL)
+	case <-time.After(time.Second):
+		t.Fatal("no notification for the new version")
+	}
+
+	_, rpcErr = call(t, "paste/unwatch", map[string]any{"url": url})
+	require.Nil(t, rpcErr)
+
+	send(t, "{")
+	msg := receive(t)
+	for msg.ID == nil {
+		msg = receive(t)
+	}
+	require.NotNil(t, msg.Error)
+	assert.Equal(t, rpcParseError, msg.Error.Code)
+
+	require.NoError(t, stdinW.Close())
+	require.NoError(t, <-done)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+// defaultServeAddr is where serve listens unless told otherwise. It is local
+// only: the server writes pastes on behalf of anyone who can reach it.
+const defaultServeAddr = "localhost:8080"
+
+// maxServeContentSize matches the limit on the content of the data table.
+const maxServeContentSize = 10 << 20
+
+// serveInlineContentTypes are the content types pastes are served with as
+// they are. Writers choose the content type of a paste, so any other, like
+// text/html or image/svg+xml, could run scripts on the origin of the server.
+var serveInlineContentTypes = map[string]bool{
+	"text/plain":       true,
+	"text/markdown":    true,
+	"text/csv":         true,
+	"application/json": true,
+}
+
+// serveMetrics collects the metrics of the service of serve, see
+// pastila.WithMetrics, served at /metrics.
+var serveMetrics = prometheus.NewRegistry()
+
+// serveCommand serves a REST API to write and read pastes through service:
+//
+//	POST /paste                      writes the request body and answers with
+//	                                 {"url": ...}. ?plain=1 leaves it
+//	                                 unencrypted, ?previous=URL makes it a new
+//	                                 version of another paste.
+//	GET  /paste/{fingerprint}/{hash} answers with the content of a paste. The
+//	                                 key goes into ?key= or the X-Pastila-Key
+//	                                 header, base64 encoded as in URLs.
+//	GET  /metrics                    answers with Prometheus metrics of the
+//	                                 reads and writes.
+func serveCommand(ctx context.Context, service *pastila.Service, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: serve [ADDR]")
+	}
+
+	addr := defaultServeAddr
+	if len(args) == 1 {
+		addr = args[0]
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	server := &http.Server{
+		Handler:           newServeHandler(service, serveMetrics),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	_, _ = fmt.Fprintf(printWriter, "Serving pastes on http://%s/paste\n", listener.Addr())
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// newServeHandler returns the handler of serveCommand, serving the metrics
+// gathered by metrics.
+func newServeHandler(service *pastila.Service, metrics prometheus.Gatherer) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.HandlerFor(metrics, promhttp.HandlerOpts{}))
+	mux.HandleFunc("POST /paste", func(w http.ResponseWriter, r *http.Request) {
+		serveWrite(w, r, service)
+	})
+	mux.HandleFunc("GET /paste/{fingerprint}/{hash}", func(w http.ResponseWriter, r *http.Request) {
+		serveRead(w, r, service)
+	})
+
+	return mux
+}
+
+func serveWrite(w http.ResponseWriter, r *http.Request, service *pastila.Service) {
+	query := r.URL.Query()
+
+	var opts []pastila.WriteOption
+	if query.Get("plain") != "1" {
+		k, err := generateRandomKey()
+		if err != nil {
+			serveError(w, http.StatusInternalServerError, err)
+			return
+		}
+		opts = append(opts, pastila.WithKey(k))
+	}
+	if previous := query.Get("previous"); previous != "" {
+		// Like -previous, the new version keeps the key of the previous
+		// one unless it is written unencrypted.
+		opts = []pastila.WriteOption{pastila.WithPreviousURL(previous)}
+		if query.Get("plain") == "1" {
+			opts = append(opts, pastila.WithKey(nil))
+		}
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxServeContentSize)
+	paste, err := service.WriteContext(r.Context(), body, opts...)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			serveError(w, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		serveError(w, serveErrorStatus(err), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string]string{"url": paste.URL})
+}
+
+func serveRead(w http.ResponseWriter, r *http.Request, service *pastila.Service) {
+	encodedKey := r.URL.Query().Get("key")
+	if encodedKey == "" {
+		encodedKey = r.Header.Get("X-Pastila-Key")
+	}
+
+	var opts []pastila.ReadOption
+	if encodedKey != "" {
+		// A "+" of a key put into a query without escaping reads as a space.
+		k, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(encodedKey, " ", "+"))
+		if err != nil {
+			serveError(w, http.StatusBadRequest, fmt.Errorf("%w, failed to base64 decode: %w", pastila.ErrInvalidKey, err))
+			return
+		}
+		opts = append(opts, pastila.WithReadKey(k))
+	}
+
+	ref := r.PathValue("fingerprint") + "/" + r.PathValue("hash")
+	paste, err := service.ReadContext(r.Context(), ref, opts...)
+	if err != nil {
+		serveError(w, serveErrorStatus(err), err)
+		return
+	}
+	defer paste.Close()
+
+	w.Header().Set("Content-Type", serveContentType(paste.ContentType))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	_, _ = io.Copy(w, paste)
+}
+
+// serveContentType returns the content type to serve a paste stored with
+// contentType with: itself if it is safe to show in a browser, or
+// application/octet-stream.
+func serveContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || !serveInlineContentTypes[mediaType] {
+		return "application/octet-stream"
+	}
+
+	return contentType
+}
+
+// serveErrorStatus maps errors of pastila to HTTP status codes: errors of
+// the request are client errors, anything else is an error of the backend.
+func serveErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, pastila.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, pastila.ErrInvalidURL), errors.Is(err, pastila.ErrInvalidKey),
+		errors.Is(err, pastila.ErrKeyRequired), errors.Is(err, pastila.ErrPassphraseRequired),
+		errors.Is(err, pastila.ErrInvalidFingerprint):
+		return http.StatusBadRequest
+	case errors.Is(err, pastila.ErrTooLarge):
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func serveError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/pastila-cli/pkg/chtest"
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+func TestServe(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	service, err := pastila.NewService(pastila.WithClickHouseURL(chtest.NewFakeClickHouse(t).URL), pastila.WithMetrics(reg))
+	require.NoError(t, err)
+	server := httptest.NewServer(newServeHandler(service, reg))
+	t.Cleanup(server.Close)
+
+	write := func(t *testing.T, query, content string) (int, map[string]string) {
+		res, err := http.Post(server.URL+"/paste"+query, "text/plain", strings.NewReader(content))
+		require.NoError(t, err)
+		defer res.Body.Close()
+
+		var body map[string]string
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+		return res.StatusCode, body
+	}
+	read := func(t *testing.T, path string, header http.Header) (int, string) {
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		require.NoError(t, err)
+		req.Header = header
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.StatusCode, string(body)
+	}
+
+	status, written := write(t, "", "Hello, REST!")
+	require.Equal(t, http.StatusCreated, status, written["error"])
+	ref, err := pastila.ParseURL(written["url"])
+	require.NoError(t, err)
+	require.NotNil(t, ref.Key)
+	path := "/paste/" + pastila.PasteRef{Ref: ref.Ref}.String()
+	encodedKey := base64.StdEncoding.EncodeToString(ref.Key)
+
+	status, content := read(t, path+"?key="+url.QueryEscape(encodedKey), nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "Hello, REST!", content)
+
+	header := http.Header{}
+	header.Set("X-Pastila-Key", encodedKey)
+	status, content = read(t, path, header)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "Hello, REST!", content)
+
+	status, _ = read(t, path, nil)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, edited := write(t, "?previous="+url.QueryEscape(written["url"]), "Hello again, REST!")
+	require.Equal(t, http.StatusCreated, status, edited["error"])
+	editedRef, err := pastila.ParseURL(edited["url"])
+	require.NoError(t, err)
+	assert.Equal(t, ref.Key, editedRef.Key)
+
+	status, plain := write(t, "?plain=1", "Hello, plain REST!")
+	require.Equal(t, http.StatusCreated, status, plain["error"])
+	plainRef, err := pastila.ParseURL(plain["url"])
+	require.NoError(t, err)
+	assert.Nil(t, plainRef.Key)
+	status, content = read(t, "/paste/"+pastila.PasteRef{Ref: plainRef.Ref}.String(), nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "Hello, plain REST!", content)
+
+	status, _ = read(t, "/paste/ffffffff/00000000000000000000000000000001", nil)
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, metrics := read(t, "/metrics", nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, metrics, `pastila_operations_total{operation="write"} 3`)
+
+	for contentType, expected := range map[string]string{
+		"text/plain; charset=utf-8": "text/plain; charset=utf-8",
+		"application/json":          "application/json",
+		"text/html":                 "application/octet-stream",
+		"image/svg+xml":             "application/octet-stream",
+	} {
+		paste, err := service.Write(strings.NewReader("<script>alert(1)</script>"), pastila.WithContentType(contentType))
+		require.NoError(t, err)
+		ref, err := pastila.ParseURL(paste.URL)
+		require.NoError(t, err)
+
+		res, err := http.Get(server.URL + "/paste/" + pastila.PasteRef{Ref: ref.Ref}.String())
+		require.NoError(t, err)
+		_ = res.Body.Close()
+		assert.Equal(t, expected, res.Header.Get("Content-Type"), contentType)
+		assert.Equal(t, "nosniff", res.Header.Get("X-Content-Type-Options"))
+	}
+}
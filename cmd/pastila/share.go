@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+// sharePollInterval is how often share looks at the shared file, and join
+// for newer versions.
+var sharePollInterval = 500 * time.Millisecond
+
+// clearScreen moves the cursor home and clears a terminal.
+const clearScreen = "\033[H\033[2J"
+
+// shareCommand writes a file, prints its URL, and writes a new version of it
+// whenever the file changes, until interrupted, for join to follow. It takes
+// -key, -plain and -filter like writing any other content.
+func shareCommand(ctx context.Context, service *pastila.Service, args []string) error {
+	path := fileName
+	if len(args) == 1 {
+		path = args[0]
+	}
+	if len(args) > 1 || path == "" || path == "-" {
+		return fmt.Errorf("usage: share FILE")
+	}
+
+	var k []byte
+	var err error
+	switch {
+	case plain:
+	case key != "":
+		k, err = loadKey(key)
+	default:
+		k, err = generateRandomKey()
+	}
+	if err != nil {
+		return err
+	}
+
+	err = share(ctx, service, path, k, printWriter)
+	if ctx.Err() != nil {
+		// Interrupting is how sharing is stopped.
+		return nil
+	}
+
+	return err
+}
+
+// share writes the file at path encrypted with key, prints its URL to w, and
+// writes a new version on every change of the file.
+func share(ctx context.Context, service *pastila.Service, path string, key []byte, w io.Writer) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	contentType := pastila.WithContentType(detectedContentType(path))
+	filtered, err := filter(ctx, writeFilter, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	// Every version shares the key, so each gets a random IV.
+	paste, err := service.WriteContext(ctx, filtered, pastila.WithKey(key), contentType, pastila.WithRandomIV())
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(w, "%s\n", paste.URL)
+
+	current := paste.URL
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(sharePollInterval):
+		}
+
+		changed, err := os.ReadFile(path)
+		// Editors may save by replacing the file, which is missing for a
+		// moment then.
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(changed, content) {
+			continue
+		}
+
+		filtered, err := filter(ctx, writeFilter, bytes.NewReader(changed))
+		if err != nil {
+			return err
+		}
+		paste, err := service.WriteContext(ctx, filtered, pastila.WithPreviousURL(current), contentType, pastila.WithRandomIV())
+		if err != nil {
+			return err
+		}
+		current, content = paste.URL, changed
+		_, _ = fmt.Fprintf(os.Stderr, "published %s\n", current)
+	}
+}
+
+// copyFiltered copies a version of a joined paste to w through -read-filter.
+func copyFiltered(ctx context.Context, w io.Writer, paste io.Reader) error {
+	content, err := filter(ctx, readFilter, paste)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, content)
+	return err
+}
+
+// joinCommand prints the newest version of a paste, and again whenever a
+// newer version is written, until interrupted. Each version is run through
+// -read-filter. On a terminal, the screen is cleared before each version.
+// With -webhook, each newer version is also posted there. Newer versions are
+// found with Latest, which the public pastila service does not allow.
+func joinCommand(ctx context.Context, service *pastila.Service, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: join URL")
+	}
+
+	clearTerminal := false
+	if printWriter == os.Stdout {
+		if fi, err := os.Stdout.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+			clearTerminal = true
+		}
+	}
+
+	err := join(ctx, service, args[0], printWriter, clearTerminal, webhookNotifier(ctx, webhook))
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	return err
+}
+
+// join prints the versions of url to w, and calls notify, if not nil, for
+// every version newer than the first one printed.
+func join(
+	ctx context.Context, service *pastila.Service, url string, w io.Writer, clearTerminal bool, notify func(*pastila.PasteInfo),
+) error {
+	current := ""
+	for {
+		latest, err := service.Latest(ctx, url)
+		if err != nil {
+			return err
+		}
+
+		if latest.URL != current {
+			paste, err := service.ReadContext(ctx, latest.URL)
+			if err != nil {
+				return err
+			}
+			if clearTerminal {
+				_, _ = io.WriteString(w, clearScreen)
+			}
+			err = copyFiltered(ctx, w, paste)
+			_ = paste.Close()
+			if err != nil {
+				return err
+			}
+			if current != "" && notify != nil {
+				notify(latest)
+			}
+			current = latest.URL
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(sharePollInterval):
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/pastila-cli/pkg/chtest"
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestShareJoin(t *testing.T) {
+	service, err := pastila.NewService(pastila.WithClickHouseURL(chtest.NewFakeClickHouse(t).URL))
+	require.NoError(t, err)
+	sharePollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { sharePollInterval = 500 * time.Millisecond })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	path := filepath.Join(t.TempDir(), "notes.md")
+	require.NoError(t, os.WriteFile(path, []byte("# Notes\n"), 0o644))
+
+	urls, urlsW := io.Pipe()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.ErrorIs(t, share(ctx, service, path, []byte("0123456789abcdef"), urlsW), context.Canceled)
+	}()
+	scanner := bufio.NewScanner(urls)
+	require.True(t, scanner.Scan())
+	url := scanner.Text()
+
+	var joined lockedBuffer
+	notified := make(chan *pastila.PasteInfo, 1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		notify := func(info *pastila.PasteInfo) { notified <- info }
+		assert.ErrorIs(t, join(ctx, service, url, &joined, true, notify), context.Canceled)
+	}()
+	assert.Eventually(t, func() bool { return joined.String() == clearScreen+"# Notes\n" }, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, os.WriteFile(path, []byte("# Notes\n\n- more\n"), 0o644))
+	assert.Eventually(t, func() bool {
+		return joined.String() == clearScreen+"# Notes\n"+clearScreen+"# Notes\n\n- more\n"
+	}, time.Second, 10*time.Millisecond)
+
+	// Only versions newer than the first one shown are notified.
+	select {
+	case info := <-notified:
+		assert.NotEqual(t, url, info.URL)
+		assert.NotZero(t, info.Size)
+	case <-time.After(time.Second):
+		t.Fatal("no notification for the new version")
+	}
+}
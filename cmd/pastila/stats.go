@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+// defaultStatsDays is the number of days stats breaks the numbers down by
+// unless told otherwise.
+const defaultStatsDays = 30
+
+// statsCommand prints the number and size of the pastes stored, and what was
+// written on each of the last days. It needs a user that can read the table
+// directly, as on self-hosted deployments.
+func statsCommand(ctx context.Context, service *pastila.Service, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: stats [DAYS]")
+	}
+
+	days := defaultStatsDays
+	if len(args) == 1 {
+		var err error
+		if days, err = strconv.Atoi(args[0]); err != nil || days < 0 {
+			return fmt.Errorf("invalid number of days %q", args[0])
+		}
+	}
+
+	usage, err := service.Usage(ctx)
+	if err != nil {
+		return err
+	}
+
+	printf("Pastes:\t\t%d\n", usage.Pastes)
+	printf("Encrypted:\t%d (%s)\n", usage.EncryptedPastes, percent(usage.EncryptedPastes, usage.Pastes))
+	printf("Size:\t\t%d bytes\n", usage.Bytes)
+
+	since := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -days)
+	for _, day := range usage.Daily {
+		if !day.Day.After(since) {
+			continue
+		}
+		printf("%s\t%d pastes\t%d encrypted\t%d bytes\n",
+			day.Day.Format(time.DateOnly), day.Pastes, day.EncryptedPastes, day.Bytes)
+	}
+
+	return nil
+}
+
+func percent(part, whole int64) string {
+	if whole == 0 {
+		return "0%"
+	}
+
+	return strconv.FormatFloat(float64(part)*100/float64(whole), 'f', 1, 64) + "%"
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/pastila-cli/pkg/chtest"
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+func TestStats(t *testing.T) {
+	service, err := pastila.NewService(pastila.WithClickHouseURL(chtest.NewFakeClickHouse(t).URL))
+	require.NoError(t, err)
+	var out bytes.Buffer
+	printWriter = &out
+	t.Cleanup(func() { printWriter = os.Stdout })
+	ctx := context.Background()
+
+	_, err = service.WriteContext(ctx, strings.NewReader("secret"), pastila.WithKey([]byte("0123456789abcdef")))
+	require.NoError(t, err)
+	_, err = service.WriteContext(ctx, strings.NewReader("public"))
+	require.NoError(t, err)
+
+	require.NoError(t, statsCommand(ctx, service, nil))
+	today := time.Now().UTC().Format(time.DateOnly)
+	assert.Equal(t, "Pastes:\t\t2\n"+
+		"Encrypted:\t1 (50.0%)\n"+
+		"Size:\t\t14 bytes\n"+
+		today+"\t2 pastes\t1 encrypted\t14 bytes\n", out.String())
+
+	out.Reset()
+	require.NoError(t, statsCommand(ctx, service, []string{"0"}))
+	assert.NotContains(t, out.String(), today, "no days are broken down")
+
+	require.ErrorContains(t, statsCommand(ctx, service, []string{"-1"}), "invalid number of days")
+}
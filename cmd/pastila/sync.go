@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+// syncStateFile keeps, in a synced directory, the manifest it was last
+// synced with, to tell local changes from remote ones.
+const syncStateFile = ".pastila-sync.json"
+
+// syncManifest is the content of a manifest paste: the files of a synced
+// directory, by slash separated path relative to it.
+type syncManifest struct {
+	Version int                  `json:"version"`
+	Files   map[string]syncEntry `json:"files"`
+}
+
+// syncEntry is a file of a synced directory. URL is the paste holding its
+// content, with its key; the manifest is encrypted unless written with
+// -plain.
+type syncEntry struct {
+	URL    string      `json:"url,omitempty"`
+	SHA256 string      `json:"sha256"`
+	Mode   fs.FileMode `json:"mode"`
+}
+
+type syncState struct {
+	ManifestURL string               `json:"manifest_url"`
+	Files       map[string]syncEntry `json:"files"`
+}
+
+// syncCommand syncs a directory with a manifest paste in both directions.
+// Files changed on one side only since the last sync are copied to the
+// other; files changed on both sides are reported as conflicts and left
+// alone. Local changes are published as a new version of the manifest, whose
+// URL is printed. Without a manifest URL, the one of the last sync is used,
+// or a new manifest is written.
+//
+// Changes made elsewhere are found by following the manifest to its newest
+// version with Latest. Where the backend cannot look up newer versions, like
+// the public pastila service, give the newest manifest URL explicitly.
+func syncCommand(ctx context.Context, service *pastila.Service, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: sync DIR [MANIFEST_URL]")
+	}
+	dir := args[0]
+
+	state, err := loadSyncState(dir)
+	if err != nil {
+		return err
+	}
+
+	manifestURL := state.ManifestURL
+	if len(args) == 2 {
+		manifestURL = args[1]
+	}
+
+	remote := &syncManifest{Version: 1, Files: map[string]syncEntry{}}
+	var manifestKey []byte
+	if manifestURL != "" {
+		info, latestErr := service.Latest(ctx, manifestURL)
+		switch {
+		case latestErr == nil:
+			manifestURL = info.URL
+		case !errors.Is(latestErr, errors.ErrUnsupported):
+			return latestErr
+		}
+
+		if remote, err = readSyncManifest(ctx, service, manifestURL); err != nil {
+			return err
+		}
+		ref, parseErr := pastila.ParseURL(manifestURL)
+		if parseErr != nil {
+			return parseErr
+		}
+		manifestKey = ref.Key
+	} else if !plain {
+		if manifestKey, err = generateRandomKey(); err != nil {
+			return fmt.Errorf("failed to generate random key: %w", err)
+		}
+	}
+
+	local, err := scanSyncDir(dir)
+	if err != nil {
+		return err
+	}
+
+	r := &syncRun{service: service, dir: dir, key: manifestKey}
+	if err := r.reconcile(ctx, local, remote.Files, state.Files); err != nil {
+		return err
+	}
+	next, synced, conflicts := r.next, r.synced, r.conflicts
+
+	if r.pushed || manifestURL == "" {
+		opts := []pastila.WriteOption{pastila.WithKey(manifestKey), pastila.WithRandomIV()}
+		if manifestURL != "" {
+			opts = append(opts, pastila.WithPreviousURL(manifestURL))
+		}
+		manifest, err := json.Marshal(&syncManifest{Version: 1, Files: next})
+		if err != nil {
+			return fmt.Errorf("failed to encode manifest: %w", err)
+		}
+		paste, err := service.WriteContext(ctx, strings.NewReader(string(manifest)), opts...)
+		if err != nil {
+			return fmt.Errorf("failed to write manifest: %w", err)
+		}
+		manifestURL = paste.URL
+		printf("%s\n", manifestURL)
+	}
+
+	if err := saveSyncState(dir, &syncState{ManifestURL: manifestURL, Files: synced}); err != nil {
+		return err
+	}
+
+	if len(conflicts) > 0 {
+		return fmt.Errorf("changed both locally and remotely, resolve and sync again: %s", strings.Join(conflicts, ", "))
+	}
+
+	return nil
+}
+
+// syncRun holds the outcome of reconciling a directory with a manifest.
+type syncRun struct {
+	service *pastila.Service
+	dir     string
+	key     []byte
+
+	// next are the files of the manifest to write if pushed.
+	next   map[string]syncEntry
+	pushed bool
+	// synced are the files both sides agree on, the base of the next sync.
+	synced    map[string]syncEntry
+	conflicts []string
+}
+
+// reconcile copies the files changed on one side only since base to the
+// other side.
+func (r *syncRun) reconcile(ctx context.Context, local, remote, base map[string]syncEntry) error {
+	r.next = copySyncEntries(remote)
+	r.synced = copySyncEntries(remote)
+
+	for _, path := range syncPaths(local, remote, base) {
+		l, inLocal := local[path]
+		rem, inRemote := remote[path]
+		b, inBase := base[path]
+
+		switch {
+		case sameSyncEntry(l, inLocal, rem, inRemote):
+		case sameSyncEntry(l, inLocal, b, inBase):
+			if err := pullSyncEntry(ctx, r.service, r.dir, path, rem, inRemote); err != nil {
+				return err
+			}
+		case sameSyncEntry(rem, inRemote, b, inBase):
+			r.pushed = true
+			if !inLocal {
+				delete(r.next, path)
+				delete(r.synced, path)
+				_, _ = fmt.Fprintf(os.Stderr, "deleted %s\n", path)
+				continue
+			}
+
+			entry, err := pushSyncEntry(ctx, r.service, r.dir, path, l, r.key)
+			if err != nil {
+				return err
+			}
+			r.next[path] = entry
+			r.synced[path] = entry
+		default:
+			r.conflicts = append(r.conflicts, path)
+			if inBase {
+				r.synced[path] = b
+			} else {
+				delete(r.synced, path)
+			}
+		}
+	}
+
+	return nil
+}
+
+func copySyncEntries(m map[string]syncEntry) map[string]syncEntry {
+	c := make(map[string]syncEntry, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+
+	return c
+}
+
+// syncPaths returns the paths of all sides, sorted.
+func syncPaths(sides ...map[string]syncEntry) []string {
+	var paths []string
+	for _, side := range sides {
+		for path := range side {
+			paths = append(paths, path)
+		}
+	}
+	slices.Sort(paths)
+
+	return slices.Compact(paths)
+}
+
+// sameSyncEntry reports whether two sides have the same content, or both
+// have no such file.
+func sameSyncEntry(a syncEntry, aOK bool, b syncEntry, bOK bool) bool {
+	if aOK != bOK {
+		return false
+	}
+
+	return !aOK || a.SHA256 == b.SHA256
+}
+
+func readSyncManifest(ctx context.Context, service *pastila.Service, url string) (*syncManifest, error) {
+	paste, err := service.ReadContext(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	defer paste.Close()
+
+	var manifest syncManifest
+	if err := json.NewDecoder(paste).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest %s: %w", url, err)
+	}
+	if manifest.Version != 1 {
+		return nil, fmt.Errorf("unsupported manifest version %d", manifest.Version)
+	}
+	for path := range manifest.Files {
+		// Manifests come from elsewhere; they must not write outside of
+		// the directory.
+		if !filepath.IsLocal(filepath.FromSlash(path)) || path == syncStateFile {
+			return nil, fmt.Errorf("manifest lists an invalid path %q", path)
+		}
+	}
+	if manifest.Files == nil {
+		manifest.Files = map[string]syncEntry{}
+	}
+
+	return &manifest, nil
+}
+
+// scanSyncDir returns the regular files of dir with their hashes.
+func scanSyncDir(dir string) (map[string]syncEntry, error) {
+	files := map[string]syncEntry{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == syncStateFile {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		sum, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		files[rel] = syncEntry{SHA256: sum, Mode: info.Mode().Perm()}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %w", dir, err)
+	}
+
+	return files, nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// pullSyncEntry makes the local file at path match the remote entry, or
+// removes it if there is no remote entry. The files are accessed through a
+// root, so symlinks in dir cannot redirect them out of it.
+func pullSyncEntry(ctx context.Context, service *pastila.Service, dir, path string, entry syncEntry, ok bool) error {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", dir, err)
+	}
+	defer root.Close()
+
+	name := filepath.FromSlash(path)
+	if !ok {
+		_, _ = fmt.Fprintf(os.Stderr, "removed %s\n", path)
+		if err := root.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+		return nil
+	}
+
+	paste, err := service.ReadContext(ctx, entry.URL, pastila.WithVerify(), pastila.WithSpool(""))
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer paste.Close()
+
+	if err := root.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return fmt.Errorf("failed to create directory of %s: %w", path, err)
+	}
+	tmpName := filepath.Join(filepath.Dir(name), ".pastila-sync-"+rand.Text())
+	tmp, err := root.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	defer func() { _ = root.Remove(tmpName) }()
+
+	_, err = io.Copy(tmp, paste)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = root.Chmod(tmpName, entry.Mode.Perm())
+	}
+	if err == nil {
+		err = root.Rename(tmpName, name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+
+	_, _ = fmt.Fprintf(os.Stderr, "pulled %s\n", path)
+	return nil
+}
+
+// pushSyncEntry writes the local file at path to a paste. Files and
+// versions of the manifest share its key, so each gets a random IV.
+func pushSyncEntry(
+	ctx context.Context, service *pastila.Service, dir, path string, entry syncEntry, key []byte,
+) (syncEntry, error) {
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(path)))
+	if err != nil {
+		return syncEntry{}, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	paste, err := service.WriteContext(ctx, f, pastila.WithKey(key), pastila.WithRandomIV())
+	if err != nil {
+		return syncEntry{}, fmt.Errorf("failed to write %s: %w", path, err)
+	}
+
+	_, _ = fmt.Fprintf(os.Stderr, "pushed %s\n", path)
+	entry.URL = paste.URL
+	return entry, nil
+}
+
+func loadSyncState(dir string) (*syncState, error) {
+	state := &syncState{Files: map[string]syncEntry{}}
+
+	data, err := os.ReadFile(filepath.Join(dir, syncStateFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sync state: %w", err)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to decode sync state %s: %w", syncStateFile, err)
+	}
+	if state.Files == nil {
+		state.Files = map[string]syncEntry{}
+	}
+
+	return state, nil
+}
+
+func saveSyncState(dir string, state *syncState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode sync state: %w", err)
+	}
+
+	// The state holds the keys of the files, like the manifest.
+	if err := os.WriteFile(filepath.Join(dir, syncStateFile), append(data, '\n'), 0o600); err != nil {
+		return fmt.Errorf("failed to write sync state: %w", err)
+	}
+
+	return nil
+}
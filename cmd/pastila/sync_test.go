@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/pastila-cli/pkg/chtest"
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+func TestSync(t *testing.T) {
+	fake := chtest.NewFakeClickHouse(t)
+	service, err := pastila.NewService(pastila.WithClickHouseURL(fake.URL))
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	printWriter = &out
+	t.Cleanup(func() { printWriter = os.Stdout })
+
+	sync := func(t *testing.T, args ...string) (string, error) {
+		out.Reset()
+		err := syncCommand(context.Background(), service, args)
+		return strings.TrimSpace(out.String()), err
+	}
+	write := func(t *testing.T, path, content string) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+	read := func(t *testing.T, path string) string {
+		content, err := os.ReadFile(path)
+		require.NoError(t, err)
+		return string(content)
+	}
+
+	a, b := t.TempDir(), t.TempDir()
+	write(t, filepath.Join(a, "notes.txt"), "first")
+	write(t, filepath.Join(a, "sub", "todo.txt"), "todo")
+
+	manifestURL, err := sync(t, a)
+	require.NoError(t, err)
+	ref, err := pastila.ParseURL(manifestURL)
+	require.NoError(t, err)
+	assert.NotNil(t, ref.Key, "manifest is encrypted")
+
+	t.Run("pull into an empty directory", func(t *testing.T) {
+		printed, err := sync(t, b, manifestURL)
+		require.NoError(t, err)
+		assert.Empty(t, printed, "nothing was pushed")
+		assert.Equal(t, "first", read(t, filepath.Join(b, "notes.txt")))
+		assert.Equal(t, "todo", read(t, filepath.Join(b, "sub", "todo.txt")))
+	})
+
+	t.Run("push a change and find it from the old manifest", func(t *testing.T) {
+		write(t, filepath.Join(b, "notes.txt"), "second")
+		require.NoError(t, os.Remove(filepath.Join(b, "sub", "todo.txt")))
+		newURL, err := sync(t, b)
+		require.NoError(t, err)
+		require.NotEmpty(t, newURL)
+		assert.NotEqual(t, manifestURL, newURL)
+
+		_, err = sync(t, a)
+		require.NoError(t, err)
+		assert.Equal(t, "second", read(t, filepath.Join(a, "notes.txt")))
+		assert.NoFileExists(t, filepath.Join(a, "sub", "todo.txt"))
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		write(t, filepath.Join(a, "notes.txt"), "from a")
+		_, err := sync(t, a)
+		require.NoError(t, err)
+
+		write(t, filepath.Join(b, "notes.txt"), "from b")
+		_, err = sync(t, b)
+		require.ErrorContains(t, err, "notes.txt")
+		assert.Equal(t, "from b", read(t, filepath.Join(b, "notes.txt")), "local change is kept")
+
+		// Resolving by taking the remote content clears the conflict.
+		write(t, filepath.Join(b, "notes.txt"), "from a")
+		_, err = sync(t, b)
+		require.NoError(t, err)
+	})
+
+	t.Run("manifest paths stay in the directory", func(t *testing.T) {
+		manifest, err := service.Write(strings.NewReader(`{"version":1,"files":{"../escape":{"sha256":"00"}}}`))
+		require.NoError(t, err)
+		_, err = sync(t, t.TempDir(), manifest.URL)
+		require.ErrorContains(t, err, "invalid path")
+	})
+
+	t.Run("pulls do not follow symlinks out of the directory", func(t *testing.T) {
+		src, dst, outside := t.TempDir(), t.TempDir(), t.TempDir()
+		write(t, filepath.Join(src, "sub", "escaped.txt"), "escaped")
+		url, err := sync(t, src)
+		require.NoError(t, err)
+
+		require.NoError(t, os.Symlink(outside, filepath.Join(dst, "sub")))
+		_, err = sync(t, dst, url)
+		require.Error(t, err)
+		assert.NoFileExists(t, filepath.Join(outside, "escaped.txt"))
+	})
+
+	t.Run("files sharing the key do not share the keystream", func(t *testing.T) {
+		dir := t.TempDir()
+		write(t, filepath.Join(dir, "one.txt"), "same content")
+		write(t, filepath.Join(dir, "two.txt"), "same content")
+		before := len(fake.Rows())
+		_, err := sync(t, dir)
+		require.NoError(t, err)
+
+		rows := fake.Rows()[before:]
+		require.Len(t, rows, 3, "two files and the manifest")
+		assert.True(t, rows[0].Encrypted)
+		assert.True(t, rows[1].Encrypted)
+		assert.NotEqual(t, rows[0].Content, rows[1].Content, "same content encrypts differently with a random IV")
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+// webhookTimeout bounds a webhook request, so a slow receiver does not hold
+// up following a paste.
+const webhookTimeout = 10 * time.Second
+
+// webhookPayload is what is posted to -webhook for a new version. Text makes
+// it a valid message for Slack incoming webhooks, and others that take the
+// same format.
+type webhookPayload struct {
+	Text        string    `json:"text"`
+	URL         string    `json:"url"`
+	Fingerprint string    `json:"fingerprint"`
+	Hash        string    `json:"hash"`
+	Size        int64     `json:"size"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// webhookNotifier returns a function posting the versions it is called with
+// to webhook, or nil if webhook is empty. A failing webhook is reported on
+// stderr, and must not stop following the paste.
+func webhookNotifier(ctx context.Context, webhook string) func(*pastila.PasteInfo) {
+	if webhook == "" {
+		return nil
+	}
+
+	return func(info *pastila.PasteInfo) {
+		if err := postWebhook(ctx, webhook, info); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+	}
+}
+
+// postWebhook notifies webhook of a new version of a paste. The posted URL
+// has no key, so the receiver learns that the paste changed but cannot read
+// it.
+func postWebhook(ctx context.Context, webhook string, info *pastila.PasteInfo) error {
+	url, _, _ := strings.Cut(info.URL, "#")
+	body, err := json.Marshal(&webhookPayload{
+		Text:        "New version of " + url,
+		URL:         url,
+		Fingerprint: hex.EncodeToString(info.Fingerprint),
+		Hash:        hex.EncodeToString(info.Hash),
+		Size:        info.Size,
+		Timestamp:   info.Time,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("invalid webhook URL: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post to webhook: %w", err)
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered with %s", res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+func TestPostWebhook(t *testing.T) {
+	var got map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+	}))
+	t.Cleanup(server.Close)
+
+	info := &pastila.PasteInfo{
+		URL:         "https://pastila.nl/?cafebabe/0123456789abcdef0123456789abcdef#MDEyMzQ1Njc4OWFiY2RlZg==",
+		Fingerprint: []byte{0xca, 0xfe, 0xba, 0xbe},
+		Hash:        []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef},
+		Size:        42,
+		Time:        time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+	require.NoError(t, postWebhook(context.Background(), server.URL, info))
+
+	// The key is not sent to the webhook.
+	url := "https://pastila.nl/?cafebabe/0123456789abcdef0123456789abcdef"
+	assert.Equal(t, map[string]any{
+		"text":        "New version of " + url,
+		"url":         url,
+		"fingerprint": "cafebabe",
+		"hash":        "0123456789abcdef0123456789abcdef",
+		"size":        float64(42),
+		"timestamp":   "2024-05-01T12:00:00Z",
+	}, got)
+}
+
+func TestPostWebhookStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no_service", http.StatusNotFound)
+	}))
+	t.Cleanup(server.Close)
+
+	err := postWebhook(context.Background(), server.URL, &pastila.PasteInfo{URL: "https://pastila.nl/?cafebabe/0123"})
+	assert.ErrorContains(t, err, "404 Not Found")
+}
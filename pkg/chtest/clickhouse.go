@@ -2,10 +2,17 @@ package chtest
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"os"
+	"regexp"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -14,12 +21,132 @@ import (
 	"github.com/testcontainers/testcontainers-go/wait"
 )
 
+// DefaultImage is the ClickHouse server image EnsureClickHouseInstance starts
+// unless the CHTEST_IMAGE environment variable names another one.
+const DefaultImage = "clickhouse/clickhouse-server:latest"
+
+// ImageEnv is the environment variable overriding DefaultImage, e.g.
+// CHTEST_IMAGE=clickhouse/clickhouse-server:25.8 to test against a pinned
+// version.
+const ImageEnv = "CHTEST_IMAGE"
+
+// ClickHouse is a database with the pastila schema, on a ClickHouse server
+// started for the tests.
+type ClickHouse struct {
+	// URL is the URL of the HTTP interface, with the credentials of the
+	// paste user and the database.
+	URL string
+
+	// NativeAddr is the host:port of the native protocol interface. The
+	// user and password are both "paste".
+	NativeAddr string
+
+	// Database is the database of the test.
+	Database string
+}
+
+// EnsureClickHouseInstance returns the URL of a database with the pastila
+// schema, on a ClickHouse server in the image named by CHTEST_IMAGE, or
+// DefaultImage.
 func EnsureClickHouseInstance(t *testing.T) string {
+	return EnsureClickHouseImage(t, "")
+}
+
+// EnsureClickHouseImage is EnsureClickHouseInstance with the given image. An
+// empty image falls back to CHTEST_IMAGE and DefaultImage.
+func EnsureClickHouseImage(t *testing.T, image string) string {
+	return StartClickHouseImage(t, image).URL
+}
+
+// StartClickHouse is EnsureClickHouseInstance returning the native protocol
+// address of the server too.
+func StartClickHouse(t *testing.T) *ClickHouse {
+	return StartClickHouseImage(t, "")
+}
+
+// StartClickHouseImage is StartClickHouse with the given image, like
+// EnsureClickHouseImage.
+//
+// The server is started once per image and shared by all tests of the
+// package; the reaper of testcontainers removes it when the tests are done.
+// Every test gets a database of its own, which is dropped when the test ends,
+// so tests do not see each other's rows.
+func StartClickHouseImage(t *testing.T, image string) *ClickHouse {
+	image = resolveImage(image)
+	s := sharedServer(image)
+	require.NoError(t, s.err)
+	url := s.url
+
+	database := "test_" + strconv.FormatInt(databases.Add(1), 10) + "_" +
+		strings.Trim(nonIdentifierRegex.ReplaceAllString(t.Name(), "_"), "_")
+	ClickHouseQuery(t, url, strings.NewReader("CREATE DATABASE `"+database+"`"))
+	t.Cleanup(func() {
+		ClickHouseQuery(t, url, strings.NewReader("DROP DATABASE IF EXISTS `"+database+"`"))
+	})
+
+	url += "&database=" + database
+	t.Logf("ClickHouse %s URL: %s", image, url)
+	EnsureClickHousePastila(t, url)
+
+	return &ClickHouse{URL: url, NativeAddr: s.nativeAddr, Database: database}
+}
+
+// resolveImage returns image, or the image named by CHTEST_IMAGE, or
+// DefaultImage.
+func resolveImage(image string) string {
+	if image == "" {
+		image = os.Getenv(ImageEnv)
+	}
+	if image == "" {
+		image = DefaultImage
+	}
+
+	return image
+}
+
+var (
+	// servers are the shared servers by image.
+	servers   = map[string]*server{}
+	serversMu sync.Mutex
+
+	// databases numbers the databases of tests, whose names may be
+	// truncated or sanitized to the same identifier.
+	databases atomic.Int64
+
+	nonIdentifierRegex = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+)
+
+type server struct {
+	once       sync.Once
+	url        string
+	nativeAddr string
+	err        error
+}
+
+// sharedServer returns the shared server of image, starting it on first
+// use.
+func sharedServer(image string) *server {
+	serversMu.Lock()
+	s, ok := servers[image]
+	if !ok {
+		s = &server{}
+		servers[image] = s
+	}
+	serversMu.Unlock()
+
+	s.once.Do(func() {
+		s.err = s.start(image)
+	})
+
+	return s
+}
+
+func (s *server) start(image string) error {
 	ctx := context.Background()
 	req := testcontainers.ContainerRequest{
-		Image:        "clickhouse/clickhouse-server:latest",
-		ExposedPorts: []string{"8123/tcp"},
-		WaitingFor:   wait.ForHTTP("/"),
+		Image:        image,
+		ExposedPorts: []string{"8123/tcp", "9000/tcp"},
+		WaitingFor:   wait.ForAll(wait.ForHTTP("/").WithPort("8123/tcp"), wait.ForListeningPort("9000/tcp")),
 		Env: map[string]string{
 			"CLICKHOUSE_USER":     "paste",
 			"CLICKHOUSE_PASSWORD": "paste",
@@ -29,34 +156,31 @@ func EnsureClickHouseInstance(t *testing.T) string {
 		ContainerRequest: req,
 		Started:          true,
 	})
-	require.NoError(t, err)
-
-	t.Cleanup(func() {
-		testcontainers.CleanupContainer(t, container)
-	})
-
-	url, err := container.Endpoint(context.Background(), "http")
-	t.Logf("ClickHouse URL: %s/play", url)
-	require.NoError(t, err)
-	url += "/?user=paste&password=paste"
+	if err != nil {
+		return err
+	}
 
-	EnsureClickHousePastila(t, url)
+	url, err := container.PortEndpoint(ctx, "8123/tcp", "http")
+	if err != nil {
+		return err
+	}
+	s.url = url + "/?user=paste&password=paste"
 
-	return url
+	s.nativeAddr, err = container.PortEndpoint(ctx, "9000/tcp", "")
+	return err
 }
 
+// EnsureClickHousePastila creates the pastila schema, see SchemaDDL, in the
+// database of url.
 func EnsureClickHousePastila(t *testing.T, url string) {
-	pastilaSchema, err := os.Open(AssetPath(t, "table.ddl.sql"))
-	require.NoError(t, err)
-
-	ClickHouseQuery(t, url, pastilaSchema)
-
-	pastilaView, err := os.Open(AssetPath(t, "view.ddl.sql"))
-	require.NoError(t, err)
-
-	ClickHouseQuery(t, url, pastilaView)
+	for _, ddl := range SchemaDDL {
+		ClickHouseQuery(t, url, strings.NewReader(ddl))
+	}
 }
 
+// AssetPath returns the path of a file of this package.
+//
+// Deprecated: it does not work when the package is vendored; use SchemaDDL.
 func AssetPath(t *testing.T, path string) string {
 	_, filename, _, ok := runtime.Caller(0)
 	require.True(t, ok)
@@ -78,3 +202,35 @@ func ClickHouseQuery(t *testing.T, url string, query io.Reader) {
 	t.Logf("ClickHouse response: %s", body)
 	require.Equal(t, http.StatusOK, resp.StatusCode)
 }
+
+// ClickHouseSelect executes a SELECT query and returns its rows, so tests can
+// check what was stored. Numbers are json.Number; ClickHouse quotes 64 bit
+// integers, which are strings then.
+func ClickHouseSelect(t *testing.T, url string, query string) []map[string]any {
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(query+"\nFORMAT JSONEachRow"))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "text/plain")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		require.Failf(t, "ClickHouse query failed", "%s: %s", resp.Status, body)
+	}
+
+	var rows []map[string]any
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	for {
+		var row map[string]any
+		err := decoder.Decode(&row)
+		if errors.Is(err, io.EOF) {
+			return rows
+		}
+		require.NoError(t, err)
+		rows = append(rows, row)
+	}
+}
@@ -0,0 +1,137 @@
+package chtest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/network"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// Cluster is a ClickHouse cluster of replicas of a single shard, sharing a
+// ClickHouse Keeper, with the pastila schema on a ReplicatedMergeTree table.
+type Cluster struct {
+	// URLs are the URLs of the replicas, in order.
+	URLs []string
+
+	replicas []testcontainers.Container
+}
+
+const keeperConfig = `<clickhouse>
+	<listen_host>0.0.0.0</listen_host>
+	<logger><console>1</console><level>warning</level></logger>
+	<keeper_server>
+		<tcp_port>9181</tcp_port>
+		<server_id>1</server_id>
+		<log_storage_path>/var/lib/clickhouse-keeper/log</log_storage_path>
+		<snapshot_storage_path>/var/lib/clickhouse-keeper/snapshots</snapshot_storage_path>
+		<raft_configuration>
+			<server><id>1</id><hostname>localhost</hostname><port>9234</port></server>
+		</raft_configuration>
+	</keeper_server>
+</clickhouse>`
+
+const replicaConfig = `<clickhouse>
+	<zookeeper><node><host>keeper</host><port>9181</port></node></zookeeper>
+	<macros><shard>1</shard><replica>%s</replica></macros>
+</clickhouse>`
+
+// replicatedEngine replaces the engine of the data table.
+const replicatedEngine = "ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/pastila/data', '{replica}')"
+
+// StartCluster starts a Keeper and the given number of replicas in the image
+// named by CHTEST_IMAGE, or DefaultImage, on a network of their own, and
+// creates the pastila schema on every replica. Everything is removed when the
+// test ends.
+func StartCluster(t *testing.T, replicas int) *Cluster {
+	ctx := context.Background()
+	image := resolveImage("")
+
+	nw, err := network.New(ctx)
+	require.NoError(t, err)
+	testcontainers.CleanupNetwork(t, nw)
+
+	keeper, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:          image,
+			Entrypoint:     []string{"clickhouse", "keeper", "--config-file=/etc/clickhouse-keeper/keeper.xml"},
+			ExposedPorts:   []string{"9181/tcp"},
+			Networks:       []string{nw.Name},
+			NetworkAliases: map[string][]string{nw.Name: {"keeper"}},
+			WaitingFor:     wait.ForListeningPort("9181/tcp"),
+			Files: []testcontainers.ContainerFile{{
+				Reader:            strings.NewReader(keeperConfig),
+				ContainerFilePath: "/etc/clickhouse-keeper/keeper.xml",
+				FileMode:          0o644,
+			}},
+		},
+		Started: true,
+	})
+	testcontainers.CleanupContainer(t, keeper)
+	require.NoError(t, err)
+
+	replicatedTable := strings.Replace(tableDDL, "ENGINE = MergeTree()", replicatedEngine, 1)
+	require.NotEqual(t, tableDDL, replicatedTable, "the data table has no MergeTree engine to replace")
+
+	cluster := &Cluster{}
+	for i := range replicas {
+		name := fmt.Sprintf("replica%d", i+1)
+		replica, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+			ContainerRequest: testcontainers.ContainerRequest{
+				Image:          image,
+				ExposedPorts:   []string{"8123/tcp"},
+				Networks:       []string{nw.Name},
+				NetworkAliases: map[string][]string{nw.Name: {name}},
+				WaitingFor:     wait.ForHTTP("/"),
+				Env: map[string]string{
+					"CLICKHOUSE_USER":     "paste",
+					"CLICKHOUSE_PASSWORD": "paste",
+				},
+				Files: []testcontainers.ContainerFile{{
+					Reader:            strings.NewReader(fmt.Sprintf(replicaConfig, name)),
+					ContainerFilePath: "/etc/clickhouse-server/config.d/replica.xml",
+					FileMode:          0o644,
+				}},
+			},
+			Started: true,
+		})
+		testcontainers.CleanupContainer(t, replica)
+		require.NoError(t, err)
+
+		url, err := replica.Endpoint(ctx, "http")
+		require.NoError(t, err)
+		url += "/?user=paste&password=paste"
+		t.Logf("ClickHouse %s URL: %s/play", name, url)
+
+		ClickHouseQuery(t, url, strings.NewReader(replicatedTable))
+		ClickHouseQuery(t, url, strings.NewReader(viewDDL))
+
+		cluster.URLs = append(cluster.URLs, url)
+		cluster.replicas = append(cluster.replicas, replica)
+	}
+
+	return cluster
+}
+
+// Stop stops replica i, so requests to its URL fail.
+func (c *Cluster) Stop(t *testing.T, i int) {
+	require.NoError(t, c.replicas[i].Stop(context.Background(), nil))
+}
+
+// StopReplication makes replica i stop fetching the rows inserted on other
+// replicas, so it lags behind them until StartReplication.
+func (c *Cluster) StopReplication(t *testing.T, i int) {
+	ClickHouseQuery(t, c.URLs[i], strings.NewReader("SYSTEM STOP FETCHES data"))
+}
+
+// StartReplication makes replica i catch up with the other replicas and
+// waits until it did.
+func (c *Cluster) StartReplication(t *testing.T, i int) {
+	ClickHouseQuery(t, c.URLs[i], strings.NewReader("SYSTEM START FETCHES data"))
+	ClickHouseQuery(t, c.URLs[i], strings.NewReader("SYSTEM SYNC REPLICA data"))
+}
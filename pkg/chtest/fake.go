@@ -0,0 +1,448 @@
+package chtest
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// FakeRow is a row stored by FakeClickHouse. References are hex encoded as
+// ClickHouse outputs them, without the trailing zero bytes.
+type FakeRow struct {
+	Table               string
+	Fingerprint         string
+	Hash                string
+	PreviousFingerprint string
+	PreviousHash        string
+	Encrypted           bool
+	Content             string
+	Time                time.Time
+
+	// Expires is the value of the expires column of tables with one, if
+	// written.
+	Expires time.Time
+}
+
+// FakeClickHouse is an in-process fake of the part of the ClickHouse HTTP
+// interface pkg/pastila uses: its queries of paste tables and data_view,
+// with query parameters, JSONEachRow and TabSeparated inserts, JSONEachRow
+// results, query IDs and /ping. It lets tests run without Docker. Unlike the data
+// table, it does not check that hashes match the content.
+type FakeClickHouse struct {
+	URL string
+
+	mu      sync.Mutex
+	rows    []FakeRow
+	queries int
+}
+
+// NewFakeClickHouse starts a FakeClickHouse, which is stopped when the test
+// ends.
+func NewFakeClickHouse(t *testing.T) *FakeClickHouse {
+	fake := &FakeClickHouse{}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	fake.URL = server.URL + "/"
+
+	return fake
+}
+
+// Rows returns the stored rows in the order they were inserted.
+func (f *FakeClickHouse) Rows() []FakeRow {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return slices.Clone(f.rows)
+}
+
+// fakeError is an exception of FakeClickHouse.
+type fakeError struct {
+	code    int
+	name    string
+	message string
+}
+
+var (
+	fakeTableRegex  = regexp.MustCompile("FROM (`[^\\s(]+)")
+	fakeInsertRegex = regexp.MustCompile("^INSERT INTO (\\S+) \\(([^)]*)\\)")
+	fakeFormatRegex = regexp.MustCompile(`FORMAT (\w+)\s*$`)
+)
+
+// ServeHTTP implements http.Handler.
+func (f *FakeClickHouse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/ping" {
+		_, _ = io.WriteString(w, "Ok.\n")
+		return
+	}
+
+	f.mu.Lock()
+	f.queries++
+	queryID := r.URL.Query().Get("query_id")
+	if queryID == "" {
+		queryID = fmt.Sprintf("fake-%d", f.queries)
+	}
+	f.mu.Unlock()
+	w.Header().Set("X-ClickHouse-Query-Id", queryID)
+
+	body := r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			writeFakeError(w, &fakeError{code: 432, name: "UNKNOWN_CODEC", message: err.Error()})
+			return
+		}
+		body = zr
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get("query"))
+	format := "JSONEachRow"
+	if m := fakeFormatRegex.FindStringSubmatch(query); m != nil {
+		format = m[1]
+		query = strings.TrimSpace(strings.TrimSuffix(query, m[0]))
+	}
+
+	var rows []any
+	var written, writtenBytes int
+	var err *fakeError
+	switch {
+	case strings.HasPrefix(query, "INSERT INTO"):
+		written, writtenBytes, err = f.insert(query, format, body)
+	case format != "JSONEachRow":
+		err = &fakeError{code: 73, name: "UNKNOWN_FORMAT", message: "Unknown format " + format}
+	default:
+		rows, err = f.selectRows(query, func(name string) string { return r.URL.Query().Get("param_" + name) })
+	}
+	if err != nil {
+		writeFakeError(w, err)
+		return
+	}
+
+	w.Header().Set("X-ClickHouse-Format", format)
+	w.Header().Set("X-ClickHouse-Summary", fmt.Sprintf(
+		`{"read_rows":"%d","written_rows":"%d","written_bytes":"%d","result_rows":"%d"}`,
+		len(rows), written, writtenBytes, len(rows),
+	))
+	encoder := json.NewEncoder(w)
+	for _, row := range rows {
+		_ = encoder.Encode(row)
+	}
+}
+
+func writeFakeError(w http.ResponseWriter, err *fakeError) {
+	w.Header().Set("X-ClickHouse-Exception-Code", strconv.Itoa(err.code))
+	w.WriteHeader(http.StatusBadRequest)
+	_, _ = fmt.Fprintf(w, "Code: %d. DB::Exception: %s. (%s) (version fake)\n", err.code, err.message, err.name)
+}
+
+// insert stores the rows of an insert query, and returns their number and
+// the size of their content.
+func (f *FakeClickHouse) insert(query, format string, body io.Reader) (int, int, *fakeError) {
+	m := fakeInsertRegex.FindStringSubmatch(query)
+	if m == nil {
+		return 0, 0, &fakeError{code: 62, name: "SYNTAX_ERROR", message: "Unsupported insert " + query}
+	}
+	table, columns := m[1], strings.Split(m[2], ",")
+	for i := range columns {
+		columns[i] = strings.TrimSpace(columns[i])
+	}
+
+	var values []map[string]string
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		if scanner.Text() == "" {
+			continue
+		}
+
+		row := map[string]string{}
+		switch format {
+		case "JSONEachRow":
+			var decoded map[string]any
+			decoder := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+			decoder.UseNumber()
+			if err := decoder.Decode(&decoded); err != nil {
+				return 0, 0, &fakeError{code: 117, name: "INCORRECT_DATA", message: err.Error()}
+			}
+			for k, v := range decoded {
+				row[k] = fmt.Sprint(v)
+			}
+		case "TabSeparated":
+			fields := strings.Split(scanner.Text(), "\t")
+			if len(fields) != len(columns) {
+				return 0, 0, &fakeError{code: 117, name: "INCORRECT_DATA", message: "Wrong number of columns"}
+			}
+			for i, column := range columns {
+				row[column] = unescapeTSV(fields[i])
+			}
+		default:
+			return 0, 0, &fakeError{code: 73, name: "UNKNOWN_FORMAT", message: "Unknown format " + format}
+		}
+		values = append(values, row)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, &fakeError{code: 117, name: "INCORRECT_DATA", message: err.Error()}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var size int
+	for _, row := range values {
+		size += len(row["content"])
+		var expires time.Time
+		if unix, err := strconv.ParseInt(row["expires"], 10, 64); err == nil && unix != 0 {
+			expires = time.Unix(unix, 0)
+		}
+		f.rows = append(f.rows, FakeRow{
+			Table:               table,
+			Fingerprint:         trimHex(row["fingerprint_hex"]),
+			Hash:                trimHex(row["hash_hex"]),
+			PreviousFingerprint: trimHex(row["prev_fingerprint_hex"]),
+			PreviousHash:        trimHex(row["prev_hash_hex"]),
+			Encrypted:           row["is_encrypted"] == "1" || row["is_encrypted"] == "true",
+			Content:             row["content"],
+			Time:                time.Now(),
+			Expires:             expires,
+		})
+	}
+
+	return len(values), size, nil
+}
+
+// selectRows answers the select queries of pkg/pastila.
+func (f *FakeClickHouse) selectRows(query string, param func(string) string) ([]any, *fakeError) {
+	table := "`data`"
+	if m := fakeTableRegex.FindStringSubmatch(query); m != nil {
+		table = m[1]
+	}
+
+	// Tables with an expires column have it selected first.
+	expiry := strings.Contains(query, "as expires_at")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case strings.Contains(query, "arrayJoin(arrayZip("):
+		fingerprints, hashes := parseFakeArray(param("fingerprintHexes")), parseFakeArray(param("hashHexes"))
+		var rows []any
+		for i := range min(len(fingerprints), len(hashes)) {
+			if row := f.first(table, fingerprints[i], hashes[i]); row != nil {
+				rows = append(rows, fakeManyRow{Fingerprint: row.Fingerprint, Hash: row.Hash, fakeContentRow: newFakeContentRow(row, expiry)})
+			}
+		}
+		return rows, nil
+	case strings.Contains(query, "WHERE prev_fingerprint ="):
+		next := f.newest(table, func(row *FakeRow) bool {
+			return row.PreviousFingerprint == trimHex(param("fingerprintHex")) && row.PreviousHash == trimHex(param("hashHex"))
+		}, 1)
+		if len(next) == 0 {
+			return nil, nil
+		}
+		return []any{fakeNextRow{Fingerprint: next[0].Fingerprint, fakeListRow: newFakeListRow(next[0])}}, nil
+	case strings.Contains(query, "LIMIT {limit:UInt32}"):
+		limit, _ := strconv.Atoi(param("limit"))
+		listed := f.newest(table, func(row *FakeRow) bool {
+			return row.Fingerprint == trimHex(param("fingerprintHex"))
+		}, limit)
+		rows := make([]any, len(listed))
+		for i, row := range listed {
+			rows[i] = newFakeListRow(row)
+		}
+		return rows, nil
+	case strings.Contains(query, "data_view(") || strings.Contains(query, "WHERE fingerprint ="):
+		if strings.Contains(query, "data_view(") {
+			table = "`data`"
+		}
+		row := f.first(table, param("fingerprintHex"), param("hashHex"))
+		if row == nil {
+			return nil, nil
+		}
+		if strings.Contains(query, "as time_ms") {
+			return []any{newFakeStatRow(row, expiry)}, nil
+		}
+		return []any{newFakeContentRow(row, expiry)}, nil
+	case strings.Contains(query, "GROUP BY fingerprint, hash"):
+		return f.usage(table), nil
+	default:
+		return nil, &fakeError{code: 62, name: "SYNTAX_ERROR", message: "Query not supported by the fake: " + query}
+	}
+}
+
+// first returns the first insertion of a row, like data_view.
+func (f *FakeClickHouse) first(table, fingerprint, hash string) *FakeRow {
+	for i := range f.rows {
+		row := &f.rows[i]
+		if row.Table == table && row.Fingerprint == trimHex(fingerprint) && row.Hash == trimHex(hash) {
+			return row
+		}
+	}
+
+	return nil
+}
+
+// newest returns the first insertions of the rows matching match, newest
+// first, up to limit.
+func (f *FakeClickHouse) newest(table string, match func(*FakeRow) bool, limit int) []*FakeRow {
+	var rows []*FakeRow
+	for i := range f.rows {
+		row := &f.rows[i]
+		if row.Table == table && match(row) && f.first(table, row.Fingerprint, row.Hash) == row {
+			rows = append(rows, row)
+		}
+	}
+	slices.Reverse(rows)
+
+	return rows[:min(limit, len(rows))]
+}
+
+// usage sums up the first insertions of the rows by day.
+func (f *FakeClickHouse) usage(table string) []any {
+	var rows []any
+	byDay := map[string]*fakeUsageRow{}
+	for _, row := range f.newest(table, func(*FakeRow) bool { return true }, len(f.rows)) {
+		day := row.Time.UTC().Format(time.DateOnly)
+		usage, ok := byDay[day]
+		if !ok {
+			usage = &fakeUsageRow{Day: day}
+			byDay[day] = usage
+			rows = append(rows, usage)
+		}
+		usage.Pastes++
+		if row.Encrypted {
+			usage.EncryptedPastes++
+		}
+		usage.Bytes += int64(len(row.Content))
+	}
+	// newest lists the rows newest first.
+	slices.Reverse(rows)
+
+	return rows
+}
+
+// The result rows below have the columns of the queries of pkg/pastila, in
+// their order: the content comes last.
+
+type fakeContentRow struct {
+	ExpiresAt           *int64 `json:"expires_at,omitempty"`
+	Encrypted           bool   `json:"is_encrypted"`
+	PreviousFingerprint string `json:"prev_fingerprint_hex"`
+	PreviousHash        string `json:"prev_hash_hex"`
+	Size                int    `json:"size"`
+	Content             string `json:"content"`
+}
+
+func newFakeContentRow(row *FakeRow, expiry bool) fakeContentRow {
+	return fakeContentRow{
+		ExpiresAt:           fakeExpiresAt(row, expiry),
+		Encrypted:           row.Encrypted,
+		PreviousFingerprint: row.PreviousFingerprint,
+		PreviousHash:        row.PreviousHash,
+		Size:                len(row.Content),
+		Content:             row.Content,
+	}
+}
+
+type fakeManyRow struct {
+	Fingerprint string `json:"fingerprint_hex"`
+	Hash        string `json:"hash_hex"`
+	fakeContentRow
+}
+
+type fakeStatRow struct {
+	ExpiresAt           *int64 `json:"expires_at,omitempty"`
+	Encrypted           bool   `json:"is_encrypted"`
+	Size                int    `json:"size"`
+	TimeMillis          string `json:"time_ms"`
+	PreviousFingerprint string `json:"prev_fingerprint_hex"`
+	PreviousHash        string `json:"prev_hash_hex"`
+}
+
+func newFakeStatRow(row *FakeRow, expiry bool) fakeStatRow {
+	return fakeStatRow{
+		ExpiresAt:           fakeExpiresAt(row, expiry),
+		Encrypted:           row.Encrypted,
+		Size:                len(row.Content),
+		TimeMillis:          strconv.FormatInt(row.Time.UnixMilli(), 10),
+		PreviousFingerprint: row.PreviousFingerprint,
+		PreviousHash:        row.PreviousHash,
+	}
+}
+
+type fakeListRow struct {
+	Hash string `json:"hash_hex"`
+	fakeStatRow
+}
+
+func newFakeListRow(row *FakeRow) fakeListRow {
+	return fakeListRow{Hash: row.Hash, fakeStatRow: newFakeStatRow(row, false)}
+}
+
+// fakeExpiresAt returns the expires_at column of row, as toUnixTimestamp
+// does, if the query selects it.
+func fakeExpiresAt(row *FakeRow, expiry bool) *int64 {
+	if !expiry {
+		return nil
+	}
+
+	var unix int64
+	if !row.Expires.IsZero() {
+		unix = row.Expires.Unix()
+	}
+	return &unix
+}
+
+type fakeNextRow struct {
+	Fingerprint string `json:"fingerprint_hex"`
+	fakeListRow
+}
+
+type fakeUsageRow struct {
+	Day             string `json:"day"`
+	Pastes          int64  `json:"pastes,string"`
+	EncryptedPastes int64  `json:"encrypted_pastes,string"`
+	Bytes           int64  `json:"bytes,string"`
+}
+
+// trimHex drops the trailing zero bytes of a hex encoded value, as
+// reinterpretAsFixedString does.
+func trimHex(s string) string {
+	s = strings.ToLower(s)
+	for strings.HasSuffix(s, "00") {
+		s = s[:len(s)-2]
+	}
+
+	return s
+}
+
+// parseFakeArray parses an Array(String) query parameter of quoted strings.
+func parseFakeArray(s string) []string {
+	s = strings.Trim(s, "[]")
+	if s == "" {
+		return nil
+	}
+
+	values := strings.Split(s, ",")
+	for i, v := range values {
+		values[i] = strings.Trim(v, "'")
+	}
+
+	return values
+}
+
+var tsvUnescaper = strings.NewReplacer(`\\`, `\`, `\t`, "\t", `\n`, "\n", `\r`, "\r", `\0`, "\x00")
+
+func unescapeTSV(s string) string {
+	return tsvUnescaper.Replace(s)
+}
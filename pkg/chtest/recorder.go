@@ -0,0 +1,168 @@
+package chtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// RecordEnv is the environment variable making NewRecorder record fixtures,
+// e.g. CHTEST_RECORD=1 go test ./pkg/pastila -run TestReadEncrypted.
+const RecordEnv = "CHTEST_RECORD"
+
+// Interaction is a recorded request and its response. Requests are told
+// apart by their method, path, query and body; the host is not recorded, so
+// fixtures replay for any ClickHouse URL with the same path and query.
+type Interaction struct {
+	Method      string      `json:"method"`
+	URI         string      `json:"uri"`
+	RequestBody string      `json:"request_body,omitempty"`
+	Status      int         `json:"status"`
+	Header      http.Header `json:"header"`
+	Body        []byte      `json:"body"`
+}
+
+// NewRecorder returns a transport replaying the interactions recorded in
+// testdata/fixtures/name.json, so tests of remote services such as the
+// public pastila service run without network. With CHTEST_RECORD set, it
+// sends requests to the remote service instead and records them to the file
+// when the test ends.
+func NewRecorder(t *testing.T, name string) http.RoundTripper {
+	path := filepath.Join("testdata", "fixtures", name+".json")
+
+	if os.Getenv(RecordEnv) != "" {
+		r := &recorder{next: http.DefaultTransport}
+		t.Cleanup(func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			var data bytes.Buffer
+			encoder := json.NewEncoder(&data)
+			encoder.SetEscapeHTML(false)
+			encoder.SetIndent("", "\t")
+			require.NoError(t, encoder.Encode(r.interactions))
+			require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+			require.NoError(t, os.WriteFile(path, data.Bytes(), 0o644))
+		})
+		return r
+	}
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err, "record the fixture with %s=1", RecordEnv)
+	r := &replayer{}
+	require.NoError(t, json.Unmarshal(data, &r.interactions))
+
+	return r
+}
+
+// requestKey returns the method, URI and body of req, restoring its body.
+func requestKey(req *http.Request) (method, uri, body string, err error) {
+	if req.Body != nil {
+		b, err := io.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return "", "", "", err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(b))
+		body = string(b)
+	}
+
+	// Passwords stay out of fixtures.
+	u := *req.URL
+	query := u.Query()
+	query.Del("password")
+	u.RawQuery = query.Encode()
+
+	return req.Method, u.RequestURI(), body, nil
+}
+
+type recorder struct {
+	next http.RoundTripper
+
+	mu           sync.Mutex
+	interactions []Interaction
+}
+
+func (r *recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	method, uri, reqBody, err := requestKey(req)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := r.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+
+	header := res.Header.Clone()
+	header.Del("Date")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.interactions = append(r.interactions, Interaction{
+		Method:      method,
+		URI:         uri,
+		RequestBody: reqBody,
+		Status:      res.StatusCode,
+		Header:      header,
+		Body:        body,
+	})
+
+	return res, nil
+}
+
+type replayer struct {
+	mu           sync.Mutex
+	interactions []Interaction
+	used         []bool
+}
+
+// RoundTrip answers with the first unused interaction recorded for the
+// request, so repeated requests replay in the order they were recorded.
+func (r *replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	method, uri, body, err := requestKey(req)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.used == nil {
+		r.used = make([]bool, len(r.interactions))
+	}
+
+	for i, interaction := range r.interactions {
+		if r.used[i] || interaction.Method != method || interaction.URI != uri || interaction.RequestBody != body {
+			continue
+		}
+		r.used[i] = true
+
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", interaction.Status, http.StatusText(interaction.Status)),
+			StatusCode:    interaction.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        interaction.Header.Clone(),
+			Body:          io.NopCloser(bytes.NewReader(interaction.Body)),
+			ContentLength: int64(len(interaction.Body)),
+			Request:       req,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("chtest: no recorded interaction for %s %s, record it with %s=1", method, uri, RecordEnv)
+}
@@ -0,0 +1,14 @@
+package chtest
+
+import _ "embed"
+
+//go:embed table.ddl.sql
+var tableDDL string
+
+//go:embed view.ddl.sql
+var viewDDL string
+
+// SchemaDDL are the statements creating the pastila schema, in order: the
+// data table and data_view, as the pastila service defines them. ClickHouse
+// executes one statement per HTTP request.
+var SchemaDDL = []string{tableDDL, viewDDL}
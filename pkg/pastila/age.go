@@ -0,0 +1,86 @@
+package pastila
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/age"
+)
+
+// WithAgeRecipients makes Write encrypt content with age to the given
+// recipients, such as the X25519 public keys parsed by age.ParseRecipients,
+// instead of with a symmetric key. Only holders of a matching identity can
+// read the paste, with WithAgeIdentity, and the URL carries no secret.
+//
+// age encryption is randomized, so WithDedup never matches an existing paste.
+// New versions written with WithPreviousPaste are encrypted to the same
+// recipients.
+func WithAgeRecipients(recipients ...age.Recipient) WriteOption {
+	return func(o *writeOptions) {
+		o.ageRecipients = recipients
+	}
+}
+
+// WithAgeIdentity sets the identities, such as the X25519 private keys parsed
+// by age.ParseIdentities, to decrypt pastes written with WithAgeRecipients.
+func WithAgeIdentity(identities ...age.Identity) ReadOption {
+	return func(o *readOptions) {
+		o.ageIdentities = identities
+	}
+}
+
+// decryptAge returns a reader decrypting the age encrypted payload of a
+// paste as it is read.
+func decryptAge(payload io.Reader, identities []age.Identity) (io.Reader, error) {
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("%w: paste is encrypted to age recipients, an identity is required", ErrKeyRequired)
+	}
+
+	src := &errRecorder{r: payload}
+	r, err := age.Decrypt(src, identities...)
+	if err != nil {
+		var noMatch *age.NoIdentityMatchError
+		switch {
+		case src.err != nil && src.err != io.EOF:
+			return nil, src.err
+		case errors.As(err, &noMatch):
+			return nil, fmt.Errorf("%w: %w", ErrInvalidKey, err)
+		default:
+			return nil, fmt.Errorf("%w, failed to decrypt age header: %w", ErrInvalidContent, err)
+		}
+	}
+
+	return &ageReader{r: r, src: src}, nil
+}
+
+// ageReader reads decrypted content. age authenticates the payload in
+// chunks, so modified or truncated content fails while being read, with
+// ErrAuthenticationFailed.
+type ageReader struct {
+	r   io.Reader
+	src *errRecorder
+}
+
+func (a *ageReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if err != nil && err != io.EOF && (a.src.err == nil || a.src.err == io.EOF) {
+		err = fmt.Errorf("%w: %w", ErrAuthenticationFailed, err)
+	}
+	return n, err
+}
+
+// errRecorder remembers the error of its reader, to tell failures to read
+// the payload apart from failures to decrypt it.
+type errRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errRecorder) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil {
+		e.err = err
+	}
+	return n, err
+}
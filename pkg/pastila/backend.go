@@ -0,0 +1,191 @@
+package pastila
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Ref identifies a stored paste.
+type Ref struct {
+	Fingerprint []byte
+	Hash        []byte
+}
+
+// Row is a paste as stored by a Backend.
+type Row struct {
+	Ref
+
+	// PreviousFingerprint and PreviousHash point to the previous version of
+	// the paste. Both are nil when there is none.
+	PreviousFingerprint []byte
+	PreviousHash        []byte
+
+	Encrypted bool
+
+	// Content is the stored content: the plaintext, or the base64 encoded
+	// ciphertext of encrypted pastes. It is empty in rows returned by Insert
+	// and Stat.
+	Content string
+
+	// Size is the size of Content in bytes. It is set by Stat and Insert, and
+	// by SelectStream if the backend knows it.
+	Size int64
+
+	// Time is when the paste was inserted, if known. It is set by Stat.
+	Time time.Time
+
+	// Expires is when the paste expires, or zero if it does not, see
+	// ExpiryBackend.
+	Expires time.Time
+
+	// QueryID and Stats describe the query that returned the row, if the
+	// backend reports them.
+	QueryID string
+	Stats   Stats
+}
+
+// InsertRow is a paste to be stored by a Backend.
+type InsertRow struct {
+	PreviousFingerprint []byte
+	PreviousHash        []byte
+
+	Encrypted bool
+
+	// Expires is when the paste expires, or zero if it does not. It is set
+	// only for backends implementing ExpiryBackend.
+	Expires time.Time
+
+	// Content streams the content to store. The content is encrypted and
+	// hashed while it is read, so the Ref is known only once Content has been
+	// read to the end.
+	Content io.Reader
+
+	ref Ref
+}
+
+// Ref returns the Ref of the row. It is valid only after Content has been
+// read to the end.
+func (r *InsertRow) Ref() Ref {
+	return r.ref
+}
+
+// Backend stores pastes. The default backend talks to the ClickHouse HTTP
+// interface; alternate implementations can be set with WithBackend.
+//
+// Retries are handled by the Service, so backends should not retry on
+// their own.
+type Backend interface {
+	// Select returns the row referenced by ref, or ErrNotFound.
+	Select(ctx context.Context, ref Ref) (*Row, error)
+
+	// Insert stores row and returns it without Content.
+	Insert(ctx context.Context, row *InsertRow) (*Row, error)
+}
+
+// StatBackend is implemented by backends that can describe a row without
+// transferring its content. Stat and Exists fall back to Select for backends
+// that do not implement it.
+type StatBackend interface {
+	// Stat returns the row referenced by ref without Content, or
+	// ErrNotFound.
+	Stat(ctx context.Context, ref Ref) (*Row, error)
+}
+
+// StreamBackend is implemented by backends that can stream the content of a
+// row, so reading a large paste does not hold it in memory. Read falls back
+// to Select for backends that do not implement it.
+type StreamBackend interface {
+	// SelectStream returns the row referenced by ref without Content, and a
+	// reader of its Content, or ErrNotFound. The reader fails if the content
+	// cannot be read to its end, and must be closed.
+	SelectStream(ctx context.Context, ref Ref) (*Row, io.ReadCloser, error)
+}
+
+// TableBackend is implemented by backends storing pastes in a ClickHouse
+// table. NewService configures them with the table set by WithTable.
+type TableBackend interface {
+	// SetTable makes the backend store pastes in table of database, which
+	// TableIdentifier quotes. It is called before the backend is used.
+	SetTable(database, table string)
+}
+
+func (s *Service) backend() Backend {
+	if s.Backend != nil {
+		return s.Backend
+	}
+
+	return &httpBackend{s: s}
+}
+
+// selectRef selects the row referenced by ref, retrying transient failures.
+// Rows are served from and added to the Cache, if any.
+func (s *Service) selectRef(ctx context.Context, ref Ref) (*Row, error) {
+	if row, ok := s.Cache.get(ref); ok {
+		return row, nil
+	}
+
+	var row *Row
+	err := s.retry(ctx, func() (err error) {
+		row, err = s.backend().Select(ctx, ref)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.Cache.put(row)
+	return row, nil
+}
+
+// selectStream selects the row referenced by ref and streams its content,
+// retrying failures to start the stream. Rows are read as a whole when they
+// go through the Cache, or when the backend cannot stream them.
+func (s *Service) selectStream(ctx context.Context, ref Ref) (*Row, io.ReadCloser, error) {
+	streamBackend, ok := s.backend().(StreamBackend)
+	if !ok || s.Cache != nil {
+		row, err := s.selectRef(ctx, ref)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return row, nil, nil
+	}
+
+	var row *Row
+	var content io.ReadCloser
+	err := s.retry(ctx, func() (err error) {
+		row, content, err = streamBackend.SelectStream(ctx, ref)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return row, content, nil
+}
+
+// statRef describes the row referenced by ref, retrying transient failures.
+func (s *Service) statRef(ctx context.Context, ref Ref) (*Row, error) {
+	b := s.backend()
+	statBackend, ok := b.(StatBackend)
+	if !ok {
+		row, err := s.selectRef(ctx, ref)
+		if err != nil {
+			return nil, err
+		}
+
+		stat := *row
+		stat.Size = int64(len(row.Content))
+		stat.Content = ""
+		return &stat, nil
+	}
+
+	var row *Row
+	err := s.retry(ctx, func() (err error) {
+		row, err = statBackend.Stat(ctx, ref)
+		return err
+	})
+
+	return row, err
+}
@@ -0,0 +1,207 @@
+package pastila
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// maxBatchSize bounds the number of pastes selected by a single query.
+const maxBatchSize = 100
+
+// BatchBackend is implemented by backends that can select many rows in a
+// single round trip. ReadAll falls back to concurrent Selects for backends
+// that do not implement it.
+type BatchBackend interface {
+	// SelectMany returns the rows referenced by refs that exist, in any
+	// order. Refs without a row do not exist. An error wrapping
+	// errors.ErrUnsupported makes ReadAll select the refs one by one
+	// instead.
+	SelectMany(ctx context.Context, refs []Ref) ([]*Row, error)
+}
+
+// batchState remembers that ClickHouse refuses to select many rows at once,
+// across requests.
+type batchState struct {
+	restricted atomic.Bool
+}
+
+// batchRestricted reports whether SelectMany is known to be refused.
+func (s *Service) batchRestricted() bool {
+	return s.batchState != nil && s.batchState.restricted.Load()
+}
+
+// batchUnsupported makes later SelectMany calls fail without a query.
+// Services not built by NewService find out on every call.
+func (s *Service) batchUnsupported() {
+	if s.batchState != nil {
+		s.batchState.restricted.Store(true)
+	}
+}
+
+// ReadAll reads the pastes referenced by urls. The returned slice has an
+// entry for every URL, nil for the pastes that could not be read, and the
+// error joins the errors of those. Lookups are batched into as few queries
+// as the backend allows; otherwise up to concurrency pastes are read at once.
+func (s *Service) ReadAll(ctx context.Context, urls []string, concurrency int, opt ...ReadOption) ([]*Paste, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	pastes := make([]*Paste, len(urls))
+	errs := make([]error, len(urls))
+
+	var unbatched []int
+	if batchBackend, ok := s.backend().(BatchBackend); ok {
+		unbatched = s.readBatched(ctx, batchBackend, urls, pastes, errs, opt)
+	} else {
+		unbatched = make([]int, len(urls))
+		for i := range unbatched {
+			unbatched[i] = i
+		}
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for _, i := range unbatched {
+		wg.Go(func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			pastes[i], errs[i] = s.ReadContext(ctx, urls[i], opt...)
+		})
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			errs[i] = fmt.Errorf("%s: %w", strings.TrimSpace(urls[i]), err)
+		}
+	}
+
+	return pastes, errors.Join(errs...)
+}
+
+// readBatched reads the pastes referenced by urls with SelectMany. It returns
+// the indexes of the URLs the backend could not select that way.
+func (s *Service) readBatched(
+	ctx context.Context, b BatchBackend, urls []string, pastes []*Paste, errs []error, opt []ReadOption,
+) []int {
+	r := &batchReader{s: s, b: b, opts: &readOptions{}, pastes: pastes, errs: errs}
+	for _, o := range opt {
+		o(r.opts)
+	}
+
+	for i, url := range urls {
+		url = strings.TrimSpace(url)
+		pasteRef, err := ParseURL(url)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		p := pendingRead{index: i, url: url, ref: pasteRef.Ref, key: pasteRef.Key}
+
+		if row, ok := s.Cache.get(p.ref); ok {
+			r.open(ctx, p, row)
+			continue
+		}
+
+		r.batch = append(r.batch, p)
+		if len(r.batch) == maxBatchSize {
+			r.flush(ctx)
+		}
+	}
+	r.flush(ctx)
+
+	return r.unbatched
+}
+
+// pendingRead is a paste waiting for its batch to be selected.
+type pendingRead struct {
+	index int
+	url   string
+	ref   Ref
+	key   []byte
+}
+
+// batchReader reads pastes in batches for readBatched.
+type batchReader struct {
+	s      *Service
+	b      BatchBackend
+	opts   *readOptions
+	pastes []*Paste
+	errs   []error
+
+	batch     []pendingRead
+	unbatched []int
+}
+
+// flush selects the pending batch and opens its pastes.
+func (r *batchReader) flush(ctx context.Context) {
+	if len(r.batch) == 0 {
+		return
+	}
+	defer func() { r.batch = r.batch[:0] }()
+
+	refs := make([]Ref, len(r.batch))
+	for i, p := range r.batch {
+		refs[i] = p.ref
+	}
+
+	var rows []*Row
+	err := r.s.retry(ctx, func() (err error) {
+		rows, err = r.b.SelectMany(ctx, refs)
+		return err
+	})
+	if errors.Is(err, errors.ErrUnsupported) {
+		for _, p := range r.batch {
+			r.unbatched = append(r.unbatched, p.index)
+		}
+		return
+	}
+
+	found := map[string]*Row{}
+	for _, row := range rows {
+		found[refKey(row.Ref)] = row
+		r.s.Cache.put(row)
+	}
+
+	for _, p := range r.batch {
+		switch row := found[refKey(p.ref)]; {
+		case err != nil:
+			r.errs[p.index] = err
+		case row == nil:
+			r.errs[p.index] = fmt.Errorf("%w: %s", ErrNotFound, p.url)
+		default:
+			r.open(ctx, p, row)
+		}
+	}
+}
+
+// open opens the paste of p from its row.
+func (r *batchReader) open(ctx context.Context, p pendingRead, row *Row) {
+	if r.errs[p.index] = checkExpiry(p.url, row); r.errs[p.index] != nil {
+		return
+	}
+	paste, err := r.s.open(ctx, p.url, p.ref, p.key, row, r.opts)
+	if err != nil {
+		r.errs[p.index] = err
+		return
+	}
+	if r.opts.progress != nil {
+		paste.ReadCloser = &progressReader{ReadCloser: paste.ReadCloser, fn: r.opts.progress}
+	}
+	r.s.limitSize(paste)
+	if r.errs[p.index] = spool(paste, r.opts); r.errs[p.index] != nil {
+		return
+	}
+	r.pastes[p.index] = paste
+}
+
+func refKey(ref Ref) string {
+	return hex.EncodeToString(ref.Fingerprint) + "/" + hex.EncodeToString(ref.Hash)
+}
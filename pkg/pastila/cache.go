@@ -0,0 +1,167 @@
+package pastila
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache keeps the rows of read pastes on disk, so reading a paste again does
+// not query the backend. Pastes are content addressed and never change, so
+// cached rows are never stale. Rows are cached as stored: the content of an
+// encrypted paste stays encrypted on disk.
+//
+// The cache is bounded by size; the least recently read rows are evicted
+// first. A nil *Cache caches nothing.
+type Cache struct {
+	dir      string
+	maxBytes int64
+
+	// mu serializes evictions.
+	mu sync.Mutex
+}
+
+// cacheTempPrefix prefixes files being written into the cache directory.
+const cacheTempPrefix = ".tmp-"
+
+// NewCache returns a Cache of at most maxBytes in dir, creating dir if
+// needed. The directory may be shared by processes.
+func NewCache(dir string, maxBytes int64) (*Cache, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("cache size must be positive")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	return &Cache{dir: dir, maxBytes: maxBytes}, nil
+}
+
+// cacheEntry is the on-disk form of a cached row.
+type cacheEntry struct {
+	PreviousFingerprint []byte `json:"prev_fingerprint,omitempty"`
+	PreviousHash        []byte `json:"prev_hash,omitempty"`
+	Encrypted           bool   `json:"encrypted"`
+	Content             string `json:"content"`
+}
+
+func (c *Cache) path(ref Ref) string {
+	return filepath.Join(c.dir, hex.EncodeToString(ref.Fingerprint)+"-"+hex.EncodeToString(ref.Hash))
+}
+
+// get returns the cached row referenced by ref. Unreadable entries are
+// treated as missing.
+func (c *Cache) get(ref Ref) (*Row, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	path := c.path(ref)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, false
+	}
+
+	// The modification time tracks the last read, for eviction.
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+
+	return &Row{
+		Ref:                 ref,
+		PreviousFingerprint: entry.PreviousFingerprint,
+		PreviousHash:        entry.PreviousHash,
+		Encrypted:           entry.Encrypted,
+		Content:             entry.Content,
+	}, true
+}
+
+// put caches row, evicting older rows to stay within the size bound. Caching
+// is best effort: failures are ignored.
+func (c *Cache) put(row *Row) {
+	if c == nil {
+		return
+	}
+
+	data, err := json.Marshal(cacheEntry{
+		PreviousFingerprint: row.PreviousFingerprint,
+		PreviousHash:        row.PreviousHash,
+		Encrypted:           row.Encrypted,
+		Content:             row.Content,
+	})
+	if err != nil || int64(len(data)) > c.maxBytes {
+		return
+	}
+
+	// Rows are written aside and renamed into place, so concurrent readers
+	// never see a partial entry.
+	f, err := os.CreateTemp(c.dir, cacheTempPrefix)
+	if err != nil {
+		return
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.path(row.Ref))
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return
+	}
+
+	c.evict(filepath.Base(c.path(row.Ref)))
+}
+
+// evict removes the least recently read rows, except the one named keep,
+// until the cache fits into maxBytes.
+func (c *Cache) evict(keep string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+
+	var files []os.FileInfo
+	var size int64
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), cacheTempPrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, info)
+		size += info.Size()
+	}
+
+	slices.SortFunc(files, func(a, b os.FileInfo) int {
+		return a.ModTime().Compare(b.ModTime())
+	})
+
+	for _, file := range files {
+		if size <= c.maxBytes {
+			return
+		}
+		if file.Name() == keep {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.dir, file.Name())); err == nil {
+			size -= file.Size()
+		}
+	}
+}
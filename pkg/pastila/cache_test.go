@@ -0,0 +1,71 @@
+package pastila
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache(t *testing.T) {
+	backend := &countingBackend{Backend: newMemoryBackend()}
+	service, err := NewService(WithBackend(backend), WithCache(t.TempDir(), 1<<20))
+	require.NoError(t, err)
+
+	written, err := service.Write(strings.NewReader("cached content"), WithKey([]byte("0123456789abcdef")))
+	require.NoError(t, err)
+
+	for range 3 {
+		paste, err := service.Read(written.URL)
+		require.NoError(t, err)
+
+		content, err := io.ReadAll(paste)
+		require.NoError(t, err)
+		assert.Equal(t, "cached content", string(content))
+	}
+	assert.Equal(t, 1, backend.selects)
+
+	// Encrypted content is cached as stored.
+	entry, err := os.ReadFile(service.Cache.path(Ref{Fingerprint: written.Fingerprint, Hash: written.Hash}))
+	require.NoError(t, err)
+	assert.NotContains(t, string(entry), "cached content")
+}
+
+func TestCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewCache(dir, 256)
+	require.NoError(t, err)
+
+	refs := make([]Ref, 4)
+	for i := range refs {
+		refs[i] = Ref{Fingerprint: []byte{0, 0, 0, byte(i)}, Hash: make([]byte, 16)}
+		cache.put(&Row{Ref: refs[i], Content: strings.Repeat("a", 80)})
+
+		// Make the order of writes visible despite coarse file times.
+		written := time.Now().Add(time.Duration(i-len(refs)) * time.Minute)
+		_ = os.Chtimes(cache.path(refs[i]), written, written)
+	}
+
+	_, ok := cache.get(refs[0])
+	assert.False(t, ok)
+	row, ok := cache.get(refs[3])
+	require.True(t, ok)
+	assert.Equal(t, strings.Repeat("a", 80), row.Content)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var size int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		require.NoError(t, err)
+		size += info.Size()
+	}
+	assert.LessOrEqual(t, size, int64(256))
+
+	_, err = NewCache(dir, 0)
+	require.Error(t, err)
+}
@@ -0,0 +1,228 @@
+package pastila
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const manifestVersion = 1
+
+// maxManifestSize bounds the manifest read before its chunks, so a malformed
+// paste cannot make Read buffer arbitrary amounts of data.
+const maxManifestSize = 16 << 20
+
+// manifest lists the chunks of a chunked paste. It is stored as the content
+// of the paste the URL points to, marked by the manifest envelope field.
+type manifest struct {
+	Version int `json:"version"`
+
+	// Size is the total size of the content in bytes.
+	Size int64 `json:"size"`
+
+	// Chunks are the fingerprint/hash references of the chunks, in order.
+	Chunks []string `json:"chunks"`
+
+	// Key encrypts the chunks of an encrypted paste. It is stored in the
+	// manifest, which is encrypted with the key or passphrase of the paste.
+	Key []byte `json:"key,omitempty"`
+}
+
+// WithChunkSize makes Write split content larger than size bytes into chunks
+// of size bytes, each stored as a separate paste, plus a manifest paste
+// referencing them. The URL of the written paste points to the manifest, and
+// Read reassembles the content transparently. This lifts the size limit of a
+// single insert.
+func WithChunkSize(size int64) WriteOption {
+	return func(o *writeOptions) {
+		o.chunkSize = size
+	}
+}
+
+// writeChunked writes input as chunks and returns the manifest paste.
+//
+// Chunks of an encrypted paste are encrypted with a random key and random
+// IVs, so no keystream is reused across chunks, and key derivation runs only
+// once, for the manifest.
+func (s *Service) writeChunked(ctx context.Context, input io.Reader, opts *writeOptions) (*Paste, error) {
+	m := &manifest{Version: manifestVersion}
+
+	chunkOpts := &writeOptions{compression: opts.compression, dedup: opts.dedup, expiry: opts.expiry}
+	if opts.key != nil || opts.passphrase != "" || opts.ageRecipients != nil {
+		m.Key = make([]byte, 16)
+		if _, err := rand.Read(m.Key); err != nil {
+			return nil, fmt.Errorf("failed to generate chunk key: %w", err)
+		}
+
+		chunkOpts.key = m.Key
+		chunkOpts.randomIV = true
+		chunkOpts.mac = opts.mac
+	}
+
+	var firstFingerprint []byte
+	buf := make([]byte, opts.chunkSize)
+	for {
+		n, err := io.ReadFull(input, buf)
+		if n > 0 {
+			m.Size += int64(n)
+			if s.MaxSize > 0 && m.Size > s.MaxSize {
+				return nil, fmt.Errorf("%w: more than %d bytes", ErrTooLarge, s.MaxSize)
+			}
+
+			chunk, writeErr := s.writeWithOptions(ctx, bytes.NewReader(buf[:n]), chunkOpts)
+			if writeErr != nil {
+				return nil, fmt.Errorf("failed to write chunk %d: %w", len(m.Chunks)+1, writeErr)
+			}
+
+			if firstFingerprint == nil {
+				firstFingerprint = chunk.Fingerprint
+			}
+			m.Chunks = append(m.Chunks, fmt.Sprintf("%x/%x", chunk.Fingerprint, chunk.Hash))
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read input: %w", err)
+		}
+	}
+
+	content, err := json.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	// The manifest takes the fingerprint of the content, not of itself.
+	manifestOpts := *opts
+	manifestOpts.chunkSize = 0
+	manifestOpts.manifest = true
+	if manifestOpts.fingerprint == nil {
+		manifestOpts.fingerprint = firstFingerprint
+	}
+
+	return s.writeWithOptions(ctx, bytes.NewReader(content), &manifestOpts)
+}
+
+// openChunks replaces the content of a manifest paste with a reader of its
+// chunks. Other pastes are returned as is.
+func (s *Service) openChunks(ctx context.Context, paste *Paste, env *envelope, opts *readOptions) (*Paste, error) {
+	if !env.manifest {
+		return paste, nil
+	}
+
+	content, err := io.ReadAll(io.LimitReader(paste.ReadCloser, maxManifestSize))
+	_ = paste.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%w, failed to read manifest: %w", ErrInvalidContent, err)
+	}
+
+	var m manifest
+	if err := json.Unmarshal(content, &m); err != nil {
+		return nil, fmt.Errorf("%w, failed to decode manifest: %w", ErrInvalidContent, err)
+	}
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("%w: unsupported manifest version %d", ErrInvalidContent, m.Version)
+	}
+	if m.Size < 0 {
+		return nil, fmt.Errorf("%w: negative manifest size %d", ErrInvalidContent, m.Size)
+	}
+	if s.MaxSize > 0 && m.Size > s.MaxSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrTooLarge, m.Size)
+	}
+
+	urls := make([]string, len(m.Chunks))
+	for i, chunk := range m.Chunks {
+		fingerprintHex, hashHex, ok := strings.Cut(chunk, "/")
+		if !ok {
+			return nil, fmt.Errorf("%w: invalid chunk reference %q", ErrInvalidContent, chunk)
+		}
+
+		fingerprint, hash, err := decodeRef(fingerprintHex, hashHex)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidContent, err)
+		}
+		urls[i] = PasteRef{Ref: Ref{Fingerprint: fingerprint, Hash: hash}, Key: m.Key}.String()
+	}
+
+	var chunkOpts []ReadOption
+	if opts.verify {
+		chunkOpts = append(chunkOpts, WithVerify())
+	}
+	if opts.requireMAC {
+		chunkOpts = append(chunkOpts, WithRequireMAC())
+	}
+
+	paste.ReadCloser = &chunkReader{ctx: ctx, s: s, urls: urls, opts: chunkOpts, size: m.Size}
+	paste.size = m.Size
+	return paste, nil
+}
+
+// chunkReader reads the chunks of a chunked paste one after another. Chunks
+// are fetched lazily, with the context of the Read. The content must add up
+// to the size in the manifest, so missing or extra chunks are detected.
+type chunkReader struct {
+	ctx     context.Context
+	s       *Service
+	urls    []string
+	opts    []ReadOption
+	index   int
+	current *Paste
+	size    int64
+	read    int64
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	n, err := r.readChunks(p)
+	r.read += int64(n)
+	switch {
+	case r.read > r.size:
+		return n, fmt.Errorf("%w: chunks are larger than the %d bytes in the manifest", ErrInvalidContent, r.size)
+	case err == io.EOF && r.read != r.size:
+		return n, fmt.Errorf("%w: chunks add up to %d bytes, the manifest says %d", ErrInvalidContent, r.read, r.size)
+	}
+
+	return n, err
+}
+
+func (r *chunkReader) readChunks(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.urls) == 0 {
+				return 0, io.EOF
+			}
+
+			chunk, err := r.s.read(r.ctx, r.urls[0], r.opts...)
+			if err != nil {
+				return 0, fmt.Errorf("failed to read chunk %d: %w", r.index+1, err)
+			}
+			r.current = chunk
+			r.urls = r.urls[1:]
+			r.index++
+		}
+
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			_ = r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+
+	return r.current.Close()
+}
@@ -0,0 +1,851 @@
+package pastila
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpBackend stores pastes in ClickHouse through its HTTP interface, using
+// the connection settings of the Service.
+type httpBackend struct {
+	s *Service
+}
+
+// Select implements Backend.
+func (b *httpBackend) Select(ctx context.Context, ref Ref) (*Row, error) {
+	row, content, err := b.SelectStream(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return nil, err
+	}
+	row.Content = string(data)
+
+	return row, nil
+}
+
+// SelectStream implements StreamBackend. The content is decoded as the
+// response is read.
+func (b *httpBackend) SelectStream(ctx context.Context, ref Ref) (*Row, io.ReadCloser, error) {
+	res, err := b.queryRows(ctx, b.withExpiry(b.selectQuery()), map[string]string{
+		"fingerprintHex": hex.EncodeToString(ref.Fingerprint),
+		"hashHex":        hex.EncodeToString(ref.Hash),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	body := bufio.NewReader(res.Body)
+	empty, err := emptyResult(res, body)
+	if err == nil && empty {
+		err = ErrNotFound
+	}
+	if err != nil {
+		_ = res.Body.Close()
+		return nil, nil, err
+	}
+
+	var row streamRow
+	var content io.Reader
+	if responseFormat(res) == formatRowBinary {
+		content, err = decodeBinaryRow(body, &row, b.s.ExpiryColumn)
+	} else {
+		content, err = decodeStreamRow(body, &row)
+	}
+	if err != nil {
+		_ = res.Body.Close()
+		return nil, nil, err
+	}
+
+	selected, err := row.toRow(ref, res.Header)
+	if err != nil {
+		_ = res.Body.Close()
+		return nil, nil, err
+	}
+	selected.Size = row.Size
+
+	return selected, readCloser{Reader: content, Closer: res.Body}, nil
+}
+
+// SelectMany implements BatchBackend. Users restricted like the one of the
+// public pastila service cannot read the table directly, or exceed their
+// result limits. The first refusal is remembered, and
+// ReadAll selects the rows one by one, through data_view for the default
+// table.
+func (b *httpBackend) SelectMany(ctx context.Context, refs []Ref) ([]*Row, error) {
+	if b.s.batchRestricted() {
+		return nil, fmt.Errorf("%w: the user cannot select many rows at once", errors.ErrUnsupported)
+	}
+
+	rows, err := b.selectMany(ctx, refs)
+	if isRestricted(err) {
+		b.s.batchUnsupported()
+		return nil, errRestricted(err)
+	}
+
+	return rows, err
+}
+
+// selectMany selects the rows referenced by refs with a single query.
+func (b *httpBackend) selectMany(ctx context.Context, refs []Ref) ([]*Row, error) {
+	fingerprints := make([]string, len(refs))
+	hashes := make([]string, len(refs))
+	for i, ref := range refs {
+		fingerprints[i] = "'" + hex.EncodeToString(ref.Fingerprint) + "'"
+		hashes[i] = "'" + hex.EncodeToString(ref.Hash) + "'"
+	}
+
+	res, err := b.queryRows(ctx, b.withExpiry(b.sql(selectManyQuery)), map[string]string{
+		"fingerprintHexes": "[" + strings.Join(fingerprints, ",") + "]",
+		"hashHexes":        "[" + strings.Join(hashes, ",") + "]",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	format := responseFormat(res)
+	body := bufio.NewReader(res.Body)
+	if empty, err := emptyResult(res, body); err != nil || empty {
+		return nil, err
+	}
+
+	var rows []*Row
+	for {
+		more, err := moreRows(body, format)
+		if err != nil {
+			return nil, err
+		}
+		if !more {
+			return rows, nil
+		}
+
+		var row selectManyRow
+		var content io.Reader
+		if format == formatRowBinary {
+			content, err = decodeBinaryManyRow(body, &row, b.s.ExpiryColumn)
+		} else {
+			content, err = decodeStreamRow(body, &row)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := io.ReadAll(content)
+		if err != nil {
+			return nil, err
+		}
+
+		fingerprint, err := decodePaddedHex(row.FingerprintHex, len(legacyFingerprint))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode fingerprint: %w", err)
+		}
+		hash, err := decodePaddedHex(row.HashHex, 16)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode hash: %w", err)
+		}
+
+		selected, err := row.toRow(Ref{Fingerprint: fingerprint, Hash: hash}, res.Header)
+		if err != nil {
+			return nil, err
+		}
+		selected.Content = string(data)
+		rows = append(rows, selected)
+	}
+}
+
+// Stat implements StatBackend. Users restricted to data_view select the
+// content instead, and get no insertion time.
+func (b *httpBackend) Stat(ctx context.Context, ref Ref) (*Row, error) {
+	row, err := b.stat(ctx, ref)
+	if !isRestricted(err) {
+		return row, err
+	}
+
+	row, err = b.Select(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	row.Size = int64(len(row.Content))
+	row.Content = ""
+
+	return row, nil
+}
+
+func (b *httpBackend) stat(ctx context.Context, ref Ref) (*Row, error) {
+	res, err := b.query(ctx, b.withExpiry(b.sql(statQuery)), ref)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var row statRow
+	if err := decodeRow(res, &row); err != nil {
+		return nil, err
+	}
+
+	return row.toRow(ref, res.Header)
+}
+
+// ListByFingerprint implements ListBackend.
+func (b *httpBackend) ListByFingerprint(ctx context.Context, fingerprint []byte, limit int) ([]*Row, error) {
+	res, err := b.do(ctx, b.sql(listQuery), nil, map[string]string{
+		"fingerprintHex": hex.EncodeToString(fingerprint),
+		"limit":          strconv.Itoa(limit),
+	})
+	if isRestricted(err) {
+		return nil, errRestricted(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body := bufio.NewReader(res.Body)
+	if empty, err := emptyResult(res, body); err != nil || empty {
+		return nil, err
+	}
+
+	var rows []*Row
+	decoder := json.NewDecoder(body)
+	for decoder.More() {
+		var row listRow
+		if err := decoder.Decode(&row); err != nil {
+			return nil, &DecodeError{Format: formatJSONEachRow, Err: streamErr(err)}
+		}
+
+		hash, err := decodePaddedHex(row.HashHex, 16)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode hash: %w", err)
+		}
+
+		listed, err := row.toRow(Ref{Fingerprint: fingerprint, Hash: hash}, res.Header)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, listed)
+	}
+
+	return rows, nil
+}
+
+// Next implements ChainBackend.
+func (b *httpBackend) Next(ctx context.Context, ref Ref) (*Row, error) {
+	res, err := b.query(ctx, b.sql(nextQuery), ref)
+	if isRestricted(err) {
+		return nil, errRestricted(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var row nextRow
+	if err := decodeRow(res, &row); err != nil {
+		return nil, err
+	}
+
+	fingerprint, err := decodePaddedHex(row.FingerprintHex, len(legacyFingerprint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode fingerprint: %w", err)
+	}
+	hash, err := decodePaddedHex(row.HashHex, 16)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode hash: %w", err)
+	}
+
+	return row.toRow(Ref{Fingerprint: fingerprint, Hash: hash}, res.Header)
+}
+
+// Usage implements UsageBackend.
+func (b *httpBackend) Usage(ctx context.Context) (*Usage, error) {
+	res, err := b.do(ctx, b.sql(usageQuery), nil, nil)
+	if isRestricted(err) {
+		return nil, errRestricted(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	usage := &Usage{}
+	body := bufio.NewReader(res.Body)
+	if empty, err := emptyResult(res, body); err != nil || empty {
+		return usage, err
+	}
+
+	decoder := json.NewDecoder(body)
+	for decoder.More() {
+		var row usageRow
+		if err := decoder.Decode(&row); err != nil {
+			return nil, &DecodeError{Format: formatJSONEachRow, Err: streamErr(err)}
+		}
+
+		day, err := time.Parse(time.DateOnly, row.Day)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode day: %w", err)
+		}
+		usage.Daily = append(usage.Daily, DailyUsage{
+			Day:             day,
+			Pastes:          row.Pastes,
+			EncryptedPastes: row.EncryptedPastes,
+			Bytes:           row.Bytes,
+		})
+		usage.Pastes += row.Pastes
+		usage.EncryptedPastes += row.EncryptedPastes
+		usage.Bytes += row.Bytes
+	}
+
+	return usage, nil
+}
+
+// Insert implements Backend. The row is streamed into the request body, so
+// the content is never held in memory as a whole.
+func (b *httpBackend) Insert(ctx context.Context, row *InsertRow) (*Row, error) {
+	query, writeRow := withFormat(b.sql(insertColumns(insertDataQuery, row))+b.insertSettings(), formatJSONEachRow), writeInsertRow
+	lean := b.s.leanWireFormat()
+	if lean {
+		query, writeRow = withFormat(b.sql(insertColumns(insertDataTSVQuery, row))+b.insertSettings(), formatTabSeparated), writeInsertRowTSV
+	}
+
+	body, bodyWriter := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		err := writeRow(bodyWriter, row)
+		_ = bodyWriter.CloseWithError(err)
+		written <- err
+	}()
+
+	res, err := b.do(ctx, query, body, nil)
+	_ = body.Close()
+	writeErr := <-written
+	if lean && isUnknownFormat(err) {
+		// The content has been consumed; only later writes can fall back.
+		b.s.wireFormatUnsupported()
+	}
+	if err != nil {
+		// A failing content stream makes the request fail too; report the
+		// cause.
+		if writeErr != nil && !errors.Is(writeErr, io.ErrClosedPipe) {
+			return nil, writeErr
+		}
+		return nil, err
+	}
+	_ = res.Body.Close()
+
+	if writeErr != nil {
+		return nil, writeErr
+	}
+
+	return &Row{
+		Ref:                 row.Ref(),
+		PreviousFingerprint: row.PreviousFingerprint,
+		PreviousHash:        row.PreviousHash,
+		Encrypted:           row.Encrypted,
+		QueryID:             res.Header.Get("X-ClickHouse-Query-Id"),
+		Stats:               parseSummary(res.Header.Get("X-ClickHouse-Summary")),
+	}, nil
+}
+
+// query executes a query for the row referenced by ref and returns the
+// response of a successful execution.
+func (b *httpBackend) query(ctx context.Context, query string, ref Ref) (*http.Response, error) {
+	return b.do(ctx, query, nil, map[string]string{
+		"fingerprintHex": hex.EncodeToString(ref.Fingerprint),
+		"hashHex":        hex.EncodeToString(ref.Hash),
+	})
+}
+
+// queryRows executes a query selecting rows with content, in RowBinary if
+// the Service uses WireFormatAuto, and JSONEachRow otherwise or if ClickHouse
+// does not support it. Responses are decoded in the format ClickHouse
+// reports, so a server or proxy answering in JSONEachRow regardless works
+// too.
+func (b *httpBackend) queryRows(ctx context.Context, query string, params map[string]string) (*http.Response, error) {
+	if !b.s.leanWireFormat() {
+		return b.do(ctx, withFormat(query, formatJSONEachRow), nil, params)
+	}
+
+	res, err := b.do(ctx, withFormat(query, formatRowBinary), nil, params)
+	if isUnknownFormat(err) {
+		b.s.wireFormatUnsupported()
+		return b.do(ctx, withFormat(query, formatJSONEachRow), nil, params)
+	}
+	if err == nil && res.Header.Get("X-ClickHouse-Format") != formatRowBinary {
+		b.s.wireFormatUnsupported()
+	}
+
+	return res, err
+}
+
+// do executes a query and returns the response of a successful execution.
+// Queries without a body are reads, which fail over to the next endpoint on
+// network errors. A body cannot be sent twice, so writes fail and move the
+// next attempt of the retry policy to the next endpoint.
+func (b *httpBackend) do(ctx context.Context, query string, body io.Reader, params map[string]string) (*http.Response, error) {
+	timeout := b.s.ReadTimeout
+	if body != nil {
+		timeout = b.s.WriteTimeout
+	}
+
+	var err error
+	for _, endpoint := range b.s.endpointOrder(body == nil) {
+		var res *http.Response
+		res, err = b.doTimeout(ctx, timeout, endpoint, query, body, params)
+		if err == nil {
+			return res, nil
+		}
+		if !errors.Is(err, ErrNetwork) {
+			break
+		}
+
+		b.s.endpointFailed(endpoint)
+		if body != nil {
+			break
+		}
+	}
+
+	return nil, err
+}
+
+// doTimeout executes a query at endpoint within timeout, if not zero. The
+// timeout runs until the response body is closed.
+func (b *httpBackend) doTimeout(
+	ctx context.Context, timeout time.Duration, endpoint, query string, body io.Reader, params map[string]string,
+) (*http.Response, error) {
+	setEndpointAttributes(ctx, endpoint)
+
+	requestCtx, cancel := ctx, context.CancelFunc(func() {})
+	if timeout > 0 {
+		requestCtx, cancel = context.WithTimeout(ctx, timeout)
+	}
+
+	req, err := b.s.clickHouseRequest(requestCtx, endpoint, query, body)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to create ClickHouse request: %w", err)
+	}
+
+	res, err := b.s.executeRequestWithParams(req, params)
+	if err != nil {
+		cancel()
+		if ctx.Err() == nil && requestCtx.Err() != nil {
+			err = fmt.Errorf("%w: %w", ErrTimeout, err)
+		}
+		return nil, fmt.Errorf("failed to execute ClickHouse request: %w", err)
+	}
+
+	res.Body = &cancelOnClose{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+// cancelOnClose cancels the context of a request when its response body is
+// closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// decodeRow decodes the single JSONEachRow row of res into v. An empty result
+// means there is no such paste.
+func decodeRow(res *http.Response, v any) error {
+	body := bufio.NewReader(res.Body)
+	empty, err := emptyResult(res, body)
+	if err != nil {
+		return err
+	}
+	if empty {
+		return ErrNotFound
+	}
+
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		return &DecodeError{Format: formatJSONEachRow, Err: streamErr(err)}
+	}
+
+	return nil
+}
+
+// emptyResult reports whether the result of the query behind res has no
+// rows. Only a body without a single byte is an empty result, and the row
+// count in the X-ClickHouse-Summary header must agree, so a response that is
+// cut short or garbled is reported as a DecodeError, never taken for a
+// missing paste.
+func emptyResult(res *http.Response, body *bufio.Reader) (bool, error) {
+	_, err := body.Peek(1)
+	if err == nil {
+		return false, nil
+	}
+	if err != io.EOF {
+		return false, &DecodeError{Format: responseFormat(res), Err: err}
+	}
+
+	if rows := parseSummary(res.Header.Get("X-ClickHouse-Summary")).ResultRows; rows > 0 {
+		return false, &DecodeError{
+			Format: responseFormat(res),
+			Err:    fmt.Errorf("empty response, but %d rows in the summary", rows),
+		}
+	}
+
+	return true, nil
+}
+
+// defaultTable is the table the pastila service stores pastes in.
+const defaultTable = "data"
+
+// selectDataQuery returns the previous pointers as hex of their little-endian
+// bytes, which is how they were written. reinterpretAsFixedString drops
+// trailing zero bytes, see selectRow.previous. The content comes last, so it
+// can be streamed, see decodeStreamRow and decodeBinaryRow. The FORMAT clause
+// is added by queryRows.
+const selectDataQuery = `
+SELECT
+	toBool(is_encrypted) as is_encrypted,
+	lower(hex(reinterpretAsFixedString(prev_fingerprint))) as prev_fingerprint_hex,
+	lower(hex(reinterpretAsFixedString(prev_hash))) as prev_hash_hex,
+	length(content) as size,
+	content
+FROM data_view(fingerprint = {fingerprintHex:String}, hash = {hashHex:String})`
+
+// selectTableQuery is selectDataQuery for tables other than the data table of
+// the pastila service, which data_view is defined for. It selects the first
+// insertion of the row like data_view does.
+const selectTableQuery = `
+SELECT
+	toBool(is_encrypted) as is_encrypted,
+	lower(hex(reinterpretAsFixedString(prev_fingerprint))) as prev_fingerprint_hex,
+	lower(hex(reinterpretAsFixedString(prev_hash))) as prev_hash_hex,
+	length(content) as size,
+	content
+FROM %s
+WHERE fingerprint = reinterpretAsUInt32(unhex({fingerprintHex:String}))
+AND hash = reinterpretAsUInt128(unhex({hashHex:String}))
+ORDER BY time LIMIT 1`
+
+// selectQuery returns the query selecting a row with its content.
+func (b *httpBackend) selectQuery() string {
+	if b.s.Database == "" && b.s.Table == "" {
+		return selectDataQuery
+	}
+
+	return b.sql(selectTableQuery)
+}
+
+// sql returns query with the name of the table pastes are stored in, which
+// queries refer to with a %s verb.
+func (b *httpBackend) sql(query string) string {
+	return fmt.Sprintf(query, TableIdentifier(b.s.Database, b.s.Table))
+}
+
+// TableIdentifier returns the quoted name of table in database, to use in
+// ClickHouse queries. An empty database is the default database of the
+// user, an empty table is the data table of the pastila service.
+func TableIdentifier(database, table string) string {
+	if table == "" {
+		table = defaultTable
+	}
+	if database != "" {
+		return quoteIdentifier(database) + "." + quoteIdentifier(table)
+	}
+
+	return quoteIdentifier(table)
+}
+
+// quoteIdentifier quotes name as a ClickHouse identifier.
+func quoteIdentifier(name string) string {
+	return "`" + strings.NewReplacer("\\", "\\\\", "`", "\\`").Replace(name) + "`"
+}
+
+const insertDataQuery = `
+INSERT INTO %s (hash_hex, fingerprint_hex, prev_hash_hex, prev_fingerprint_hex, is_encrypted, content)`
+
+// insertColumns adds the expires column to the columns of an insert query,
+// for rows that expire. The insert writers write it last.
+func insertColumns(query string, row *InsertRow) string {
+	if row.Expires.IsZero() {
+		return query
+	}
+
+	return strings.TrimSuffix(query, ")") + ", expires)"
+}
+
+// insertSettings returns the SETTINGS clause of inserts, if any.
+func (b *httpBackend) insertSettings() string {
+	if !b.s.AsyncInsert {
+		return ""
+	}
+
+	wait := 0
+	if b.s.AsyncInsertWait {
+		wait = 1
+	}
+	return fmt.Sprintf("\nSETTINGS async_insert = 1, wait_for_async_insert = %d", wait)
+}
+
+// insertDataTSVQuery lists the columns in the order writeInsertRowTSV writes
+// them: the hash depends on the whole content, so it comes last.
+const insertDataTSVQuery = `
+INSERT INTO %s (is_encrypted, prev_hash_hex, prev_fingerprint_hex, content, hash_hex, fingerprint_hex)`
+
+type selectRow struct {
+	Encrypted          bool   `json:"is_encrypted"`
+	Content            string `json:"content"`
+	PrevFingerprintHex string `json:"prev_fingerprint_hex"`
+	PrevHashHex        string `json:"prev_hash_hex"`
+
+	// ExpiresAt is selected only from tables with an expires column, see
+	// httpBackend.withExpiry.
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// streamRow is a selected row whose content is streamed.
+type streamRow struct {
+	selectRow
+	Size int64 `json:"size"`
+}
+
+// isRestricted reports whether err is the failure of a query reading the
+// table directly by a user restricted like the one of the public pastila
+// service: allowed to select from data_view only, with max_result_rows = 1
+// and force_primary_key = 1.
+func isRestricted(err error) bool {
+	var chErr *ClickHouseError
+	if !errors.As(err, &chErr) {
+		return false
+	}
+
+	switch chErr.Code {
+	case errCodeAccessDenied, errCodeTooManyRowsOrBytes, errCodeIndexNotUsed:
+		return true
+	default:
+		return false
+	}
+}
+
+// errRestricted wraps the failure of a query that has no data_view fallback.
+func errRestricted(err error) error {
+	return fmt.Errorf("%w: the user cannot read the table directly: %w", errors.ErrUnsupported, err)
+}
+
+// toRow converts the selected row of ref to a Row.
+func (r *selectRow) toRow(ref Ref, header http.Header) (*Row, error) {
+	previousFingerprint, previousHash, err := r.previous()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Row{
+		Ref:                 ref,
+		PreviousFingerprint: previousFingerprint,
+		PreviousHash:        previousHash,
+		Encrypted:           r.Encrypted,
+		Content:             r.Content,
+		Expires:             r.expires(),
+		QueryID:             header.Get("X-ClickHouse-Query-Id"),
+		Stats:               parseSummary(header.Get("X-ClickHouse-Summary")),
+	}, nil
+}
+
+// expires returns when the row expires, or zero if it does not.
+func (r *selectRow) expires() time.Time {
+	if r.ExpiresAt == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(r.ExpiresAt, 0)
+}
+
+// previous decodes the previous pointers of the row. Both are nil when the
+// paste has no previous version.
+func (r *selectRow) previous() (fingerprint, hash []byte, err error) {
+	if r.PrevHashHex == "" {
+		return nil, nil, nil
+	}
+
+	fingerprint, err = decodePaddedHex(r.PrevFingerprintHex, len(legacyFingerprint))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode previous fingerprint: %w", err)
+	}
+	hash, err = decodePaddedHex(r.PrevHashHex, 16)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode previous hash: %w", err)
+	}
+
+	return fingerprint, hash, nil
+}
+
+// decodePaddedHex decodes s and restores the trailing zero bytes dropped by
+// reinterpretAsFixedString up to size bytes.
+func decodePaddedHex(s string, size int) ([]byte, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > size {
+		return nil, fmt.Errorf("expected at most %d bytes, got %d", size, len(b))
+	}
+
+	return append(b, make([]byte, size-len(b))...), nil
+}
+
+// selectManyQuery selects the first insertion of every referenced row, like
+// data_view does for a single one. The columns following the reference are
+// those of selectDataQuery.
+const selectManyQuery = `
+SELECT
+	lower(hex(reinterpretAsFixedString(fingerprint))) as fingerprint_hex,
+	lower(hex(reinterpretAsFixedString(hash))) as hash_hex,
+	toBool(is_encrypted) as is_encrypted,
+	lower(hex(reinterpretAsFixedString(prev_fingerprint))) as prev_fingerprint_hex,
+	lower(hex(reinterpretAsFixedString(prev_hash))) as prev_hash_hex,
+	length(content) as size,
+	content
+FROM %s
+WHERE (fingerprint, hash) IN (
+	SELECT arrayJoin(arrayZip(
+		arrayMap(x -> reinterpretAsUInt32(unhex(x)), {fingerprintHexes:Array(String)}),
+		arrayMap(x -> reinterpretAsUInt128(unhex(x)), {hashHexes:Array(String)})
+	))
+)
+ORDER BY time LIMIT 1 BY fingerprint, hash`
+
+type selectManyRow struct {
+	streamRow
+	FingerprintHex string `json:"fingerprint_hex"`
+	HashHex        string `json:"hash_hex"`
+}
+
+// statQuery reads from the table directly, because the size and time columns
+// are materialized and thus not part of data_view.
+const statQuery = `
+SELECT
+	toBool(is_encrypted) as is_encrypted,
+	size,
+	toString(toUnixTimestamp64Milli(time)) as time_ms,
+	lower(hex(reinterpretAsFixedString(prev_fingerprint))) as prev_fingerprint_hex,
+	lower(hex(reinterpretAsFixedString(prev_hash))) as prev_hash_hex
+FROM %s
+WHERE fingerprint = reinterpretAsUInt32(unhex({fingerprintHex:String}))
+AND hash = reinterpretAsUInt128(unhex({hashHex:String}))
+ORDER BY time LIMIT 1
+FORMAT JSONEachRow`
+
+type statRow struct {
+	selectRow
+	Size       int64  `json:"size"`
+	TimeMillis string `json:"time_ms"`
+}
+
+// toRow converts the stat row of ref to a Row.
+func (r *statRow) toRow(ref Ref, header http.Header) (*Row, error) {
+	row, err := r.selectRow.toRow(ref, header)
+	if err != nil {
+		return nil, err
+	}
+
+	row.Size = r.Size
+	millis, err := strconv.ParseInt(r.TimeMillis, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode insertion time: %w", err)
+	}
+	row.Time = time.UnixMilli(millis)
+
+	return row, nil
+}
+
+// listQuery selects the first insertion of the newest rows with a
+// fingerprint, with the columns of statQuery. Like statQuery, it reads from
+// the table directly.
+const listQuery = `
+SELECT hash_hex, is_encrypted, size, time_ms, prev_fingerprint_hex, prev_hash_hex
+FROM (
+	SELECT
+		lower(hex(reinterpretAsFixedString(hash))) as hash_hex,
+		toBool(is_encrypted) as is_encrypted,
+		size,
+		time,
+		toString(toUnixTimestamp64Milli(time)) as time_ms,
+		lower(hex(reinterpretAsFixedString(prev_fingerprint))) as prev_fingerprint_hex,
+		lower(hex(reinterpretAsFixedString(prev_hash))) as prev_hash_hex
+	FROM %s
+	WHERE fingerprint = reinterpretAsUInt32(unhex({fingerprintHex:String}))
+	ORDER BY time LIMIT 1 BY hash
+)
+ORDER BY time DESC LIMIT {limit:UInt32}
+FORMAT JSONEachRow`
+
+type listRow struct {
+	statRow
+	HashHex string `json:"hash_hex"`
+}
+
+// nextQuery selects the first insertion of the newest row whose previous
+// pointers are the given reference, with the columns of listQuery. Previous
+// pointers are stored like the reference itself, see insertDataQuery.
+const nextQuery = `
+SELECT fingerprint_hex, hash_hex, is_encrypted, size, time_ms, prev_fingerprint_hex, prev_hash_hex
+FROM (
+	SELECT
+		lower(hex(reinterpretAsFixedString(fingerprint))) as fingerprint_hex,
+		lower(hex(reinterpretAsFixedString(hash))) as hash_hex,
+		toBool(is_encrypted) as is_encrypted,
+		size,
+		time,
+		toString(toUnixTimestamp64Milli(time)) as time_ms,
+		lower(hex(reinterpretAsFixedString(prev_fingerprint))) as prev_fingerprint_hex,
+		lower(hex(reinterpretAsFixedString(prev_hash))) as prev_hash_hex
+	FROM %s
+	WHERE prev_fingerprint = reinterpretAsUInt32(unhex({fingerprintHex:String}))
+	AND prev_hash = reinterpretAsUInt128(unhex({hashHex:String}))
+	ORDER BY time LIMIT 1 BY fingerprint, hash
+)
+ORDER BY time DESC LIMIT 1
+FORMAT JSONEachRow`
+
+type nextRow struct {
+	listRow
+	FingerprintHex string `json:"fingerprint_hex"`
+}
+
+// usageQuery sums up the first insertions of the rows by day. Rows written
+// again have the same content, so any of their insertions has the size of
+// the first one.
+const usageQuery = `
+SELECT
+	toString(toDate(first_time, 'UTC')) as day,
+	toString(count()) as pastes,
+	toString(countIf(first_is_encrypted != 0)) as encrypted_pastes,
+	toString(sum(first_size)) as bytes
+FROM (
+	SELECT min(time) as first_time, any(is_encrypted) as first_is_encrypted, any(size) as first_size
+	FROM %s
+	GROUP BY fingerprint, hash
+)
+GROUP BY day
+ORDER BY day
+FORMAT JSONEachRow`
+
+type usageRow struct {
+	Day             string `json:"day"`
+	Pastes          int64  `json:"pastes,string"`
+	EncryptedPastes int64  `json:"encrypted_pastes,string"`
+	Bytes           int64  `json:"bytes,string"`
+}
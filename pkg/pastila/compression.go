@@ -0,0 +1,103 @@
+package pastila
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is an algorithm used to compress content before it is
+// encrypted and stored.
+type Compression byte
+
+const (
+	NoCompression Compression = iota
+	Zstd
+)
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case Zstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("Compression(%d)", byte(c))
+	}
+}
+
+// compressor wraps w so that everything written to it is compressed. The
+// returned writer must be closed to flush the compressed stream.
+func (c Compression) compressor(w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case Zstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("%w: unsupported compression %s", ErrInvalidContent, c)
+	}
+}
+
+// zstdMaxWindow is the largest window decompressed content may use, the one
+// compressor uses, so that hostile pastes cannot make Read allocate
+// gigabytes. The size of the decompressed content is limited by
+// Service.MaxSize.
+const zstdMaxWindow = 8 << 20
+
+// decompressor wraps r so that reading from it returns decompressed content.
+func (c Compression) decompressor(r io.Reader) (io.ReadCloser, error) {
+	switch c {
+	case Zstd:
+		d, err := zstd.NewReader(r,
+			zstd.WithDecoderMaxWindow(zstdMaxWindow),
+			zstd.WithDecoderConcurrency(1),
+		)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported compression %s", ErrInvalidContent, c)
+	}
+}
+
+// gzipRequestBody returns a reader of body compressed with gzip. Closing it
+// stops the compression and closes body.
+func gzipRequestBody(body io.ReadCloser) io.ReadCloser {
+	compressed, w := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(w)
+		_, err := io.Copy(zw, body)
+		if closeErr := zw.Close(); err == nil {
+			err = closeErr
+		}
+		_ = body.Close()
+		_ = w.CloseWithError(err)
+	}()
+
+	return compressed
+}
+
+// gzipResponseBody decompresses a gzip encoded response body. The gzip
+// header is read lazily, as an empty body carries none.
+type gzipResponseBody struct {
+	body io.ReadCloser
+	zr   *gzip.Reader
+}
+
+func (b *gzipResponseBody) Read(p []byte) (int, error) {
+	if b.zr == nil {
+		zr, err := gzip.NewReader(b.body)
+		if err != nil {
+			return 0, err
+		}
+		b.zr = zr
+	}
+
+	return b.zr.Read(p)
+}
+
+func (b *gzipResponseBody) Close() error {
+	return b.body.Close()
+}
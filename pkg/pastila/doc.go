@@ -0,0 +1,23 @@
+// Package pastila reads and writes pastes of pastila.nl, a copy-paste
+// service storing its pastes in ClickHouse, and of self-hosted deployments of
+// it.
+//
+// # Compatibility with the web client
+//
+// Pastes written with the default options are stored the way the pastila web
+// client stores them, and both can read each other's pastes. The following
+// write options store parameters the web client does not know about in an
+// envelope header in front of the content, so the pastes they write can only
+// be read with this package, e.g. by the pastila CLI:
+//
+//   - WithRandomIV
+//   - WithPassphrase
+//   - WithCompression
+//   - WithContentType
+//   - WithMAC, for encrypted content
+//   - WithAgeRecipients
+//   - WithChunkSize, for content larger than a chunk
+//
+// The other options, such as WithFingerprint or WithPreviousPaste, keep pastes
+// readable by the web client.
+package pastila
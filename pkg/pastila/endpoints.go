@@ -0,0 +1,54 @@
+package pastila
+
+import (
+	"sync/atomic"
+)
+
+// endpointState tracks which of the Endpoints of a Service requests go to.
+type endpointState struct {
+	// preferred is the index of the endpoint that writes, and reads unless
+	// they are load balanced, go to first. It moves on when that endpoint
+	// fails.
+	preferred atomic.Int64
+
+	// next counts load balanced reads.
+	next atomic.Uint64
+}
+
+// endpointOrder returns the ClickHouse URLs to try a request with, in order.
+func (s *Service) endpointOrder(read bool) []string {
+	if len(s.Endpoints) == 0 {
+		if s.ClickHouseURL == "" {
+			return []string{DefaultClickHouseURL}
+		}
+		return []string{s.ClickHouseURL}
+	}
+
+	var start int
+	if state := s.endpointState; state != nil {
+		if read && s.LoadBalanceReads {
+			start = int(state.next.Add(1) % uint64(len(s.Endpoints)))
+		} else {
+			start = int(state.preferred.Load())
+		}
+	}
+
+	order := make([]string, 0, len(s.Endpoints))
+	order = append(order, s.Endpoints[start:]...)
+	return append(order, s.Endpoints[:start]...)
+}
+
+// endpointFailed makes requests prefer the endpoint after the failed one.
+func (s *Service) endpointFailed(endpoint string) {
+	state := s.endpointState
+	if state == nil {
+		return
+	}
+
+	for i, e := range s.Endpoints {
+		if e == endpoint {
+			state.preferred.CompareAndSwap(int64(i), int64((i+1)%len(s.Endpoints)))
+			return
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package pastila
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// envelopeMagic prefixes content that carries an envelope header. Such
+// content is always stored base64 encoded, even if it is not encrypted, and
+// then reads "PSTL", which makes it easy to spot in storage. Content written
+// by the pastila web client has no header.
+var envelopeMagic = []byte{0x3d, 0x24, 0xcb}
+
+// envelopeMagicBase64 is envelopeMagic as stored.
+const envelopeMagicBase64 = "PSTL"
+
+const envelopeVersion = 1
+
+// Envelope header fields. Each field is a tag byte followed by a uvarint
+// length and the value. The header ends with envelopeFieldEnd.
+const (
+	envelopeFieldEnd byte = iota
+	envelopeFieldIV
+	envelopeFieldKDF
+	envelopeFieldCompression
+	envelopeFieldManifest
+	envelopeFieldContentType
+	envelopeFieldMAC
+	envelopeFieldAge
+)
+
+// maxContentTypeSize bounds the size of the content type of a paste.
+const maxContentTypeSize = 255
+
+// envelope holds the parameters needed to decrypt content written with
+// options the pastila web client does not know about.
+type envelope struct {
+	// iv is the initialization vector of the AES-CTR stream. A nil iv means
+	// all zeros, as used by the web client.
+	iv []byte
+
+	// kdf is set when the key is derived from a passphrase.
+	kdf *kdfField
+
+	// compression is applied to the plaintext before encryption.
+	compression Compression
+
+	// manifest is set when the content is a manifest of a chunked paste.
+	manifest bool
+
+	// contentType is set when the payload starts with the content type of
+	// the paste, so it is encrypted along with the content.
+	contentType bool
+
+	// mac is set when the ciphertext is followed by its HMAC-SHA256 tag.
+	mac bool
+
+	// age is set when the payload is encrypted with age to the public keys
+	// of its recipients, instead of with AES-CTR.
+	age bool
+}
+
+// isZero reports whether e carries no parameters, in which case content is
+// written without a header for compatibility with the web client.
+func (e *envelope) isZero() bool {
+	return e.iv == nil && e.kdf == nil && e.compression == NoCompression && !e.manifest && !e.contentType && !e.mac && !e.age
+}
+
+func (e *envelope) marshal() []byte {
+	var buf bytes.Buffer
+	buf.Write(envelopeMagic)
+	buf.WriteByte(envelopeVersion)
+
+	writeField := func(tag byte, value []byte) {
+		buf.WriteByte(tag)
+		buf.Write(binary.AppendUvarint(nil, uint64(len(value))))
+		buf.Write(value)
+	}
+
+	if e.iv != nil {
+		writeField(envelopeFieldIV, e.iv)
+	}
+	if e.kdf != nil {
+		writeField(envelopeFieldKDF, e.kdf.marshal())
+	}
+	if e.compression != NoCompression {
+		writeField(envelopeFieldCompression, []byte{byte(e.compression)})
+	}
+	if e.manifest {
+		writeField(envelopeFieldManifest, nil)
+	}
+	if e.contentType {
+		writeField(envelopeFieldContentType, nil)
+	}
+	if e.mac {
+		writeField(envelopeFieldMAC, nil)
+	}
+	if e.age {
+		writeField(envelopeFieldAge, nil)
+	}
+
+	buf.WriteByte(envelopeFieldEnd)
+	return buf.Bytes()
+}
+
+// openEnvelope splits data into its envelope header and the payload. Data
+// without a header yields an empty envelope and is returned as is.
+func openEnvelope(data []byte) (*envelope, []byte, error) {
+	e := &envelope{}
+	if !bytes.HasPrefix(data, envelopeMagic) {
+		return e, data, nil
+	}
+
+	rest := data[len(envelopeMagic):]
+	if len(rest) == 0 || rest[0] != envelopeVersion {
+		return nil, nil, fmt.Errorf("%w: unsupported envelope version", ErrInvalidContent)
+	}
+	rest = rest[1:]
+
+	for {
+		if len(rest) == 0 {
+			return nil, nil, fmt.Errorf("%w: truncated envelope header", ErrInvalidContent)
+		}
+
+		tag := rest[0]
+		rest = rest[1:]
+		if tag == envelopeFieldEnd {
+			return e, rest, nil
+		}
+
+		size, n := binary.Uvarint(rest)
+		if n <= 0 || size > uint64(len(rest)-n) {
+			return nil, nil, fmt.Errorf("%w: truncated envelope header", ErrInvalidContent)
+		}
+		value := rest[n : n+int(size)]
+		rest = rest[n+int(size):]
+
+		switch tag {
+		case envelopeFieldIV:
+			if len(value) != aes.BlockSize {
+				return nil, nil, fmt.Errorf("%w: invalid IV length %d", ErrInvalidContent, len(value))
+			}
+			e.iv = value
+		case envelopeFieldKDF:
+			kdf, err := parseKDFField(value)
+			if err != nil {
+				return nil, nil, err
+			}
+			e.kdf = kdf
+		case envelopeFieldCompression:
+			if len(value) != 1 || Compression(value[0]) != Zstd {
+				return nil, nil, fmt.Errorf("%w: unsupported compression", ErrInvalidContent)
+			}
+			e.compression = Compression(value[0])
+		case envelopeFieldManifest:
+			e.manifest = true
+		case envelopeFieldContentType:
+			e.contentType = true
+		case envelopeFieldMAC:
+			e.mac = true
+		case envelopeFieldAge:
+			e.age = true
+		default:
+			return nil, nil, fmt.Errorf("%w: unknown envelope field %d", ErrInvalidContent, tag)
+		}
+	}
+}
+
+// maxEnvelopeHeaderSize bounds the size of envelope headers read from
+// streams. Headers written by this package are much smaller.
+const maxEnvelopeHeaderSize = 512
+
+// readEnvelope reads the envelope header, if any, off r. It returns the raw
+// header along with the envelope, which is empty for data without a header.
+func readEnvelope(r *bufio.Reader) (*envelope, []byte, error) {
+	head, err := r.Peek(maxEnvelopeHeaderSize)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+
+	// The peeked bytes are overwritten by later reads.
+	head = bytes.Clone(head)
+	env, payload, err := openEnvelope(head)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := head[:len(head)-len(payload)]
+	if _, err := r.Discard(len(header)); err != nil {
+		return nil, nil, err
+	}
+
+	return env, header, nil
+}
+
+// readPlainEnvelope reads the envelope header off unencrypted content and
+// returns the envelope and a reader of the payload. It reports false, and
+// leaves r unread, for content without a valid envelope, which is then plain
+// text that merely happens to start with envelopeMagicBase64.
+func readPlainEnvelope(r *bufio.Reader) (*envelope, *bufio.Reader, bool) {
+	head, _ := r.Peek(base64.StdEncoding.EncodedLen(maxEnvelopeHeaderSize))
+	if !bytes.HasPrefix(head, []byte(envelopeMagicBase64)) {
+		return nil, nil, false
+	}
+
+	data, err := base64.StdEncoding.DecodeString(string(head[:len(head)-len(head)%4]))
+	if err != nil {
+		return nil, nil, false
+	}
+
+	env, _, err := openEnvelope(data)
+	if err != nil || (env.compression == NoCompression && !env.manifest && !env.contentType) {
+		return nil, nil, false
+	}
+
+	payload := bufio.NewReader(newBase64Decoder(r, ErrInvalidContent))
+	if _, _, err := readEnvelope(payload); err != nil {
+		return nil, nil, false
+	}
+
+	return env, payload, true
+}
+
+// appendContentType appends the payload prefix carrying contentType.
+func appendContentType(b []byte, contentType string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(contentType)))
+	return append(b, contentType...)
+}
+
+// readContentType reads the content type prefix off payload, if env says it
+// carries one.
+func readContentType(env *envelope, payload *bufio.Reader) (string, error) {
+	if !env.contentType {
+		return "", nil
+	}
+
+	size, err := binary.ReadUvarint(payload)
+	if err == nil && size > maxContentTypeSize {
+		return "", fmt.Errorf("%w: content type longer than %d bytes", ErrInvalidContent, maxContentTypeSize)
+	}
+
+	var contentType []byte
+	if err == nil {
+		contentType = make([]byte, size)
+		_, err = io.ReadFull(payload, contentType)
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return "", fmt.Errorf("%w: truncated content type", ErrInvalidContent)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return string(contentType), nil
+}
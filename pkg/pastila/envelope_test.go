@@ -0,0 +1,208 @@
+package pastila
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	env := &envelope{iv: bytes.Repeat([]byte{0x42}, 16)}
+	data := append(env.marshal(), "ciphertext"...)
+
+	opened, payload, err := openEnvelope(data)
+	require.NoError(t, err)
+	assert.Equal(t, env, opened)
+	assert.Equal(t, "ciphertext", string(payload))
+}
+
+func TestEnvelopeLegacyContent(t *testing.T) {
+	opened, payload, err := openEnvelope([]byte("ciphertext"))
+	require.NoError(t, err)
+	assert.True(t, opened.isZero())
+	assert.Equal(t, "ciphertext", string(payload))
+}
+
+func TestEnvelopeTruncated(t *testing.T) {
+	data := (&envelope{iv: bytes.Repeat([]byte{0x42}, 16)}).marshal()
+
+	_, _, err := openEnvelope(data[:len(data)-5])
+	assert.ErrorIs(t, err, ErrInvalidContent)
+}
+
+func TestEnvelopeKDFRoundTrip(t *testing.T) {
+	env := &envelope{kdf: &kdfField{params: DefaultKDFParams, salt: bytes.Repeat([]byte{0x42}, kdfSaltSize)}}
+
+	opened, _, err := openEnvelope(env.marshal())
+	require.NoError(t, err)
+	assert.Equal(t, env, opened)
+}
+
+func TestEnvelopeKDFExcessiveMemory(t *testing.T) {
+	params := DefaultKDFParams
+	params.Memory = kdfMaxMemory + 1
+	env := &envelope{kdf: &kdfField{params: params, salt: bytes.Repeat([]byte{0x42}, kdfSaltSize)}}
+
+	_, _, err := openEnvelope(env.marshal())
+	assert.ErrorIs(t, err, ErrInvalidContent)
+	assert.ErrorIs(t, err, ErrInvalidKDFParams)
+}
+
+func TestReadHostileKDFParams(t *testing.T) {
+	backend := newMemoryBackend()
+	service := &Service{Backend: backend}
+
+	for name, params := range map[string]KDFParams{
+		"time":    {Time: math.MaxUint32, Memory: 64, Threads: 1},
+		"memory":  {Time: 1, Memory: kdfMaxMemory + 1, Threads: 1},
+		"threads": {Time: 1, Memory: 64 * 1024, Threads: math.MaxUint8},
+	} {
+		t.Run(name, func(t *testing.T) {
+			env := &envelope{kdf: &kdfField{params: params, salt: bytes.Repeat([]byte{0x42}, kdfSaltSize)}}
+			ref := Ref{Fingerprint: legacyFingerprint, Hash: bytes.Repeat([]byte(name[:1]), 16)}
+			backend.rows[backend.key(ref)] = &Row{
+				Ref:       ref,
+				Encrypted: true,
+				Content:   base64.StdEncoding.EncodeToString(append(env.marshal(), "ciphertext"...)),
+			}
+
+			// Deriving a key with these parameters would not return in time.
+			done := make(chan error, 1)
+			go func() {
+				_, err := service.Read(PasteRef{Ref: ref}.String(), WithReadPassphrase("secret"))
+				done <- err
+			}()
+
+			select {
+			case err := <-done:
+				assert.ErrorIs(t, err, ErrInvalidContent)
+				assert.ErrorIs(t, err, ErrInvalidKDFParams)
+			case <-time.After(10 * time.Second):
+				t.Fatal("key derivation ran with hostile parameters")
+			}
+		})
+	}
+}
+
+func TestOpenPlainEnvelope(t *testing.T) {
+	content := strings.Repeat("Hello ClickHouse! ", 100)
+
+	var buf bytes.Buffer
+	_, err := encodeContent(&buf, strings.NewReader(content), nil, &envelope{compression: Zstd}, &writeOptions{})
+	require.NoError(t, err)
+	assert.Less(t, buf.Len(), len(content))
+
+	env, payload, ok := readPlainEnvelope(bufio.NewReader(&buf))
+	require.True(t, ok)
+
+	r, err := env.compression.decompressor(payload)
+	require.NoError(t, err)
+	actualContent, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, content, string(actualContent))
+}
+
+func TestDecompressorLimits(t *testing.T) {
+	content := make([]byte, 3*zstdMaxWindow)
+	for i := range content {
+		content[i] = byte(i * i >> 8)
+	}
+
+	compress := func(opts ...zstd.EOption) *bytes.Buffer {
+		var buf bytes.Buffer
+		zw, err := zstd.NewWriter(&buf, opts...)
+		require.NoError(t, err)
+		_, err = zw.Write(content)
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+		return &buf
+	}
+
+	r, err := Zstd.decompressor(compress())
+	require.NoError(t, err)
+	actual, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, content, actual)
+
+	r, err = Zstd.decompressor(compress(zstd.WithWindowSize(4 * zstdMaxWindow)))
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, zstd.ErrWindowSizeExceeded)
+
+	// Frames of a single segment use a window of the size of the content.
+	zw, err := zstd.NewWriter(nil, zstd.WithWindowSize(4*zstdMaxWindow))
+	require.NoError(t, err)
+	r, err = Zstd.decompressor(bytes.NewReader(zw.EncodeAll(content, nil)))
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, zstd.ErrDecoderSizeExceeded)
+}
+
+func TestOpenPlainEnvelopeLookalike(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PSTL is not an envelope"))
+	_, _, ok := readPlainEnvelope(r)
+	assert.False(t, ok)
+
+	content, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "PSTL is not an envelope", string(content))
+}
+
+// FuzzOpenEnvelope checks that envelope headers of untrusted content never
+// make openEnvelope panic.
+func FuzzOpenEnvelope(f *testing.F) {
+	f.Add((&envelope{iv: bytes.Repeat([]byte{0x42}, 16)}).marshal())
+	f.Add((&envelope{compression: Zstd, contentType: true}).marshal())
+	f.Add((&envelope{kdf: &kdfField{params: DefaultKDFParams, salt: make([]byte, kdfSaltSize)}}).marshal())
+	f.Add([]byte("ciphertext"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		env, payload, err := openEnvelope(data)
+		if err == nil {
+			assert.NotNil(t, env)
+			assert.LessOrEqual(t, len(payload), len(data))
+		}
+	})
+}
+
+// FuzzReadEncrypted checks that decrypting rows with untrusted content and
+// keys from untrusted URLs fails with an error rather than a panic.
+func FuzzReadEncrypted(f *testing.F) {
+	backend := newMemoryBackend()
+	service := &Service{Backend: backend}
+
+	for _, opts := range [][]WriteOption{
+		nil,
+		{WithRandomIV()},
+		{WithCompression(Zstd), WithContentType("text/plain")},
+		{WithMAC()},
+	} {
+		paste, err := service.Write(bytes.NewReader([]byte("Hello ClickHouse!")), opts...)
+		require.NoError(f, err)
+		f.Add(backend.rows[backend.key(Ref{Fingerprint: paste.Fingerprint, Hash: paste.Hash})].Content, paste.Key)
+	}
+	f.Add("", []byte{})
+	f.Add("not base64", make([]byte, 16))
+
+	f.Fuzz(func(t *testing.T, content string, key []byte) {
+		ref := Ref{Fingerprint: legacyFingerprint, Hash: bytes.Repeat([]byte{0x42}, 16)}
+		fuzzBackend := newMemoryBackend()
+		fuzzBackend.rows[fuzzBackend.key(ref)] = &Row{Ref: ref, Encrypted: true, Content: content}
+
+		paste, err := (&Service{Backend: fuzzBackend}).Read(PasteRef{Ref: ref}.String(), WithReadKey(key))
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(io.Discard, io.LimitReader(paste, 1<<20))
+		_ = paste.Close()
+	})
+}
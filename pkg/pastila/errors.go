@@ -0,0 +1,170 @@
+package pastila
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrNetwork is returned when ClickHouse cannot be reached.
+	ErrNetwork = fmt.Errorf("network error")
+
+	// ErrTimeout is returned when a request to ClickHouse times out.
+	ErrTimeout = fmt.Errorf("request timed out")
+
+	// ErrReadOnly is returned when the ClickHouse user may not insert
+	// pastes, or change the settings of a query.
+	ErrReadOnly = fmt.Errorf("clickhouse user is read-only")
+
+	// ErrAccessDenied is returned when the ClickHouse user lacks a grant a
+	// query needs.
+	ErrAccessDenied = fmt.Errorf("clickhouse access denied")
+
+	// ErrQuotaExceeded is returned when the ClickHouse user has used up its
+	// quota.
+	ErrQuotaExceeded = fmt.Errorf("clickhouse quota exceeded")
+
+	// ErrLimitExceeded is returned when a query exceeds a limit ClickHouse
+	// puts on the user, such as max_query_size or max_result_bytes.
+	ErrLimitExceeded = fmt.Errorf("clickhouse limit exceeded")
+)
+
+// ClickHouse error codes that are handled specially.
+const (
+	errCodeSyntaxError                = 62
+	errCodeTimeoutExceeded            = 159
+	errCodeReadonly                   = 164
+	errCodeQuotaExceeded              = 201
+	errCodeTooManySimultaneousQueries = 202
+	errCodeIndexNotUsed               = 277
+	errCodeTooManyRowsOrBytes         = 396
+	errCodeAccessDenied               = 497
+)
+
+// clickHouseErrorRegex matches the exception text of ClickHouse, with the
+// optional name of the error and version of the server following it.
+var clickHouseErrorRegex = regexp.MustCompile(`(?s)^Code: (\d+)\. (?:DB::Exception: )?(.*?)` +
+	`(?: \(([A-Z_]+)\))?` +
+	`(?: \(version [^)]*\))?\.?\s*$`)
+
+// ClickHouseError is an error response of ClickHouse. Errors that users of
+// restricted accounts, such as those of the public pastila service or of
+// play.clickhouse.com, commonly run into are explained by Error instead of
+// the exception text, and match ErrReadOnly, ErrAccessDenied,
+// ErrQuotaExceeded or ErrLimitExceeded with errors.Is.
+type ClickHouseError struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+
+	// Code is the ClickHouse error code, or 0 if the response did not
+	// carry one.
+	Code int
+
+	// Name is the symbolic name of Code, e.g. UNKNOWN_TABLE, if known.
+	Name string
+
+	// Message is the error message without the code and version decoration.
+	Message string
+}
+
+func (e *ClickHouseError) Error() string {
+	if e.Code == 0 {
+		return fmt.Sprintf("unexpected status code: %d, response: %s", e.StatusCode, e.Message)
+	}
+
+	// The message names the grant or setting ClickHouse complained about,
+	// so it is kept next to the hint.
+	msg := fmt.Sprintf("clickhouse error %d: %s", e.Code, e.Message)
+	if e.Name != "" {
+		msg = fmt.Sprintf("clickhouse error %d (%s): %s", e.Code, e.Name, e.Message)
+	}
+	if hint, err := e.diagnose(); err != nil {
+		return fmt.Sprintf("%v: %s (%s)", err, hint, msg)
+	}
+	return msg
+}
+
+// DecodeError is returned when a response of ClickHouse cannot be decoded,
+// e.g. because it is truncated or not in the expected format. An empty result
+// is not a DecodeError, but ErrNotFound.
+type DecodeError struct {
+	// Format is the ClickHouse format of the response, e.g. RowBinary.
+	Format string
+
+	// Err is the cause.
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to decode ClickHouse %s response: %v", e.Format, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ClickHouseError) Unwrap() error {
+	_, err := e.diagnose()
+	return err
+}
+
+// diagnose returns a hint how to deal with a common failure mode of
+// restricted users, and its error, or a nil error.
+func (e *ClickHouseError) diagnose() (hint string, err error) {
+	switch {
+	case e.Code == errCodeReadonly:
+		return "it cannot write pastes, nor change settings, e.g. to compress responses; " +
+			"use a user allowed to insert into the data table", ErrReadOnly
+	case e.Code == errCodeAccessDenied:
+		return "the user lacks a grant the query needs, such as SELECT or INSERT on the data table", ErrAccessDenied
+	case e.Code == errCodeQuotaExceeded:
+		return "the user has used up its quota; try again once the quota interval is over", ErrQuotaExceeded
+	case e.Code == errCodeSyntaxError && strings.Contains(e.Message, "Max query size exceeded"):
+		return "the query is longer than max_query_size; read fewer pastes at once", ErrLimitExceeded
+	case e.Code == errCodeTooManyRowsOrBytes:
+		return "the paste is larger than max_result_bytes; write large content with WithChunkSize", ErrLimitExceeded
+	case e.Code == errCodeTimeoutExceeded:
+		return "the query ran longer than max_execution_time; try again when the server is less busy", ErrLimitExceeded
+	default:
+		return "", nil
+	}
+}
+
+// parseClickHouseError parses an error response body in the
+// "Code: NNN. DB::Exception: ..." format. The X-ClickHouse-Exception-Code
+// header value, if any, takes precedence over the code in the body.
+func parseClickHouseError(statusCode int, codeHeader, body string) *ClickHouseError {
+	e := &ClickHouseError{StatusCode: statusCode, Message: strings.TrimSpace(body)}
+
+	if m := clickHouseErrorRegex.FindStringSubmatch(e.Message); m != nil {
+		e.Code, _ = strconv.Atoi(m[1])
+		e.Message = m[2]
+		e.Name = m[3]
+	}
+
+	if code, err := strconv.Atoi(codeHeader); err == nil {
+		e.Code = code
+	}
+
+	return e
+}
+
+// wrapRequestError classifies an error of an HTTP round trip as ErrTimeout or
+// ErrNetwork. Context cancellation is returned as is.
+func wrapRequestError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return err
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+
+	return fmt.Errorf("%w: %w", ErrNetwork, err)
+}
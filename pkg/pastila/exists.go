@@ -0,0 +1,27 @@
+package pastila
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// Exists reports whether the paste referenced by url exists. Unlike Read, it
+// does not transfer the content unless the backend cannot avoid it. Expired
+// pastes do not exist.
+func (s *Service) Exists(ctx context.Context, url string) (bool, error) {
+	ref, err := ParseURL(strings.TrimSpace(url))
+	if err != nil {
+		return false, err
+	}
+
+	row, err := s.statRef(ctx, ref.Ref)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return checkExpiry(url, row) == nil, nil
+}
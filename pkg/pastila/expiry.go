@@ -0,0 +1,107 @@
+package pastila
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrExpired is returned for pastes whose expiry time has passed, which a
+// self-hosted ClickHouse deletes with a TTL, but only once it merges their
+// parts. Errors matching it are *ExpiredError.
+var ErrExpired = fmt.Errorf("paste expired")
+
+// ExpiredError is returned for a paste read after its expiry time.
+type ExpiredError struct {
+	URL string
+
+	// Expires is when the paste expired.
+	Expires time.Time
+}
+
+func (e *ExpiredError) Error() string {
+	return fmt.Sprintf("%v at %s: %s", ErrExpired, e.Expires.Format(time.RFC3339), e.URL)
+}
+
+func (e *ExpiredError) Unwrap() error {
+	return ErrExpired
+}
+
+// ExpiryBackend is implemented by backends that can store when pastes
+// expire. Write fails with errors.ErrUnsupported for WithExpiry unless the
+// backend implements it and reports support.
+type ExpiryBackend interface {
+	// SupportsExpiry reports whether Insert stores InsertRow.Expires, and
+	// rows are returned with Row.Expires.
+	SupportsExpiry() bool
+}
+
+// WithExpiryColumn makes the Service store and honor when pastes expire, in
+// the expires column of the table, for self-hosted schemas with one:
+//
+//	ALTER TABLE data
+//	    ADD COLUMN expires DateTime DEFAULT 0,
+//	    MODIFY TTL expires DELETE WHERE expires != 0
+//
+// Zero means the paste never expires. The data table of the public pastila
+// service has no such column.
+func WithExpiryColumn() ServiceOption {
+	return func(o *serviceOptions) {
+		o.service.ExpiryColumn = true
+	}
+}
+
+// WithExpiry makes the written paste expire after d, see WithExpiryColumn.
+// Reading it afterwards fails with ErrExpired until ClickHouse deletes it.
+// With WithDedup, an existing paste is returned with its own expiry.
+func WithExpiry(d time.Duration) WriteOption {
+	return func(o *writeOptions) {
+		o.expiry = d
+	}
+}
+
+// checkExpiry fails with an *ExpiredError if row, read from url, has expired.
+func checkExpiry(url string, row *Row) error {
+	if row.Expires.IsZero() || row.Expires.After(time.Now()) {
+		return nil
+	}
+
+	return &ExpiredError{URL: url, Expires: row.Expires}
+}
+
+// supportsExpiry reports whether the backend stores when pastes expire.
+func (s *Service) supportsExpiry() bool {
+	b, ok := s.backend().(ExpiryBackend)
+	return ok && b.SupportsExpiry()
+}
+
+// validateExpiry checks that a paste can be written to expire after d.
+func (s *Service) validateExpiry(d time.Duration) error {
+	switch {
+	case d == 0:
+		return nil
+	case d < 0:
+		return fmt.Errorf("invalid expiry %s", d)
+	case !s.supportsExpiry():
+		return fmt.Errorf("%w: backend does not store expiry, see WithExpiryColumn", errors.ErrUnsupported)
+	default:
+		return nil
+	}
+}
+
+// SupportsExpiry implements ExpiryBackend.
+func (b *httpBackend) SupportsExpiry() bool {
+	return b.s.ExpiryColumn
+}
+
+// withExpiry adds the expiry time, as Unix seconds, in front of the columns
+// selected by query if the table has an expires column. The content stays
+// last.
+func (b *httpBackend) withExpiry(query string) string {
+	if !b.s.ExpiryColumn {
+		return query
+	}
+
+	return strings.Replace(query, "SELECT\n", "SELECT\n\ttoUnixTimestamp(expires) as expires_at,\n", 1)
+}
@@ -0,0 +1,156 @@
+package pastila
+
+import (
+	"bytes"
+	"unicode"
+	"unicode/utf8"
+)
+
+// legacyFingerprint is the fingerprint of content without any word shingles.
+// It is also what earlier versions of this library wrote for every paste.
+var legacyFingerprint = []byte{0xff, 0xff, 0xff, 0xff}
+
+const (
+	fingerprintMinWord = 4
+	fingerprintMaxWord = 100
+)
+
+// fingerprinter computes the fingerprint of content the same way the pastila
+// web client does:
+//
+//	text.match(/\p{L}{4,100}/gu)
+//	  -> shingles of three consecutive words joined with ","
+//	  -> first four bytes of sipHash128 of each shingle
+//	  -> the smallest of them, or ffffffff
+//
+// Similar content thus shares a fingerprint. It is an io.Writer so the
+// fingerprint can be computed while content is streamed. Words are kept as
+// UTF-8 in buffers that are reused, so it does not allocate per word.
+type fingerprinter struct {
+	// partial holds an incomplete UTF-8 sequence from the previous write.
+	partial  [utf8.UTFMax]byte
+	npartial int
+
+	// word is the letter run being read, as UTF-8, and runes its length in
+	// letters.
+	word  []byte
+	runes int
+
+	// previous are the last two words, oldest first.
+	previous  [2][]byte
+	nprevious int
+
+	min [4]byte
+}
+
+func newFingerprinter() *fingerprinter {
+	f := &fingerprinter{}
+	copy(f.min[:], legacyFingerprint)
+	return f
+}
+
+func (f *fingerprinter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) > 0 {
+		if f.npartial > 0 {
+			// Complete the sequence of the previous write. Bytes of it that
+			// turn out to be invalid are decoded one by one.
+			c := copy(f.partial[f.npartial:], p)
+			seq := f.partial[:f.npartial+c]
+			if !utf8.FullRune(seq) {
+				f.npartial += c
+				break
+			}
+
+			r, size := utf8.DecodeRune(seq)
+			f.rune(r, seq[:size])
+			if size <= f.npartial {
+				f.npartial = copy(f.partial[:], f.partial[size:f.npartial])
+				continue
+			}
+
+			p = p[size-f.npartial:]
+			f.npartial = 0
+			continue
+		}
+
+		if !utf8.FullRune(p) {
+			f.npartial = copy(f.partial[:], p)
+			break
+		}
+
+		r, size := utf8.DecodeRune(p)
+		f.rune(r, p[:size])
+		p = p[size:]
+	}
+
+	return n, nil
+}
+
+// rune adds r, encoded as b, to the content.
+func (f *fingerprinter) rune(r rune, b []byte) {
+	if unicode.IsLetter(r) && r != utf8.RuneError {
+		f.word = append(f.word, b...)
+		f.runes++
+		if f.runes == fingerprintMaxWord {
+			f.endWord()
+		}
+		return
+	}
+
+	f.endWord()
+}
+
+// Sum returns the fingerprint of the content written so far.
+func (f *fingerprinter) Sum() []byte {
+	fingerprint := f.min
+	if f.runes >= fingerprintMinWord && f.nprevious == 2 {
+		sum := f.shingle(f.word)
+		if bytes.Compare(sum[:4], fingerprint[:]) < 0 {
+			copy(fingerprint[:], sum[:4])
+		}
+	}
+
+	return fingerprint[:]
+}
+
+func (f *fingerprinter) endWord() {
+	word := f.word
+	runes := f.runes
+	f.word = f.word[:0]
+	f.runes = 0
+	if runes < fingerprintMinWord {
+		return
+	}
+
+	if f.nprevious < 2 {
+		f.previous[f.nprevious] = word
+		f.nprevious++
+		f.word = nil
+		return
+	}
+
+	sum := f.shingle(word)
+	if bytes.Compare(sum[:4], f.min[:]) < 0 {
+		copy(f.min[:], sum[:4])
+	}
+
+	// The buffer of the oldest word is reused for the next one.
+	f.word = f.previous[0][:0]
+	f.previous[0], f.previous[1] = f.previous[1], word
+}
+
+// shingle returns the hash of the previous two words and word, joined with
+// ",".
+func (f *fingerprinter) shingle(word []byte) [16]byte {
+	comma := []byte{','}
+
+	h := newSipHash128()
+	_, _ = h.Write(f.previous[0])
+	_, _ = h.Write(comma)
+	_, _ = h.Write(f.previous[1])
+	_, _ = h.Write(comma)
+	_, _ = h.Write(word)
+	return h.Sum()
+}
@@ -0,0 +1,42 @@
+package pastila
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFingerprint(t *testing.T) {
+	cases := []struct {
+		content  string
+		expected string
+	}{
+		{"", "ffffffff"},
+		{"Hello ClickHouse!", "ffffffff"},
+		{"Hello ClickHouse! unencrypted :(", "c055a950"},
+		{"Hello, ClickHouse; a b c unencrypted", "c055a950"},
+	}
+
+	for _, c := range cases {
+		f := newFingerprinter()
+		_, _ = f.Write([]byte(c.content))
+		assert.Equal(t, c.expected, hex.EncodeToString(f.Sum()), c.content)
+	}
+}
+
+func TestFingerprintChunked(t *testing.T) {
+	content := strings.Repeat("zażółć gęślą jaźń, pastila ", 20) + strings.Repeat("x", 250)
+
+	whole := newFingerprinter()
+	_, _ = whole.Write([]byte(content))
+
+	chunked := newFingerprinter()
+	for i := 0; i < len(content); i += 3 {
+		_, _ = chunked.Write([]byte(content[i:min(i+3, len(content))]))
+	}
+
+	assert.Equal(t, whole.Sum(), chunked.Sum())
+	assert.NotEqual(t, legacyFingerprint, whole.Sum())
+}
@@ -0,0 +1,195 @@
+package pastila
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ChainBackend is implemented by backends that can look up the versions
+// written after a row. Latest requires it.
+type ChainBackend interface {
+	// Next returns the first insertion of the newest row whose previous
+	// pointers are ref, without Content, or ErrNotFound.
+	Next(ctx context.Context, ref Ref) (*Row, error)
+}
+
+// DefaultMaxVersions is the number of versions History reads unless
+// WithMaxVersions sets another.
+const DefaultMaxVersions = 100
+
+// WithMaxVersions makes History stop after the n newest versions. Zero means
+// DefaultMaxVersions.
+func WithMaxVersions(n int) ReadOption {
+	return func(o *readOptions) {
+		o.maxVersions = n
+	}
+}
+
+// History returns the versions of the paste referenced by url, newest first,
+// by following the previous pointers written by WithPreviousPaste, up to the
+// number of versions set by WithMaxVersions. Previous versions are read with
+// the key of url and the given options.
+//
+// The content of each version is read into memory, so no request stays open
+// and closing the returned pastes is optional. On error, History returns the
+// versions read before the failing one.
+func (s *Service) History(ctx context.Context, url string, opt ...ReadOption) ([]*Paste, error) {
+	opts := readOptions{}
+	for _, o := range opt {
+		o(&opts)
+	}
+	maxVersions := opts.maxVersions
+	if maxVersions <= 0 {
+		maxVersions = DefaultMaxVersions
+	}
+
+	var history []*Paste
+	seen := map[string]bool{}
+
+	for url != "" && len(history) < maxVersions {
+		paste, err := s.readVersion(ctx, url, opt...)
+		if err != nil {
+			return history, fmt.Errorf("failed to read version %d: %w", len(history)+1, err)
+		}
+		if len(history) > 0 {
+			paste.URL = s.pasteURL(paste.Fingerprint, paste.Hash, paste.Key)
+		}
+		history = append(history, paste)
+
+		// Rows are looked up by their first insertion, so a chain cannot
+		// normally loop. Guard against malformed data anyway.
+		seen[hex.EncodeToString(paste.Hash)] = true
+		if paste.PreviousHash == nil || seen[hex.EncodeToString(paste.PreviousHash)] {
+			break
+		}
+
+		// Previous versions are read by their bare reference, whatever
+		// shape the URLBuilder gives to URLs.
+		previous := PasteRef{Ref: Ref{Fingerprint: paste.PreviousFingerprint, Hash: paste.PreviousHash}, Key: paste.Key}
+		url = previous.String()
+	}
+
+	return history, nil
+}
+
+// readVersion reads the paste referenced by url, with its content, into
+// memory.
+func (s *Service) readVersion(ctx context.Context, url string, opt ...ReadOption) (*Paste, error) {
+	paste, err := s.ReadContext(ctx, url, opt...)
+	if err != nil {
+		return nil, err
+	}
+	body := paste.ReadCloser
+	defer body.Close()
+
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	paste.ReadCloser = io.NopCloser(bytes.NewReader(content))
+
+	return paste, nil
+}
+
+// Latest returns the newest version of the paste referenced by url, by
+// following the previous pointers written by WithPreviousPaste the other way
+// round, so an old URL of a document leads to its current content. Where
+// several versions were written from the same one, the newest of them is
+// followed. It returns the paste itself if it has no newer versions.
+//
+// The returned URL carries the key of url, which later versions keep unless
+// they were written with another one. It fails with errors.ErrUnsupported for
+// backends that do not implement ChainBackend, and for ClickHouse users that
+// may only select from data_view, like the one of the public pastila service.
+func (s *Service) Latest(ctx context.Context, url string) (*PasteInfo, error) {
+	url = strings.TrimSpace(url)
+
+	ref, err := ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	chainBackend, ok := s.backend().(ChainBackend)
+	if !ok {
+		return nil, fmt.Errorf("%w: backend cannot look up newer versions", errors.ErrUnsupported)
+	}
+
+	row, err := s.statRef(ctx, ref.Ref)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, url)
+		}
+		return nil, err
+	}
+
+	// As in History, guard against chains looping through malformed data.
+	seen := map[string]bool{}
+	newer := false
+	for {
+		seen[hex.EncodeToString(row.Hash)] = true
+
+		var next *Row
+		err := s.retry(ctx, func() (err error) {
+			next, err = chainBackend.Next(ctx, row.Ref)
+			return err
+		})
+		if errors.Is(err, ErrNotFound) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up version after %x/%x: %w", row.Fingerprint, row.Hash, err)
+		}
+		if seen[hex.EncodeToString(next.Hash)] {
+			break
+		}
+
+		row = next
+		newer = true
+	}
+
+	if !newer {
+		return newPasteInfo(url, row), nil
+	}
+	return newPasteInfo(s.pasteURL(row.Fingerprint, row.Hash, ref.Key), row), nil
+}
+
+// Next returns the version written directly after the paste referenced by
+// url, or ErrNotFound if there is none yet. Where several versions were
+// written from it, the newest of them is returned. Unlike Latest, it neither
+// requires the paste itself to exist nor follows the chain further, so a
+// writer appending versions can be followed one at a time.
+//
+// The returned URL carries the key of url, and it fails with
+// errors.ErrUnsupported like Latest.
+func (s *Service) Next(ctx context.Context, url string) (*PasteInfo, error) {
+	url = strings.TrimSpace(url)
+
+	ref, err := ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	chainBackend, ok := s.backend().(ChainBackend)
+	if !ok {
+		return nil, fmt.Errorf("%w: backend cannot look up newer versions", errors.ErrUnsupported)
+	}
+
+	var next *Row
+	err = s.retry(ctx, func() (err error) {
+		next, err = chainBackend.Next(ctx, ref.Ref)
+		return err
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("%w: no version after %s", ErrNotFound, url)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up version after %x/%x: %w", ref.Fingerprint, ref.Hash, err)
+	}
+
+	return newPasteInfo(s.pasteURL(next.Fingerprint, next.Hash, ref.Key), next), nil
+}
@@ -0,0 +1,95 @@
+package pastila
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// KDFParams are the Argon2id parameters used to derive a key from a
+// passphrase. They are stored with the paste, so reads derive the same key.
+// Pastes asking for more than 16 passes, 256 MiB of memory or 16 threads are
+// rejected before any key is derived.
+type KDFParams struct {
+	// Time is the number of passes over the memory.
+	Time uint32
+	// Memory is the size of the memory in KiB.
+	Memory uint32
+	// Threads is the degree of parallelism.
+	Threads uint8
+}
+
+// DefaultKDFParams follow the second recommended option of RFC 9106.
+var DefaultKDFParams = KDFParams{Time: 3, Memory: 64 * 1024, Threads: 4}
+
+const (
+	kdfSaltSize = 16
+	kdfKeySize  = 16
+
+	// The parameters are read from the stored paste, so whoever wrote it
+	// chooses them. They are capped to what a reader can afford: a few
+	// seconds of a few cores and 256 MiB of memory, in KiB.
+	kdfMaxTime    = 16
+	kdfMaxMemory  = 256 * 1024
+	kdfMaxThreads = 16
+)
+
+func (p KDFParams) validate() error {
+	if p.Time == 0 || p.Threads == 0 {
+		return fmt.Errorf("%w: time and threads must be positive", ErrInvalidKDFParams)
+	}
+	if p.Memory < 8*uint32(p.Threads) {
+		return fmt.Errorf("%w: memory must be at least 8 KiB per thread", ErrInvalidKDFParams)
+	}
+	if p.Time > kdfMaxTime {
+		return fmt.Errorf("%w: time exceeds %d passes", ErrInvalidKDFParams, kdfMaxTime)
+	}
+	if p.Memory > kdfMaxMemory {
+		return fmt.Errorf("%w: memory exceeds %d KiB", ErrInvalidKDFParams, kdfMaxMemory)
+	}
+	if p.Threads > kdfMaxThreads {
+		return fmt.Errorf("%w: threads exceed %d", ErrInvalidKDFParams, kdfMaxThreads)
+	}
+
+	return nil
+}
+
+func (p KDFParams) deriveKey(passphrase string, salt []byte) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, p.Time, p.Memory, p.Threads, kdfKeySize)
+}
+
+// kdfField is the envelope representation of the parameters and salt used to
+// derive a key: salt, time, memory and threads.
+type kdfField struct {
+	params KDFParams
+	salt   []byte
+}
+
+func (f *kdfField) marshal() []byte {
+	b := append([]byte{}, f.salt...)
+	b = binary.BigEndian.AppendUint32(b, f.params.Time)
+	b = binary.BigEndian.AppendUint32(b, f.params.Memory)
+	return append(b, f.params.Threads)
+}
+
+func parseKDFField(b []byte) (*kdfField, error) {
+	if len(b) != kdfSaltSize+9 {
+		return nil, fmt.Errorf("%w: invalid KDF field length %d", ErrInvalidContent, len(b))
+	}
+
+	f := &kdfField{
+		salt: b[:kdfSaltSize],
+		params: KDFParams{
+			Time:    binary.BigEndian.Uint32(b[kdfSaltSize:]),
+			Memory:  binary.BigEndian.Uint32(b[kdfSaltSize+4:]),
+			Threads: b[kdfSaltSize+8],
+		},
+	}
+
+	if err := f.params.validate(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidContent, err)
+	}
+
+	return f, nil
+}
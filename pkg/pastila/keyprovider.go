@@ -0,0 +1,19 @@
+package pastila
+
+import "context"
+
+// KeyProvider supplies keys of encrypted pastes read from URLs without a
+// key, for example from a key file, a keychain or a prompt.
+type KeyProvider interface {
+	// Key returns the key of the paste referenced by ref. Returning an
+	// empty key makes Read fail with ErrKeyRequired.
+	Key(ctx context.Context, ref Ref) ([]byte, error)
+}
+
+// KeyProviderFunc adapts a function to KeyProvider.
+type KeyProviderFunc func(ctx context.Context, ref Ref) ([]byte, error)
+
+// Key implements KeyProvider.
+func (f KeyProviderFunc) Key(ctx context.Context, ref Ref) ([]byte, error) {
+	return f(ctx, ref)
+}
@@ -0,0 +1,57 @@
+package pastila
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// maxListSize bounds the number of pastes returned by ListByFingerprint.
+// Unrelated pastes without word shingles share the legacy fingerprint, so
+// there may be a lot of them.
+const maxListSize = 1000
+
+// ListBackend is implemented by backends that can look rows up by their
+// fingerprint. ListByFingerprint requires it.
+type ListBackend interface {
+	// ListByFingerprint returns the first insertion of at most limit rows
+	// with fingerprint, newest first, without Content.
+	ListByFingerprint(ctx context.Context, fingerprint []byte, limit int) ([]*Row, error)
+}
+
+// ListByFingerprint returns the pastes with the given 4 byte fingerprint,
+// newest first. Pastes share a fingerprint when their content is similar, or
+// when they were written with the same WithFingerprint, e.g. to group the
+// versions of a document. At most the newest 1000 pastes are returned.
+//
+// The returned URLs carry no key: encrypted pastes are read with
+// WithReadKey or WithReadPassphrase. It fails with errors.ErrUnsupported for
+// backends that do not implement ListBackend, and for ClickHouse users that
+// may only select from data_view, like the one of the public pastila service.
+// The list is cut short for users with the limit setting.
+func (s *Service) ListByFingerprint(ctx context.Context, fingerprint []byte) ([]*PasteInfo, error) {
+	if len(fingerprint) != len(legacyFingerprint) {
+		return nil, fmt.Errorf("%w: must be %d bytes long", ErrInvalidFingerprint, len(legacyFingerprint))
+	}
+
+	listBackend, ok := s.backend().(ListBackend)
+	if !ok {
+		return nil, fmt.Errorf("%w: backend cannot list pastes by fingerprint", errors.ErrUnsupported)
+	}
+
+	var rows []*Row
+	err := s.retry(ctx, func() (err error) {
+		rows, err = listBackend.ListByFingerprint(ctx, fingerprint, maxListSize)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]*PasteInfo, len(rows))
+	for i, row := range rows {
+		infos[i] = newPasteInfo(s.pasteURL(row.Fingerprint, row.Hash, nil), row)
+	}
+
+	return infos, nil
+}
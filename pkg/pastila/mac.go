@@ -0,0 +1,71 @@
+package pastila
+
+import (
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+)
+
+// macSize is the size of the HMAC-SHA256 tag that ends authenticated
+// content.
+const macSize = sha256.Size
+
+// WithMAC makes Write authenticate encrypted content with HMAC-SHA256 over
+// the envelope header and the ciphertext, keyed by a key derived from the
+// encryption key. Read then fails with ErrAuthenticationFailed for content
+// that was corrupted or tampered with, instead of returning garbage.
+// Unencrypted content is not authenticated.
+func WithMAC() WriteOption {
+	return func(o *writeOptions) {
+		o.mac = true
+	}
+}
+
+// WithRequireMAC makes Read fail with ErrAuthenticationFailed for pastes
+// without a MAC, including unencrypted ones. Whether a paste has a MAC is
+// recorded in the paste itself, so without this option, whoever can write
+// pastes can store the ciphertext of an authenticated paste again without its
+// MAC and modify it unnoticed. Pastes encrypted to age recipients are
+// authenticated by age and accepted.
+func WithRequireMAC() ReadOption {
+	return func(o *readOptions) {
+		o.requireMAC = true
+	}
+}
+
+// deriveMACKey derives the MAC key from the encryption key, so the paste
+// key stays the only secret to share.
+func deriveMACKey(encryptionKey []byte) ([]byte, error) {
+	key, err := hkdf.Key(sha256.New, encryptionKey, nil, "pastila content mac", sha256.Size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive MAC key: %w", err)
+	}
+
+	return key, nil
+}
+
+func newMAC(macKey []byte) hash.Hash {
+	return hmac.New(sha256.New, macKey)
+}
+
+// verifyMAC checks the tag ending payload, the part of data following its
+// envelope header, and returns the ciphertext it authenticates.
+func verifyMAC(macKey, data, payload []byte) ([]byte, error) {
+	if len(payload) < macSize {
+		return nil, fmt.Errorf("%w: truncated MAC", ErrInvalidContent)
+	}
+
+	header := data[:len(data)-len(payload)]
+	ciphertext, tag := payload[:len(payload)-macSize], payload[len(payload)-macSize:]
+
+	mac := newMAC(macKey)
+	mac.Write(header)
+	mac.Write(ciphertext)
+	if !hmac.Equal(mac.Sum(nil), tag) {
+		return nil, ErrAuthenticationFailed
+	}
+
+	return ciphertext, nil
+}
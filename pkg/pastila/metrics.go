@@ -0,0 +1,125 @@
+package pastila
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	operationRead  = "read"
+	operationWrite = "write"
+)
+
+// Metrics are Prometheus metrics of the Reads and Writes of a Service. A
+// single Metrics can be shared by several Services.
+type Metrics struct {
+	operations *prometheus.CounterVec
+	bytes      *prometheus.CounterVec
+	errors     *prometheus.CounterVec
+	duration   *prometheus.HistogramVec
+}
+
+// NewMetrics creates the metrics and registers them with reg. Metrics already
+// registered, e.g. by another NewMetrics call, are reused.
+func NewMetrics(reg prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pastila_operations_total",
+			Help: "Number of paste reads and writes.",
+		}, []string{"operation"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pastila_content_bytes_total",
+			Help: "Bytes of stored content read and written.",
+		}, []string{"operation"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pastila_errors_total",
+			Help: "Number of failed paste reads and writes by error type.",
+		}, []string{"operation", "type"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "pastila_operation_duration_seconds",
+			Help:    "Latency of paste reads and writes.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"operation"}),
+	}
+
+	var err error
+	if m.operations, err = register(reg, m.operations); err != nil {
+		return nil, err
+	}
+	if m.bytes, err = register(reg, m.bytes); err != nil {
+		return nil, err
+	}
+	if m.errors, err = register(reg, m.errors); err != nil {
+		return nil, err
+	}
+	if m.duration, err = register(reg, m.duration); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func register[C prometheus.Collector](reg prometheus.Registerer, c C) (C, error) {
+	if err := reg.Register(c); err != nil {
+		var already prometheus.AlreadyRegisteredError
+		if errors.As(err, &already) {
+			if existing, ok := already.ExistingCollector.(C); ok {
+				return existing, nil
+			}
+		}
+
+		return c, err
+	}
+
+	return c, nil
+}
+
+// observe records an operation that started at start and resulted in paste
+// and err. It is a no-op on nil Metrics.
+func (m *Metrics) observe(operation string, start time.Time, paste *Paste, err error) {
+	if m == nil {
+		return
+	}
+
+	m.operations.WithLabelValues(operation).Inc()
+	m.duration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		m.errors.WithLabelValues(operation, errorType(err)).Inc()
+		return
+	}
+
+	m.bytes.WithLabelValues(operation).Add(float64(paste.size))
+}
+
+// errorType classifies err for the type label of pastila_errors_total.
+func errorType(err error) string {
+	var chErr *ClickHouseError
+	var decodeErr *DecodeError
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrTimeout):
+		return "timeout"
+	case errors.Is(err, ErrNotFound):
+		return "not_found"
+	case errors.Is(err, ErrNetwork):
+		return "network"
+	case errors.As(err, &chErr):
+		return "clickhouse"
+	case errors.As(err, &decodeErr):
+		return "decode"
+	case errors.Is(err, ErrInvalidURL), errors.Is(err, ErrInvalidKey), errors.Is(err, ErrKeyRequired),
+		errors.Is(err, ErrPassphraseRequired), errors.Is(err, ErrInvalidFingerprint),
+		errors.Is(err, ErrInvalidKDFParams), errors.Is(err, ErrInvalidContentType):
+		return "invalid_input"
+	case errors.Is(err, ErrInvalidContent), errors.Is(err, ErrHashMismatch), errors.Is(err, ErrAuthenticationFailed):
+		return "invalid_content"
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,236 @@
+package native
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"slices"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+// The previous pointers are read as numbers, which the native protocol
+// transfers losslessly, and converted back to their little-endian bytes.
+const selectQuery = `
+SELECT
+	toBool(is_encrypted),
+	content,
+	prev_fingerprint,
+	prev_hash
+FROM data_view(fingerprint = {fingerprintHex:String}, hash = {hashHex:String})`
+
+// selectTableQuery is selectQuery for tables other than the data table of
+// the pastila service, which data_view is defined for. It selects the first
+// insertion of the row like data_view does.
+const selectTableQuery = `
+SELECT
+	toBool(is_encrypted),
+	content,
+	prev_fingerprint,
+	prev_hash
+FROM %s
+WHERE fingerprint = reinterpretAsUInt32(unhex({fingerprintHex:String}))
+AND hash = reinterpretAsUInt128(unhex({hashHex:String}))
+ORDER BY time LIMIT 1`
+
+// statQuery reads from the table directly, because the size and time columns
+// are materialized and thus not part of data_view.
+const statQuery = `
+SELECT
+	toBool(is_encrypted),
+	toInt64(size),
+	time,
+	prev_fingerprint,
+	prev_hash
+FROM %s
+WHERE fingerprint = reinterpretAsUInt32(unhex({fingerprintHex:String}))
+AND hash = reinterpretAsUInt128(unhex({hashHex:String}))
+ORDER BY time LIMIT 1`
+
+const insertQuery = `
+INSERT INTO %s (hash_hex, fingerprint_hex, prev_hash_hex, prev_fingerprint_hex, is_encrypted, content)`
+
+// Backend stores pastes in ClickHouse through the native protocol. It
+// implements pastila.Backend, pastila.StatBackend and pastila.TableBackend.
+type Backend struct {
+	conn driver.Conn
+
+	// database and table are set by pastila.WithTable.
+	database string
+	table    string
+}
+
+var (
+	_ pastila.Backend      = (*Backend)(nil)
+	_ pastila.StatBackend  = (*Backend)(nil)
+	_ pastila.TableBackend = (*Backend)(nil)
+)
+
+// Open connects to ClickHouse. LZ4 compression is used unless options set
+// another one.
+func Open(options clickhouse.Options) (*Backend, error) {
+	if options.Compression == nil {
+		options.Compression = &clickhouse.Compression{Method: clickhouse.CompressionLZ4}
+	}
+
+	conn, err := clickhouse.Open(&options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ClickHouse: %w", err)
+	}
+
+	return &Backend{conn: conn}, nil
+}
+
+// Close closes the connections to ClickHouse.
+func (b *Backend) Close() error {
+	return b.conn.Close()
+}
+
+// SetTable implements pastila.TableBackend.
+func (b *Backend) SetTable(database, table string) {
+	b.database = database
+	b.table = table
+}
+
+// sql returns query with the name of the table pastes are stored in, which
+// queries refer to with a %s verb.
+func (b *Backend) sql(query string) string {
+	return fmt.Sprintf(query, pastila.TableIdentifier(b.database, b.table))
+}
+
+// selectQuery returns the query selecting a row with its content.
+func (b *Backend) selectQuery() string {
+	if b.database == "" && b.table == "" {
+		return selectQuery
+	}
+
+	return b.sql(selectTableQuery)
+}
+
+// Select implements pastila.Backend.
+func (b *Backend) Select(ctx context.Context, ref pastila.Ref) (*pastila.Row, error) {
+	var (
+		row             = &pastila.Row{Ref: ref}
+		prevFingerprint uint32
+		prevHash        big.Int
+	)
+
+	err := b.conn.QueryRow(withRef(ctx, ref), b.selectQuery()).
+		Scan(&row.Encrypted, &row.Content, &prevFingerprint, &prevHash)
+	if err != nil {
+		return nil, queryError(err)
+	}
+
+	row.PreviousFingerprint, row.PreviousHash = previous(prevFingerprint, &prevHash)
+	row.Size = int64(len(row.Content))
+
+	return row, nil
+}
+
+// Stat implements pastila.StatBackend.
+func (b *Backend) Stat(ctx context.Context, ref pastila.Ref) (*pastila.Row, error) {
+	var (
+		row             = &pastila.Row{Ref: ref}
+		insertedAt      time.Time
+		prevFingerprint uint32
+		prevHash        big.Int
+	)
+
+	err := b.conn.QueryRow(withRef(ctx, ref), b.sql(statQuery)).
+		Scan(&row.Encrypted, &row.Size, &insertedAt, &prevFingerprint, &prevHash)
+	if err != nil {
+		return nil, queryError(err)
+	}
+
+	row.PreviousFingerprint, row.PreviousHash = previous(prevFingerprint, &prevHash)
+	row.Time = insertedAt
+
+	return row, nil
+}
+
+// Insert implements pastila.Backend. A native block holds whole values, so
+// the content is read into memory before it is sent.
+func (b *Backend) Insert(ctx context.Context, row *pastila.InsertRow) (*pastila.Row, error) {
+	content, err := io.ReadAll(row.Content)
+	if err != nil {
+		return nil, err
+	}
+	ref := row.Ref()
+
+	batch, err := b.conn.PrepareBatch(ctx, b.sql(insertQuery))
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare ClickHouse insert: %w", err)
+	}
+
+	var encrypted uint8
+	if row.Encrypted {
+		encrypted = 1
+	}
+
+	if err := batch.Append(
+		hex.EncodeToString(ref.Hash),
+		hex.EncodeToString(ref.Fingerprint),
+		hex.EncodeToString(row.PreviousHash),
+		hex.EncodeToString(row.PreviousFingerprint),
+		encrypted,
+		string(content),
+	); err != nil {
+		_ = batch.Abort()
+		return nil, fmt.Errorf("failed to encode ClickHouse insert: %w", err)
+	}
+
+	if err := batch.Send(); err != nil {
+		return nil, fmt.Errorf("failed to execute ClickHouse insert: %w", err)
+	}
+
+	return &pastila.Row{
+		Ref:                 ref,
+		PreviousFingerprint: row.PreviousFingerprint,
+		PreviousHash:        row.PreviousHash,
+		Encrypted:           row.Encrypted,
+		Size:                int64(len(content)),
+	}, nil
+}
+
+func withRef(ctx context.Context, ref pastila.Ref) context.Context {
+	return clickhouse.Context(ctx, clickhouse.WithParameters(clickhouse.Parameters{
+		"fingerprintHex": hex.EncodeToString(ref.Fingerprint),
+		"hashHex":        hex.EncodeToString(ref.Hash),
+	}))
+}
+
+func queryError(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return pastila.ErrNotFound
+	}
+
+	var exception *clickhouse.Exception
+	if errors.As(err, &exception) {
+		return &pastila.ClickHouseError{Code: int(exception.Code), Name: exception.Name, Message: exception.Message}
+	}
+
+	return fmt.Errorf("failed to execute ClickHouse query: %w", err)
+}
+
+// previous converts the previous pointers to the little-endian bytes they were
+// written from. Both are nil when the paste has no previous version.
+func previous(fingerprint uint32, hash *big.Int) ([]byte, []byte) {
+	if hash.Sign() == 0 {
+		return nil, nil
+	}
+
+	fingerprintBytes := binary.LittleEndian.AppendUint32(nil, fingerprint)
+	hashBytes := hash.FillBytes(make([]byte, 16))
+	slices.Reverse(hashBytes)
+
+	return fingerprintBytes, hashBytes
+}
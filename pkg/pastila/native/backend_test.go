@@ -0,0 +1,80 @@
+package native
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/pastila-cli/pkg/chtest"
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+func TestBackendTable(t *testing.T) {
+	backend := &Backend{}
+	assert.Contains(t, backend.selectQuery(), "FROM data_view(")
+	assert.Contains(t, backend.sql(statQuery), "FROM `data`\n")
+	assert.Contains(t, backend.sql(insertQuery), "INSERT INTO `data` (")
+
+	_, err := pastila.NewService(pastila.WithBackend(backend), pastila.WithTable("tenant", "pastes"))
+	require.NoError(t, err)
+	assert.Contains(t, backend.selectQuery(), "FROM `tenant`.`pastes`\n")
+	assert.Contains(t, backend.sql(statQuery), "FROM `tenant`.`pastes`\n")
+	assert.Contains(t, backend.sql(insertQuery), "INSERT INTO `tenant`.`pastes` (")
+}
+
+func TestBackend(t *testing.T) {
+	ch := chtest.StartClickHouse(t)
+	chtest.ClickHouseQuery(t, ch.URL, strings.NewReader("CREATE TABLE pastes AS data"))
+
+	backend, err := Open(clickhouse.Options{
+		Addr: []string{ch.NativeAddr},
+		Auth: clickhouse.Auth{Database: ch.Database, Username: "paste", Password: "paste"},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = backend.Close() })
+
+	for name, opts := range map[string][]pastila.ServiceOption{
+		"data":   nil,
+		"pastes": {pastila.WithTable("", "pastes")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			service, err := pastila.NewService(append(opts, pastila.WithBackend(backend))...)
+			require.NoError(t, err)
+
+			first, err := service.Write(strings.NewReader("Hello ClickHouse!"))
+			require.NoError(t, err)
+			second, err := service.Write(strings.NewReader("Hello again!"), pastila.WithPreviousPaste(first))
+			require.NoError(t, err)
+
+			paste, err := service.Read(second.URL)
+			require.NoError(t, err)
+			content, err := io.ReadAll(paste)
+			require.NoError(t, err)
+			assert.Equal(t, "Hello again!", string(content))
+			assert.Equal(t, first.Hash, paste.PreviousHash)
+
+			info, err := service.Stat(context.Background(), second.URL)
+			require.NoError(t, err)
+			assert.True(t, info.Encrypted)
+			assert.Equal(t, first.Fingerprint, info.PreviousFingerprint)
+			assert.False(t, info.Time.IsZero())
+		})
+	}
+
+	// Each table holds only its own pastes.
+	service, err := pastila.NewService(pastila.WithBackend(backend), pastila.WithTable("", "pastes"))
+	require.NoError(t, err)
+	written, err := service.Write(strings.NewReader("only in pastes"))
+	require.NoError(t, err)
+	_, err = service.Read(written.URL)
+	require.NoError(t, err)
+
+	backend.SetTable("", "")
+	_, err = service.Read(written.URL)
+	require.ErrorIs(t, err, pastila.ErrNotFound)
+}
@@ -0,0 +1,15 @@
+// Package native provides a pastila.Backend built on the ClickHouse native TCP
+// protocol, for self-hosted setups without the HTTP interface or where large
+// pastes benefit from native block compression.
+//
+//	backend, err := native.Open(clickhouse.Options{Addr: []string{"localhost:9000"}})
+//	if err != nil {
+//		return err
+//	}
+//	defer backend.Close()
+//
+//	service, err := pastila.NewService(pastila.WithBackend(backend))
+//
+// Pastes are stored in the table set by pastila.WithTable, like with the HTTP
+// interface.
+package native
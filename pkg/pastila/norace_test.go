@@ -0,0 +1,5 @@
+//go:build !race
+
+package pastila
+
+const raceEnabled = false
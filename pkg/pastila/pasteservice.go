@@ -0,0 +1,33 @@
+package pastila
+
+import (
+	"context"
+	"io"
+)
+
+// PasteReader reads pastes. *Service implements it; applications depending
+// on it rather than on *Service can test their code with a fake, such as
+// pastilatest.Mock.
+type PasteReader interface {
+	ReadContext(ctx context.Context, url string, opt ...ReadOption) (*Paste, error)
+	Stat(ctx context.Context, url string) (*PasteInfo, error)
+}
+
+// PasteWriter writes pastes. *Service implements it.
+type PasteWriter interface {
+	WriteContext(ctx context.Context, input io.Reader, opt ...WriteOption) (*Paste, error)
+}
+
+// PasteService is the whole of what *Service does with pastes.
+type PasteService interface {
+	PasteReader
+	PasteWriter
+
+	Exists(ctx context.Context, url string) (bool, error)
+	History(ctx context.Context, url string, opt ...ReadOption) ([]*Paste, error)
+	Latest(ctx context.Context, url string) (*PasteInfo, error)
+	Next(ctx context.Context, url string) (*PasteInfo, error)
+	ListByFingerprint(ctx context.Context, fingerprint []byte) ([]*PasteInfo, error)
+}
+
+var _ PasteService = (*Service)(nil)
@@ -0,0 +1,69 @@
+package pastila
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// WithProgress makes Read call fn with the total number of content bytes
+// read so far, every time more content is read. Pastes read by ReadAll report
+// their progress separately.
+func WithProgress(fn func(n int64)) ReadOption {
+	return func(o *readOptions) {
+		o.progress = fn
+	}
+}
+
+// ReadTo reads the paste referenced by url into w and returns the number of
+// bytes written. The content is streamed into w, without buffering it whole.
+func (s *Service) ReadTo(ctx context.Context, url string, w io.Writer, opt ...ReadOption) (int64, error) {
+	paste, err := s.ReadContext(ctx, url, opt...)
+	if err != nil {
+		return 0, err
+	}
+	defer paste.Close()
+
+	n, err := paste.WriteTo(w)
+	if err != nil {
+		return n, fmt.Errorf("failed to read content: %w", err)
+	}
+
+	return n, nil
+}
+
+// progressReader reports the progress of reading the content of a paste.
+type progressReader struct {
+	io.ReadCloser
+	fn func(n int64)
+	n  int64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.n += int64(n)
+		r.fn(r.n)
+	}
+	return n, err
+}
+
+// WriteTo keeps the underlying reader in charge of copying, so content that
+// is in memory already is not copied through an intermediate buffer.
+func (r *progressReader) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(progressWriter{w: w, r: r}, r.ReadCloser)
+}
+
+type progressWriter struct {
+	w io.Writer
+	r *progressReader
+}
+
+func (w progressWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n > 0 {
+		w.r.n += int64(n)
+		w.r.fn(w.r.n)
+	}
+	return n, err
+}
@@ -0,0 +1,128 @@
+package pastila
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy configures retries of failed ClickHouse requests. Delays grow
+// exponentially from BaseDelay up to MaxDelay.
+//
+// Reads are always retried. Writes are retried only when the input is an
+// io.Seeker, because streamed content cannot be sent again otherwise.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts, including the first one. Zero
+	// or one disables retries.
+	MaxAttempts int
+
+	// BaseDelay is the delay before the first retry.
+	BaseDelay time.Duration
+
+	// MaxDelay caps the delay between attempts. Zero means no cap, the delay
+	// doubling until it saturates at the largest time.Duration.
+	MaxDelay time.Duration
+
+	// Jitter is the fraction of each delay, between 0 and 1, that is
+	// randomized to spread retries of concurrent clients.
+	Jitter float64
+
+	// Retryable reports whether an error is transient. If nil,
+	// IsTransientError is used.
+	Retryable func(error) bool
+}
+
+// DefaultRetryPolicy is a reasonable policy for the public pastila service.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   250 * time.Millisecond,
+	MaxDelay:    5 * time.Second,
+	Jitter:      0.2,
+}
+
+// IsTransientError reports whether err is likely to go away on retry:
+// connection failures, timed out requests, 5xx responses and overloaded
+// servers. Canceled contexts are not transient, but requests exceeding the
+// timeouts set by WithTimeouts are, although they wrap
+// context.DeadlineExceeded.
+func IsTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrTimeout) {
+		return true
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var chErr *ClickHouseError
+	if errors.As(err, &chErr) {
+		return chErr.StatusCode >= http.StatusInternalServerError && chErr.StatusCode != http.StatusNotImplemented ||
+			chErr.Code == errCodeTooManySimultaneousQueries
+	}
+
+	return errors.Is(err, ErrNetwork) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	shift := min(max(attempt-1, 0), 62)
+	d := p.BaseDelay << shift
+	if d>>shift != p.BaseDelay {
+		d = math.MaxInt64
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+
+	if p.Jitter > 0 {
+		// #nosec G404 -- jitter does not need a secure source
+		d -= time.Duration(p.Jitter * rand.Float64() * float64(d))
+	}
+
+	return d
+}
+
+// retry calls fn until it succeeds, fails permanently, runs out of attempts
+// or ctx is done. Only ctx decides whether to give up on timeouts, as the
+// timeouts of single requests are retried.
+func (s *Service) retry(ctx context.Context, fn func() error) error {
+	retryable := s.Retry.Retryable
+	if retryable == nil {
+		retryable = IsTransientError
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := s.attempt(ctx, fn)
+		if err == nil || attempt >= s.Retry.MaxAttempts || ctx.Err() != nil || !retryable(err) {
+			return err
+		}
+
+		timer := time.NewTimer(s.Retry.delay(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w, giving up after %d attempts: %w", ctx.Err(), attempt, err)
+		case <-timer.C:
+		}
+	}
+}
+
+// attempt calls fn once the Limiter allows it.
+func (s *Service) attempt(ctx context.Context, fn func() error) error {
+	if s.Limiter != nil {
+		if err := s.Limiter.Wait(ctx); err != nil {
+			return fmt.Errorf("rate limit: %w", err)
+		}
+	}
+
+	return fn()
+}
@@ -0,0 +1,271 @@
+package pastila
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// maxStreamFieldSize bounds the size of the fields of a streamed row other
+// than its content.
+const maxStreamFieldSize = 1 << 10
+
+// decodeStreamRow decodes the next JSONEachRow row of r into v, except for
+// its content field, which must come last. It returns a reader of the
+// unescaped content, which fails if the row turns out to be truncated. The
+// caller checks that there is a row, see emptyResult.
+func decodeStreamRow(r *bufio.Reader, v any) (io.Reader, error) {
+	if err := readStreamFields(r, v); err != nil {
+		return nil, &DecodeError{Format: formatJSONEachRow, Err: err}
+	}
+
+	return &jsonStringReader{r: r}, nil
+}
+
+// readStreamFields reads a JSONEachRow row up to the opening quote of its
+// content, decoding the fields preceding the content into v.
+func readStreamFields(r *bufio.Reader, v any) error {
+	c, err := nextToken(r)
+	if err == nil && c != '{' {
+		err = fmt.Errorf("unexpected %q at start of row", c)
+	}
+	if err != nil {
+		return streamErr(err)
+	}
+
+	// The fields preceding the content are collected into an object of
+	// their own, for encoding/json to decode.
+	fields := []byte{'{'}
+	for {
+		key, err := readStreamField(r)
+		if err != nil {
+			return err
+		}
+		if c, err = nextToken(r); err == nil && c != ':' {
+			err = fmt.Errorf("unexpected %q after field name", c)
+		}
+		if err != nil {
+			return streamErr(err)
+		}
+
+		if string(key) == `"content"` {
+			if c, err = nextToken(r); err == nil && c != '"' {
+				err = fmt.Errorf("unexpected %q at start of content", c)
+			}
+			if err != nil {
+				return streamErr(err)
+			}
+
+			return json.Unmarshal(append(fields, '}'), v)
+		}
+
+		value, err := readStreamField(r)
+		if err != nil {
+			return err
+		}
+		if len(fields) > 1 {
+			fields = append(fields, ',')
+		}
+		fields = append(append(append(fields, key...), ':'), value...)
+
+		if c, err = nextToken(r); err == nil && c != ',' {
+			err = fmt.Errorf("unexpected %q, expected content last", c)
+		}
+		if err != nil {
+			return streamErr(err)
+		}
+	}
+}
+
+// nextToken returns the next byte of r that is not JSON whitespace.
+func nextToken(r *bufio.Reader) (byte, error) {
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+			return c, nil
+		}
+	}
+}
+
+// readStreamField reads the raw JSON of a string or a literal, such as a
+// boolean or a number, off r.
+func readStreamField(r *bufio.Reader) ([]byte, error) {
+	c, err := nextToken(r)
+	if err != nil {
+		return nil, streamErr(err)
+	}
+
+	raw := []byte{c}
+	escaped := false
+	for len(raw) <= maxStreamFieldSize {
+		next, err := r.Peek(1)
+		if err != nil {
+			return nil, streamErr(err)
+		}
+
+		switch {
+		case c != '"' && bytes.ContainsAny(next, " \t\r\n,:}"):
+			return raw, nil
+		case c == '"' && !escaped && next[0] == '"':
+			_, _ = r.Discard(1)
+			return append(raw, '"'), nil
+		}
+
+		escaped = c == '"' && !escaped && next[0] == '\\'
+		raw = append(raw, next[0])
+		_, _ = r.Discard(1)
+	}
+
+	return nil, fmt.Errorf("field longer than %d bytes", maxStreamFieldSize)
+}
+
+// streamErr reports the end of a stream in the middle of a row as
+// truncation.
+func streamErr(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// jsonStringReader unescapes the inside of a JSON string as it is read, up
+// to the closing quote, which must end the row. It is the counterpart of
+// jsonStringWriter.
+type jsonStringReader struct {
+	r       *bufio.Reader
+	pending []byte
+	err     error
+}
+
+func (j *jsonStringReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) && j.err == nil {
+		if len(j.pending) > 0 {
+			c := copy(p[n:], j.pending)
+			j.pending = j.pending[c:]
+			n += c
+			continue
+		}
+
+		// Return what is there rather than wait for more.
+		if n > 0 && j.r.Buffered() == 0 {
+			break
+		}
+
+		chunk, err := j.r.Peek(max(j.r.Buffered(), 1))
+		if err != nil {
+			j.err = &DecodeError{Format: formatJSONEachRow, Err: streamErr(err)}
+			break
+		}
+
+		i := bytes.IndexAny(chunk, `"\`)
+		if i < 0 {
+			i = len(chunk)
+		}
+		if i > 0 {
+			c := copy(p[n:], chunk[:i])
+			_, _ = j.r.Discard(c)
+			n += c
+			continue
+		}
+
+		_, _ = j.r.Discard(1)
+		if chunk[0] == '"' {
+			j.err = j.end()
+			break
+		}
+
+		j.pending, err = readEscape(j.r)
+		if err != nil {
+			j.err = &DecodeError{Format: formatJSONEachRow, Err: streamErr(err)}
+		}
+	}
+
+	if n > 0 {
+		return n, nil
+	}
+	return 0, j.err
+}
+
+// end checks that the row ends after the content.
+func (j *jsonStringReader) end() error {
+	c, err := nextToken(j.r)
+	if err == nil && c != '}' {
+		err = fmt.Errorf("unexpected %q after content", c)
+	}
+	if err != nil {
+		return &DecodeError{Format: formatJSONEachRow, Err: streamErr(err)}
+	}
+
+	return io.EOF
+}
+
+// readEscape decodes the escape sequence following a backslash.
+func readEscape(r *bufio.Reader) ([]byte, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch c {
+	case '"', '\\', '/':
+		return []byte{c}, nil
+	case 'b':
+		return []byte{'\b'}, nil
+	case 'f':
+		return []byte{'\f'}, nil
+	case 'n':
+		return []byte{'\n'}, nil
+	case 'r':
+		return []byte{'\r'}, nil
+	case 't':
+		return []byte{'\t'}, nil
+	case 'u':
+	default:
+		return nil, fmt.Errorf("invalid escape %q", c)
+	}
+
+	rr, err := readHexRune(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Characters outside the basic plane are escaped as surrogate pairs.
+	if utf16.IsSurrogate(rr) {
+		if next, err := r.Peek(2); err == nil && string(next) == `\u` {
+			_, _ = r.Discard(2)
+			low, err := readHexRune(r)
+			if err != nil {
+				return nil, err
+			}
+			rr = utf16.DecodeRune(rr, low)
+		} else {
+			rr = utf8.RuneError
+		}
+	}
+
+	return utf8.AppendRune(nil, rr), nil
+}
+
+// readHexRune reads the four hex digits of a \u escape.
+func readHexRune(r *bufio.Reader) (rune, error) {
+	var digits [4]byte
+	if _, err := io.ReadFull(r, digits[:]); err != nil {
+		return 0, err
+	}
+
+	v, err := strconv.ParseUint(string(digits[:]), 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid escape \\u%s", digits[:])
+	}
+
+	return rune(v), nil
+}
@@ -1,30 +1,71 @@
 package pastila
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
-	"encoding/base64"
+	"crypto/rand"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"regexp"
-
-	"github.com/frifox/siphash128"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
 )
 
+// HTTPClient is used by Services without a Client.
+//
+// Deprecated: set Service.Client instead.
 var HTTPClient = http.DefaultClient
 var DefaultClickHouseURL = "https://uzg8q0g12h.eu-central-1.aws.clickhouse.cloud/?user=paste"
 var chURL = "https://pastila.nl/"
 
+const modulePath = "github.com/jkaflik/pastila-cli"
+
 var (
 	ErrInvalidURL  = fmt.Errorf("invalid pastila url")
 	ErrNotFound    = fmt.Errorf("pastila not found")
 	ErrKeyRequired = fmt.Errorf("key is required for encrypted data")
 	ErrInvalidKey  = fmt.Errorf("invalid key")
+
+	// ErrInvalidContent is returned when stored content is malformed.
+	ErrInvalidContent = fmt.Errorf("invalid paste content")
+
+	// ErrPassphraseRequired is returned when reading a passphrase protected
+	// paste without WithReadPassphrase.
+	ErrPassphraseRequired = fmt.Errorf("passphrase is required for this paste")
+
+	// ErrHashMismatch is returned by Read with WithVerify when the stored
+	// content does not match the hash in the URL.
+	ErrHashMismatch = fmt.Errorf("paste content does not match its hash")
+
+	// ErrInvalidFingerprint is returned for a fingerprint of a wrong size.
+	ErrInvalidFingerprint = fmt.Errorf("invalid fingerprint")
+
+	// ErrInvalidKDFParams is returned for unusable key derivation parameters.
+	ErrInvalidKDFParams = fmt.Errorf("invalid key derivation parameters")
+
+	// ErrTooLarge is returned for content exceeding Service.MaxSize.
+	ErrTooLarge = fmt.Errorf("paste is too large")
+
+	// ErrAuthenticationFailed is returned for pastes written with WithMAC
+	// whose content does not match its MAC, because it was corrupted or
+	// tampered with, or because the key is wrong.
+	ErrAuthenticationFailed = fmt.Errorf("paste content failed authentication")
+
+	// ErrInvalidContentType is returned for a content type that cannot be
+	// stored.
+	ErrInvalidContentType = fmt.Errorf("invalid content type")
 )
 
 var QueryMatchRegex = regexp.MustCompile(`(?m)([a-f0-9]+)/([a-f0-9]+)(?:#(.+))?$`)
@@ -41,9 +82,36 @@ type Paste struct {
 
 	Key []byte
 
+	// ContentType is the media type the paste was written with, if any.
+	ContentType string
+
 	QueryID string
+
+	// Stats are the execution statistics of the query that read or wrote
+	// the paste.
+	Stats Stats
+
+	// passphrase and kdfParams are carried over to new versions of a
+	// passphrase protected paste by WithPreviousPaste.
+	passphrase string
+	kdfParams  KDFParams
+
+	// ageRecipients are carried over to new versions of a paste written
+	// with WithAgeRecipients.
+	ageRecipients []age.Recipient
+
+	// size is the size of the stored content in bytes.
+	size int64
+}
+
+// WriteTo writes the content of the paste to w. It implements io.WriterTo,
+// so io.Copy streams the content without an intermediate buffer when it can.
+func (p *Paste) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, p.ReadCloser)
 }
 
+// Service reads and writes pastes. Build it with NewService; the zero value
+// talks to the public pastila service.
 type Service struct {
 	// PastilaURL is the URL of the pastila service. Used to generate URLs for writing data.
 	PastilaURL string
@@ -51,129 +119,476 @@ type Service struct {
 	// ClickHouseURL is the URL of the ClickHouse service. Used to read and write data.
 	ClickHouseURL string
 
+	// Database and Table name the table pastes are stored in on the
+	// ClickHouse service. An empty Database is the default database of the
+	// user, an empty Table is the data table of the pastila service.
+	Database string
+	Table    string
+
+	// ExpiryColumn reports that the table has an expires column, see
+	// WithExpiryColumn.
+	ExpiryColumn bool
+
+	// WireFormat selects the formats rows are exchanged with ClickHouse in.
+	// The zero value, WireFormatAuto, avoids JSON escaping the content.
+	WireFormat WireFormat
+
+	// HTTPCompression makes requests to ClickHouse compress inserted rows
+	// and ask for compressed responses, both with gzip.
+	HTTPCompression bool
+
+	// AsyncInsert makes ClickHouse buffer written rows and insert them in
+	// batches with the rows of other clients, see its async_insert setting.
+	// With AsyncInsertWait, Write returns once the row is inserted.
+	// Otherwise, it returns once the row is buffered, sooner, but the paste
+	// becomes readable only when the buffer is flushed, and is lost if the
+	// flush fails.
+	AsyncInsert     bool
+	AsyncInsertWait bool
+
+	// ReadTimeout and WriteTimeout limit each request to ClickHouse reading
+	// and writing pastes, including reading its response. Zero means no
+	// limit.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// Endpoints are the URLs of replicas of the ClickHouse service, used
+	// instead of ClickHouseURL. Requests fail over to the next endpoint on
+	// network errors: reads right away, writes when they are retried.
+	Endpoints []string
+
+	// LoadBalanceReads spreads reads over Endpoints in turn, instead of
+	// sending them to the same endpoint as writes.
+	LoadBalanceReads bool
+
 	// Auth cookie for pastila with auth
 	AuthCookie string
+
+	// User and Password authenticate requests to ClickHouse. They replace
+	// the user and password parameters of ClickHouseURL, if any.
+	User     string
+	Password string
+
+	// JWT authenticates requests to ClickHouse Cloud with a bearer token.
+	JWT string
+
+	// APIToken and SigningKey authenticate requests to a private pastila
+	// backend in front of ClickHouse, see SignRequest.
+	APIToken   string
+	SigningKey []byte
+
+	// Client is the HTTP client used to talk to ClickHouse. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+
+	// Retry configures retries of transient failures. The zero value
+	// disables retries.
+	Retry RetryPolicy
+
+	// UserAgent identifies the client to ClickHouse. If empty, PastilaCLI
+	// and the version of this module are used.
+	UserAgent string
+
+	// QueryID, if set, returns the ID of every request to ClickHouse, which
+	// names the query in system.query_log. It is called with the context of
+	// the request, once per attempt. If nil, or if it returns "", ClickHouse
+	// generates the ID.
+	QueryID func(ctx context.Context) string
+
+	// MaxSize limits the size of the content of pastes in bytes. Write fails
+	// with ErrTooLarge once it reads more from its input, before the rest is
+	// sent, and reading a larger paste fails with ErrTooLarge. Zero means no
+	// limit.
+	MaxSize int64
+
+	// RequestHook, if set, is called with every request to ClickHouse right
+	// before it is sent. It may modify the request, e.g. to add headers.
+	RequestHook func(*http.Request)
+
+	// ResponseHook, if set, is called with every response of ClickHouse and
+	// the time it took to receive its headers. The body must not be read.
+	ResponseHook func(*http.Response, time.Duration)
+
+	// Limiter limits the rate of requests to the backend, including
+	// retries, across all Reads and Writes. If nil, requests are not
+	// limited.
+	Limiter *rate.Limiter
+
+	// Tracer creates spans of Reads and Writes. If nil, no spans are
+	// created.
+	Tracer trace.Tracer
+
+	// Metrics collects metrics of Reads and Writes. If nil, no metrics are
+	// collected.
+	Metrics *Metrics
+
+	// URLBuilder forms the URLs of written pastes. If nil, URLs are formed
+	// by QueryURLBuilder(PastilaURL).
+	URLBuilder URLBuilder
+
+	// KeyProvider supplies the keys of encrypted pastes read from URLs
+	// without a key. If nil, such reads fail with ErrKeyRequired.
+	KeyProvider KeyProvider
+
+	// Cache keeps read pastes on disk. If nil, every Read queries Backend.
+	Cache *Cache
+
+	// Backend stores the pastes. If nil, the ClickHouse HTTP interface at
+	// ClickHouseURL is used.
+	Backend Backend
+
+	// endpointState remembers failed Endpoints across requests. Services
+	// not built by NewService try Endpoints in order on every request.
+	endpointState *endpointState
+
+	// wireFormatState remembers whether ClickHouse supports the formats of
+	// WireFormatAuto across requests.
+	wireFormatState *wireFormatState
+
+	// batchState remembers whether ClickHouse lets the user select many
+	// rows at once across requests.
+	batchState *batchState
+}
+
+type readOptions struct {
+	key           []byte
+	passphrase    string
+	ageIdentities []age.Identity
+	verify        bool
+	requireMAC    bool
+	progress      func(n int64)
+	maxVersions   int
+	spool         bool
+	spoolDir      string
 }
 
-func (s *Service) Read(url string) (*Paste, error) {
-	matches := QueryMatchRegex.FindStringSubmatch(url)
-	if matches == nil {
-		return nil, fmt.Errorf("%w: %s", ErrInvalidURL, url)
+type ReadOption func(*readOptions)
+
+// WithReadKey sets the key to decrypt the paste with, so URLs can be shared
+// without their key. It takes precedence over the key in the URL.
+func WithReadKey(key []byte) ReadOption {
+	return func(o *readOptions) {
+		o.key = key
 	}
+}
 
-	fingerprintHex := matches[1]
-	hashHex := matches[2]
+// WithReadPassphrase sets the passphrase used to derive the key of pastes
+// written with WithPassphrase.
+func WithReadPassphrase(passphrase string) ReadOption {
+	return func(o *readOptions) {
+		o.passphrase = passphrase
+	}
+}
 
-	var key []byte
-	if len(matches) == 4 {
-		var err error
-		key, err = base64.StdEncoding.DecodeString(matches[3])
-		if err != nil {
-			return nil, fmt.Errorf("%w, failed to base64 decode: %w", ErrInvalidKey, err)
+// WithVerify makes Read recompute the hash of the stored content and compare
+// it to the hash in the URL, returning ErrHashMismatch on tampering or
+// truncation. Content streamed by a StreamBackend is verified while it is
+// read, so reading it fails with ErrHashMismatch at its end instead.
+func WithVerify() ReadOption {
+	return func(o *readOptions) {
+		o.verify = true
+	}
+}
+
+// Read is ReadContext with context.Background.
+func (s *Service) Read(url string, opt ...ReadOption) (*Paste, error) {
+	return s.ReadContext(context.Background(), url, opt...)
+}
+
+// ReadContext reads the paste referenced by url. The context controls the
+// underlying ClickHouse request.
+func (s *Service) ReadContext(ctx context.Context, url string, opt ...ReadOption) (*Paste, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "pastila.Read")
+	paste, err := s.read(ctx, url, opt...)
+	if err == nil {
+		s.limitSize(paste)
+
+		opts := &readOptions{}
+		for _, o := range opt {
+			o(opts)
+		}
+		if err = spool(paste, opts); err != nil {
+			paste = nil
 		}
 	}
+	endSpan(span, paste, err)
+	s.Metrics.observe(operationRead, start, paste, err)
 
-	req, err := s.clickHouseRequest(selectDataQuery, nil)
+	return paste, err
+}
+
+// limitSize makes reading the content of paste fail beyond MaxSize.
+func (s *Service) limitSize(paste *Paste) {
+	if s.MaxSize > 0 {
+		paste.ReadCloser = &maxSizeReader{ReadCloser: paste.ReadCloser, max: s.MaxSize, remaining: s.MaxSize}
+	}
+}
+
+func (s *Service) read(ctx context.Context, url string, opt ...ReadOption) (*Paste, error) {
+	opts := &readOptions{}
+	for _, o := range opt {
+		o(opts)
+	}
+
+	// URLs are often copied with trailing whitespace or CRLF line endings.
+	url = strings.TrimSpace(url)
+
+	pasteRef, err := ParseURL(url)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create ClickHouse request: %w", err)
+		return nil, err
 	}
+	ref, key := pasteRef.Ref, pasteRef.Key
 
-	res, err := s.executeRequestWithParams(req, map[string]string{
-		"fingerprintHex": fingerprintHex,
-		"hashHex":        hashHex,
-	})
+	row, content, err := s.selectStream(ctx, ref)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, url)
+		}
+		return nil, err
+	}
+	if err := checkExpiry(url, row); err != nil {
+		if content != nil {
+			_ = content.Close()
+		}
+		return nil, err
+	}
 
+	var paste *Paste
+	if content != nil {
+		if opts.verify {
+			content = newHashVerifier(content, url, ref.Hash)
+		}
+		paste, err = s.openStream(ctx, url, ref, key, row, content, opts)
+	} else {
+		paste, err = s.open(ctx, url, ref, key, row, opts)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute ClickHouse request: %w", err)
+		return nil, err
 	}
 
-	defer res.Body.Close()
+	if opts.progress != nil {
+		paste.ReadCloser = &progressReader{ReadCloser: paste.ReadCloser, fn: opts.progress}
+	}
+	return paste, nil
+}
 
-	var row selectRow
-	if decodeErr := json.NewDecoder(res.Body).Decode(&row); decodeErr != nil {
-		if decodeErr == io.EOF {
-			return nil, fmt.Errorf("%w: %s", ErrNotFound, url)
+// open decodes the selected row of the paste referenced by url.
+func (s *Service) open(ctx context.Context, url string, ref Ref, key []byte, row *Row, opts *readOptions) (*Paste, error) {
+	if opts.verify {
+		h := newSipHash128()
+		_, _ = io.WriteString(h, row.Content)
+		if sum := h.Sum(); !bytes.Equal(sum[:], ref.Hash) {
+			return nil, fmt.Errorf("%w: %s", ErrHashMismatch, url)
 		}
+	}
+
+	sized := *row
+	sized.Size = int64(len(row.Content))
+	return s.openStream(ctx, url, ref, key, &sized, io.NopCloser(strings.NewReader(row.Content)), opts)
+}
 
-		return nil, fmt.Errorf("failed to decode ClickHouse response: %w", err)
+// openStream decodes the content of the selected row of the paste referenced
+// by url while it is read. Closing the paste closes content; so does a
+// failure to open it.
+func (s *Service) openStream(
+	ctx context.Context, url string, ref Ref, key []byte, row *Row, content io.ReadCloser, opts *readOptions,
+) (paste *Paste, err error) {
+	defer func() {
+		if err != nil {
+			_ = content.Close()
+		}
+	}()
+
+	fingerprint, hash := ref.Fingerprint, ref.Hash
+	if opts.key != nil {
+		key = opts.key
+	}
+
+	paste = &Paste{
+		URL:                 url,
+		Key:                 key,
+		Fingerprint:         fingerprint,
+		Hash:                hash,
+		PreviousFingerprint: row.PreviousFingerprint,
+		PreviousHash:        row.PreviousHash,
+		QueryID:             row.QueryID,
+		Stats:               row.Stats,
+		size:                row.Size,
 	}
 
-	fingerprint, err := hex.DecodeString(fingerprintHex)
+	r := bufio.NewReader(content)
+
+	// data is not encrypted, return as is unless it carries an envelope
+	if !row.Encrypted {
+		if opts.requireMAC {
+			return nil, fmt.Errorf("%w: paste is not encrypted", ErrAuthenticationFailed)
+		}
+
+		env, payload, ok := readPlainEnvelope(r)
+		if !ok {
+			paste.ReadCloser = readCloser{Reader: r, Closer: content}
+			return paste, nil
+		}
+
+		return s.openPayload(ctx, paste, env, payload, content, opts)
+	}
+
+	env, plaintext, err := s.decryptContent(ctx, paste, ref, r, opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode fingerprint: %w", err)
+		return nil, err
 	}
-	hash, err := hex.DecodeString(hashHex)
+
+	return s.openPayload(ctx, paste, env, plaintext, content, opts)
+}
+
+// decryptContent returns the envelope and a reader of the decrypted payload
+// of the base64 encoded encrypted content r of paste. The key of paste is
+// used unless the paste is passphrase protected or encrypted with age; a
+// missing key is asked from the KeyProvider and set on paste.
+func (s *Service) decryptContent(
+	ctx context.Context, paste *Paste, ref Ref, r io.Reader, opts *readOptions,
+) (*envelope, io.Reader, error) {
+	data := bufio.NewReader(newBase64Decoder(r, ErrInvalidKey))
+	env, header, err := readEnvelope(data)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode hash: %w", err)
+		return nil, nil, err
+	}
+	if opts.requireMAC && !env.mac && !env.age {
+		return nil, nil, fmt.Errorf("%w: paste has no MAC", ErrAuthenticationFailed)
 	}
 
-	// data is not encrypted, return as is
-	if !row.Encrypted {
-		return &Paste{
-			URL:         url,
-			Key:         key,
-			Fingerprint: fingerprint,
-			Hash:        hash,
-			ReadCloser:  io.NopCloser(bytes.NewBufferString(row.Content)),
-			QueryID:     res.Header.Get("X-ClickHouse-Query-Id"),
-		}, nil
+	if env.age {
+		plaintext, err := decryptAge(data, opts.ageIdentities)
+		if err != nil {
+			return nil, nil, err
+		}
+		return env, plaintext, nil
+	}
+
+	decryptionKey := paste.Key
+	if env.kdf != nil {
+		if opts.passphrase == "" {
+			return nil, nil, ErrPassphraseRequired
+		}
+		decryptionKey = env.kdf.params.deriveKey(opts.passphrase, env.kdf.salt)
+		paste.passphrase = opts.passphrase
+		paste.kdfParams = env.kdf.params
+	}
+
+	if len(decryptionKey) == 0 && s.KeyProvider != nil {
+		decryptionKey, err = s.KeyProvider.Key(ctx, ref)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get key: %w", err)
+		}
+		paste.Key = decryptionKey
 	}
 
-	if len(key) == 0 {
-		return nil, ErrKeyRequired
+	if len(decryptionKey) == 0 {
+		return nil, nil, ErrKeyRequired
 	}
 
-	ciphertext, err := base64.StdEncoding.DecodeString(row.Content)
+	plaintext, err := decryptCTR(data, header, env, decryptionKey)
 	if err != nil {
-		return nil, fmt.Errorf("%w, failed to decode base64 ciphertext: %w", ErrInvalidKey, err)
+		return nil, nil, err
 	}
 
+	return env, plaintext, nil
+}
+
+// decryptCTR returns a reader of the AES-CTR decrypted ciphertext, which is
+// authenticated first if the envelope says it has a MAC. header is the
+// encoded envelope, which the MAC covers too.
+func decryptCTR(ciphertext io.Reader, header []byte, env *envelope, key []byte) (io.Reader, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, fmt.Errorf("%w, failed to create AES cipher: %w", ErrInvalidKey, err)
 	}
-	iv := make([]byte, aes.BlockSize)
-	plaintext := make([]byte, len(ciphertext))
-	cipher.NewCTR(block, iv).XORKeyStream(plaintext, ciphertext)
 
-	return &Paste{
-		URL:         url,
-		Key:         key,
-		Fingerprint: fingerprint,
-		Hash:        hash,
-		ReadCloser:  io.NopCloser(bytes.NewReader(plaintext)),
-		QueryID:     res.Header.Get("X-ClickHouse-Query-Id"),
-	}, nil
+	if env.mac {
+		// Nothing may be decrypted before the content is authenticated, so
+		// authenticated content is read as a whole.
+		macKey, err := deriveMACKey(key)
+		if err != nil {
+			return nil, err
+		}
+		payload, err := io.ReadAll(ciphertext)
+		if err != nil {
+			return nil, err
+		}
+		authenticated, err := verifyMAC(macKey, append(header, payload...), payload)
+		if err != nil {
+			return nil, err
+		}
+		ciphertext = bytes.NewReader(authenticated)
+	}
+
+	iv := env.iv
+	if iv == nil {
+		iv = make([]byte, aes.BlockSize)
+	}
+
+	return cipher.StreamReader{S: cipher.NewCTR(block, iv), R: ciphertext}, nil
 }
 
-const selectDataQuery = `
-SELECT
-	toBool(is_encrypted) as is_encrypted,
-	content
-FROM data_view(fingerprint = {fingerprintHex:String}, hash = {hashHex:String})
-FORMAT JSONEachRow`
-const insertDataQuery = `
-INSERT INTO data (hash_hex, fingerprint_hex, prev_hash_hex, prev_fingerprint_hex, is_encrypted, content)
-FORMAT JSONEachRow`
+// openPayload sets the content of paste to the decrypted payload, less its
+// content type, decompressed while it is read. Closing the paste closes
+// content.
+func (s *Service) openPayload(
+	ctx context.Context, paste *Paste, env *envelope, payload io.Reader, content io.Closer, opts *readOptions,
+) (*Paste, error) {
+	r := bufio.NewReader(payload)
 
-type selectRow struct {
-	Encrypted bool   `json:"is_encrypted"`
-	Content   string `json:"content"`
+	var err error
+	paste.ContentType, err = readContentType(env, r)
+	if err != nil {
+		return nil, err
+	}
+
+	paste.ReadCloser = readCloser{Reader: r, Closer: content}
+	if env.compression != NoCompression {
+		decompressor, err := env.compression.decompressor(r)
+		if err != nil {
+			return nil, fmt.Errorf("%w, failed to decompress content: %w", ErrInvalidContent, err)
+		}
+		paste.ReadCloser = readCloser{Reader: decompressor, Closer: multiCloser{decompressor, content}}
+	}
+
+	return s.openChunks(ctx, paste, env, opts)
 }
 
-type insertRow struct {
-	Encrypted          bool   `json:"is_encrypted"`
-	Content            string `json:"content"`
-	HashHex            string `json:"hash_hex"`
-	FingerprintHex     string `json:"fingerprint_hex"`
-	PrevHashHex        string `json:"prev_hash_hex"`
-	PrevFingerprintHex string `json:"prev_fingerprint_hex"`
+func decodeRef(fingerprintHex, hashHex string) (fingerprint, hash []byte, err error) {
+	fingerprint, err = hex.DecodeString(fingerprintHex)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode fingerprint: %w", err)
+	}
+	hash, err = hex.DecodeString(hashHex)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode hash: %w", err)
+	}
+
+	return fingerprint, hash, nil
 }
 
 type writeOptions struct {
 	key                 []byte
+	randomIV            bool
+	passphrase          string
+	kdfParams           KDFParams
 	previousFingerprint []byte
 	previousHash        []byte
+	previousErr         error
+	fingerprint         []byte
+	compression         Compression
+	mac                 bool
+	chunkSize           int64
+	dedup               bool
+	contentType         string
+	ageRecipients       []age.Recipient
+	expiry              time.Duration
+
+	// manifest marks the content as the manifest of a chunked paste.
+	manifest bool
 }
 
 type WriteOption func(*writeOptions)
@@ -184,6 +599,71 @@ func WithKey(key []byte) WriteOption {
 	}
 }
 
+// WithRandomIV makes Write encrypt content with a random IV, which is stored
+// in front of the ciphertext. Without it, the all-zero IV of the pastila web
+// client is used, which makes reusing a key across pastes unsafe.
+func WithRandomIV() WriteOption {
+	return func(o *writeOptions) {
+		o.randomIV = true
+	}
+}
+
+// WithPassphrase makes Write encrypt content with a key derived from
+// passphrase using Argon2id. A random salt and the parameters are stored with
+// the paste, and the URL carries no key. Use WithReadPassphrase to read it.
+func WithPassphrase(passphrase string, params KDFParams) WriteOption {
+	return func(o *writeOptions) {
+		o.passphrase = passphrase
+		o.kdfParams = params
+	}
+}
+
+// WithLegacyFingerprint makes Write use the constant ffffffff fingerprint
+// written by earlier versions of this library, instead of computing it from
+// the content like the pastila web client does. The fingerprint is computed
+// from the plaintext, so it tells similar encrypted pastes apart; use this
+// option when that is undesirable.
+func WithLegacyFingerprint() WriteOption {
+	return WithFingerprint(legacyFingerprint)
+}
+
+// WithFingerprint makes Write use the given 4 byte fingerprint instead of
+// computing it from the content, e.g. to group related pastes.
+func WithFingerprint(fingerprint []byte) WriteOption {
+	return func(o *writeOptions) {
+		o.fingerprint = fingerprint
+	}
+}
+
+// WithCompression makes Write compress content before encryption. Read
+// decompresses such pastes automatically.
+func WithCompression(c Compression) WriteOption {
+	return func(o *writeOptions) {
+		o.compression = c
+	}
+}
+
+// WithDedup makes Write look the content up before uploading it, and return
+// the existing paste instead of inserting the same row again. The content is
+// buffered in memory to compute its hash first. Pastes encrypted with a
+// random IV or a passphrase never match an existing one. An existing paste is
+// returned with its own previous version, which differs from the one set by
+// WithPreviousPaste if it was written as a version of another paste.
+func WithDedup() WriteOption {
+	return func(o *writeOptions) {
+		o.dedup = true
+	}
+}
+
+// WithContentType stores the media type of the content, such as
+// "application/json", along with it. Read returns it as Paste.ContentType.
+// The content type of an encrypted paste is encrypted too.
+func WithContentType(contentType string) WriteOption {
+	return func(o *writeOptions) {
+		o.contentType = contentType
+	}
+}
+
 func WithPreviousPaste(p *Paste) WriteOption {
 	return func(o *writeOptions) {
 		if p == nil {
@@ -192,88 +672,392 @@ func WithPreviousPaste(p *Paste) WriteOption {
 
 		o.previousFingerprint = p.Fingerprint
 		o.previousHash = p.Hash
+		o.previousErr = nil
 		o.key = p.Key
+		if p.passphrase != "" {
+			o.passphrase = p.passphrase
+			o.kdfParams = p.kdfParams
+		}
+		o.ageRecipients = p.ageRecipients
+	}
+}
+
+// WithPreviousURL makes the written paste a new version of the paste at url,
+// as editing it in the pastila web client does, without reading it. Like
+// with WithPreviousPaste, the new version is encrypted with the key in url,
+// or not at all if url has none; give WithKey after this option to change
+// that.
+func WithPreviousURL(url string) WriteOption {
+	return func(o *writeOptions) {
+		ref, err := ParseURL(strings.TrimSpace(url))
+		if err != nil {
+			o.previousErr = err
+			return
+		}
+
+		o.previousFingerprint = ref.Fingerprint
+		o.previousHash = ref.Hash
+		o.previousErr = nil
+		o.key = ref.Key
 	}
 }
 
+// Write is WriteContext with context.Background.
 func (s *Service) Write(input io.Reader, opt ...WriteOption) (*Paste, error) {
+	return s.WriteContext(context.Background(), input, opt...)
+}
+
+// WriteContext writes the content of input as a new paste. The context
+// controls the underlying ClickHouse request.
+func (s *Service) WriteContext(ctx context.Context, input io.Reader, opt ...WriteOption) (*Paste, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "pastila.Write")
+	paste, err := s.write(ctx, input, opt...)
+	endSpan(span, paste, err)
+	s.Metrics.observe(operationWrite, start, paste, err)
+
+	return paste, err
+}
+
+func (s *Service) write(ctx context.Context, input io.Reader, opt ...WriteOption) (*Paste, error) {
 	opts := &writeOptions{}
 	for _, o := range opt {
 		o(opts)
 	}
 
-	var isEncrypted bool
-	var content string
-	b, readErr := io.ReadAll(input)
-	if readErr != nil {
-		return nil, fmt.Errorf("failed to read input: %w", readErr)
+	return s.writeWithOptions(ctx, input, opts)
+}
+
+func (s *Service) writeWithOptions(ctx context.Context, input io.Reader, opts *writeOptions) (*Paste, error) {
+	if err := s.validateWriteOptions(opts); err != nil {
+		return nil, err
 	}
 
-	if opts.key != nil {
-		block, err := aes.NewCipher(opts.key)
+	if opts.chunkSize > 0 {
+		// Content fitting into a single chunk is written as a regular paste.
+		head := make([]byte, opts.chunkSize+1)
+		n, err := io.ReadFull(input, head)
+		switch {
+		case err == nil:
+			return s.writeChunked(ctx, io.MultiReader(bytes.NewReader(head), input), opts)
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			input = bytes.NewReader(head[:n])
+		default:
+			return nil, fmt.Errorf("failed to read input: %w", err)
+		}
+	}
+
+	env, key, err := newWriteEnvelope(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	row, err := s.store(ctx, input, key, env, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// An existing paste found by WithDedup keeps its own previous version.
+	previousFingerprint, previousHash := opts.previousFingerprint, opts.previousHash
+	if row.deduped {
+		previousFingerprint, previousHash = row.PreviousFingerprint, row.PreviousHash
+	}
+
+	// Passphrase protected pastes must not leak the derived key in the URL.
+	pasteKey := opts.key
+	if opts.passphrase != "" {
+		pasteKey = nil
+	}
+
+	return &Paste{
+		URL: s.pasteURL(row.Fingerprint, row.Hash, pasteKey),
+
+		Hash:                row.Hash,
+		Fingerprint:         row.Fingerprint,
+		PreviousHash:        previousHash,
+		PreviousFingerprint: previousFingerprint,
+
+		Key:         pasteKey,
+		ContentType: opts.contentType,
+		QueryID:     row.QueryID,
+		Stats:       row.Stats,
+		size:        row.Size,
+
+		passphrase:    opts.passphrase,
+		kdfParams:     opts.kdfParams,
+		ageRecipients: opts.ageRecipients,
+	}, nil
+}
+
+// validateWriteOptions checks the options of a write before any content is
+// read.
+func (s *Service) validateWriteOptions(opts *writeOptions) error {
+	if opts.previousErr != nil {
+		return fmt.Errorf("invalid previous paste: %w", opts.previousErr)
+	}
+	// The previous pointers are stored as integers of exactly these sizes,
+	// or zero when there is no previous version.
+	if opts.previousHash != nil && (len(opts.previousFingerprint) != len(legacyFingerprint) || len(opts.previousHash) != 16) {
+		return fmt.Errorf("%w: invalid previous paste reference %x/%x", ErrInvalidURL, opts.previousFingerprint, opts.previousHash)
+	}
+
+	if opts.fingerprint != nil && len(opts.fingerprint) != len(legacyFingerprint) {
+		return fmt.Errorf("%w: must be %d bytes long", ErrInvalidFingerprint, len(legacyFingerprint))
+	}
+
+	if err := s.validateExpiry(opts.expiry); err != nil {
+		return err
+	}
+
+	if len(opts.contentType) > maxContentTypeSize {
+		return fmt.Errorf("%w: longer than %d bytes", ErrInvalidContentType, maxContentTypeSize)
+	}
+
+	if opts.ageRecipients != nil && (opts.key != nil || opts.passphrase != "") {
+		return fmt.Errorf("%w: age recipients cannot be combined with a key or passphrase", ErrInvalidKey)
+	}
+
+	return nil
+}
+
+// newWriteEnvelope returns the envelope of content written with opts, and the
+// key to encrypt it with, or nil for unencrypted content. A passphrase is
+// derived into a key with a random salt.
+func newWriteEnvelope(opts *writeOptions) (*envelope, *contentKey, error) {
+	encrypted := opts.key != nil || opts.passphrase != "" || opts.ageRecipients != nil
+
+	// age authenticates content and needs no IV of its own.
+	env := &envelope{
+		compression: opts.compression,
+		manifest:    opts.manifest,
+		contentType: opts.contentType != "",
+		mac:         opts.mac && encrypted && opts.ageRecipients == nil,
+		age:         opts.ageRecipients != nil,
+	}
+	switch {
+	case env.age:
+		return env, &contentKey{recipients: opts.ageRecipients}, nil
+	case !encrypted:
+		return env, nil, nil
+	}
+
+	if opts.randomIV {
+		env.iv = make([]byte, aes.BlockSize)
+		if _, err := rand.Read(env.iv); err != nil {
+			return nil, nil, fmt.Errorf("failed to generate IV: %w", err)
+		}
+	}
+
+	encryptionKey := opts.key
+	if opts.passphrase != "" {
+		if err := opts.kdfParams.validate(); err != nil {
+			return nil, nil, err
+		}
+
+		env.kdf = &kdfField{params: opts.kdfParams, salt: make([]byte, kdfSaltSize)}
+		if _, err := rand.Read(env.kdf.salt); err != nil {
+			return nil, nil, fmt.Errorf("failed to generate salt: %w", err)
+		}
+		encryptionKey = env.kdf.params.deriveKey(opts.passphrase, env.kdf.salt)
+	}
+
+	block, err := aes.NewCipher(encryptionKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w, failed to create AES cipher: %w", ErrInvalidKey, err)
+	}
+	key := &contentKey{block: block}
+
+	if env.mac {
+		key.macKey, err = deriveMACKey(encryptionKey)
 		if err != nil {
-			return nil, fmt.Errorf("%w, failed to create AES cipher: %w", ErrInvalidKey, err)
+			return nil, nil, err
 		}
+	}
 
-		iv := make([]byte, aes.BlockSize)
-		stream := cipher.NewCTR(block, iv)
-		encrypted := make([]byte, len(b))
-		stream.XORKeyStream(encrypted, b)
+	return env, key, nil
+}
 
-		content = base64.StdEncoding.EncodeToString(encrypted)
-		isEncrypted = true
+// store inserts the content of input, or with WithDedup returns the row of
+// the same content stored already. Seekable input is retried.
+func (s *Service) store(ctx context.Context, input io.Reader, key *contentKey, env *envelope, opts *writeOptions) (*storedRow, error) {
+	if opts.dedup {
+		row, rest, err := s.lookup(ctx, input, key, env, opts)
+		if err != nil {
+			return nil, err
+		}
+		if row != nil {
+			return &storedRow{Row: row, deduped: true}, nil
+		}
+		input = rest
+	}
+
+	// Streamed content cannot be replayed, so only seekable input is retried.
+	var row *Row
+	insert := func() (err error) {
+		row, err = s.insert(ctx, input, key, env, opts)
+		return err
+	}
+
+	// Seeking fails for files such as pipes, and for pastes read without
+	// WithSpool.
+	seeker, seekable := input.(io.Seeker)
+	var start int64
+	if seekable {
+		var seekErr error
+		start, seekErr = seeker.Seek(0, io.SeekCurrent)
+		seekable = seekErr == nil
+	}
+
+	var err error
+	if seekable {
+		err = s.retry(ctx, func() error {
+			if _, seekErr := seeker.Seek(start, io.SeekStart); seekErr != nil {
+				return fmt.Errorf("failed to read input: %w", seekErr)
+			}
+			return insert()
+		})
 	} else {
-		content = string(b)
+		err = s.attempt(ctx, insert)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	hash := siphash128.SipHash128([]byte(content))
-	fingerprint := bytes.Repeat([]byte{0xff}, 4)
+	return &storedRow{Row: row}, nil
+}
+
+// storedRow is the row of a written paste.
+type storedRow struct {
+	*Row
+
+	// deduped is set for a row found by WithDedup instead of inserted.
+	deduped bool
+}
 
-	var buf bytes.Buffer
+// lookup returns the stored row of the content of input, if any, and a
+// reader of the content to insert otherwise. Seekable input is read twice,
+// other input is held in memory.
+func (s *Service) lookup(
+	ctx context.Context, input io.Reader, key *contentKey, env *envelope, opts *writeOptions,
+) (*Row, io.Reader, error) {
+	content := input
+	if s.MaxSize > 0 {
+		content = &maxSizeReader{ReadCloser: io.NopCloser(input), max: s.MaxSize, remaining: s.MaxSize}
+	}
 
-	if err := json.NewEncoder(&buf).Encode(insertRow{
-		Encrypted:          isEncrypted,
-		Content:            content,
-		HashHex:            hex.EncodeToString(hash[:]),
-		FingerprintHex:     hex.EncodeToString(fingerprint),
-		PrevHashHex:        hex.EncodeToString(opts.previousHash),
-		PrevFingerprintHex: hex.EncodeToString(opts.previousFingerprint),
-	}); err != nil {
-		return nil, fmt.Errorf("failed to encode insert row: %w", err)
+	// Seeking fails for files such as pipes.
+	seeker, seekable := input.(io.Seeker)
+	var start int64
+	if seekable {
+		var err error
+		start, err = seeker.Seek(0, io.SeekCurrent)
+		seekable = err == nil
+	}
+	if !seekable {
+		data, err := io.ReadAll(content)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read input: %w", err)
+		}
+		input = bytes.NewReader(data)
+		content = input
 	}
 
-	req, err := s.clickHouseRequest(insertDataQuery, &buf)
+	ref, err := encodeContent(io.Discard, content, key, env, opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create ClickHouse request: %w", err)
+		return nil, nil, err
+	}
+	if seekable {
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return nil, nil, fmt.Errorf("failed to read input: %w", err)
+		}
 	}
 
-	res, err := s.executeRequestWithParams(req, nil)
+	row, err := s.statRef(ctx, *ref)
+	if errors.Is(err, ErrNotFound) {
+		return nil, input, nil
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute ClickHouse request: %w", err)
+		return nil, nil, err
 	}
-	defer res.Body.Close()
 
-	var keyAppend string
-	if opts.key != nil {
-		keyAppend = "#" + base64.StdEncoding.EncodeToString(opts.key)
+	row.Ref = *ref
+	return row, nil, nil
+}
+
+// insert encodes input and stores it as a new row. The content is encoded
+// while the backend reads it.
+func (s *Service) insert(
+	ctx context.Context, input io.Reader, key *contentKey, env *envelope, opts *writeOptions,
+) (*Row, error) {
+	if s.MaxSize > 0 {
+		input = &maxSizeReader{ReadCloser: io.NopCloser(input), max: s.MaxSize, remaining: s.MaxSize}
 	}
 
-	pastilaURL := s.PastilaURL
-	if pastilaURL == "" {
-		pastilaURL = chURL
+	content, contentWriter := io.Pipe()
+	row := &InsertRow{
+		PreviousFingerprint: opts.previousFingerprint,
+		PreviousHash:        opts.previousHash,
+		Encrypted:           key != nil,
+		Content:             content,
+	}
+	if opts.expiry > 0 {
+		row.Expires = time.Now().Add(opts.expiry).Truncate(time.Second)
 	}
 
-	return &Paste{
-		URL: fmt.Sprintf("%s?%x/%x%s", pastilaURL, fingerprint, hash, keyAppend),
+	encoded := make(chan error, 1)
+	counter := &countingWriter{w: contentWriter}
+	go func() {
+		ref, err := encodeContent(counter, input, key, env, opts)
+		if err == nil {
+			row.ref = *ref
+		}
+		_ = contentWriter.CloseWithError(err)
+		encoded <- err
+	}()
 
-		Hash:                hash[:],
-		Fingerprint:         fingerprint,
-		PreviousHash:        opts.previousHash,
-		PreviousFingerprint: opts.previousFingerprint,
+	stored, err := s.backend().Insert(ctx, row)
+	_ = content.Close()
+	encodeErr := <-encoded
 
-		Key:     opts.key,
-		QueryID: res.Header.Get("X-ClickHouse-Query-Id"),
-	}, nil
+	// A failing input makes the insert fail too; report the cause.
+	if encodeErr != nil && (err == nil || !errors.Is(encodeErr, io.ErrClosedPipe)) {
+		return nil, encodeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	stored.Size = counter.n
+
+	return stored, nil
+}
+
+// defaultUserAgent carries the version of this module, as recorded in the
+// build info of the binary it is part of.
+var defaultUserAgent = sync.OnceValue(func() string {
+	version := "dev"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if info.Main.Path == modulePath && info.Main.Version != "(devel)" && info.Main.Version != "" {
+			version = info.Main.Version
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == modulePath {
+				version = dep.Version
+			}
+		}
+	}
+
+	return "PastilaCLI/" + strings.TrimPrefix(version, "v")
+})
+
+// pasteURL builds the pastila URL of a paste. The key, if any, goes into the
+// fragment, so browsers never send it to the server.
+func (s *Service) pasteURL(fingerprint, hash, key []byte) string {
+	ref := PasteRef{Ref: Ref{Fingerprint: fingerprint, Hash: hash}, Key: key}
+	if s.URLBuilder != nil {
+		return s.URLBuilder(ref)
+	}
+
+	return ref.URL(s.PastilaURL)
 }
 
 func (s *Service) executeRequestWithParams(request *http.Request, params map[string]string) (*http.Response, error) {
@@ -281,14 +1065,44 @@ func (s *Service) executeRequestWithParams(request *http.Request, params map[str
 	for key, value := range params {
 		reqQuery.Add("param_"+key, value)
 	}
+	if s.HTTPCompression {
+		reqQuery.Set("enable_http_compression", "1")
+		request.Header.Set("Accept-Encoding", "gzip")
+		if request.Body != nil && request.Body != http.NoBody {
+			request.Body = gzipRequestBody(request.Body)
+			request.GetBody = nil
+			request.ContentLength = -1
+			request.Header.Set("Content-Encoding", "gzip")
+		}
+	}
 	request.URL.RawQuery = reqQuery.Encode()
+	s.SignRequest(request)
+
+	if s.RequestHook != nil {
+		s.RequestHook(request)
+	}
 
-	resp, err := HTTPClient.Do(request)
+	start := time.Now()
+	resp, err := s.httpClient().Do(request)
+	if err == nil && s.ResponseHook != nil {
+		s.ResponseHook(resp, time.Since(start))
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute ClickHouse request: %w", err)
+		return nil, fmt.Errorf("failed to execute ClickHouse request: %w", wrapRequestError(request.Context(), err))
+	}
+
+	// Setting Accept-Encoding turns off the transparent decompression of
+	// http.Transport.
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		resp.Body = &gzipResponseBody{body: resp.Body}
+		resp.Header.Del("Content-Encoding")
+		resp.ContentLength = -1
 	}
 
-	if resp.Header.Get("X-ClickHouse-Query-Id") == "" {
+	// Private backends rejecting a request answer without a query ID, and
+	// their answer is reported like one of ClickHouse.
+	rejected := resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden
+	if resp.Header.Get("X-ClickHouse-Query-Id") == "" && !rejected {
 		_ = resp.Body.Close()
 		return nil, fmt.Errorf("%w, missing query id", ErrInvalidURL)
 	}
@@ -298,20 +1112,27 @@ func (s *Service) executeRequestWithParams(request *http.Request, params map[str
 		_, _ = responseBody.ReadFrom(resp.Body)
 		_ = resp.Body.Close()
 
-		return nil, fmt.Errorf("unexpected status code: %d, response: %s", resp.StatusCode, responseBody.String())
+		return nil, parseClickHouseError(
+			resp.StatusCode, resp.Header.Get("X-ClickHouse-Exception-Code"), responseBody.String(),
+		)
 	}
 
 	return resp, nil
 }
 
-func (s *Service) clickHouseRequest(query string, body io.Reader) (*http.Request, error) {
-	clickHouseURL := s.ClickHouseURL
-	if clickHouseURL == "" {
-		clickHouseURL = DefaultClickHouseURL
+func (s *Service) httpClient() *http.Client {
+	if s.Client != nil {
+		return s.Client
+	}
+	if HTTPClient != nil {
+		return HTTPClient
 	}
 
-	ctx := context.Background()
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, clickHouseURL, body)
+	return http.DefaultClient
+}
+
+func (s *Service) clickHouseRequest(ctx context.Context, endpoint, query string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create ClickHouse request: %w", err)
 	}
@@ -320,15 +1141,33 @@ func (s *Service) clickHouseRequest(query string, body io.Reader) (*http.Request
 		req.AddCookie(&http.Cookie{Name: "auth", Value: s.AuthCookie})
 	}
 
-	if err != nil {
-		return nil, fmt.Errorf("failed to create ClickHouse request: %w", err)
-	}
-
 	urlQuery := req.URL.Query()
 	urlQuery.Add("query", query)
+	if s.QueryID != nil {
+		if id := s.QueryID(ctx); id != "" {
+			urlQuery.Set("query_id", id)
+		}
+	}
+
+	// ClickHouse rejects requests authenticated in more than one way.
+	if s.User != "" || s.JWT != "" {
+		urlQuery.Del("user")
+		urlQuery.Del("password")
+	}
+	if s.User != "" {
+		req.Header.Set("X-ClickHouse-User", s.User)
+		req.Header.Set("X-ClickHouse-Key", s.Password)
+	}
+	if s.JWT != "" {
+		req.Header.Set("Authorization", "Bearer "+s.JWT)
+	}
 
 	req.URL.RawQuery = urlQuery.Encode()
-	req.Header.Set("User-Agent", "PastilaCLI/1.0")
+	userAgent := s.UserAgent
+	if userAgent == "" {
+		userAgent = defaultUserAgent()
+	}
+	req.Header.Set("User-Agent", userAgent)
 
 	return req, nil
 }
@@ -0,0 +1,480 @@
+package pastila
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+// ErrInvalidConfig is returned by NewService for unusable options.
+var ErrInvalidConfig = fmt.Errorf("invalid service configuration")
+
+// ServiceOption configures a Service built by NewService.
+type ServiceOption func(*serviceOptions)
+
+type serviceOptions struct {
+	service        Service
+	connectTimeout time.Duration
+	unixSocket     string
+	rateLimit      *rateLimit
+
+	metricsRegistry prometheus.Registerer
+	cache           *cacheConfig
+}
+
+type cacheConfig struct {
+	dir      string
+	maxBytes int64
+}
+
+type rateLimit struct {
+	rps   float64
+	burst int
+}
+
+// WithPastilaURL sets the URL of the pastila service used in paste URLs.
+func WithPastilaURL(pastilaURL string) ServiceOption {
+	return func(o *serviceOptions) {
+		o.service.PastilaURL = pastilaURL
+	}
+}
+
+// WithClickHouseURL sets the URL of the ClickHouse service storing pastes.
+func WithClickHouseURL(clickHouseURL string) ServiceOption {
+	return func(o *serviceOptions) {
+		o.service.ClickHouseURL = clickHouseURL
+	}
+}
+
+// WithTable makes the Service store pastes in table of database on the
+// ClickHouse service, instead of in the data table of the default database,
+// for deployments with other schemas or a database per tenant. The table
+// must have the columns of the data table of the pastila service. Either
+// name may be empty to keep its default. Backends set by WithBackend must
+// implement TableBackend.
+func WithTable(database, table string) ServiceOption {
+	return func(o *serviceOptions) {
+		o.service.Database = database
+		o.service.Table = table
+	}
+}
+
+// WithEndpoints sets the URLs of replicas of the ClickHouse service, which
+// requests fail over between. It replaces WithClickHouseURL.
+func WithEndpoints(urls ...string) ServiceOption {
+	return func(o *serviceOptions) {
+		o.service.Endpoints = urls
+	}
+}
+
+// WithLoadBalancedReads spreads reads over the endpoints set by
+// WithEndpoints in turn.
+func WithLoadBalancedReads() ServiceOption {
+	return func(o *serviceOptions) {
+		o.service.LoadBalanceReads = true
+	}
+}
+
+// WithHTTPClient sets the HTTP client used to talk to ClickHouse.
+func WithHTTPClient(client *http.Client) ServiceOption {
+	return func(o *serviceOptions) {
+		o.service.Client = client
+	}
+}
+
+// WithAuthCookie sets the auth cookie of a pastila deployment with authentication.
+func WithAuthCookie(cookie string) ServiceOption {
+	return func(o *serviceOptions) {
+		o.service.AuthCookie = cookie
+	}
+}
+
+// WithAuth authenticates requests to ClickHouse as user, instead of with
+// credentials in the ClickHouse URL.
+func WithAuth(user, password string) ServiceOption {
+	return func(o *serviceOptions) {
+		o.service.User = user
+		o.service.Password = password
+	}
+}
+
+// WithJWT authenticates requests to ClickHouse Cloud with a JWT.
+func WithJWT(token string) ServiceOption {
+	return func(o *serviceOptions) {
+		o.service.JWT = token
+	}
+}
+
+// WithUserAgent sets the User-Agent of requests to ClickHouse, so embedding
+// applications can identify themselves.
+func WithUserAgent(userAgent string) ServiceOption {
+	return func(o *serviceOptions) {
+		o.service.UserAgent = userAgent
+	}
+}
+
+// WithQueryID makes requests to ClickHouse carry the query IDs id-1, id-2 and
+// so on, in the order they are sent, so operators can find them in
+// system.query_log by the id prefix. Requests are numbered because ClickHouse
+// rejects a query while another one with the same ID is running.
+func WithQueryID(id string) ServiceOption {
+	var sent atomic.Uint64
+	return WithQueryIDFunc(func(context.Context) string {
+		return fmt.Sprintf("%s-%d", id, sent.Add(1))
+	})
+}
+
+// WithQueryIDFunc makes requests to ClickHouse carry the query IDs returned
+// by fn, e.g. to take a correlation ID from the context, see Service.QueryID.
+// The IDs of concurrent requests must differ.
+func WithQueryIDFunc(fn func(ctx context.Context) string) ServiceOption {
+	return func(o *serviceOptions) {
+		o.service.QueryID = fn
+	}
+}
+
+// WithMaxSize limits the size of the content of written and read pastes, see
+// Service.MaxSize.
+func WithMaxSize(bytes int64) ServiceOption {
+	return func(o *serviceOptions) {
+		o.service.MaxSize = bytes
+	}
+}
+
+// WithTimeouts limits the time to connect to ClickHouse, and the time of
+// each request reading and writing pastes, including reading the content of
+// the response, so a slow server cannot hang the Service. Requests exceeding
+// the read or write timeout fail with ErrTimeout and are retried. Zero
+// durations leave the respective time unlimited. The connect timeout
+// requires the client set by WithHTTPClient, if any, to use an
+// *http.Transport, which is copied.
+func WithTimeouts(connect, read, write time.Duration) ServiceOption {
+	return func(o *serviceOptions) {
+		o.connectTimeout = connect
+		o.service.ReadTimeout = read
+		o.service.WriteTimeout = write
+	}
+}
+
+// WithUnixSocket makes the Service connect to ClickHouse through the unix
+// domain socket at path, such as a local server's or one forwarded from
+// another host, instead of the host of the ClickHouse URL, which only sets
+// the Host header then. Like the connect timeout of WithTimeouts, it requires
+// the client set by WithHTTPClient, if any, to use an *http.Transport, which
+// is copied.
+func WithUnixSocket(path string) ServiceOption {
+	return func(o *serviceOptions) {
+		o.unixSocket = path
+	}
+}
+
+// WithHTTPCompression makes the Service compress the data sent to and
+// received from ClickHouse with gzip, which it must allow the
+// enable_http_compression setting for.
+func WithHTTPCompression() ServiceOption {
+	return func(o *serviceOptions) {
+		o.service.HTTPCompression = true
+	}
+}
+
+// WithAsyncInsert makes ClickHouse insert written pastes asynchronously,
+// which cuts the latency of writes to busy servers. With wait, Write still
+// returns only once the paste is stored; see Service.AsyncInsert for the
+// risks of not waiting. The user must be allowed to change the async_insert
+// and wait_for_async_insert settings.
+func WithAsyncInsert(wait bool) ServiceOption {
+	return func(o *serviceOptions) {
+		o.service.AsyncInsert = true
+		o.service.AsyncInsertWait = wait
+	}
+}
+
+// WithWireFormat sets the formats rows are exchanged with ClickHouse in, see
+// Service.WireFormat.
+func WithWireFormat(f WireFormat) ServiceOption {
+	return func(o *serviceOptions) {
+		o.service.WireFormat = f
+	}
+}
+
+// WithRetry sets the retry policy of transient failures.
+func WithRetry(policy RetryPolicy) ServiceOption {
+	return func(o *serviceOptions) {
+		o.service.Retry = policy
+	}
+}
+
+// WithRateLimit limits requests to the backend to rps per second with bursts
+// of up to burst requests. The limit is shared by all Reads and Writes of the
+// Service.
+func WithRateLimit(rps float64, burst int) ServiceOption {
+	return func(o *serviceOptions) {
+		o.rateLimit = &rateLimit{rps: rps, burst: burst}
+	}
+}
+
+// WithRequestHook adds a hook called with every request to ClickHouse right
+// before it is sent. Hooks are called in the order they were added.
+func WithRequestHook(hook func(*http.Request)) ServiceOption {
+	return func(o *serviceOptions) {
+		previous := o.service.RequestHook
+		if previous == nil {
+			o.service.RequestHook = hook
+			return
+		}
+
+		o.service.RequestHook = func(req *http.Request) {
+			previous(req)
+			hook(req)
+		}
+	}
+}
+
+// WithResponseHook adds a hook called with every response of ClickHouse and
+// its latency. Hooks are called in the order they were added.
+func WithResponseHook(hook func(*http.Response, time.Duration)) ServiceOption {
+	return func(o *serviceOptions) {
+		previous := o.service.ResponseHook
+		if previous == nil {
+			o.service.ResponseHook = hook
+			return
+		}
+
+		o.service.ResponseHook = func(res *http.Response, latency time.Duration) {
+			previous(res, latency)
+			hook(res, latency)
+		}
+	}
+}
+
+// WithTracerProvider makes the Service emit spans of Reads and Writes to tp.
+func WithTracerProvider(tp trace.TracerProvider) ServiceOption {
+	return func(o *serviceOptions) {
+		o.service.Tracer = tp.Tracer(instrumentationName)
+	}
+}
+
+// WithMetrics makes the Service collect Prometheus metrics of Reads and
+// Writes, registered with reg.
+func WithMetrics(reg prometheus.Registerer) ServiceOption {
+	return func(o *serviceOptions) {
+		o.metricsRegistry = reg
+	}
+}
+
+// WithURLBuilder makes the Service form the URLs of written pastes with b,
+// instead of appending the reference to the pastila URL as a query.
+func WithURLBuilder(b URLBuilder) ServiceOption {
+	return func(o *serviceOptions) {
+		o.service.URLBuilder = b
+	}
+}
+
+// WithKeyProvider makes the Service ask p for the keys of encrypted pastes
+// read from URLs without a key.
+func WithKeyProvider(p KeyProvider) ServiceOption {
+	return func(o *serviceOptions) {
+		o.service.KeyProvider = p
+	}
+}
+
+// WithCache makes the Service cache read pastes in dir, using at most
+// maxBytes of disk space.
+func WithCache(dir string, maxBytes int64) ServiceOption {
+	return func(o *serviceOptions) {
+		o.cache = &cacheConfig{dir: dir, maxBytes: maxBytes}
+	}
+}
+
+// WithBackend makes the Service store pastes in b instead of ClickHouse.
+func WithBackend(b Backend) ServiceOption {
+	return func(o *serviceOptions) {
+		o.service.Backend = b
+	}
+}
+
+// NewService builds a Service and validates its configuration. Options not
+// given fall back to the defaults of the public pastila service.
+func NewService(opt ...ServiceOption) (*Service, error) {
+	opts := &serviceOptions{}
+	for _, o := range opt {
+		o(opts)
+	}
+
+	service := opts.service
+	if err := validateServiceURLs(&service); err != nil {
+		return nil, err
+	}
+	if err := validateService(&service); err != nil {
+		return nil, err
+	}
+
+	if len(service.Endpoints) > 1 {
+		service.endpointState = &endpointState{}
+	}
+	service.wireFormatState = &wireFormatState{}
+	service.batchState = &batchState{}
+
+	if service.Backend != nil && (service.Database != "" || service.Table != "") {
+		tableBackend, ok := service.Backend.(TableBackend)
+		if !ok {
+			return nil, fmt.Errorf("%w: backend %T does not support tables", ErrInvalidConfig, service.Backend)
+		}
+		tableBackend.SetTable(service.Database, service.Table)
+	}
+
+	if err := setupTransport(&service, opts); err != nil {
+		return nil, err
+	}
+	if err := setupExtensions(&service, opts); err != nil {
+		return nil, err
+	}
+
+	return &service, nil
+}
+
+// validateServiceURLs checks that the URLs of service are absolute http(s)
+// URLs.
+func validateServiceURLs(service *Service) error {
+	urls := []struct{ name, value string }{
+		{"pastila URL", service.PastilaURL},
+		{"ClickHouse URL", service.ClickHouseURL},
+	}
+	for _, endpoint := range service.Endpoints {
+		if endpoint == "" {
+			return fmt.Errorf("%w: empty endpoint", ErrInvalidConfig)
+		}
+		urls = append(urls, struct{ name, value string }{"endpoint", endpoint})
+	}
+	for _, u := range urls {
+		name, value := u.name, u.value
+		if value == "" {
+			continue
+		}
+
+		u, err := url.Parse(value)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %w", ErrInvalidConfig, name, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%w: %s must be an absolute http(s) URL: %s", ErrInvalidConfig, name, value)
+		}
+	}
+
+	if service.ClickHouseURL != "" && len(service.Endpoints) > 0 {
+		return fmt.Errorf("%w: ClickHouse URL and endpoints are exclusive", ErrInvalidConfig)
+	}
+
+	return nil
+}
+
+// validateService checks the settings of service other than its URLs.
+func validateService(service *Service) error {
+	if service.WireFormat != WireFormatAuto && service.WireFormat != WireFormatJSON {
+		return fmt.Errorf("%w: unknown wire format %d", ErrInvalidConfig, service.WireFormat)
+	}
+
+	if service.User != "" && service.JWT != "" {
+		return fmt.Errorf("%w: user and JWT authentication are exclusive", ErrInvalidConfig)
+	}
+	if service.User == "" && service.Password != "" {
+		return fmt.Errorf("%w: password without user", ErrInvalidConfig)
+	}
+
+	if service.MaxSize < 0 {
+		return fmt.Errorf("%w: negative maximum size", ErrInvalidConfig)
+	}
+
+	if service.Retry.MaxAttempts < 0 || service.Retry.BaseDelay < 0 || service.Retry.MaxDelay < 0 ||
+		service.Retry.Jitter < 0 || service.Retry.Jitter > 1 {
+		return fmt.Errorf("%w: invalid retry policy", ErrInvalidConfig)
+	}
+
+	return nil
+}
+
+// setupTransport sets a client of service connecting with the timeout and
+// through the unix socket of opts, if any.
+func setupTransport(service *Service, opts *serviceOptions) error {
+	if opts.connectTimeout < 0 || service.ReadTimeout < 0 || service.WriteTimeout < 0 {
+		return fmt.Errorf("%w: negative timeout", ErrInvalidConfig)
+	}
+	if opts.connectTimeout == 0 && opts.unixSocket == "" {
+		return nil
+	}
+
+	client := &http.Client{}
+	if service.Client != nil {
+		*client = *service.Client
+	}
+	transport, err := dialTransport(client.Transport, opts.connectTimeout, opts.unixSocket)
+	if err != nil {
+		return err
+	}
+	client.Transport = transport
+	service.Client = client
+
+	return nil
+}
+
+// setupExtensions sets the rate limiter, metrics and cache of service, if
+// opts ask for them.
+func setupExtensions(service *Service, opts *serviceOptions) error {
+	if opts.rateLimit != nil {
+		if opts.rateLimit.rps <= 0 || opts.rateLimit.burst < 1 {
+			return fmt.Errorf("%w: rate limit must be positive", ErrInvalidConfig)
+		}
+		service.Limiter = rate.NewLimiter(rate.Limit(opts.rateLimit.rps), opts.rateLimit.burst)
+	}
+
+	if opts.metricsRegistry != nil {
+		metrics, err := NewMetrics(opts.metricsRegistry)
+		if err != nil {
+			return fmt.Errorf("%w: failed to register metrics: %w", ErrInvalidConfig, err)
+		}
+		service.Metrics = metrics
+	}
+
+	if opts.cache != nil {
+		cache, err := NewCache(opts.cache.dir, opts.cache.maxBytes)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+		}
+		service.Cache = cache
+	}
+
+	return nil
+}
+
+// dialTransport returns a copy of rt that gives up connecting, and the TLS
+// handshake, after timeout, if not zero, and connects to socket, if set.
+func dialTransport(rt http.RoundTripper, timeout time.Duration, socket string) (*http.Transport, error) {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	transport, ok := rt.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("%w: connect timeout and unix socket need an *http.Transport, got %T", ErrInvalidConfig, rt)
+	}
+
+	transport = transport.Clone()
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+	transport.DialContext = dialer.DialContext
+	if socket != "" {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+	}
+	if timeout > 0 {
+		transport.TLSHandshakeTimeout = timeout
+	}
+	return transport, nil
+}
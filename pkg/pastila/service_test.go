@@ -2,8 +2,27 @@ package pastila
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -12,7 +31,7 @@ import (
 )
 
 func TestReadEncrypted(t *testing.T) {
-	service := &Service{}
+	service := &Service{Client: &http.Client{Transport: chtest.NewRecorder(t, "read_encrypted")}}
 	r, err := service.Read("https://pastila.nl/?ffffffff/52662368cc45b2ad0e9a47faa8582369#2L9DFnYzHu27jLxA9elfyg==")
 
 	require.NoError(t, err)
@@ -24,7 +43,7 @@ func TestReadEncrypted(t *testing.T) {
 }
 
 func TestReadUnencrypted(t *testing.T) {
-	service := &Service{}
+	service := &Service{Client: &http.Client{Transport: chtest.NewRecorder(t, "read_unencrypted")}}
 	r, err := service.Read("https://pastila.nl/?c055a950/620234bcb081dcff3cfdf3c3c2806062")
 
 	require.NoError(t, err)
@@ -49,6 +68,36 @@ func TestReadInvalidUrlPath(t *testing.T) {
 	assert.ErrorIs(t, err, ErrInvalidURL)
 }
 
+func TestParseURL(t *testing.T) {
+	ref, err := ParseURL("https://pastila.nl/?ffffffff/52662368cc45b2ad0e9a47faa8582369#MDEyMzQ1Njc4OWFiY2RlZg==")
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0xff, 0xff, 0xff, 0xff}, ref.Fingerprint)
+	assert.Equal(t, "52662368cc45b2ad0e9a47faa8582369", hex.EncodeToString(ref.Hash))
+	assert.Equal(t, []byte("0123456789abcdef"), ref.Key)
+	assert.Equal(t, "ffffffff/52662368cc45b2ad0e9a47faa8582369#MDEyMzQ1Njc4OWFiY2RlZg==", ref.String())
+	assert.Equal(t, "https://paste.example.com/?"+ref.String(), ref.URL("https://paste.example.com/"))
+
+	ref, err = ParseURL("ffffffff/52662368cc45b2ad0e9a47faa8582369")
+	require.NoError(t, err)
+	assert.Nil(t, ref.Key)
+	assert.Equal(t, "https://pastila.nl/?ffffffff/52662368cc45b2ad0e9a47faa8582369", ref.URL(""))
+
+	_, err = ParseURL("https://pastila.nl/?ffffffff/52662368cc45b2ad0e9a47faa8582369#invalid")
+	assert.ErrorIs(t, err, ErrInvalidKey)
+	_, err = ParseURL("https://some.url/invalid/path")
+	assert.ErrorIs(t, err, ErrInvalidURL)
+}
+
+func TestReadContextCanceled(t *testing.T) {
+	service := &Service{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := service.ReadContext(ctx, "https://pastila.nl/?c055a950/620234bcb081dcff3cfdf3c3c2806062")
+
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
 func ensureLocalService(t *testing.T) *Service {
 	chURL = chtest.EnsureClickHouseInstance(t)
 	return &Service{ClickHouseURL: chURL, PastilaURL: "http://mylocal.pastila.nl/"}
@@ -85,3 +134,1232 @@ func TestWriteEncryptedOwnKey(t *testing.T) {
 	assert.NotEmpty(t, url.QueryID)
 	assert.Equal(t, "http://mylocal.pastila.nl/?ffffffff/f7dfa9488fcbea210ff70e44d0566245#AQEBAQEBAQEBAQEBAQEBAQ==", url.URL)
 }
+
+func TestWriteEncryptedRandomIV(t *testing.T) {
+	const expectedContent = "Hello ClickHouse!"
+
+	service := ensureLocalService(t)
+
+	key := bytes.Repeat([]byte{0x01}, 16)
+	first, err := service.Write(bytes.NewBufferString(expectedContent), WithKey(key), WithRandomIV())
+	require.NoError(t, err)
+	second, err := service.Write(bytes.NewBufferString(expectedContent), WithKey(key), WithRandomIV())
+	require.NoError(t, err)
+	assert.NotEqual(t, first.Hash, second.Hash)
+
+	paste, err := service.Read(first.URL)
+	require.NoError(t, err)
+
+	actualContent, err := io.ReadAll(paste)
+	require.NoError(t, paste.Close())
+	require.NoError(t, err)
+
+	assert.Equal(t, expectedContent, string(actualContent))
+}
+
+func TestWritePassphrase(t *testing.T) {
+	const expectedContent = "Hello ClickHouse!"
+
+	service := ensureLocalService(t)
+
+	paste, err := service.Write(bytes.NewBufferString(expectedContent), WithPassphrase("correct horse", DefaultKDFParams))
+	require.NoError(t, err)
+	assert.NotContains(t, paste.URL, "#")
+
+	_, err = service.Read(paste.URL)
+	assert.ErrorIs(t, err, ErrPassphraseRequired)
+
+	paste, err = service.Read(paste.URL, WithReadPassphrase("correct horse"))
+	require.NoError(t, err)
+
+	actualContent, err := io.ReadAll(paste)
+	require.NoError(t, paste.Close())
+	require.NoError(t, err)
+
+	assert.Equal(t, expectedContent, string(actualContent))
+}
+
+func TestWriteInvalidFingerprint(t *testing.T) {
+	service := &Service{}
+	_, err := service.Write(bytes.NewBufferString("Hello ClickHouse!"), WithFingerprint([]byte{0x01}))
+
+	assert.ErrorIs(t, err, ErrInvalidFingerprint)
+}
+
+func TestHistory(t *testing.T) {
+	service := ensureLocalService(t)
+
+	key := bytes.Repeat([]byte{0x01}, 16)
+	first, err := service.Write(bytes.NewBufferString("first version"), WithKey(key))
+	require.NoError(t, err)
+	second, err := service.Write(bytes.NewBufferString("second version"), WithPreviousPaste(first))
+	require.NoError(t, err)
+
+	history, err := service.History(context.Background(), second.URL)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+
+	assert.Equal(t, second.Hash, history[0].Hash)
+	assert.Equal(t, first.Hash, history[0].PreviousHash)
+	assert.Equal(t, first.Fingerprint, history[0].PreviousFingerprint)
+	assert.Equal(t, first.Hash, history[1].Hash)
+	assert.Nil(t, history[1].PreviousHash)
+
+	latest, err := service.Latest(context.Background(), first.URL)
+	require.NoError(t, err)
+	assert.Equal(t, second.URL, latest.URL)
+
+	rows := chtest.ClickHouseSelect(t, service.ClickHouseURL, `
+SELECT
+	lower(hex(reinterpretAsFixedString(prev_fingerprint))) AS prev_fingerprint_hex,
+	lower(hex(reinterpretAsFixedString(prev_hash))) AS prev_hash_hex,
+	is_encrypted
+FROM data ORDER BY time`)
+	require.Len(t, rows, 2)
+	assert.Equal(t, map[string]any{"prev_fingerprint_hex": "", "prev_hash_hex": "", "is_encrypted": json.Number("1")}, rows[0])
+	previousFingerprint, err := decodePaddedHex(rows[1]["prev_fingerprint_hex"].(string), 4)
+	require.NoError(t, err)
+	previousHash, err := decodePaddedHex(rows[1]["prev_hash_hex"].(string), 16)
+	require.NoError(t, err)
+	assert.Equal(t, first.Fingerprint, previousFingerprint)
+	assert.Equal(t, first.Hash, previousHash)
+	assert.Equal(t, json.Number("1"), rows[1]["is_encrypted"])
+
+	for i, expectedContent := range []string{"second version", "first version"} {
+		actualContent, err := io.ReadAll(history[i])
+		require.NoError(t, err)
+		assert.Equal(t, expectedContent, string(actualContent))
+	}
+}
+
+func TestSelectRowPrevious(t *testing.T) {
+	row := selectRow{PrevFingerprintHex: "c055", PrevHashHex: "620234bcb081dcff3cfdf3c3c28060"}
+
+	fingerprint, hash, err := row.previous()
+	require.NoError(t, err)
+	assert.Equal(t, "c0550000", hex.EncodeToString(fingerprint))
+	assert.Equal(t, "620234bcb081dcff3cfdf3c3c2806000", hex.EncodeToString(hash))
+
+	fingerprint, hash, err = (&selectRow{}).previous()
+	require.NoError(t, err)
+	assert.Nil(t, fingerprint)
+	assert.Nil(t, hash)
+}
+
+func TestExists(t *testing.T) {
+	service := ensureLocalService(t)
+
+	paste, err := service.Write(bytes.NewBufferString("Hello ClickHouse!"))
+	require.NoError(t, err)
+
+	exists, err := service.Exists(context.Background(), paste.URL)
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = service.Exists(context.Background(), service.PastilaURL+"?ffffffff/00000000000000000000000000000000")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestStat(t *testing.T) {
+	service := ensureLocalService(t)
+
+	key := bytes.Repeat([]byte{0x01}, 16)
+	first, err := service.Write(bytes.NewBufferString("Hello ClickHouse!"), WithKey(key))
+	require.NoError(t, err)
+	second, err := service.Write(bytes.NewBufferString("Hello again!"), WithPreviousPaste(first))
+	require.NoError(t, err)
+
+	info, err := service.Stat(context.Background(), first.URL)
+	require.NoError(t, err)
+	assert.True(t, info.Encrypted)
+	assert.Equal(t, int64(base64.StdEncoding.EncodedLen(len("Hello ClickHouse!"))), info.Size)
+	assert.False(t, info.HasPrevious())
+	assert.WithinDuration(t, time.Now(), info.Time, time.Minute)
+
+	info, err = service.Stat(context.Background(), second.URL)
+	require.NoError(t, err)
+	assert.True(t, info.HasPrevious())
+	assert.Equal(t, first.Hash, info.PreviousHash)
+
+	usage, err := service.Usage(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), usage.Pastes)
+	assert.Equal(t, int64(2), usage.EncryptedPastes)
+	require.Len(t, usage.Daily, 1)
+}
+
+func TestWriteCompressed(t *testing.T) {
+	expectedContent := strings.Repeat("Hello ClickHouse! ", 1000)
+
+	service := ensureLocalService(t)
+
+	for _, opts := range [][]WriteOption{
+		{WithCompression(Zstd)},
+		{WithCompression(Zstd), WithKey(bytes.Repeat([]byte{0x01}, 16))},
+	} {
+		paste, err := service.Write(strings.NewReader(expectedContent), opts...)
+		require.NoError(t, err)
+
+		paste, err = service.Read(paste.URL)
+		require.NoError(t, err)
+
+		actualContent, err := io.ReadAll(paste)
+		require.NoError(t, paste.Close())
+		require.NoError(t, err)
+
+		assert.Equal(t, expectedContent, string(actualContent))
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestServiceClient(t *testing.T) {
+	errTransport := errors.New("transport called")
+	service := &Service{Client: &http.Client{Transport: roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return nil, errTransport
+	})}}
+
+	_, err := service.Read("https://pastila.nl/?c055a950/620234bcb081dcff3cfdf3c3c2806062")
+
+	assert.ErrorIs(t, err, errTransport)
+}
+
+func TestServiceRetry(t *testing.T) {
+	attempts := 0
+	service := &Service{
+		Client: &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			attempts++
+			if req.Body != nil {
+				_, _ = io.Copy(io.Discard, req.Body)
+			}
+			return &http.Response{
+				StatusCode: http.StatusServiceUnavailable,
+				Header:     http.Header{"X-Clickhouse-Query-Id": {"retry"}},
+				Body:       io.NopCloser(strings.NewReader("overloaded")),
+			}, nil
+		})},
+		Retry: RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond},
+	}
+
+	_, err := service.Read("https://pastila.nl/?c055a950/620234bcb081dcff3cfdf3c3c2806062")
+	require.Error(t, err)
+	assert.True(t, IsTransientError(err))
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	_, err = service.Write(strings.NewReader("seekable input is retried"))
+	require.Error(t, err)
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	_, err = service.Write(io.MultiReader(strings.NewReader("streamed input is not")))
+	require.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestServiceRestrictedUser(t *testing.T) {
+	const missing = "00000000000000000000000000000000"
+	var direct atomic.Int32
+	service := &Service{Client: &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		header := http.Header{"X-Clickhouse-Query-Id": {"restricted"}}
+		switch {
+		case !strings.Contains(req.URL.Query().Get("query"), "data_view"):
+			direct.Add(1)
+			header.Set("X-Clickhouse-Exception-Code", "277")
+			return &http.Response{StatusCode: http.StatusBadRequest, Header: header, Body: io.NopCloser(strings.NewReader(
+				"Code: 277. DB::Exception: Primary key (fingerprint, hash) is not used and setting 'force_primary_key' is set. " +
+					"(INDEX_NOT_USED) (version 24.3.1.1)\n"))}, nil
+		case req.URL.Query().Get("param_hashHex") == missing:
+			return &http.Response{StatusCode: http.StatusOK, Header: header, Body: http.NoBody}, nil
+		default:
+			return &http.Response{StatusCode: http.StatusOK, Header: header, Body: io.NopCloser(strings.NewReader(
+				`{"is_encrypted": false, "content": "restricted"}`))}, nil
+		}
+	})}}
+
+	pastes, err := service.ReadAll(context.Background(), []string{
+		"https://pastila.nl/?c055a950/620234bcb081dcff3cfdf3c3c2806062",
+		"https://pastila.nl/?c055a950/" + missing,
+	}, 1)
+	require.ErrorIs(t, err, ErrNotFound)
+	require.Len(t, pastes, 2)
+	require.NotNil(t, pastes[0])
+	content, err := io.ReadAll(pastes[0])
+	require.NoError(t, err)
+	assert.Equal(t, "restricted", string(content))
+	assert.Nil(t, pastes[1])
+
+	info, err := service.Stat(context.Background(), "https://pastila.nl/?c055a950/620234bcb081dcff3cfdf3c3c2806062")
+	require.NoError(t, err)
+	assert.EqualValues(t, len("restricted"), info.Size)
+	assert.True(t, info.Time.IsZero())
+
+	_, err = service.ListByFingerprint(context.Background(), []byte{0xc0, 0x55, 0xa9, 0x50})
+	assert.ErrorIs(t, err, errors.ErrUnsupported)
+	_, err = service.Latest(context.Background(), "https://pastila.nl/?c055a950/620234bcb081dcff3cfdf3c3c2806062")
+	assert.ErrorIs(t, err, errors.ErrUnsupported)
+	assert.EqualValues(t, 5, direct.Load())
+}
+
+func TestReadAllRestricted(t *testing.T) {
+	fake := chtest.NewFakeClickHouse(t)
+	var restricted atomic.Bool
+	var batches, selects, running, maxRunning atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		switch {
+		case strings.Contains(query, "arrayJoin(arrayZip("):
+			batches.Add(1)
+			if restricted.Load() {
+				w.Header().Set("X-ClickHouse-Exception-Code", "497")
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = io.WriteString(w, "Code: 497. DB::Exception: default: Not enough privileges. (ACCESS_DENIED)\n")
+				return
+			}
+		case strings.Contains(query, "data_view("):
+			selects.Add(1)
+			maxRunning.Store(max(maxRunning.Load(), running.Add(1)))
+			defer running.Add(-1)
+			time.Sleep(10 * time.Millisecond)
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	service, err := NewService(WithClickHouseURL(server.URL+"/"), WithWireFormat(WireFormatJSON))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	var urls []string
+	for i := range maxBatchSize + 1 {
+		paste, err := service.WriteContext(ctx, strings.NewReader(strconv.Itoa(i)))
+		require.NoError(t, err)
+		urls = append(urls, paste.URL)
+	}
+	missing := "https://pastila.nl/?ffffffff/00000000000000000000000000000000"
+	urls = append(urls, missing)
+	batches.Store(0)
+	selects.Store(0)
+
+	// Refs the batch query did not find are not selected again.
+	pastes, err := service.ReadAll(ctx, urls, 4)
+	require.ErrorIs(t, err, ErrNotFound)
+	assert.Nil(t, pastes[len(urls)-1])
+	assert.EqualValues(t, 2, batches.Load())
+	assert.Zero(t, selects.Load())
+
+	// Refused batches are remembered and read concurrently instead.
+	restricted.Store(true)
+	batches.Store(0)
+	pastes, err = service.ReadAll(ctx, urls, 4)
+	require.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, missing+": "+ErrNotFound.Error()+": "+missing, err.Error())
+	for i, paste := range pastes[:len(urls)-1] {
+		require.NotNil(t, paste, urls[i])
+		content, err := io.ReadAll(paste)
+		require.NoError(t, err)
+		assert.Equal(t, strconv.Itoa(i), string(content))
+	}
+	assert.Nil(t, pastes[len(urls)-1])
+	assert.EqualValues(t, 1, batches.Load())
+	assert.EqualValues(t, len(urls), selects.Load())
+	assert.LessOrEqual(t, maxRunning.Load(), int32(4))
+}
+
+func TestRetryDelay(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: time.Second, MaxDelay: time.Minute}
+	assert.Equal(t, time.Second, policy.delay(1))
+	assert.Equal(t, 4*time.Second, policy.delay(3))
+	assert.Equal(t, time.Minute, policy.delay(7))
+	assert.Equal(t, time.Minute, policy.delay(100))
+
+	policy.MaxDelay = 0
+	assert.Equal(t, 32*time.Second, policy.delay(6))
+	for _, attempt := range []int{35, 64, 65, 1000} {
+		assert.Equal(t, time.Duration(math.MaxInt64), policy.delay(attempt), "attempt %d", attempt)
+	}
+}
+
+func TestIsTransientError(t *testing.T) {
+	assert.True(t, IsTransientError(&ClickHouseError{StatusCode: http.StatusBadGateway}))
+	assert.True(t, IsTransientError(&ClickHouseError{StatusCode: http.StatusBadRequest, Code: 202}))
+	assert.True(t, IsTransientError(fmt.Errorf("%w: reset", ErrNetwork)))
+	assert.False(t, IsTransientError(&ClickHouseError{StatusCode: http.StatusBadRequest}))
+	assert.True(t, IsTransientError(fmt.Errorf("%w: %w", ErrTimeout, context.DeadlineExceeded)))
+	assert.False(t, IsTransientError(context.Canceled))
+	assert.False(t, IsTransientError(context.DeadlineExceeded))
+	assert.False(t, IsTransientError(ErrNotFound))
+}
+
+func TestParseClickHouseError(t *testing.T) {
+	err := parseClickHouseError(http.StatusNotFound, "60",
+		"Code: 60. DB::Exception: Table default.x does not exist. (UNKNOWN_TABLE) (version 24.3.1.1)\n")
+	assert.Equal(t, &ClickHouseError{
+		StatusCode: http.StatusNotFound,
+		Code:       60,
+		Name:       "UNKNOWN_TABLE",
+		Message:    "Table default.x does not exist.",
+	}, err)
+	assert.Equal(t, "clickhouse error 60 (UNKNOWN_TABLE): Table default.x does not exist.", err.Error())
+
+	err = parseClickHouseError(http.StatusBadGateway, "", "<html>bad gateway</html>")
+	assert.Equal(t, 0, err.Code)
+	assert.Equal(t, "unexpected status code: 502, response: <html>bad gateway</html>", err.Error())
+
+	err = parseClickHouseError(http.StatusForbidden, "164",
+		"Code: 164. DB::Exception: paste: Cannot execute query in readonly mode. (READONLY) (version 24.3.1.1)\n")
+	assert.ErrorIs(t, err, ErrReadOnly)
+	assert.Equal(t, "clickhouse user is read-only: it cannot write pastes, nor change settings, e.g. to compress responses; "+
+		"use a user allowed to insert into the data table "+
+		"(clickhouse error 164 (READONLY): paste: Cannot execute query in readonly mode.)", err.Error())
+
+	for body, expected := range map[string]error{
+		"Code: 201. DB::Exception: Quota for user `play` for 3600s has been exceeded. (QUOTA_EXCEEDED)":      ErrQuotaExceeded,
+		"Code: 497. DB::Exception: play: Not enough privileges. (ACCESS_DENIED)":                             ErrAccessDenied,
+		"Code: 62. DB::Exception: Syntax error: Max query size exceeded. (SYNTAX_ERROR)":                     ErrLimitExceeded,
+		"Code: 396. DB::Exception: Limit for result exceeded, max bytes: 1.00 MiB. (TOO_MANY_ROWS_OR_BYTES)": ErrLimitExceeded,
+		"Code: 62. DB::Exception: Syntax error: failed at position 1. (SYNTAX_ERROR)":                        nil,
+	} {
+		err := parseClickHouseError(http.StatusBadRequest, "", body)
+		if expected == nil {
+			assert.NoError(t, errors.Unwrap(err))
+			assert.Contains(t, err.Error(), "failed at position 1")
+			continue
+		}
+		assert.ErrorIs(t, err, expected)
+		assert.NotContains(t, err.Error(), "DB::Exception")
+		assert.Contains(t, err.Error(), "("+err.Name+"): "+err.Message+")")
+	}
+}
+
+func TestServiceNetworkError(t *testing.T) {
+	service := &Service{Client: &http.Client{Transport: roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return nil, syscall.ECONNREFUSED
+	})}}
+
+	_, err := service.Read("https://pastila.nl/?c055a950/620234bcb081dcff3cfdf3c3c2806062")
+
+	assert.ErrorIs(t, err, ErrNetwork)
+	assert.ErrorIs(t, err, syscall.ECONNREFUSED)
+}
+
+func TestServiceEndpoints(t *testing.T) {
+	var hosts []string
+	client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		hosts = append(hosts, req.URL.Host)
+		if req.URL.Host == "down.example.com" {
+			return nil, syscall.ECONNREFUSED
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"X-Clickhouse-Query-Id": {"endpoints"}},
+			Body:       io.NopCloser(strings.NewReader(`{"is_encrypted": false, "content": "replicated"}`)),
+		}, nil
+	})}
+
+	service, err := NewService(
+		WithHTTPClient(client),
+		WithEndpoints("https://down.example.com/", "https://a.example.com/", "https://b.example.com/"),
+	)
+	require.NoError(t, err)
+
+	for range 2 {
+		paste, err := service.Read("https://pastila.nl/?c055a950/620234bcb081dcff3cfdf3c3c2806062")
+		require.NoError(t, err)
+		content, err := io.ReadAll(paste)
+		require.NoError(t, err)
+		assert.Equal(t, "replicated", string(content))
+	}
+	assert.Equal(t, []string{"down.example.com", "a.example.com", "a.example.com"}, hosts)
+
+	hosts = nil
+	service.LoadBalanceReads = true
+	for range 3 {
+		_, err := service.Read("https://pastila.nl/?c055a950/620234bcb081dcff3cfdf3c3c2806062")
+		require.NoError(t, err)
+	}
+	assert.ElementsMatch(t, []string{"a.example.com", "b.example.com", "down.example.com", "a.example.com"}, hosts)
+
+	_, err = NewService(WithClickHouseURL("https://a.example.com/"), WithEndpoints("https://b.example.com/"))
+	require.ErrorIs(t, err, ErrInvalidConfig)
+	_, err = NewService(WithEndpoints("ftp://a.example.com/"))
+	require.ErrorIs(t, err, ErrInvalidConfig)
+}
+
+func TestParseSummary(t *testing.T) {
+	stats := parseSummary(`{"read_rows":"1","read_bytes":"153","written_rows":"0","written_bytes":"0",` +
+		`"total_rows_to_read":"1","result_rows":"0","result_bytes":"0","elapsed_ns":"2150000"}`)
+
+	assert.Equal(t, Stats{ReadRows: 1, ReadBytes: 153, Elapsed: 2150 * time.Microsecond}, stats)
+	assert.Equal(t, Stats{}, parseSummary(""))
+}
+
+func TestNewService(t *testing.T) {
+	client := &http.Client{}
+	service, err := NewService(
+		WithPastilaURL("https://paste.example.com/"),
+		WithClickHouseURL("https://clickhouse.example.com/?user=paste"),
+		WithAuthCookie("secret"),
+		WithHTTPClient(client),
+		WithTimeouts(0, time.Second, 2*time.Second),
+	)
+	require.NoError(t, err)
+
+	assert.Equal(t, "https://paste.example.com/", service.PastilaURL)
+	assert.Equal(t, "https://clickhouse.example.com/?user=paste", service.ClickHouseURL)
+	assert.Equal(t, "secret", service.AuthCookie)
+	assert.Equal(t, time.Second, service.ReadTimeout)
+	assert.Equal(t, 2*time.Second, service.WriteTimeout)
+	assert.Same(t, client, service.Client)
+
+	_, err = NewService(WithClickHouseURL("clickhouse.example.com"))
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+
+	_, err = NewService(WithRetry(RetryPolicy{Jitter: 2}))
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+}
+
+func TestServiceTimeouts(t *testing.T) {
+	hang := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	})
+
+	_, err := NewService(WithHTTPClient(&http.Client{Transport: hang}), WithTimeouts(time.Second, 0, 0))
+	require.ErrorIs(t, err, ErrInvalidConfig)
+
+	service, err := NewService(WithTimeouts(time.Second, 0, 0))
+	require.NoError(t, err)
+	transport, ok := service.Client.Transport.(*http.Transport)
+	require.True(t, ok)
+	assert.Equal(t, time.Second, transport.TLSHandshakeTimeout)
+
+	service, err = NewService(
+		WithHTTPClient(&http.Client{Transport: hang}),
+		WithTimeouts(0, 10*time.Millisecond, 10*time.Millisecond),
+	)
+	require.NoError(t, err)
+
+	_, err = service.Read("https://pastila.nl/?c055a950/620234bcb081dcff3cfdf3c3c2806062")
+	assert.ErrorIs(t, err, ErrTimeout)
+	_, err = service.Write(strings.NewReader("content"))
+	assert.ErrorIs(t, err, ErrTimeout)
+}
+
+func TestServiceUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "clickhouse.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "clickhouse.internal:8123", r.Host)
+		w.Header().Set("X-ClickHouse-Query-Id", "unix")
+		_, _ = w.Write([]byte(`{"is_encrypted": false, "content": "over a unix socket"}`))
+	}))
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+
+	service, err := NewService(WithClickHouseURL("http://clickhouse.internal:8123/"), WithUnixSocket(socket))
+	require.NoError(t, err)
+
+	paste, err := service.Read("https://pastila.nl/?c055a950/620234bcb081dcff3cfdf3c3c2806062")
+	require.NoError(t, err)
+	content, err := io.ReadAll(paste)
+	require.NoError(t, err)
+	assert.Equal(t, "over a unix socket", string(content))
+}
+
+func TestServiceTimeoutRetry(t *testing.T) {
+	var attempts atomic.Int32
+	hang := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		attempts.Add(1)
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	})
+
+	service, err := NewService(
+		WithHTTPClient(&http.Client{Transport: hang}),
+		WithTimeouts(0, 10*time.Millisecond, 0),
+		WithRetry(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}),
+	)
+	require.NoError(t, err)
+
+	_, err = service.Read("https://pastila.nl/?c055a950/620234bcb081dcff3cfdf3c3c2806062")
+	assert.ErrorIs(t, err, ErrTimeout)
+	assert.EqualValues(t, 3, attempts.Load())
+
+	attempts.Store(0)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	_, err = service.ReadContext(ctx, "https://pastila.nl/?c055a950/620234bcb081dcff3cfdf3c3c2806062")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.NotErrorIs(t, err, ErrTimeout)
+	assert.EqualValues(t, 1, attempts.Load())
+}
+
+func TestServiceHTTPCompression(t *testing.T) {
+	var inserted []byte
+	service := &Service{
+		HTTPCompression: true,
+		Client: &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			assert.Equal(t, "1", req.URL.Query().Get("enable_http_compression"))
+			assert.Equal(t, "gzip", req.Header.Get("Accept-Encoding"))
+
+			header := http.Header{"X-Clickhouse-Query-Id": {"compressed"}, "Content-Encoding": {"gzip"}}
+			if req.Body != nil {
+				assert.Equal(t, "gzip", req.Header.Get("Content-Encoding"))
+				zr, err := gzip.NewReader(req.Body)
+				require.NoError(t, err)
+				inserted, err = io.ReadAll(zr)
+				require.NoError(t, err)
+				return &http.Response{StatusCode: http.StatusOK, Header: header, Body: http.NoBody}, nil
+			}
+
+			var body bytes.Buffer
+			zw := gzip.NewWriter(&body)
+			_, _ = zw.Write([]byte(`{"is_encrypted": false, "content": "compressed"}`))
+			_ = zw.Close()
+			return &http.Response{StatusCode: http.StatusOK, Header: header, Body: io.NopCloser(&body)}, nil
+		})},
+	}
+
+	_, err := service.Write(strings.NewReader("compressed"))
+	require.NoError(t, err)
+	assert.Contains(t, string(inserted), "\tcompressed\t")
+
+	paste, err := service.Read("https://pastila.nl/?c055a950/620234bcb081dcff3cfdf3c3c2806062")
+	require.NoError(t, err)
+	content, err := io.ReadAll(paste)
+	require.NoError(t, err)
+	assert.Equal(t, "compressed", string(content))
+}
+
+func TestServiceAuth(t *testing.T) {
+	var req *http.Request
+	service, err := NewService(
+		WithClickHouseURL("https://clickhouse.example.com/?user=paste"),
+		WithAuth("alice", "secret"),
+		WithHTTPClient(&http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			req = r
+			return nil, errors.New("not connected")
+		})}),
+	)
+	require.NoError(t, err)
+
+	_, _ = service.Exists(context.Background(), "https://pastila.nl/?c055a950/620234bcb081dcff3cfdf3c3c2806062")
+	require.NotNil(t, req)
+	assert.True(t, strings.HasPrefix(req.Header.Get("User-Agent"), "PastilaCLI/"))
+	assert.Equal(t, "alice", req.Header.Get("X-ClickHouse-User"))
+	assert.Equal(t, "secret", req.Header.Get("X-ClickHouse-Key"))
+	assert.False(t, req.URL.Query().Has("user"))
+
+	_, err = NewService(WithAuth("alice", "secret"), WithJWT("token"))
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+}
+
+func TestServiceHooks(t *testing.T) {
+	var calls []string
+	service, err := NewService(
+		WithHTTPClient(&http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			assert.Equal(t, "traced", r.Header.Get("X-Trace"))
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"X-Clickhouse-Query-Id": {"hooked"}},
+				Body:       io.NopCloser(strings.NewReader("")),
+			}, nil
+		})}),
+		WithRequestHook(func(r *http.Request) {
+			calls = append(calls, "request")
+			r.Header.Set("X-Trace", "traced")
+		}),
+		WithRequestHook(func(*http.Request) { calls = append(calls, "second request") }),
+		WithResponseHook(func(r *http.Response, _ time.Duration) {
+			calls = append(calls, "response "+r.Header.Get("X-ClickHouse-Query-Id"))
+		}),
+	)
+	require.NoError(t, err)
+
+	exists, err := service.Exists(context.Background(), "https://pastila.nl/?c055a950/620234bcb081dcff3cfdf3c3c2806062")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, []string{"request", "second request", "response hooked"}, calls)
+}
+
+func TestServiceSignedRequests(t *testing.T) {
+	key := []byte("signing key")
+	var requests int
+	service, err := NewService(
+		WithHTTPClient(&http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			requests++
+			assert.Equal(t, "token", r.Header.Get(APITokenHeader))
+			assert.NoError(t, VerifyRequest(r, key, time.Minute))
+			assert.ErrorIs(t, VerifyRequest(r, []byte("other key"), time.Minute), ErrInvalidSignature)
+
+			// The query is signed.
+			tampered := r.Clone(r.Context())
+			tampered.URL.RawQuery += "&param_extra=1"
+			assert.ErrorIs(t, VerifyRequest(tampered, key, time.Minute), ErrInvalidSignature)
+
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"X-Clickhouse-Query-Id": {"signed"}},
+				Body:       io.NopCloser(strings.NewReader("")),
+			}, nil
+		})}),
+		WithAPIToken("token"),
+		WithRequestSigning(key),
+	)
+	require.NoError(t, err)
+
+	_, err = service.Exists(context.Background(), "https://pastila.nl/?c055a950/620234bcb081dcff3cfdf3c3c2806062")
+	require.NoError(t, err)
+	assert.Equal(t, 1, requests)
+}
+
+func TestVerifyRequest(t *testing.T) {
+	key := []byte("signing key")
+	req := httptest.NewRequest(http.MethodPost, "https://clickhouse.example/?query=SELECT+1", nil)
+	assert.ErrorIs(t, VerifyRequest(req, key, time.Minute), ErrInvalidSignature)
+
+	(&Service{SigningKey: key}).SignRequest(req)
+	require.NoError(t, VerifyRequest(req, key, time.Minute))
+	assert.Empty(t, req.Header.Get(APITokenHeader))
+
+	req.Header.Set(TimestampHeader, strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+	assert.ErrorIs(t, VerifyRequest(req, key, time.Minute), ErrInvalidSignature)
+}
+
+func TestServiceStreamingRead(t *testing.T) {
+	var stored map[string]any
+	service := &Service{
+		WireFormat: WireFormatJSON,
+		Client: &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			header := http.Header{"X-Clickhouse-Query-Id": {"streamed"}}
+			if req.Body != nil {
+				require.NoError(t, json.NewDecoder(req.Body).Decode(&stored))
+				return &http.Response{StatusCode: http.StatusOK, Header: header, Body: http.NoBody}, nil
+			}
+
+			content, err := json.Marshal(stored["content"])
+			require.NoError(t, err)
+			body := fmt.Sprintf(`{"is_encrypted":%t,"prev_fingerprint_hex":"","prev_hash_hex":"","size":%d,"content":%s}`+"\n",
+				stored["is_encrypted"], len(stored["content"].(string)), content)
+			return &http.Response{StatusCode: http.StatusOK, Header: header, Body: io.NopCloser(iotest.HalfReader(strings.NewReader(body)))}, nil
+		})},
+	}
+
+	content := strings.Repeat("streamed content\n", 10000)
+	for name, opts := range map[string][]WriteOption{
+		"plain":      {},
+		"compressed": {WithCompression(Zstd), WithContentType("text/plain")},
+		"encrypted":  {WithKey([]byte("0123456789abcdef")), WithRandomIV(), WithCompression(Zstd), WithContentType("text/plain")},
+		"mac":        {WithKey([]byte("0123456789abcdef")), WithMAC()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			written, err := service.Write(strings.NewReader(content), opts...)
+			require.NoError(t, err)
+
+			paste, err := service.Read(written.URL, WithVerify())
+			require.NoError(t, err)
+			assert.Equal(t, written.ContentType, paste.ContentType)
+			assert.Equal(t, written.size, paste.size)
+
+			actual, err := io.ReadAll(paste)
+			require.NoError(t, err)
+			require.NoError(t, paste.Close())
+			assert.Equal(t, content, string(actual))
+		})
+	}
+
+	// Streamed content is verified at its end.
+	written, err := service.Write(strings.NewReader(content))
+	require.NoError(t, err)
+	stored["content"] = strings.ToUpper(content)
+
+	paste, err := service.Read(written.URL, WithVerify())
+	require.NoError(t, err)
+	_, err = io.ReadAll(paste)
+	assert.ErrorIs(t, err, ErrHashMismatch)
+}
+
+func TestServiceWireFormat(t *testing.T) {
+	var stored []string
+	var queries []string
+	supported := true
+	client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		query := req.URL.Query().Get("query")
+		queries = append(queries, query[strings.LastIndex(query, " ")+1:])
+		header := http.Header{"X-Clickhouse-Query-Id": {"formatted"}}
+		if !supported && !strings.HasSuffix(query, formatJSONEachRow) {
+			body := "Code: 73. DB::Exception: Unknown format. (UNKNOWN_FORMAT)"
+			return &http.Response{StatusCode: http.StatusBadRequest, Header: header, Body: io.NopCloser(strings.NewReader(body))}, nil
+		}
+
+		if req.Body != nil {
+			row, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			if strings.HasSuffix(query, formatTabSeparated) {
+				stored = strings.Split(strings.TrimSuffix(string(row), "\n"), "\t")
+			}
+			return &http.Response{StatusCode: http.StatusOK, Header: header, Body: http.NoBody}, nil
+		}
+
+		content := strings.NewReplacer(`\n`, "\n", `\t`, "\t", `\\`, `\`).Replace(stored[3])
+		if strings.HasSuffix(query, formatJSONEachRow) {
+			encoded, err := json.Marshal(content)
+			require.NoError(t, err)
+			body := fmt.Sprintf(`{"is_encrypted":%t,"content":%s}`, stored[0] == "1", encoded)
+			return &http.Response{StatusCode: http.StatusOK, Header: header, Body: io.NopCloser(strings.NewReader(body))}, nil
+		}
+
+		var body []byte
+		body = append(body, stored[0][0]-'0', 0, 0)
+		body = binary.LittleEndian.AppendUint64(body, uint64(len(content)))
+		body = binary.AppendUvarint(body, uint64(len(content)))
+		body = append(body, content...)
+		header.Set("X-Clickhouse-Format", formatRowBinary)
+		return &http.Response{StatusCode: http.StatusOK, Header: header, Body: io.NopCloser(bytes.NewReader(body))}, nil
+	})}
+
+	service, err := NewService(WithHTTPClient(client))
+	require.NoError(t, err)
+
+	for _, content := range []string{"tab\tnewline\nbackslash\\", strings.Repeat("binary ", 1000)} {
+		written, err := service.Write(strings.NewReader(content), WithKey([]byte("0123456789abcdef")))
+		require.NoError(t, err)
+		paste, err := service.Read(written.URL, WithVerify())
+		require.NoError(t, err)
+		actual, err := io.ReadAll(paste)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(actual))
+
+		written, err = service.Write(strings.NewReader(content), WithKey(nil))
+		require.NoError(t, err)
+		paste, err = service.Read(written.URL, WithVerify())
+		require.NoError(t, err)
+		actual, err = io.ReadAll(paste)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(actual))
+	}
+	assert.NotContains(t, queries, formatJSONEachRow)
+
+	// Reads fall back to JSONEachRow right away, and so do later writes.
+	supported = false
+	queries = nil
+	paste, err := service.Read("https://pastila.nl/?" + stored[5] + "/" + stored[4])
+	require.NoError(t, err)
+	_, err = service.Write(strings.NewReader("fallback"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{formatRowBinary, formatJSONEachRow, formatJSONEachRow}, queries)
+	require.NoError(t, paste.Close())
+}
+
+func TestServiceEmptyResult(t *testing.T) {
+	url := PasteRef{Ref: Ref{Fingerprint: []byte{0xc0, 0x55, 0xa9, 0x50}, Hash: make([]byte, 16)}}.String()
+	for name, tc := range map[string]struct {
+		header   http.Header
+		body     string
+		notFound bool
+	}{
+		"empty":            {body: "", notFound: true},
+		"empty binary":     {header: http.Header{"X-Clickhouse-Format": {formatRowBinary}}, body: "", notFound: true},
+		"rows in summary":  {header: http.Header{"X-Clickhouse-Summary": {`{"result_rows":"1"}`}}, body: ""},
+		"whitespace":       {body: "\n"},
+		"garbage":          {body: "<html>"},
+		"truncated binary": {header: http.Header{"X-Clickhouse-Format": {formatRowBinary}}, body: "\x01"},
+		"truncated JSON":   {body: `{"is_encrypted":false,`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			service := &Service{Client: &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				header := http.Header{"X-Clickhouse-Query-Id": {"empty"}}
+				for key, values := range tc.header {
+					header[key] = values
+				}
+				return &http.Response{StatusCode: http.StatusOK, Header: header, Body: io.NopCloser(strings.NewReader(tc.body))}, nil
+			})}}
+
+			_, readErr := service.Read(url)
+			_, statErr := service.Stat(context.Background(), url)
+			for _, err := range []error{readErr, statErr} {
+				if tc.notFound {
+					assert.ErrorIs(t, err, ErrNotFound)
+					continue
+				}
+
+				var decodeErr *DecodeError
+				assert.ErrorAs(t, err, &decodeErr)
+				assert.NotErrorIs(t, err, ErrNotFound)
+			}
+		})
+	}
+}
+
+func TestServiceListByFingerprint(t *testing.T) {
+	service, err := NewService(WithPastilaURL("https://paste.example.com/"), WithHTTPClient(&http.Client{Transport: roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			assert.Equal(t, "c055a950", req.URL.Query().Get("param_fingerprintHex"))
+			assert.Equal(t, "1000", req.URL.Query().Get("param_limit"))
+
+			body := `{"hash_hex":"62020000000000000000000000000001","is_encrypted":true,"size":12,"time_ms":"1700000000000",` +
+				`"prev_fingerprint_hex":"c055a950","prev_hash_hex":"6201"}` + "\n" +
+				`{"hash_hex":"6201","is_encrypted":false,"size":7,"time_ms":"1600000000000","prev_fingerprint_hex":"","prev_hash_hex":""}` + "\n"
+			header := http.Header{"X-Clickhouse-Query-Id": {"listed"}}
+			return &http.Response{StatusCode: http.StatusOK, Header: header, Body: io.NopCloser(strings.NewReader(body))}, nil
+		},
+	)}))
+	require.NoError(t, err)
+
+	infos, err := service.ListByFingerprint(context.Background(), []byte{0xc0, 0x55, 0xa9, 0x50})
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+
+	assert.Equal(t, "https://paste.example.com/?c055a950/62020000000000000000000000000001", infos[0].URL)
+	assert.True(t, infos[0].Encrypted)
+	assert.EqualValues(t, 12, infos[0].Size)
+	assert.Equal(t, time.UnixMilli(1700000000000), infos[0].Time)
+	assert.Equal(t, []byte{0xc0, 0x55, 0xa9, 0x50}, infos[0].PreviousFingerprint)
+	assert.Equal(t, append([]byte{0x62, 0x01}, make([]byte, 14)...), infos[0].PreviousHash)
+	assert.False(t, infos[1].HasPrevious())
+
+	_, err = service.ListByFingerprint(context.Background(), []byte{0xc0})
+	assert.ErrorIs(t, err, ErrInvalidFingerprint)
+
+	service, err = NewService(WithBackend(newMemoryBackend()))
+	require.NoError(t, err)
+	_, err = service.ListByFingerprint(context.Background(), []byte{0xc0, 0x55, 0xa9, 0x50})
+	assert.ErrorIs(t, err, errors.ErrUnsupported)
+}
+
+func TestServiceQueryID(t *testing.T) {
+	var queryIDs []string
+	client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		_, err := io.Copy(io.Discard, req.Body)
+		require.NoError(t, err)
+
+		queryID := req.URL.Query().Get("query_id")
+		queryIDs = append(queryIDs, queryID)
+		if queryID == "" {
+			queryID = "generated"
+		}
+		header := http.Header{"X-Clickhouse-Query-Id": {queryID}}
+		return &http.Response{StatusCode: http.StatusOK, Header: header, Body: http.NoBody}, nil
+	})}
+
+	service, err := NewService(WithHTTPClient(client), WithQueryID("ci-42"))
+	require.NoError(t, err)
+	paste, err := service.Write(strings.NewReader("first"))
+	require.NoError(t, err)
+	assert.Equal(t, "ci-42-1", paste.QueryID)
+	_, err = service.Write(strings.NewReader("second"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ci-42-1", "ci-42-2"}, queryIDs)
+
+	type correlationKey struct{}
+	service, err = NewService(WithHTTPClient(client), WithQueryIDFunc(func(ctx context.Context) string {
+		id, _ := ctx.Value(correlationKey{}).(string)
+		return id
+	}))
+	require.NoError(t, err)
+	queryIDs = nil
+	_, err = service.WriteContext(context.WithValue(context.Background(), correlationKey{}, "request-7"), strings.NewReader("x"))
+	require.NoError(t, err)
+	_, err = service.Write(strings.NewReader("y"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"request-7", ""}, queryIDs)
+}
+
+func TestServiceAsyncInsert(t *testing.T) {
+	var queries []string
+	client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Body != nil {
+			_, err := io.Copy(io.Discard, req.Body)
+			require.NoError(t, err)
+		}
+
+		queries = append(queries, req.URL.Query().Get("query"))
+		header := http.Header{"X-Clickhouse-Query-Id": {"async"}}
+		return &http.Response{StatusCode: http.StatusOK, Header: header, Body: http.NoBody}, nil
+	})}
+
+	for wait, setting := range map[bool]string{false: "0", true: "1"} {
+		service, err := NewService(WithHTTPClient(client), WithAsyncInsert(wait), WithWireFormat(WireFormatJSON))
+		require.NoError(t, err)
+
+		queries = nil
+		_, err = service.Write(strings.NewReader("async"), WithDedup())
+		require.NoError(t, err)
+		require.Len(t, queries, 2)
+
+		// Only the insert is affected, not the lookup of WithDedup.
+		assert.NotContains(t, queries[0], "SETTINGS")
+		expected := "\nSETTINGS async_insert = 1, wait_for_async_insert = " + setting + "\nFORMAT JSONEachRow"
+		assert.True(t, strings.HasSuffix(queries[1], expected), queries[1])
+	}
+}
+
+func TestServiceTable(t *testing.T) {
+	var queries []string
+	client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Body != nil {
+			_, err := io.Copy(io.Discard, req.Body)
+			require.NoError(t, err)
+		}
+
+		queries = append(queries, req.URL.Query().Get("query"))
+		header := http.Header{"X-Clickhouse-Query-Id": {"table"}}
+		return &http.Response{StatusCode: http.StatusOK, Header: header, Body: http.NoBody}, nil
+	})}
+
+	for name, tc := range map[string]struct {
+		opts  []ServiceOption
+		table string
+	}{
+		"default":  {table: "`data`"},
+		"table":    {opts: []ServiceOption{WithTable("", "pastes")}, table: "`pastes`"},
+		"database": {opts: []ServiceOption{WithTable("tenant`1", "")}, table: "`tenant\\`1`.`data`"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			service, err := NewService(append(tc.opts, WithHTTPClient(client))...)
+			require.NoError(t, err)
+
+			queries = nil
+			paste, err := service.Write(strings.NewReader("table"))
+			require.NoError(t, err)
+			_, err = service.Read(paste.URL)
+			require.ErrorIs(t, err, ErrNotFound)
+			_, err = service.Stat(context.Background(), paste.URL)
+			require.ErrorIs(t, err, ErrNotFound)
+
+			require.Len(t, queries, 3)
+			assert.Contains(t, queries[0], "INSERT INTO "+tc.table+" (")
+			if tc.opts == nil {
+				// The data table is read through data_view, like the pastila
+				// web client does.
+				assert.Contains(t, queries[1], "FROM data_view(")
+			} else {
+				assert.Contains(t, queries[1], "FROM "+tc.table+"\n")
+			}
+			assert.Contains(t, queries[2], "FROM "+tc.table+"\n")
+		})
+	}
+}
+
+func TestServiceFakeClickHouse(t *testing.T) {
+	for name, opts := range map[string][]ServiceOption{
+		"lean":        nil,
+		"json":        {WithWireFormat(WireFormatJSON)},
+		"compression": {WithHTTPCompression()},
+		"table":       {WithTable("pastes", "data")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fake := chtest.NewFakeClickHouse(t)
+			service, err := NewService(append([]ServiceOption{WithClickHouseURL(fake.URL)}, opts...)...)
+			require.NoError(t, err)
+			ctx := context.Background()
+
+			first, err := service.WriteContext(ctx, strings.NewReader("first\tline\n"), WithFingerprint([]byte{1, 2, 3, 0}))
+			require.NoError(t, err)
+			second, err := service.WriteContext(ctx, strings.NewReader("second"),
+				WithFingerprint(first.Fingerprint), WithPreviousPaste(first))
+			require.NoError(t, err)
+			assert.Equal(t, first.Fingerprint, second.Fingerprint)
+			assert.NotEmpty(t, second.QueryID)
+
+			paste, err := service.ReadContext(ctx, second.URL)
+			require.NoError(t, err)
+			content, err := io.ReadAll(paste)
+			require.NoError(t, err)
+			require.NoError(t, paste.Close())
+			assert.Equal(t, "second", string(content))
+			assert.Equal(t, first.Fingerprint, paste.PreviousFingerprint)
+			assert.Equal(t, first.Hash, paste.PreviousHash)
+
+			info, err := service.Stat(ctx, first.URL)
+			require.NoError(t, err)
+			assert.Equal(t, int64(len("first\tline\n")), info.Size)
+			assert.False(t, info.HasPrevious())
+
+			infos, err := service.ListByFingerprint(ctx, first.Fingerprint)
+			require.NoError(t, err)
+			require.Len(t, infos, 2)
+			assert.Equal(t, second.Hash, infos[0].Hash)
+
+			latest, err := service.Latest(ctx, first.URL)
+			require.NoError(t, err)
+			assert.Equal(t, second.Hash, latest.Hash)
+
+			pastes, err := service.ReadAll(ctx, []string{first.URL, second.URL}, 2)
+			require.NoError(t, err)
+			for _, paste := range pastes {
+				require.NoError(t, paste.Close())
+			}
+
+			_, err = service.ReadContext(ctx, "https://pastila.nl/?ffffffff/00000000000000000000000000000001")
+			require.ErrorIs(t, err, ErrNotFound)
+			assert.Len(t, fake.Rows(), 2)
+		})
+	}
+}
+
+func TestServiceUsage(t *testing.T) {
+	service, err := NewService(WithClickHouseURL(chtest.NewFakeClickHouse(t).URL))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	usage, err := service.Usage(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, &Usage{}, usage)
+
+	_, err = service.WriteContext(ctx, strings.NewReader("encrypted"), WithKey([]byte("0123456789abcdef")))
+	require.NoError(t, err)
+	// Pastes written twice count once.
+	for range 2 {
+		_, err = service.WriteContext(ctx, strings.NewReader("plain"))
+		require.NoError(t, err)
+	}
+
+	usage, err = service.Usage(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), usage.Pastes)
+	assert.Equal(t, int64(1), usage.EncryptedPastes)
+	require.Len(t, usage.Daily, 1)
+	assert.Equal(t, time.Now().UTC().Truncate(24*time.Hour), usage.Daily[0].Day)
+	assert.Equal(t, usage.Bytes, usage.Daily[0].Bytes)
+	assert.Equal(t, usage.Pastes, usage.Daily[0].Pastes)
+
+	service, err = NewService(WithBackend(newMemoryBackend()))
+	require.NoError(t, err)
+	_, err = service.Usage(ctx)
+	require.ErrorIs(t, err, errors.ErrUnsupported)
+}
+
+func TestServiceExpiry(t *testing.T) {
+	ctx := context.Background()
+	for name, format := range map[string]WireFormat{"auto": WireFormatAuto, "json": WireFormatJSON} {
+		t.Run(name, func(t *testing.T) {
+			fake := chtest.NewFakeClickHouse(t)
+			service, err := NewService(WithClickHouseURL(fake.URL), WithWireFormat(format), WithExpiryColumn())
+			require.NoError(t, err)
+
+			written, err := service.WriteContext(ctx, strings.NewReader("expiring"), WithExpiry(time.Hour))
+			require.NoError(t, err)
+			assert.WithinDuration(t, time.Now().Add(time.Hour), fake.Rows()[0].Expires, time.Second)
+
+			paste, err := service.ReadContext(ctx, written.URL)
+			require.NoError(t, err)
+			_ = paste.Close()
+			info, err := service.Stat(ctx, written.URL)
+			require.NoError(t, err)
+			assert.Equal(t, fake.Rows()[0].Expires, info.Expires)
+
+			// Pastes without an expiry never expire.
+			forever, err := service.WriteContext(ctx, strings.NewReader("forever"))
+			require.NoError(t, err)
+			assert.True(t, fake.Rows()[1].Expires.IsZero())
+			info, err = service.Stat(ctx, forever.URL)
+			require.NoError(t, err)
+			assert.True(t, info.Expires.IsZero())
+
+			// ClickHouse deletes expired rows only eventually.
+			expired := &InsertRow{
+				Content: strings.NewReader("expired"),
+				Expires: time.Now().Add(-time.Minute).Truncate(time.Second),
+				ref:     Ref{Fingerprint: []byte{0xca, 0xfe, 0xba, 0xbe}, Hash: make([]byte, 16)},
+			}
+			_, err = service.backend().Insert(ctx, expired)
+			require.NoError(t, err)
+			url := service.pasteURL(expired.ref.Fingerprint, expired.ref.Hash, nil)
+
+			var expiredErr *ExpiredError
+			_, err = service.ReadContext(ctx, url)
+			require.ErrorAs(t, err, &expiredErr)
+			assert.ErrorIs(t, err, ErrExpired)
+			assert.Equal(t, expired.Expires, expiredErr.Expires)
+			_, err = service.Stat(ctx, url)
+			assert.ErrorIs(t, err, ErrExpired)
+			exists, err := service.Exists(ctx, url)
+			require.NoError(t, err)
+			assert.False(t, exists)
+			pastes, err := service.ReadAll(ctx, []string{url, written.URL}, 1)
+			assert.ErrorIs(t, err, ErrExpired)
+			assert.Nil(t, pastes[0])
+			assert.NotNil(t, pastes[1])
+
+			// Chunks expire with their manifest.
+			before := len(fake.Rows())
+			_, err = service.WriteContext(ctx, strings.NewReader("expiring in chunks"), WithChunkSize(4), WithExpiry(time.Hour))
+			require.NoError(t, err)
+			rows := fake.Rows()[before:]
+			require.Len(t, rows, 6, "5 chunks and the manifest")
+			for _, row := range rows {
+				assert.WithinDuration(t, time.Now().Add(time.Hour), row.Expires, time.Second)
+			}
+		})
+	}
+
+	service, err := NewService(WithClickHouseURL(chtest.NewFakeClickHouse(t).URL))
+	require.NoError(t, err)
+	_, err = service.WriteContext(ctx, strings.NewReader("expiring"), WithExpiry(time.Hour))
+	require.ErrorIs(t, err, errors.ErrUnsupported)
+
+	service, err = NewService(WithBackend(newMemoryBackend()))
+	require.NoError(t, err)
+	_, err = service.WriteContext(ctx, strings.NewReader("expiring"), WithExpiry(time.Hour))
+	require.ErrorIs(t, err, errors.ErrUnsupported)
+}
+
+func TestServiceCluster(t *testing.T) {
+	cluster := chtest.StartCluster(t, 2)
+	service, err := NewService(WithEndpoints(cluster.URLs...))
+	require.NoError(t, err)
+	lagging, err := NewService(WithClickHouseURL(cluster.URLs[1]))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	cluster.StopReplication(t, 1)
+	paste, err := service.WriteContext(ctx, strings.NewReader("Hello replicas!"))
+	require.NoError(t, err)
+
+	_, err = lagging.ReadContext(ctx, paste.URL)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	cluster.StartReplication(t, 1)
+	cluster.Stop(t, 0)
+
+	read, err := service.ReadContext(ctx, paste.URL)
+	require.NoError(t, err)
+	content, err := io.ReadAll(read)
+	require.NoError(t, err)
+	require.NoError(t, read.Close())
+	assert.Equal(t, "Hello replicas!", string(content))
+}
+
+// tableMemoryBackend is a memoryBackend that records the table it is
+// configured with.
+type tableMemoryBackend struct {
+	*memoryBackend
+	database, table string
+}
+
+func (b *tableMemoryBackend) SetTable(database, table string) {
+	b.database, b.table = database, table
+}
+
+func TestServiceTableBackend(t *testing.T) {
+	backend := &tableMemoryBackend{memoryBackend: newMemoryBackend()}
+	_, err := NewService(WithBackend(backend), WithTable("tenant", "pastes"))
+	require.NoError(t, err)
+	assert.Equal(t, "tenant", backend.database)
+	assert.Equal(t, "pastes", backend.table)
+
+	// Backends that cannot store pastes in another table must not ignore it.
+	_, err = NewService(WithBackend(newMemoryBackend()), WithTable("", "pastes"))
+	require.ErrorIs(t, err, ErrInvalidConfig)
+	_, err = NewService(WithBackend(newMemoryBackend()))
+	require.NoError(t, err)
+}
@@ -0,0 +1,96 @@
+package pastila
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// sipHash128 is an incremental implementation of ClickHouse's sipHash128:
+// SipHash-2-4 with zero keys, returning v0^v1 and v2^v3 as the two halves of
+// the 128-bit result. It allows hashing content while it is being streamed.
+type sipHash128 struct {
+	v0, v1, v2, v3 uint64
+
+	tail  [8]byte
+	ntail int
+	size  int
+}
+
+func newSipHash128() *sipHash128 {
+	return &sipHash128{
+		v0: 0x736f6d6570736575,
+		v1: 0x646f72616e646f6d,
+		v2: 0x6c7967656e657261,
+		v3: 0x7465646279746573,
+	}
+}
+
+func (h *sipHash128) Write(p []byte) (int, error) {
+	n := len(p)
+	h.size += n
+
+	if h.ntail > 0 {
+		c := copy(h.tail[h.ntail:], p)
+		h.ntail += c
+		p = p[c:]
+		if h.ntail < len(h.tail) {
+			return n, nil
+		}
+
+		h.compress(binary.LittleEndian.Uint64(h.tail[:]))
+		h.ntail = 0
+	}
+
+	for len(p) >= 8 {
+		h.compress(binary.LittleEndian.Uint64(p))
+		p = p[8:]
+	}
+
+	h.ntail = copy(h.tail[:], p)
+	return n, nil
+}
+
+// Sum returns the hash of the data written so far. It does not change the
+// state of h.
+func (h *sipHash128) Sum() [16]byte {
+	d := *h
+
+	var last [8]byte
+	copy(last[:], d.tail[:d.ntail])
+	last[7] = byte(d.size)
+
+	d.compress(binary.LittleEndian.Uint64(last[:]))
+	d.v2 ^= 0xff
+	for i := 0; i < 4; i++ {
+		d.round()
+	}
+
+	var sum [16]byte
+	binary.LittleEndian.PutUint64(sum[:8], d.v0^d.v1)
+	binary.LittleEndian.PutUint64(sum[8:], d.v2^d.v3)
+	return sum
+}
+
+func (h *sipHash128) compress(m uint64) {
+	h.v3 ^= m
+	h.round()
+	h.round()
+	h.v0 ^= m
+}
+
+func (h *sipHash128) round() {
+	h.v0 += h.v1
+	h.v1 = bits.RotateLeft64(h.v1, 13)
+	h.v1 ^= h.v0
+	h.v0 = bits.RotateLeft64(h.v0, 32)
+	h.v2 += h.v3
+	h.v3 = bits.RotateLeft64(h.v3, 16)
+	h.v3 ^= h.v2
+	h.v0 += h.v3
+	h.v3 = bits.RotateLeft64(h.v3, 21)
+	h.v3 ^= h.v0
+	h.v2 += h.v1
+	h.v1 = bits.RotateLeft64(h.v1, 17)
+	h.v1 ^= h.v2
+	h.v2 = bits.RotateLeft64(h.v2, 32)
+}
@@ -0,0 +1,37 @@
+package pastila
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/frifox/siphash128"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSipHash128MatchesClickHouse(t *testing.T) {
+	content := bytes.Repeat([]byte("Hello ClickHouse!"), 10)
+
+	for size := 0; size <= len(content); size++ {
+		expected := siphash128.SipHash128(content[:size])
+
+		// Feed the content in uneven chunks to exercise the tail buffer.
+		h := newSipHash128()
+		for chunk := content[:size]; len(chunk) > 0; {
+			n := min(len(chunk), 1+size%7)
+			_, _ = h.Write(chunk[:n])
+			chunk = chunk[n:]
+		}
+
+		actual := h.Sum()
+		assert.Equal(t, expected[:], actual[:], "size %d", size)
+	}
+}
+
+func TestSipHash128KnownValue(t *testing.T) {
+	h := newSipHash128()
+	_, _ = h.Write([]byte("Hello ClickHouse!"))
+
+	sum := h.Sum()
+	assert.Equal(t, "fa052372d3a8a5ee87eda55a42ac2338", hex.EncodeToString(sum[:]))
+}
@@ -0,0 +1,86 @@
+package pastila
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// WithSpool makes Read copy the content of the paste into a temporary file in
+// dir, or in the default directory for temporary files if dir is empty,
+// before it returns. The paste can then be read at any offset with Seek and
+// ReadAt, without fetching it again or holding it in memory. Reading errors,
+// such as ErrHashMismatch with WithVerify, are returned by Read. Closing the
+// paste removes the file.
+func WithSpool(dir string) ReadOption {
+	return func(o *readOptions) {
+		o.spool = true
+		o.spoolDir = dir
+	}
+}
+
+// spool copies the content of paste into a temporary file if opts ask for
+// it, and makes the paste read it from there.
+func spool(paste *Paste, opts *readOptions) error {
+	if !opts.spool {
+		return nil
+	}
+
+	f, err := os.CreateTemp(opts.spoolDir, "pastila-*")
+	if err != nil {
+		return fmt.Errorf("failed to create spool file: %w", err)
+	}
+
+	_, err = io.Copy(f, paste.ReadCloser)
+	if closeErr := paste.ReadCloser.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	paste.ReadCloser = spoolFile{f}
+	return nil
+}
+
+// spoolFile is the content of a paste spooled into a temporary file, which
+// closing removes.
+type spoolFile struct {
+	*os.File
+}
+
+func (f spoolFile) Close() error {
+	err := f.File.Close()
+	if removeErr := os.Remove(f.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// Seek implements io.Seeker for pastes read with WithSpool. It fails with
+// errors.ErrUnsupported for other pastes.
+func (p *Paste) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := p.ReadCloser.(io.Seeker)
+	if !ok {
+		return 0, fmt.Errorf("%w: paste is not spooled, see WithSpool", errors.ErrUnsupported)
+	}
+
+	return seeker.Seek(offset, whence)
+}
+
+// ReadAt implements io.ReaderAt for pastes read with WithSpool. It fails with
+// errors.ErrUnsupported for other pastes.
+func (p *Paste) ReadAt(b []byte, off int64) (int, error) {
+	readerAt, ok := p.ReadCloser.(io.ReaderAt)
+	if !ok {
+		return 0, fmt.Errorf("%w: paste is not spooled, see WithSpool", errors.ErrUnsupported)
+	}
+
+	return readerAt.ReadAt(b, off)
+}
@@ -0,0 +1,82 @@
+package pastila
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PasteInfo describes a stored paste without its content.
+type PasteInfo struct {
+	URL string
+
+	Fingerprint []byte
+	Hash        []byte
+
+	// PreviousFingerprint and PreviousHash point to the previous version of
+	// the paste. Both are nil when there is none.
+	PreviousFingerprint []byte
+	PreviousHash        []byte
+
+	Encrypted bool
+
+	// Size is the size of the stored content in bytes. For encrypted pastes
+	// it is the size of the base64 encoded ciphertext.
+	Size int64
+
+	// Time is when the paste was inserted. It is zero if the backend does
+	// not report it.
+	Time time.Time
+
+	// Expires is when the paste expires, or zero if it does not, see
+	// WithExpiry.
+	Expires time.Time
+}
+
+// HasPrevious reports whether the paste is an edit of a previous version.
+func (i *PasteInfo) HasPrevious() bool {
+	return i.PreviousHash != nil
+}
+
+// Stat returns metadata of the paste referenced by url. Unlike Read, it does
+// not transfer the content, except for ClickHouse users that may only select
+// from data_view, like the one of the public pastila service, who get no
+// Time either. Like Read, it fails with ErrExpired for expired pastes.
+func (s *Service) Stat(ctx context.Context, url string) (*PasteInfo, error) {
+	url = strings.TrimSpace(url)
+
+	ref, err := ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	row, err := s.statRef(ctx, ref.Ref)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, url)
+		}
+		return nil, err
+	}
+	if err := checkExpiry(url, row); err != nil {
+		return nil, err
+	}
+
+	return newPasteInfo(url, row), nil
+}
+
+// newPasteInfo describes the row of the paste at url.
+func newPasteInfo(url string, row *Row) *PasteInfo {
+	return &PasteInfo{
+		URL:                 url,
+		Fingerprint:         row.Fingerprint,
+		Hash:                row.Hash,
+		PreviousFingerprint: row.PreviousFingerprint,
+		PreviousHash:        row.PreviousHash,
+		Encrypted:           row.Encrypted,
+		Size:                row.Size,
+		Time:                row.Time,
+		Expires:             row.Expires,
+	}
+}
@@ -0,0 +1,41 @@
+package pastila
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// Stats are execution statistics of the ClickHouse query behind a Read or
+// Write, as reported in the X-ClickHouse-Summary header.
+type Stats struct {
+	ReadRows     uint64
+	ReadBytes    uint64
+	WrittenRows  uint64
+	WrittenBytes uint64
+	ResultRows   uint64
+	Elapsed      time.Duration
+}
+
+// parseSummary parses an X-ClickHouse-Summary header. ClickHouse reports the
+// numbers as JSON strings. A missing or malformed header yields zero Stats.
+func parseSummary(header string) Stats {
+	var summary map[string]string
+	if err := json.Unmarshal([]byte(header), &summary); err != nil {
+		return Stats{}
+	}
+
+	number := func(name string) uint64 {
+		n, _ := strconv.ParseUint(summary[name], 10, 64)
+		return n
+	}
+
+	return Stats{
+		ReadRows:     number("read_rows"),
+		ReadBytes:    number("read_bytes"),
+		WrittenRows:  number("written_rows"),
+		WrittenBytes: number("written_bytes"),
+		ResultRows:   number("result_rows"),
+		Elapsed:      time.Duration(number("elapsed_ns")),
+	}
+}
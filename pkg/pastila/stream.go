@@ -0,0 +1,427 @@
+package pastila
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"slices"
+	"sync"
+
+	"filippo.io/age"
+)
+
+// contentKey encrypts, and optionally authenticates, content.
+type contentKey struct {
+	block cipher.Block
+
+	// recipients, if set, are the age recipients to encrypt to instead of
+	// with block, see WithAgeRecipients.
+	recipients []age.Recipient
+
+	// macKey, if set, keys the MAC trailing the ciphertext, see WithMAC.
+	macKey []byte
+}
+
+// encodeContent streams input as the content to store into w and returns
+// the Ref of the content. When key is not nil, the content is AES-CTR or age
+// encrypted on the fly. Content is prefixed by env unless it is empty, and
+// base64 encoded when encrypted or prefixed.
+func encodeContent(w io.Writer, input io.Reader, key *contentKey, env *envelope, opts *writeOptions) (*Ref, error) {
+	bw := bufio.NewWriter(w)
+
+	var fingerprint *fingerprinter
+	if opts.fingerprint == nil {
+		fingerprint = newFingerprinter()
+		input = io.TeeReader(input, fingerprint)
+	}
+
+	contentHash := newSipHash128()
+	content := io.MultiWriter(contentHash, bw)
+
+	// Writers of the chain are closed from the outermost inwards, so each
+	// flushes into the next one. The base64 encoder comes last, after the
+	// MAC, if any.
+	var closers []io.Closer
+
+	sink, encoder, mac, err := newEncodedSink(content, key, env)
+	if err != nil {
+		return nil, err
+	}
+
+	if key != nil {
+		var closer io.Closer
+		sink, closer, err = newEncrypter(sink, key, env)
+		if err != nil {
+			return nil, err
+		}
+
+		if closer != nil {
+			closers = append(closers, closer)
+		}
+	}
+
+	// The content type precedes the content, uncompressed.
+	if env.contentType {
+		if _, err = sink.Write(appendContentType(nil, opts.contentType)); err != nil {
+			return nil, err
+		}
+	}
+
+	if env.compression != NoCompression {
+		var compressor io.WriteCloser
+		compressor, err = env.compression.compressor(sink)
+		if err != nil {
+			return nil, err
+		}
+
+		sink = compressor
+		closers = append(closers, compressor)
+	}
+
+	if err = copyInput(sink, input); err != nil {
+		return nil, err
+	}
+	if err = finishContent(closers, encoder, mac); err != nil {
+		return nil, err
+	}
+	if err = bw.Flush(); err != nil {
+		return nil, err
+	}
+
+	sum := contentHash.Sum()
+	ref := &Ref{Hash: sum[:], Fingerprint: opts.fingerprint}
+	if fingerprint != nil {
+		ref.Fingerprint = fingerprint.Sum()
+	}
+
+	return ref, nil
+}
+
+// newEncodedSink returns the writer of the ciphertext of content written
+// with key and env: the base64 encoder, if any, with the envelope written to
+// it, and the MAC, if any, covering the envelope already.
+func newEncodedSink(content io.Writer, key *contentKey, env *envelope) (io.Writer, io.WriteCloser, hash.Hash, error) {
+	if key == nil && env.isZero() {
+		return content, nil, nil, nil
+	}
+
+	encoder := base64.NewEncoder(base64.StdEncoding, content)
+	if !env.isZero() {
+		if _, err := encoder.Write(env.marshal()); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if key == nil || key.macKey == nil {
+		return encoder, encoder, nil, nil
+	}
+
+	// The MAC covers the envelope header and the ciphertext.
+	mac := newMAC(key.macKey)
+	mac.Write(env.marshal())
+	return io.MultiWriter(encoder, mac), encoder, mac, nil
+}
+
+// newEncrypter returns a writer encrypting into w with key, age encrypted to
+// its recipients if it has any and AES-CTR encrypted otherwise, and the
+// closer finishing the age encryption, or nil.
+func newEncrypter(w io.Writer, key *contentKey, env *envelope) (io.Writer, io.Closer, error) {
+	if key.recipients != nil {
+		encrypter, err := age.Encrypt(w, key.recipients...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to encrypt content: %w", err)
+		}
+
+		return encrypter, encrypter, nil
+	}
+
+	iv := env.iv
+	if iv == nil {
+		iv = make([]byte, aes.BlockSize)
+	}
+
+	return &ctrWriter{s: cipher.NewCTR(key.block, iv), w: w}, nil, nil
+}
+
+// finishContent closes the writers of the chain of encodeContent from the
+// outermost inwards, then appends the MAC, if any, and closes the base64
+// encoder, if any.
+func finishContent(closers []io.Closer, encoder io.WriteCloser, mac hash.Hash) error {
+	for _, c := range slices.Backward(closers) {
+		if err := c.Close(); err != nil {
+			return fmt.Errorf("failed to encode content: %w", err)
+		}
+	}
+
+	if mac != nil {
+		if _, err := encoder.Write(mac.Sum(nil)); err != nil {
+			return err
+		}
+	}
+	if encoder != nil {
+		if err := encoder.Close(); err != nil {
+			return fmt.Errorf("failed to encode content: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// ctrWriter encrypts with a stream cipher what is written to it. Unlike
+// cipher.StreamWriter, it reuses the buffer of the ciphertext across writes.
+type ctrWriter struct {
+	s   cipher.Stream
+	w   io.Writer
+	buf []byte
+}
+
+func (c *ctrWriter) Write(p []byte) (int, error) {
+	if cap(c.buf) < len(p) {
+		c.buf = make([]byte, len(p))
+	}
+
+	buf := c.buf[:len(p)]
+	c.s.XORKeyStream(buf, p)
+	n, err := c.w.Write(buf)
+	if n != len(p) && err == nil {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+// writeInsertRow writes row as a single JSONEachRow insert row into w.
+//
+// The row is written by hand instead of with encoding/json so the content can
+// be streamed. Every other field is a boolean or a hex string and needs no
+// escaping. Fields depending on the whole content come last.
+func writeInsertRow(w io.Writer, row *InsertRow) error {
+	bw := bufio.NewWriter(w)
+
+	if _, err := fmt.Fprintf(bw, `{"is_encrypted":%t,"prev_hash_hex":"%x","prev_fingerprint_hex":"%x","content":"`,
+		row.Encrypted, row.PreviousHash, row.PreviousFingerprint); err != nil {
+		return fmt.Errorf("failed to encode insert row: %w", err)
+	}
+
+	if _, err := copyBuffered(jsonStringWriter{w: bw}, row.Content); err != nil {
+		return err
+	}
+
+	ref := row.Ref()
+	if _, err := fmt.Fprintf(bw, "\",\"hash_hex\":\"%x\",\"fingerprint_hex\":\"%x\"", ref.Hash, ref.Fingerprint); err != nil {
+		return fmt.Errorf("failed to encode insert row: %w", err)
+	}
+	if !row.Expires.IsZero() {
+		if _, err := fmt.Fprintf(bw, ",\"expires\":%d", row.Expires.Unix()); err != nil {
+			return fmt.Errorf("failed to encode insert row: %w", err)
+		}
+	}
+	if _, err := bw.WriteString("}\n"); err != nil {
+		return fmt.Errorf("failed to encode insert row: %w", err)
+	}
+
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to encode insert row: %w", err)
+	}
+
+	return nil
+}
+
+// copyBuffers pools the buffers content is copied through, so writes do not
+// allocate them over and over.
+var copyBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 32*1024)
+		return &buf
+	},
+}
+
+// copyBuffered is io.Copy with a pooled buffer.
+func copyBuffered(w io.Writer, r io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+
+	return io.CopyBuffer(w, r, *buf)
+}
+
+// copyInput copies input into w, telling read failures apart from write
+// failures, which only happen when the request is aborted.
+func copyInput(w io.Writer, input io.Reader) error {
+	pooled := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(pooled)
+
+	buf := *pooled
+	for {
+		n, readErr := input.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return fmt.Errorf("failed to read input: %w", readErr)
+		}
+	}
+}
+
+// jsonStringWriter writes bytes as the inside of a JSON string. Only quotes,
+// backslashes and control characters are escaped; other bytes, including
+// invalid UTF-8, are passed through so ClickHouse stores exactly the bytes
+// that were hashed.
+type jsonStringWriter struct {
+	w io.Writer
+}
+
+// jsonControlEscapes are the \u escapes of the control characters without a
+// shorter one.
+var jsonControlEscapes = func() (escapes [0x20]string) {
+	for c := range escapes {
+		escapes[c] = fmt.Sprintf(`\u%04x`, c)
+	}
+	return escapes
+}()
+
+func (j jsonStringWriter) Write(p []byte) (int, error) {
+	start := 0
+	for i, c := range p {
+		if c >= 0x20 && c != '"' && c != '\\' {
+			continue
+		}
+
+		if _, err := j.w.Write(p[start:i]); err != nil {
+			return start, err
+		}
+
+		// Escapes are written as strings, which io.WriteString passes to the
+		// bufio.Writer without a copy.
+		var escaped string
+		switch c {
+		case '"':
+			escaped = `\"`
+		case '\\':
+			escaped = `\\`
+		case '\n':
+			escaped = `\n`
+		case '\r':
+			escaped = `\r`
+		case '\t':
+			escaped = `\t`
+		default:
+			escaped = jsonControlEscapes[c]
+		}
+
+		if _, err := io.WriteString(j.w, escaped); err != nil {
+			return i, err
+		}
+		start = i + 1
+	}
+
+	if _, err := j.w.Write(p[start:]); err != nil {
+		return start, err
+	}
+
+	return len(p), nil
+}
+
+// maxSizeReader fails with ErrTooLarge once more than max bytes are read.
+type maxSizeReader struct {
+	io.ReadCloser
+	max       int64
+	remaining int64
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	if m.remaining < 0 {
+		return 0, m.tooLarge()
+	}
+
+	// Read one byte more than allowed to tell a limit-sized input apart from
+	// a larger one.
+	if int64(len(p)) > m.remaining+1 {
+		p = p[:m.remaining+1]
+	}
+
+	n, err := m.ReadCloser.Read(p)
+	if int64(n) > m.remaining {
+		n = int(m.remaining)
+		m.remaining = -1
+		return max(n, 0), m.tooLarge()
+	}
+
+	m.remaining -= int64(n)
+	return n, err
+}
+
+func (m *maxSizeReader) tooLarge() error {
+	return fmt.Errorf("%w: more than %d bytes", ErrTooLarge, m.max)
+}
+
+// base64Decoder decodes base64 encoded content, failing with its sentinel
+// error on malformed input.
+type base64Decoder struct {
+	r        io.Reader
+	sentinel error
+}
+
+func newBase64Decoder(r io.Reader, sentinel error) io.Reader {
+	return &base64Decoder{r: base64.NewDecoder(base64.StdEncoding, r), sentinel: sentinel}
+}
+
+func (d *base64Decoder) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+
+	var corrupt base64.CorruptInputError
+	if errors.As(err, &corrupt) {
+		err = fmt.Errorf("%w, failed to decode base64 content: %w", d.sentinel, err)
+	}
+	return n, err
+}
+
+// hashVerifier hashes streamed content as it is read, and fails with
+// ErrHashMismatch at its end if it does not match the expected hash.
+type hashVerifier struct {
+	io.ReadCloser
+	url  string
+	hash []byte
+	h    *sipHash128
+}
+
+func newHashVerifier(content io.ReadCloser, url string, hash []byte) *hashVerifier {
+	return &hashVerifier{ReadCloser: content, url: url, hash: hash, h: newSipHash128()}
+}
+
+func (v *hashVerifier) Read(p []byte) (int, error) {
+	n, err := v.ReadCloser.Read(p)
+	_, _ = v.h.Write(p[:n])
+	if err == io.EOF {
+		if sum := v.h.Sum(); !bytes.Equal(sum[:], v.hash) {
+			return n, fmt.Errorf("%w: %s", ErrHashMismatch, v.url)
+		}
+	}
+	return n, err
+}
+
+// readCloser reads from a decoding reader and closes the underlying stream.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// multiCloser closes all of its closers, in order.
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	var errs []error
+	for _, c := range m {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
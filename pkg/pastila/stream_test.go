@@ -0,0 +1,203 @@
+package pastila
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONStringWriter(t *testing.T) {
+	const content = "quote \" backslash \\ newline \n tab \t bell \a unicode żółw <tag> &"
+
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	_, err := jsonStringWriter{w: &buf}.Write([]byte(content))
+	require.NoError(t, err)
+	buf.WriteByte('"')
+
+	var decoded string
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, content, decoded)
+}
+
+func TestDecodeStreamRow(t *testing.T) {
+	const content = "quote \" backslash \\ newline \n tab \t bell \a unicode żółw 🐢 <tag> &"
+
+	encoded, err := json.Marshal(content)
+	require.NoError(t, err)
+
+	// encoding/json escapes some characters jsonStringWriter does not, and
+	// ClickHouse escapes slashes and characters outside the basic plane.
+	for name, body := range map[string]string{
+		"jsonStringWriter": `{"is_encrypted":true,"size":3,"content":"` + writeJSONString(t, content) + `"}`,
+		"encoding/json":    `{ "is_encrypted": true, "size": 3, "content": ` + string(encoded) + " }\n",
+		"escapes":          `{"is_encrypted":true,"size":3,"content":"a\/b \ud83d\udc22"}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			var row streamRow
+			r, err := decodeStreamRow(bufio.NewReader(iotest.OneByteReader(strings.NewReader(body))), &row)
+			require.NoError(t, err)
+			assert.True(t, row.Encrypted)
+			assert.EqualValues(t, 3, row.Size)
+
+			decoded, err := io.ReadAll(r)
+			require.NoError(t, err)
+			if name == "escapes" {
+				assert.Equal(t, "a/b 🐢", string(decoded))
+			} else {
+				assert.Equal(t, content, string(decoded))
+			}
+		})
+	}
+
+	var decodeErr *DecodeError
+	_, err = decodeStreamRow(bufio.NewReader(strings.NewReader("")), &streamRow{})
+	require.ErrorAs(t, err, &decodeErr)
+	assert.Equal(t, formatJSONEachRow, decodeErr.Format)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	r, err := decodeStreamRow(bufio.NewReader(strings.NewReader(`{"is_encrypted":false,"content":"trunc`)), &streamRow{})
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	r, err = decodeStreamRow(bufio.NewReader(strings.NewReader(`{"content":"x","is_encrypted":false}`)), &streamRow{})
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.Error(t, err)
+}
+
+func writeJSONString(t *testing.T, s string) string {
+	var buf bytes.Buffer
+	_, err := jsonStringWriter{w: &buf}.Write([]byte(s))
+	require.NoError(t, err)
+	return buf.String()
+}
+
+func TestEncodeContent(t *testing.T) {
+	var buf bytes.Buffer
+	ref, err := encodeContent(&buf, bytes.NewBufferString("Hello ClickHouse! unencrypted :("), nil, &envelope{}, &writeOptions{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "Hello ClickHouse! unencrypted :(", buf.String())
+	assert.Equal(t, "620234bcb081dcff3cfdf3c3c2806062", hex.EncodeToString(ref.Hash))
+	assert.Equal(t, "c055a950", hex.EncodeToString(ref.Fingerprint))
+}
+
+func TestEncodeContentFingerprint(t *testing.T) {
+	ref, err := encodeContent(io.Discard, bytes.NewBufferString("Hello ClickHouse! unencrypted :("), nil, &envelope{},
+		&writeOptions{fingerprint: []byte{0x01, 0x02, 0x03, 0x04}})
+	require.NoError(t, err)
+	assert.Equal(t, "01020304", hex.EncodeToString(ref.Fingerprint))
+}
+
+func TestWriteInsertRow(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeInsertRow(&buf, &InsertRow{
+		PreviousHash: []byte{0xab},
+		Content:      bytes.NewBufferString("line\n\"quoted\""),
+		ref:          Ref{Fingerprint: []byte{0xc0, 0x55, 0xa9, 0x50}, Hash: []byte{0x62, 0x02}},
+	})
+	require.NoError(t, err)
+
+	var row map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &row))
+	assert.Equal(t, map[string]any{
+		"is_encrypted":         false,
+		"content":              "line\n\"quoted\"",
+		"hash_hex":             "6202",
+		"fingerprint_hex":      "c055a950",
+		"prev_hash_hex":        "ab",
+		"prev_fingerprint_hex": "",
+	}, row)
+}
+
+func TestWriteInsertRowTSV(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeInsertRowTSV(&buf, &InsertRow{
+		Encrypted:    true,
+		PreviousHash: []byte{0xab},
+		Content:      bytes.NewBufferString("tab\tline\n\\zero\x00"),
+		ref:          Ref{Fingerprint: []byte{0xc0, 0x55, 0xa9, 0x50}, Hash: []byte{0x62, 0x02}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "1\tab\t\ttab\\tline\\n\\\\zero\\0\t6202\tc055a950\n", buf.String())
+
+	// The expiry comes last, like in the column list of insertColumns.
+	buf.Reset()
+	row := &InsertRow{
+		Content: bytes.NewBufferString("x"),
+		Expires: time.Unix(1714564800, 0),
+		ref:     Ref{Fingerprint: []byte{1}, Hash: []byte{2}},
+	}
+	require.NoError(t, writeInsertRowTSV(&buf, row))
+	assert.Equal(t, "0\t\t\tx\t02\t01\t1714564800\n", buf.String())
+	assert.True(t, strings.HasSuffix(insertColumns(insertDataTSVQuery, row), ", fingerprint_hex, expires)"))
+
+	buf.Reset()
+	row.Content = bytes.NewBufferString("x")
+	require.NoError(t, writeInsertRow(&buf, row))
+	assert.True(t, strings.HasSuffix(buf.String(), `,"expires":1714564800}`+"\n"), buf.String())
+}
+
+func TestDecodeBinaryRow(t *testing.T) {
+	row := []byte{1, 4, 'c', '0', '5', '5', 0}
+	row = binary.LittleEndian.AppendUint64(row, 7)
+	row = append(row, 7)
+	row = append(row, "content"...)
+
+	var decoded streamRow
+	r, err := decodeBinaryRow(bufio.NewReader(iotest.HalfReader(bytes.NewReader(row))), &decoded, false)
+	require.NoError(t, err)
+	assert.True(t, decoded.Encrypted)
+	assert.Equal(t, "c055", decoded.PrevFingerprintHex)
+	assert.EqualValues(t, 7, decoded.Size)
+	content, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(content))
+
+	var decodeErr *DecodeError
+	_, err = decodeBinaryRow(bufio.NewReader(bytes.NewReader(nil)), &decoded, false)
+	require.ErrorAs(t, err, &decodeErr)
+	assert.Equal(t, formatRowBinary, decodeErr.Format)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	r, err = decodeBinaryRow(bufio.NewReader(bytes.NewReader(row[:len(row)-2])), &decoded, false)
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// The expiry time precedes the other columns.
+	expiring := binary.LittleEndian.AppendUint32(nil, 1714564800)
+	decoded = streamRow{}
+	r, err = decodeBinaryRow(bufio.NewReader(bytes.NewReader(append(expiring, row...))), &decoded, true)
+	require.NoError(t, err)
+	assert.Equal(t, time.Unix(1714564800, 0), decoded.expires())
+	assert.Equal(t, "c055", decoded.PrevFingerprintHex)
+	content, err = io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(content))
+}
+
+func TestMaxSizeReader(t *testing.T) {
+	r := &maxSizeReader{ReadCloser: io.NopCloser(strings.NewReader("123456789")), max: 8, remaining: 8}
+
+	content, err := io.ReadAll(r)
+	require.ErrorIs(t, err, ErrTooLarge)
+	assert.Equal(t, "12345678", string(content))
+
+	// Reads after the limit keep failing without a negative count.
+	n, err := r.Read(make([]byte, 4))
+	require.ErrorIs(t, err, ErrTooLarge)
+	assert.Zero(t, n)
+}
@@ -0,0 +1,73 @@
+package pastila
+
+import (
+	"context"
+	"io"
+	"net/url"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const instrumentationName = "github.com/jkaflik/pastila-cli/pkg/pastila"
+
+// startSpan starts a span of a Service operation. Operations of a Service
+// without a Tracer get a non-recording span.
+func (s *Service) startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	tracer := s.Tracer
+	if tracer == nil {
+		tracer = noop.NewTracerProvider().Tracer(instrumentationName)
+	}
+
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+}
+
+// setEndpointAttributes describes the ClickHouse endpoint a request of the
+// operation traced by the span of ctx is sent to, without exposing
+// credentials. The endpoint of the last attempt overrides those failed over
+// from.
+func setEndpointAttributes(ctx context.Context, endpoint string) {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("server.address", u.Hostname()),
+		attribute.String("pastila.backend.url", u.Scheme+"://"+u.Host+u.Path),
+	)
+}
+
+// endSpan ends a span of a Service operation resulting in paste and err.
+func endSpan(span trace.Span, paste *Paste, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else if paste != nil {
+		span.SetAttributes(
+			attribute.String("pastila.query_id", paste.QueryID),
+			attribute.Int64("pastila.content.bytes", paste.size),
+		)
+	}
+
+	span.End()
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
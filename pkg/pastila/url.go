@@ -0,0 +1,93 @@
+package pastila
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// PasteRef is what a pastila URL carries: the Ref of a paste and the key to
+// decrypt it, if any.
+type PasteRef struct {
+	Ref
+
+	// Key is nil for URLs without a key.
+	Key []byte
+}
+
+// ParseURL parses a pastila URL. The URL of the pastila service in front of
+// the reference is not checked, so URLs of any deployment parse, as does a
+// bare "fingerprint/hash#key" reference.
+func ParseURL(url string) (PasteRef, error) {
+	matches := QueryMatchRegex.FindStringSubmatch(url)
+	if matches == nil {
+		return PasteRef{}, fmt.Errorf("%w: %s", ErrInvalidURL, url)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(matches[3])
+	if err != nil {
+		return PasteRef{}, fmt.Errorf("%w, failed to base64 decode: %w", ErrInvalidKey, err)
+	}
+	if matches[3] == "" {
+		key = nil
+	}
+
+	fingerprint, hash, err := decodeRef(matches[1], matches[2])
+	if err != nil {
+		return PasteRef{}, err
+	}
+
+	return PasteRef{Ref: Ref{Fingerprint: fingerprint, Hash: hash}, Key: key}, nil
+}
+
+// String returns the reference as it appears at the end of a pastila URL:
+// "fingerprint/hash", followed by "#key" when there is a key.
+func (r PasteRef) String() string {
+	ref := fmt.Sprintf("%x/%x", r.Fingerprint, r.Hash)
+	if r.Key != nil {
+		ref += "#" + base64.StdEncoding.EncodeToString(r.Key)
+	}
+
+	return ref
+}
+
+// URL returns the URL of the paste on the pastila service at pastilaURL, or
+// on the public pastila service if pastilaURL is empty.
+func (r PasteRef) URL(pastilaURL string) string {
+	if pastilaURL == "" {
+		pastilaURL = chURL
+	}
+
+	return pastilaURL + "?" + r.String()
+}
+
+// URLBuilder forms the URLs of written pastes, for pastila frontends that
+// shape URLs differently from the public one. ParseURL must accept the URLs
+// it forms for Read to accept them.
+type URLBuilder func(ref PasteRef) string
+
+// QueryURLBuilder forms URLs the way the pastila web client does:
+// pastilaURL?fingerprint/hash#key.
+func QueryURLBuilder(pastilaURL string) URLBuilder {
+	return func(ref PasteRef) string {
+		return ref.URL(pastilaURL)
+	}
+}
+
+// PathURLBuilder forms URLs with the reference in the path:
+// pastilaURL/fingerprint/hash#key, for frontends that route by path.
+func PathURLBuilder(pastilaURL string) URLBuilder {
+	return func(ref PasteRef) string {
+		return strings.TrimSuffix(pastilaURL, "/") + "/" + ref.String()
+	}
+}
+
+// WithoutKey makes b form URLs without the key, for keys shared separately
+// from URLs. Pastes written so are read by appending "#" and the base64
+// encoded key to their URL.
+func WithoutKey(b URLBuilder) URLBuilder {
+	return func(ref PasteRef) string {
+		ref.Key = nil
+		return b(ref)
+	}
+}
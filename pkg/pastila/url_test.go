@@ -0,0 +1,33 @@
+package pastila
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// FuzzParseURL checks that ParseURL never panics on URLs copied from
+// anywhere, and that the references it parses form URLs it parses back.
+func FuzzParseURL(f *testing.F) {
+	for _, url := range []string{
+		"https://pastila.nl/?ffffffff/52662368cc45b2ad0e9a47faa8582369#2L9DFnYzHu27jLxA9elfyg==",
+		"https://pastila.nl/?cafebabe/14aa3e22cd6438df3a5808560fe40150",
+		"ffffffff/52662368cc45b2ad0e9a47faa8582369#",
+		"https://example.com/pastes/fff/abc#QQ==\nsecond line",
+		"https://pastila.nl/?ffffffff/52662368cc45b2ad0e9a47faa8582369#not base64!",
+	} {
+		f.Add(url)
+	}
+
+	f.Fuzz(func(t *testing.T, url string) {
+		ref, err := ParseURL(url)
+		if err != nil {
+			return
+		}
+
+		reparsed, err := ParseURL(ref.URL("https://pastila.nl/"))
+		require.NoError(t, err)
+		assert.Equal(t, ref, reparsed)
+	})
+}
@@ -0,0 +1,59 @@
+package pastila
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// UsageBackend is implemented by backends that can summarize the pastes they
+// store. Usage requires it.
+type UsageBackend interface {
+	// Usage summarizes the first insertions of the rows stored.
+	Usage(ctx context.Context) (*Usage, error)
+}
+
+// Usage summarizes the pastes stored by a backend.
+type Usage struct {
+	// Pastes is the number of pastes, each counted once however often it
+	// was written.
+	Pastes int64
+	// EncryptedPastes is the number of encrypted pastes among Pastes.
+	EncryptedPastes int64
+	// Bytes is the size of the content of Pastes.
+	Bytes int64
+	// Daily breaks the numbers down by the UTC day of the first insertion,
+	// oldest first. Days without pastes are left out.
+	Daily []DailyUsage
+}
+
+// DailyUsage is the part of Usage of a day.
+type DailyUsage struct {
+	Day             time.Time
+	Pastes          int64
+	EncryptedPastes int64
+	Bytes           int64
+}
+
+// Usage summarizes the pastes stored, for operators of self-hosted
+// deployments. It reads the whole table, so it may take a while on large
+// ones.
+//
+// It fails with errors.ErrUnsupported for backends that do not implement
+// UsageBackend, and for ClickHouse users that may only select from
+// data_view, like the one of the public pastila service.
+func (s *Service) Usage(ctx context.Context) (*Usage, error) {
+	usageBackend, ok := s.backend().(UsageBackend)
+	if !ok {
+		return nil, fmt.Errorf("%w: backend cannot summarize pastes", errors.ErrUnsupported)
+	}
+
+	var usage *Usage
+	err := s.retry(ctx, func() (err error) {
+		usage, err = usageBackend.Usage(ctx)
+		return err
+	})
+
+	return usage, err
+}
@@ -0,0 +1,298 @@
+package pastila
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// WireFormat selects the formats rows are exchanged with ClickHouse in.
+type WireFormat int
+
+const (
+	// WireFormatAuto selects rows in RowBinary and inserts them in
+	// TabSeparated, which carry the content as is, or with a few escaped
+	// bytes, instead of as a JSON string. It falls back to JSONEachRow for
+	// servers that do not support these formats.
+	WireFormatAuto WireFormat = iota
+
+	// WireFormatJSON exchanges rows in JSONEachRow, like the pastila web
+	// client does.
+	WireFormatJSON
+)
+
+// ClickHouse formats used by the ClickHouse backend.
+const (
+	formatJSONEachRow  = "JSONEachRow"
+	formatRowBinary    = "RowBinary"
+	formatTabSeparated = "TabSeparated"
+)
+
+// errCodeUnknownFormat is returned by ClickHouse for formats it does not
+// support.
+const errCodeUnknownFormat = 73
+
+// wireFormatState remembers that ClickHouse does not support the formats of
+// WireFormatAuto, across requests.
+type wireFormatState struct {
+	unsupported atomic.Bool
+}
+
+// leanWireFormat reports whether requests use the formats of WireFormatAuto.
+func (s *Service) leanWireFormat() bool {
+	return s.WireFormat == WireFormatAuto && (s.wireFormatState == nil || !s.wireFormatState.unsupported.Load())
+}
+
+// wireFormatUnsupported makes later requests use JSONEachRow. Services not
+// built by NewService find out on every request.
+func (s *Service) wireFormatUnsupported() {
+	if s.wireFormatState != nil {
+		s.wireFormatState.unsupported.Store(true)
+	}
+}
+
+// isUnknownFormat reports whether err is ClickHouse rejecting the format of a
+// query.
+func isUnknownFormat(err error) bool {
+	var chErr *ClickHouseError
+	return errors.As(err, &chErr) && chErr.Code == errCodeUnknownFormat
+}
+
+// withFormat appends the FORMAT clause to query.
+func withFormat(query, format string) string {
+	return query + "\nFORMAT " + format
+}
+
+// writeInsertRowTSV writes row as a single TabSeparated insert row into w,
+// with the columns of insertDataTSVQuery.
+func writeInsertRowTSV(w io.Writer, row *InsertRow) error {
+	bw := bufio.NewWriter(w)
+
+	encrypted := 0
+	if row.Encrypted {
+		encrypted = 1
+	}
+	if _, err := fmt.Fprintf(bw, "%d\t%x\t%x\t", encrypted, row.PreviousHash, row.PreviousFingerprint); err != nil {
+		return fmt.Errorf("failed to encode insert row: %w", err)
+	}
+
+	if _, err := copyBuffered(tsvWriter{w: bw}, row.Content); err != nil {
+		return err
+	}
+
+	ref := row.Ref()
+	if _, err := fmt.Fprintf(bw, "\t%x\t%x", ref.Hash, ref.Fingerprint); err != nil {
+		return fmt.Errorf("failed to encode insert row: %w", err)
+	}
+	if !row.Expires.IsZero() {
+		if _, err := fmt.Fprintf(bw, "\t%d", row.Expires.Unix()); err != nil {
+			return fmt.Errorf("failed to encode insert row: %w", err)
+		}
+	}
+	if err := bw.WriteByte('\n'); err != nil {
+		return fmt.Errorf("failed to encode insert row: %w", err)
+	}
+
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to encode insert row: %w", err)
+	}
+
+	return nil
+}
+
+// tsvWriter writes bytes as a TabSeparated value. Only the bytes that would
+// end the value, or be taken for an escape sequence, are escaped. Base64
+// encoded content has none of them.
+type tsvWriter struct {
+	w io.Writer
+}
+
+func (t tsvWriter) Write(p []byte) (int, error) {
+	start := 0
+	for i, c := range p {
+		var escaped string
+		switch c {
+		case '\\':
+			escaped = `\\`
+		case '\t':
+			escaped = `\t`
+		case '\n':
+			escaped = `\n`
+		case '\r':
+			escaped = `\r`
+		case 0:
+			escaped = `\0`
+		default:
+			continue
+		}
+
+		if _, err := t.w.Write(p[start:i]); err != nil {
+			return start, err
+		}
+		if _, err := io.WriteString(t.w, escaped); err != nil {
+			return i, err
+		}
+		start = i + 1
+	}
+
+	if _, err := t.w.Write(p[start:]); err != nil {
+		return start, err
+	}
+
+	return len(p), nil
+}
+
+// responseFormat returns the format of the rows of res, which is JSONEachRow
+// unless ClickHouse reports otherwise.
+func responseFormat(res *http.Response) string {
+	if res.Header.Get("X-ClickHouse-Format") == formatRowBinary {
+		return formatRowBinary
+	}
+	return formatJSONEachRow
+}
+
+// moreRows reports whether r holds another row of a result in format,
+// skipping the line break that ends a JSONEachRow row.
+func moreRows(r *bufio.Reader, format string) (bool, error) {
+	for {
+		next, err := r.Peek(1)
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, &DecodeError{Format: format, Err: err}
+		}
+		if format == formatRowBinary || next[0] != '\n' {
+			return true, nil
+		}
+		_, _ = r.Discard(1)
+	}
+}
+
+// decodeBinaryRow decodes the next RowBinary row of r, with the columns of
+// selectDataQuery, preceded by the expiry time if expiry is set, and returns
+// a reader of its content. The caller checks that there is a row, see
+// emptyResult.
+func decodeBinaryRow(r *bufio.Reader, row *streamRow, expiry bool) (io.Reader, error) {
+	if err := readBinaryExpiry(r, &row.selectRow, expiry); err != nil {
+		return nil, &DecodeError{Format: formatRowBinary, Err: err}
+	}
+	if err := readBinaryFields(r, row); err != nil {
+		return nil, &DecodeError{Format: formatRowBinary, Err: err}
+	}
+
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, &DecodeError{Format: formatRowBinary, Err: streamErr(err)}
+	}
+
+	return &binaryContentReader{r: r, remaining: size}, nil
+}
+
+// decodeBinaryManyRow decodes the next RowBinary row of r, with the columns
+// of selectManyQuery, preceded by the expiry time if expiry is set, and
+// returns a reader of its content.
+func decodeBinaryManyRow(r *bufio.Reader, row *selectManyRow, expiry bool) (io.Reader, error) {
+	err := readBinaryExpiry(r, &row.selectRow, expiry)
+	if err != nil {
+		return nil, &DecodeError{Format: formatRowBinary, Err: err}
+	}
+	if row.FingerprintHex, err = readBinaryString(r); err != nil {
+		return nil, &DecodeError{Format: formatRowBinary, Err: err}
+	}
+	if row.HashHex, err = readBinaryString(r); err != nil {
+		return nil, &DecodeError{Format: formatRowBinary, Err: err}
+	}
+
+	return decodeBinaryRow(r, &row.streamRow, false)
+}
+
+// readBinaryExpiry reads the UInt32 expiry time selected in front of the
+// other columns by httpBackend.withExpiry, if expiry is set.
+func readBinaryExpiry(r *bufio.Reader, row *selectRow, expiry bool) error {
+	if !expiry {
+		return nil
+	}
+
+	var expiresAt [4]byte
+	if _, err := io.ReadFull(r, expiresAt[:]); err != nil {
+		return streamErr(err)
+	}
+	row.ExpiresAt = int64(binary.LittleEndian.Uint32(expiresAt[:]))
+
+	return nil
+}
+
+// readBinaryFields reads the columns preceding the content off a RowBinary
+// row.
+func readBinaryFields(r *bufio.Reader, row *streamRow) error {
+	encrypted, err := r.ReadByte()
+	if err != nil {
+		return streamErr(err)
+	}
+	row.Encrypted = encrypted != 0
+
+	if row.PrevFingerprintHex, err = readBinaryString(r); err != nil {
+		return err
+	}
+	if row.PrevHashHex, err = readBinaryString(r); err != nil {
+		return err
+	}
+
+	var size [8]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return streamErr(err)
+	}
+	row.Size = int64(binary.LittleEndian.Uint64(size[:]))
+
+	return nil
+}
+
+// readBinaryString reads a RowBinary string of at most maxStreamFieldSize
+// bytes.
+func readBinaryString(r *bufio.Reader) (string, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", streamErr(err)
+	}
+	if size > maxStreamFieldSize {
+		return "", fmt.Errorf("field longer than %d bytes", maxStreamFieldSize)
+	}
+
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", streamErr(err)
+	}
+
+	return string(b), nil
+}
+
+// binaryContentReader reads the content of a RowBinary row, which fails if
+// the response ends before it does.
+type binaryContentReader struct {
+	r         *bufio.Reader
+	remaining uint64
+}
+
+func (b *binaryContentReader) Read(p []byte) (int, error) {
+	if b.remaining == 0 {
+		return 0, io.EOF
+	}
+	if uint64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+
+	n, err := b.r.Read(p)
+	b.remaining -= uint64(n)
+	if err == io.EOF {
+		err = nil
+		if b.remaining > 0 && n == 0 {
+			err = &DecodeError{Format: formatRowBinary, Err: io.ErrUnexpectedEOF}
+		}
+	}
+	return n, err
+}
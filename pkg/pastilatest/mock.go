@@ -0,0 +1,148 @@
+// Package pastilatest provides utilities for testing code using package
+// pastila, without network or ClickHouse.
+package pastilatest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+// ErrNotMocked is returned by the methods of Mock whose function is not set.
+var ErrNotMocked = errors.New("pastilatest: method not mocked")
+
+// Mock is a pastila.PasteService calling the function set for each method.
+// Methods whose function is nil fail with ErrNotMocked. Mock records the
+// calls, so tests can check how the code under test used it.
+type Mock struct {
+	ReadContextFunc       func(ctx context.Context, url string, opt ...pastila.ReadOption) (*pastila.Paste, error)
+	StatFunc              func(ctx context.Context, url string) (*pastila.PasteInfo, error)
+	WriteContextFunc      func(ctx context.Context, input io.Reader, opt ...pastila.WriteOption) (*pastila.Paste, error)
+	ExistsFunc            func(ctx context.Context, url string) (bool, error)
+	HistoryFunc           func(ctx context.Context, url string, opt ...pastila.ReadOption) ([]*pastila.Paste, error)
+	LatestFunc            func(ctx context.Context, url string) (*pastila.PasteInfo, error)
+	NextFunc              func(ctx context.Context, url string) (*pastila.PasteInfo, error)
+	ListByFingerprintFunc func(ctx context.Context, fingerprint []byte) ([]*pastila.PasteInfo, error)
+
+	mu    sync.Mutex
+	calls []Call
+}
+
+var _ pastila.PasteService = (*Mock)(nil)
+
+// Call is a recorded call of a Mock method. Args are the arguments following
+// the context, without the options.
+type Call struct {
+	Method string
+	Args   []any
+}
+
+// Calls returns the calls of the mock, in order.
+func (m *Mock) Calls() []Call {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]Call(nil), m.calls...)
+}
+
+func (m *Mock) record(method string, args ...any) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.calls = append(m.calls, Call{Method: method, Args: args})
+}
+
+func notMocked(method string) error {
+	return fmt.Errorf("%w: %s", ErrNotMocked, method)
+}
+
+// ReadContext implements pastila.PasteReader.
+func (m *Mock) ReadContext(ctx context.Context, url string, opt ...pastila.ReadOption) (*pastila.Paste, error) {
+	m.record("ReadContext", url)
+	if m.ReadContextFunc == nil {
+		return nil, notMocked("ReadContext")
+	}
+
+	return m.ReadContextFunc(ctx, url, opt...)
+}
+
+// Stat implements pastila.PasteReader.
+func (m *Mock) Stat(ctx context.Context, url string) (*pastila.PasteInfo, error) {
+	m.record("Stat", url)
+	if m.StatFunc == nil {
+		return nil, notMocked("Stat")
+	}
+
+	return m.StatFunc(ctx, url)
+}
+
+// WriteContext implements pastila.PasteWriter.
+func (m *Mock) WriteContext(ctx context.Context, input io.Reader, opt ...pastila.WriteOption) (*pastila.Paste, error) {
+	m.record("WriteContext", input)
+	if m.WriteContextFunc == nil {
+		return nil, notMocked("WriteContext")
+	}
+
+	return m.WriteContextFunc(ctx, input, opt...)
+}
+
+// Exists implements pastila.PasteService.
+func (m *Mock) Exists(ctx context.Context, url string) (bool, error) {
+	m.record("Exists", url)
+	if m.ExistsFunc == nil {
+		return false, notMocked("Exists")
+	}
+
+	return m.ExistsFunc(ctx, url)
+}
+
+// History implements pastila.PasteService.
+func (m *Mock) History(ctx context.Context, url string, opt ...pastila.ReadOption) ([]*pastila.Paste, error) {
+	m.record("History", url)
+	if m.HistoryFunc == nil {
+		return nil, notMocked("History")
+	}
+
+	return m.HistoryFunc(ctx, url, opt...)
+}
+
+// Latest implements pastila.PasteService.
+func (m *Mock) Latest(ctx context.Context, url string) (*pastila.PasteInfo, error) {
+	m.record("Latest", url)
+	if m.LatestFunc == nil {
+		return nil, notMocked("Latest")
+	}
+
+	return m.LatestFunc(ctx, url)
+}
+
+// Next implements pastila.PasteService.
+func (m *Mock) Next(ctx context.Context, url string) (*pastila.PasteInfo, error) {
+	m.record("Next", url)
+	if m.NextFunc == nil {
+		return nil, notMocked("Next")
+	}
+
+	return m.NextFunc(ctx, url)
+}
+
+// ListByFingerprint implements pastila.PasteService.
+func (m *Mock) ListByFingerprint(ctx context.Context, fingerprint []byte) ([]*pastila.PasteInfo, error) {
+	m.record("ListByFingerprint", fingerprint)
+	if m.ListByFingerprintFunc == nil {
+		return nil, notMocked("ListByFingerprint")
+	}
+
+	return m.ListByFingerprintFunc(ctx, fingerprint)
+}
+
+// NewPaste returns a paste with url and content, for mocked methods to
+// return.
+func NewPaste(url, content string) *pastila.Paste {
+	return &pastila.Paste{ReadCloser: io.NopCloser(strings.NewReader(content)), URL: url}
+}
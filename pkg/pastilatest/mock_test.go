@@ -0,0 +1,61 @@
+package pastilatest
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jkaflik/pastila-cli/pkg/pastila"
+)
+
+// shout is code under test, reading a paste and writing it upper cased.
+func shout(ctx context.Context, service pastila.PasteService, url string) (string, error) {
+	paste, err := service.ReadContext(ctx, url)
+	if err != nil {
+		return "", err
+	}
+	defer paste.Close()
+
+	content, err := io.ReadAll(paste)
+	if err != nil {
+		return "", err
+	}
+
+	written, err := service.WriteContext(ctx, strings.NewReader(strings.ToUpper(string(content))))
+	if err != nil {
+		return "", err
+	}
+
+	return written.URL, nil
+}
+
+func TestMock(t *testing.T) {
+	var written string
+	mock := &Mock{
+		ReadContextFunc: func(context.Context, string, ...pastila.ReadOption) (*pastila.Paste, error) {
+			return NewPaste("https://pastila.nl/?ffffffff/01", "hello"), nil
+		},
+		WriteContextFunc: func(_ context.Context, input io.Reader, _ ...pastila.WriteOption) (*pastila.Paste, error) {
+			content, err := io.ReadAll(input)
+			written = string(content)
+			return NewPaste("https://pastila.nl/?ffffffff/02", ""), err
+		},
+	}
+
+	url, err := shout(context.Background(), mock, "https://pastila.nl/?ffffffff/01")
+	require.NoError(t, err)
+	assert.Equal(t, "https://pastila.nl/?ffffffff/02", url)
+	assert.Equal(t, "HELLO", written)
+
+	calls := mock.Calls()
+	require.Len(t, calls, 2)
+	assert.Equal(t, Call{Method: "ReadContext", Args: []any{"https://pastila.nl/?ffffffff/01"}}, calls[0])
+	assert.Equal(t, "WriteContext", calls[1].Method)
+
+	_, err = mock.Latest(context.Background(), url)
+	assert.ErrorIs(t, err, ErrNotMocked)
+}